@@ -0,0 +1,512 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"nefelim4ag/go-memcached-server/memstore"
+	"nefelim4ag/go-memcached-server/metrics"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"log/slog"
+)
+
+// Peer channel format, all numbers are little endian:
+//
+//	handshake: magic "GMCI", version uint32, node id uint64, listen address length uint16, listen address
+//	accepted:  byte 1, sent back by peer once handshake is accepted, rejected link is closed instead
+//	event:     op byte, key length uint16, key
+//
+// Each node sends only changes made by its own clients straight to every peer,
+// received events are applied without being reported again, so they never loop.
+// Peers form full mesh, node with own id in handshake is rejected.
+// Incoming peer is reported by its listen address, unspecified host is replaced by peer IP.
+// Address must match configured peer, host names of configured peers are resolved,
+// and link must come from IP of that peer, so no host can claim address of other one.
+const (
+	handshakeMagic    = "GMCI"
+	handshakeVersion  = 1
+	handshakeAccepted = 1
+)
+
+const (
+	opDelete     byte = 1 // key was deleted
+	opInvalidate byte = 2 // key was stored, peers drop their copy
+)
+
+// Events queued per peer while it is slow or down, newer events are dropped over it
+const peerQueueSize = 64 * 1024
+
+// Longest listen address accepted in handshake
+const maxAddressLength = 256
+
+// Reconnect delay of peer, doubled on each failure
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 10 * time.Second
+)
+
+var (
+	ErrBadHandshake = errors.New("bad peer handshake")
+	ErrSelf         = errors.New("peer is this node")
+	ErrUnknownPeer  = errors.New("peer is not configured")
+)
+
+type (
+	// Node broadcast delete and invalidate events of store clients to peers
+	// and apply events received from peers to store
+	Node struct {
+		id      uint64
+		address string
+		store   *memstore.SharedStore
+
+		listener net.Listener
+		shutdown chan struct{}
+		workers  sync.WaitGroup
+
+		lock    sync.Mutex
+		peers   []*peer          // links by configured address
+		stats   map[string]*peer // configured peers by address
+		inbound map[net.Conn]struct{}
+	}
+
+	event struct {
+		op  byte
+		key string
+	}
+
+	// peer is outgoing link and counters of events exchanged with configured peer
+	peer struct {
+		address string
+		queue   chan event
+
+		connected   atomic.Bool
+		backoff     atomic.Int64 // current reconnect delay, nanoseconds
+		sent        atomic.Uint64
+		dropped     atomic.Uint64
+		failures    atomic.Uint64
+		received    atomic.Uint64
+		invalidated atomic.Uint64 // received events which deleted present key
+	}
+
+	// PeerStats is counters of events exchanged with peer
+	PeerStats struct {
+		Address     string
+		Connected   bool
+		Queued      int
+		Backoff     time.Duration
+		Sent        uint64
+		Dropped     uint64
+		Failures    uint64
+		Received    uint64
+		Invalidated uint64
+	}
+)
+
+// NewNode create cluster node of store
+func NewNode(store *memstore.SharedStore) *Node {
+	return &Node{
+		id:       rand.Uint64(),
+		store:    store,
+		shutdown: make(chan struct{}),
+		stats:    map[string]*peer{},
+		inbound:  map[net.Conn]struct{}{},
+	}
+}
+
+// Listen bind peer channel listener, nodes of cluster can be bound before any serves
+func (n *Node) Listen(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on address %s: %w", address, err)
+	}
+	n.listener = listener
+	n.address = listener.Addr().String()
+
+	return nil
+}
+
+// Serve accept peers, connect to peers listening on addresses and start broadcasting store changes
+func (n *Node) Serve(peers []string) {
+	n.lock.Lock()
+	for _, address := range peers {
+		p := &peer{address: address, queue: make(chan event, peerQueueSize)}
+		n.peers = append(n.peers, p)
+		n.stats[address] = p
+	}
+	n.lock.Unlock()
+	slog.Info("Peers listening", "address", n.address, "peers", len(n.peers))
+
+	n.workers.Add(1 + len(n.peers))
+	go n.accept()
+	for _, p := range n.peers {
+		go n.connect(p)
+	}
+	n.store.SetChangeHook(n.broadcast)
+}
+
+// Addr return listen address, e.g. to find port chosen for :0
+func (n *Node) Addr() net.Addr {
+	return n.listener.Addr()
+}
+
+// Stop close peer links, store changes are not broadcast anymore
+func (n *Node) Stop() {
+	n.store.SetChangeHook(nil)
+	close(n.shutdown)
+	// Listener is missing if Listen failed or was never called
+	if n.listener != nil {
+		n.listener.Close()
+	}
+
+	n.lock.Lock()
+	for conn := range n.inbound {
+		conn.Close()
+	}
+	n.lock.Unlock()
+
+	n.workers.Wait()
+}
+
+// broadcast queue store change to all peers, it must not block store
+func (n *Node) broadcast(key string, deleted bool) {
+	e := event{op: opInvalidate, key: key}
+	if deleted {
+		e.op = opDelete
+	}
+
+	for _, p := range n.peers {
+		select {
+		case p.queue <- e:
+		default:
+			p.dropped.Add(1)
+		}
+	}
+}
+
+func (n *Node) accept() {
+	defer n.workers.Done()
+
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			select {
+			case <-n.shutdown:
+				return
+			default:
+			}
+			slog.Error("Peer accept failed", "error", err)
+			continue
+		}
+
+		n.lock.Lock()
+		n.inbound[conn] = struct{}{}
+		n.workers.Add(1)
+		n.lock.Unlock()
+
+		go n.serve(conn)
+	}
+}
+
+// serve apply events of incoming peer link until it is closed
+func (n *Node) serve(conn net.Conn) {
+	defer n.workers.Done()
+	defer func() {
+		n.lock.Lock()
+		delete(n.inbound, conn)
+		n.lock.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	p, err := n.readHandshake(r, conn.RemoteAddr())
+	if err != nil {
+		slog.Warn("Peer rejected", "remote", conn.RemoteAddr(), "error", err)
+		return
+	}
+	if _, err := conn.Write([]byte{handshakeAccepted}); err != nil {
+		return
+	}
+
+	key := make([]byte, 0, 256)
+	var header [3]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return
+		}
+		key = key[:binary.LittleEndian.Uint16(header[1:])]
+		if _, err := io.ReadFull(r, key); err != nil {
+			return
+		}
+
+		switch header[0] {
+		case opDelete, opInvalidate:
+		default:
+			slog.Warn("Peer sent unknown event", "peer", p.address, "op", header[0])
+			return
+		}
+
+		p.received.Add(1)
+		if n.store.Invalidate(string(key)) {
+			p.invalidated.Add(1)
+		}
+	}
+}
+
+func (n *Node) readHandshake(r *bufio.Reader, remote net.Addr) (*peer, error) {
+	header := make([]byte, len(handshakeMagic)+4+8+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if string(header[:len(handshakeMagic)]) != handshakeMagic {
+		return nil, fmt.Errorf("%w: wrong magic", ErrBadHandshake)
+	}
+	if v := binary.LittleEndian.Uint32(header[len(handshakeMagic):]); v != handshakeVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrBadHandshake, v)
+	}
+	if binary.LittleEndian.Uint64(header[len(handshakeMagic)+4:]) == n.id {
+		return nil, ErrSelf
+	}
+
+	length := binary.LittleEndian.Uint16(header[len(header)-2:])
+	if length > maxAddressLength {
+		return nil, fmt.Errorf("%w: address length %d", ErrBadHandshake, length)
+	}
+	raw := make([]byte, length)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+	address := peerAddress(string(raw), remote)
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadHandshake, err)
+	}
+
+	p := n.configuredPeer(address)
+	if p == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownPeer, address)
+	}
+	if !peerRemote(p.address, remote) {
+		return nil, fmt.Errorf("%w: %s connected from %s", ErrUnknownPeer, address, remote)
+	}
+	return p, nil
+}
+
+// peerRemote report whether link comes from IP of configured peer address
+func peerRemote(address string, remote net.Addr) bool {
+	addr, ok := remote.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	ips := []string{host}
+	if net.ParseIP(host) == nil {
+		if ips, err = net.LookupHost(host); err != nil {
+			return false
+		}
+	}
+	return slices.ContainsFunc(ips, func(ip string) bool { return addr.IP.Equal(net.ParseIP(ip)) })
+}
+
+// configuredPeer return configured peer listening on address, peers send bound
+// IP address, so host names of configured addresses are resolved to match it
+func (n *Node) configuredPeer(address string) *peer {
+	n.lock.Lock()
+	p, ok := n.stats[address]
+	peers := n.peers
+	n.lock.Unlock()
+	if ok {
+		return p
+	}
+
+	host, port, _ := net.SplitHostPort(address)
+	for _, p := range peers {
+		peerHost, peerPort, err := net.SplitHostPort(p.address)
+		if err != nil || peerPort != port {
+			continue
+		}
+		ips, err := net.LookupHost(peerHost)
+		if err == nil && slices.Contains(ips, host) {
+			return p
+		}
+	}
+	return nil
+}
+
+// peerAddress return listen address of incoming peer, peer listening on all
+// interfaces is reported by IP it connected from
+func peerAddress(listen string, remote net.Addr) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return listen
+	}
+	if addr, ok := remote.(*net.TCPAddr); ok {
+		return net.JoinHostPort(addr.IP.String(), port)
+	}
+	return listen
+}
+
+func (n *Node) writeHandshake(w io.Writer) error {
+	b := append([]byte(handshakeMagic), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b[len(handshakeMagic):], handshakeVersion)
+	b = binary.LittleEndian.AppendUint64(b, n.id)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(n.address)))
+	_, err := w.Write(append(b, n.address...))
+	return err
+}
+
+// connect keep outgoing link to peer, reconnects with backoff
+func (n *Node) connect(p *peer) {
+	defer n.workers.Done()
+
+	backoff := minBackoff
+	for {
+		start := time.Now()
+		err := n.send(p)
+		p.connected.Store(false)
+
+		select {
+		case <-n.shutdown:
+			return
+		default:
+		}
+
+		// Link which worked for a while is reconnected fast
+		if time.Since(start) > maxBackoff {
+			backoff = minBackoff
+		}
+		p.failures.Add(1)
+		p.backoff.Store(int64(backoff))
+		slog.Warn("Peer link down", "peer", p.address, "error", err, "retry", backoff)
+
+		select {
+		case <-n.shutdown:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// send write queued events to peer until link fails or node stops
+func (n *Node) send(p *peer) error {
+	conn, err := net.DialTimeout("tcp", p.address, maxBackoff)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	if err := n.writeHandshake(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	ack := []byte{0}
+	conn.SetReadDeadline(time.Now().Add(maxBackoff))
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return fmt.Errorf("%w: %w", ErrBadHandshake, err)
+	}
+	if ack[0] != handshakeAccepted {
+		return fmt.Errorf("%w: unexpected reply %d", ErrBadHandshake, ack[0])
+	}
+	p.connected.Store(true)
+	p.backoff.Store(0)
+	slog.Info("Peer connected", "peer", p.address)
+
+	var record []byte
+	for {
+		var e event
+		select {
+		case <-n.shutdown:
+			return nil
+		case e = <-p.queue:
+		}
+
+		record = append(record[:0], e.op)
+		record = binary.LittleEndian.AppendUint16(record, uint16(len(e.key)))
+		record = append(record, e.key...)
+		if _, err := w.Write(record); err != nil {
+			p.dropped.Add(1)
+			return err
+		}
+		p.sent.Add(1)
+
+		// Events are batched while queue is not empty
+		if len(p.queue) == 0 {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Stats return counters of configured peers sorted by address, incoming
+// links are counted on configured peer they matched
+func (n *Node) Stats() []PeerStats {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	stats := make([]PeerStats, 0, len(n.stats))
+	for _, p := range n.stats {
+		stats = append(stats, PeerStats{
+			Address:     p.address,
+			Connected:   p.connected.Load(),
+			Queued:      len(p.queue),
+			Backoff:     time.Duration(p.backoff.Load()),
+			Sent:        p.sent.Load(),
+			Dropped:     p.dropped.Load(),
+			Failures:    p.failures.Load(),
+			Received:    p.received.Load(),
+			Invalidated: p.invalidated.Load(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Address < stats[j].Address })
+
+	return stats
+}
+
+// WriteMetrics is metrics collector of per peer counters
+func (n *Node) WriteMetrics(w *metrics.Writer) {
+	stats := n.Stats()
+	families := []struct {
+		name  string
+		help  string
+		typ   string
+		value func(s PeerStats) float64
+	}{
+		{"memcached_peer_connected", "Whether outgoing link to peer is up.", "gauge", func(s PeerStats) float64 {
+			if s.Connected {
+				return 1
+			}
+			return 0
+		}},
+		{"memcached_peer_queued_events", "Events waiting to be sent to peer.", "gauge", func(s PeerStats) float64 { return float64(s.Queued) }},
+		{"memcached_peer_sent_events_total", "Events sent to peer.", "counter", func(s PeerStats) float64 { return float64(s.Sent) }},
+		{"memcached_peer_dropped_events_total", "Events not sent to peer, because queue was full or link failed.", "counter", func(s PeerStats) float64 { return float64(s.Dropped) }},
+		{"memcached_peer_link_failures_total", "Failures of outgoing link to peer.", "counter", func(s PeerStats) float64 { return float64(s.Failures) }},
+		{"memcached_peer_received_events_total", "Events received from peer.", "counter", func(s PeerStats) float64 { return float64(s.Received) }},
+		{"memcached_peer_invalidated_items_total", "Items deleted by events received from peer.", "counter", func(s PeerStats) float64 { return float64(s.Invalidated) }},
+	}
+
+	for _, f := range families {
+		w.Header(f.name, f.help, f.typ)
+		for _, s := range stats {
+			w.Sample(f.name, `peer="`+s.Address+`"`, f.value(s))
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package cluster
+
+import (
+	"io"
+	"nefelim4ag/go-memcached-server/memstore"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestCluster start full mesh of nodes on localhost, items are stored before
+// nodes serve, so they are not broadcast
+func newTestCluster(t *testing.T, count int, items ...string) []*Node {
+	nodes := make([]*Node, count)
+	for i := range nodes {
+		s := memstore.NewSharedStore()
+		s.SetMemoryLimit(64 * 1024 * 1024)
+		for _, key := range items {
+			s.Set(key, &memstore.MEntry{Key: key, Value: []byte(key), Size: uint32(len(key))})
+		}
+		nodes[i] = NewNode(s)
+		if err := nodes[i].Listen("127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, n := range nodes {
+		peers := []string{}
+		for j, p := range nodes {
+			if i != j {
+				peers = append(peers, p.Addr().String())
+			}
+		}
+		n.Serve(peers)
+		t.Cleanup(n.Stop)
+	}
+
+	for i, n := range nodes {
+		for j, p := range nodes {
+			if i != j {
+				waitPeer(t, n, p.Addr().String(), func(p PeerStats) bool { return p.Connected })
+			}
+		}
+	}
+
+	return nodes
+}
+
+// waitPeer wait until counters of node link to peer at address are ready
+func waitPeer(t *testing.T, n *Node, address string, ready func(p PeerStats) bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !ready(peerStats(n, address)); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Node %s timed out waiting for peer %s, got %+v", n.Addr(), address, peerStats(n, address))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func peerStats(n *Node, address string) PeerStats {
+	for _, p := range n.Stats() {
+		if p.Address == address {
+			return p
+		}
+	}
+	return PeerStats{}
+}
+
+func TestInvalidation(t *testing.T) {
+	nodes := newTestCluster(t, 3, "set", "del")
+	a, b, c := nodes[0], nodes[1], nodes[2]
+
+	// Store on one node deletes stale copies on others, but not on itself
+	a.store.Set("set", &memstore.MEntry{Key: "set", Value: []byte("new"), Size: 3})
+	invalidated := func(p PeerStats) bool { return p.Invalidated == 1 }
+	waitPeer(t, b, a.Addr().String(), invalidated)
+	waitPeer(t, c, a.Addr().String(), invalidated)
+	for _, n := range []*Node{b, c} {
+		if _, ok := n.store.Get("set"); ok {
+			t.Fatalf("Stale item is kept on node %s", n.Addr())
+		}
+	}
+	if e, ok := a.store.Get("set"); !ok || string(e.Value[:e.Size]) != "new" {
+		t.Fatal("Stored item is invalidated on own node")
+	}
+
+	b.store.Delete("del")
+	waitPeer(t, a, b.Addr().String(), invalidated)
+	waitPeer(t, c, b.Addr().String(), invalidated)
+	for _, n := range []*Node{a, c} {
+		if _, ok := n.store.Get("del"); ok {
+			t.Fatalf("Deleted item is kept on node %s", n.Addr())
+		}
+	}
+
+	// Received events are not sent again
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := a.store.Get("set"); !ok {
+		t.Fatal("Invalidation looped back to origin node")
+	}
+	for i, want := range []uint64{2, 2, 0} {
+		sent := uint64(0)
+		for _, p := range nodes[i].Stats() {
+			sent += p.Sent
+		}
+		if sent != want {
+			t.Fatalf("Expected %d own events sent by node %d, got %d", want, i, sent)
+		}
+	}
+
+	if p := peerStats(b, a.Addr().String()); p.Sent != 1 || p.Received != 1 || p.Invalidated != 1 {
+		t.Fatalf("Expected one event each way, got %+v", p)
+	}
+}
+
+func TestUnchangedValueNotBroadcast(t *testing.T) {
+	nodes := newTestCluster(t, 2, "key")
+	a, b := nodes[0], nodes[1]
+
+	a.store.Touch("key", 100)
+	a.store.Delete("missing")
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := b.store.Get("key"); !ok {
+		t.Fatal("Touch invalidated peer copy")
+	}
+	if p := peerStats(a, b.Addr().String()); p.Sent != 0 {
+		t.Fatalf("Expected no events, got %+v", p)
+	}
+}
+
+func TestSelfPeerRejected(t *testing.T) {
+	s := memstore.NewSharedStore()
+	n := NewNode(s)
+	if err := n.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	n.Serve([]string{n.Addr().String()})
+	defer n.Stop()
+
+	s.Set("key", &memstore.MEntry{Key: "key"})
+	waitPeer(t, n, n.Addr().String(), func(p PeerStats) bool { return p.Failures > 0 && p.Backoff > 0 })
+	if _, ok := s.Get("key"); !ok {
+		t.Fatal("Node invalidated own item")
+	}
+	if p := peerStats(n, n.Addr().String()); p.Received != 0 {
+		t.Fatalf("Expected no events from self, got %+v", p)
+	}
+}
+
+func TestUnknownPeerRejected(t *testing.T) {
+	nodes := make([]*Node, 3)
+	for i := range nodes {
+		nodes[i] = NewNode(memstore.NewSharedStore())
+		if err := nodes[i].Listen("127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(nodes[i].Stop)
+	}
+	a, b, stranger := nodes[0], nodes[1], nodes[2]
+
+	// Peer configured by host name is matched by its resolved address
+	_, port, _ := net.SplitHostPort(b.Addr().String())
+	a.Serve([]string{net.JoinHostPort("localhost", port)})
+	b.Serve([]string{a.Addr().String()})
+	stranger.Serve([]string{a.Addr().String()})
+
+	connected := func(p PeerStats) bool { return p.Connected }
+	waitPeer(t, stranger, a.Addr().String(), func(p PeerStats) bool { return p.Failures > 0 })
+	waitPeer(t, b, a.Addr().String(), connected)
+	waitPeer(t, a, net.JoinHostPort("localhost", port), connected)
+	if stats := a.Stats(); len(stats) != 1 {
+		t.Fatalf("Expected only configured peer in stats, got %+v", stats)
+	}
+}
+
+func TestImpersonatingPeerRejected(t *testing.T) {
+	n := NewNode(memstore.NewSharedStore())
+	if err := n.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	n.Serve([]string{"127.0.0.2:1"})
+	defer n.Stop()
+
+	// Link from 127.0.0.1 claims address of peer configured at 127.0.0.2
+	conn, err := net.Dial("tcp", n.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	impostor := &Node{id: n.id + 1, address: "127.0.0.2:1"}
+	if err := impostor.writeHandshake(conn); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected impersonating peer link to be closed, got %v", err)
+	}
+}
+
+func TestStopWithoutListen(t *testing.T) {
+	NewNode(memstore.NewSharedStore()).Stop()
+}
@@ -0,0 +1,674 @@
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"nefelim4ag/go-memcached-server/memstore"
+	"nefelim4ag/go-memcached-server/proxy"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrHelp is returned by Parse when usage is requested by -h or --help
+var ErrHelp = errors.New("help requested")
+
+// Config is server configuration from command line and config file, options
+// follow memcached semantics: -p11211, -p 11211, --port=11211 and clustered
+// -vv are accepted. Long options of this server are accepted with single dash
+// as well.
+type Config struct {
+	ConfigFile string // -config, file of long options, flags override it
+
+	Port          int      // -p, TCP port, 0 disables TCP
+	Listen        []string // -l, interfaces, may include port
+	MaxConns      int      // -c
+	Threads       int      // -t, 0 keeps GOMAXPROCS
+	UDPPort       int      // -U, 0 disables UDP
+	UnixSocket    string   // -s
+	UnixMask      uint32   // -a
+	Verbosity     int      // -v, repeated
+	MemoryLimit   int64    // -m, bytes
+	ItemSizeLimit int64    // -I, bytes
+
+	LogLevel int
+	Pprof    bool
+	Eviction string
+	Metrics  string
+	AuthFile string // -Y, user:password lines, enables authentication
+
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+	OpLogPath        string
+	OpLogFsync       string
+
+	ExtPath     string
+	ExtSize     int64 // bytes
+	ExtItemSize int
+
+	ReplicateFrom     string
+	ReplicateAuthFile string // user:password line sent to primary with auth enabled
+	ReplicaReadOnly   bool
+
+	ProxyBackends       []string
+	ProxyTimeout        time.Duration
+	ProxyHealthInterval time.Duration
+
+	PeerListen string
+	Peers      []string
+
+	SlabAutomove int // -o slab_automove, -1 keeps default
+
+	TLS           bool     // -Z, TLS on TCP listeners
+	TLSCert       string   // -o ssl_chain_cert
+	TLSKey        string   // -o ssl_key
+	TLSClientCA   string   // -o ssl_ca_cert
+	TLSVerifyMode int      // -o ssl_verify_mode, -1 requires client certificate if client CA is set
+	TLSMinVersion uint16   // -o ssl_min_version
+	TLSCiphers    []uint16 // -o ssl_ciphers, nil keeps Go defaults
+}
+
+// Default return configuration used for options which are not set
+func Default() *Config {
+	return &Config{
+		Port:                11211,
+		MaxConns:            1024,
+		UnixMask:            0700,
+		MemoryLimit:         512 * 1024 * 1024,
+		ItemSizeLimit:       1024 * 1024,
+		LogLevel:            3,
+		Eviction:            "lru",
+		SnapshotInterval:    5 * time.Minute,
+		OpLogFsync:          memstore.FsyncEverySec,
+		ExtSize:             1024 * 1024 * 1024,
+		ExtItemSize:         512,
+		ProxyTimeout:        proxy.DefaultTimeout,
+		ProxyHealthInterval: proxy.DefaultHealthInterval,
+		SlabAutomove:        -1,
+		TLSVerifyMode:       -1,
+		TLSMinVersion:       tls.VersionTLS12,
+	}
+}
+
+// option is command line option, long name is matched first, so legacy
+// multi-letter options are not split to short ones
+type option struct {
+	long  string
+	short byte
+	arg   string // argument name in usage, empty for switches
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var options = []option{
+	{"port", 'p', "num", "TCP port to listen on, 0 is off (default 11211)", func(c *Config, v string) error {
+		return parsePort(v, &c.Port)
+	}},
+	{"listen", 'l', "addr", "interface to listen on, comma separated or repeated for several, may include port (default all)", func(c *Config, v string) error {
+		for _, address := range strings.Split(v, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				c.Listen = append(c.Listen, address)
+			}
+		}
+		return nil
+	}},
+	{"conn-limit", 'c', "num", "max simultaneous connections (default 1024)", func(c *Config, v string) error {
+		return parsePositive(v, &c.MaxConns)
+	}},
+	{"threads", 't', "num", "number of threads, sets GOMAXPROCS (default all CPUs)", func(c *Config, v string) error {
+		return parsePositive(v, &c.Threads)
+	}},
+	{"udp-port", 'U', "num", "UDP port to listen on, 0 is off (default 0)", func(c *Config, v string) error {
+		return parsePort(v, &c.UDPPort)
+	}},
+	{"unix-socket", 's', "file", "unix socket path to listen on, served together with TCP unless -p 0", func(c *Config, v string) error {
+		c.UnixSocket = v
+		return nil
+	}},
+	{"unix-mask", 'a', "mask", "access mask for unix socket, in octal (default 0700)", func(c *Config, v string) error {
+		mask, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || mask > 0777 {
+			return fmt.Errorf("invalid unix socket mask %q", v)
+		}
+		c.UnixMask = uint32(mask)
+		return nil
+	}},
+	{"verbose", 'v', "", "verbose logging, -vv logs commands", func(c *Config, v string) error {
+		if v == "" {
+			c.Verbosity++
+			return nil
+		}
+		return parseNonNegative(v, &c.Verbosity)
+	}},
+	{"memory-limit", 'm', "num", "items memory in megabytes, or with k, m, g suffix (default 512)", func(c *Config, v string) error {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			v = strconv.FormatInt(n, 10) + "m"
+		}
+		return parseSize(v, &c.MemoryLimit)
+	}},
+	{"max-item-size", 'I', "size", "max item size, with k, m suffix, 1k minimum (default 1m)", func(c *Config, v string) error {
+		return parseSize(v, &c.ItemSizeLimit)
+	}},
+	{"extended", 'o', "opts", "comma separated memcached extended options", func(c *Config, v string) error {
+		return c.setExtended(v)
+	}},
+	{"auth-file", 'Y', "file", "file of user:password lines, clients must authenticate, reloaded on SIGHUP", func(c *Config, v string) error {
+		c.AuthFile = v
+		return nil
+	}},
+	{"enable-ssl", 'Z', "", "enable TLS on TCP listeners", func(c *Config, v string) error {
+		return parseBool(v, &c.TLS)
+	}},
+	{"help", 'h', "", "print this help and exit", func(c *Config, v string) error {
+		return ErrHelp
+	}},
+	{"config", 0, "file", "config file of \"option = value\" lines, flags override it, reloaded on SIGHUP", func(c *Config, v string) error {
+		c.ConfigFile = v
+		return nil
+	}},
+
+	{"loglevel", 0, "num", "log level, 4=debug, 3=info, 2=warning, 1=error (default 3)", func(c *Config, v string) error {
+		level, err := strconv.Atoi(v)
+		if err != nil || level < 1 || level > 4 {
+			return fmt.Errorf("unsupported log level %q", v)
+		}
+		c.LogLevel = level
+		return nil
+	}},
+	{"pprof", 0, "", "enable pprof server on 127.0.0.1:6060", func(c *Config, v string) error {
+		return parseBool(v, &c.Pprof)
+	}},
+	{"eviction", 0, "policy", "eviction policy: " + strings.Join(memstore.EvictionPolicies, ", ") + " (default lru)", func(c *Config, v string) error {
+		c.Eviction = v
+		return nil
+	}},
+	{"metrics", 0, "addr", "enable Prometheus metrics listener on address, e.g. :9150", func(c *Config, v string) error {
+		c.Metrics = v
+		return nil
+	}},
+	{"snapshot", 0, "file", "file to save items on shutdown and load them on start", func(c *Config, v string) error {
+		c.SnapshotPath = v
+		return nil
+	}},
+	{"snapshot-interval", 0, "duration", "periodic snapshot interval, 0 disables periodic snapshots (default 5m)", func(c *Config, v string) error {
+		return parseDuration(v, &c.SnapshotInterval)
+	}},
+	{"oplog", 0, "file", "append changes to operation log and replay it on start", func(c *Config, v string) error {
+		c.OpLogPath = v
+		return nil
+	}},
+	{"oplog-fsync", 0, "policy", "operation log fsync policy: always, everysec, never (default everysec)", func(c *Config, v string) error {
+		c.OpLogFsync = v
+		return nil
+	}},
+	{"ext-path", 0, "file", "file to keep large cold values in instead of evicting them", func(c *Config, v string) error {
+		c.ExtPath = v
+		return nil
+	}},
+	{"ext-size", 0, "num", "extstore file size in megabytes (default 1024)", func(c *Config, v string) error {
+		return parseSize(v+"m", &c.ExtSize)
+	}},
+	{"ext-item-size", 0, "num", "minimal value size moved to extstore (default 512)", func(c *Config, v string) error {
+		return parsePositive(v, &c.ExtItemSize)
+	}},
+	{"replicate-from", 0, "addr", "run as replica of primary at address, e.g. primary:11211", func(c *Config, v string) error {
+		c.ReplicateFrom = v
+		return nil
+	}},
+	{"replicate-auth-file", 0, "file", "file of user:password line to authenticate to primary", func(c *Config, v string) error {
+		c.ReplicateAuthFile = v
+		return nil
+	}},
+	{"replica-read-only", 0, "", "reject client changes on replica", func(c *Config, v string) error {
+		return parseBool(v, &c.ReplicaReadOnly)
+	}},
+	{"proxy", 0, "addrs", "run as router: comma separated backends to forward key commands to by ketama hash", func(c *Config, v string) error {
+		c.ProxyBackends = splitList(v)
+		return nil
+	}},
+	{"proxy-timeout", 0, "duration", "router backend dial and request timeout (default 1s)", func(c *Config, v string) error {
+		return parseDuration(v, &c.ProxyTimeout)
+	}},
+	{"proxy-health-interval", 0, "duration", "router backend health check interval (default 1s)", func(c *Config, v string) error {
+		return parseDuration(v, &c.ProxyHealthInterval)
+	}},
+	{"peer-listen", 0, "addr", "accept cluster peers on address, e.g. :11311", func(c *Config, v string) error {
+		c.PeerListen = v
+		return nil
+	}},
+	{"peers", 0, "addrs", "comma separated peer listen addresses to send invalidations to", func(c *Config, v string) error {
+		c.Peers = splitList(v)
+		return nil
+	}},
+	{"tls-cert", 0, "file", "TLS certificate chain in PEM, as -o ssl_chain_cert", func(c *Config, v string) error {
+		c.TLSCert = v
+		return nil
+	}},
+	{"tls-key", 0, "file", "TLS private key in PEM, as -o ssl_key", func(c *Config, v string) error {
+		c.TLSKey = v
+		return nil
+	}},
+	{"tls-client-ca", 0, "file", "CA certificates in PEM to verify client certificates by, as -o ssl_ca_cert", func(c *Config, v string) error {
+		c.TLSClientCA = v
+		return nil
+	}},
+	{"tls-verify-mode", 0, "num", "client certificate: 0 none, 1 verify if given, 2 and 3 required (default 2 with client CA, else 0)", func(c *Config, v string) error {
+		return parseVerifyMode(v, &c.TLSVerifyMode)
+	}},
+	{"tls-min-version", 0, "version", "minimal TLS version: 1.0, 1.1, 1.2, 1.3 (default 1.2)", func(c *Config, v string) error {
+		return parseTLSVersion(v, &c.TLSMinVersion)
+	}},
+	{"tls-ciphers", 0, "suites", "comma or colon separated TLS 1.2 cipher suites, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", func(c *Config, v string) error {
+		return parseCipherSuites(v, &c.TLSCiphers)
+	}},
+}
+
+// Parse parse command line arguments without program name over config file
+// given by -config and defaults. List options of file and flags are combined.
+func Parse(args []string) (*Config, error) {
+	c := Default()
+	if err := c.parseArgs(args); err != nil {
+		return nil, err
+	}
+
+	if c.ConfigFile != "" {
+		path := c.ConfigFile
+		c = Default()
+		if err := c.load(path); err != nil {
+			return nil, err
+		}
+		if err := c.parseArgs(args); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, c.validate()
+}
+
+// parseArgs apply command line arguments over c
+func (c *Config) parseArgs(args []string) error {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			if i+1 < len(args) {
+				return fmt.Errorf("unexpected argument %q", args[i+1])
+			}
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			return fmt.Errorf("unexpected argument %q", arg)
+		}
+
+		// --name[=value] or -name[=value] of long option
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if opt := findLong(name); opt != nil && (len(name) > 1 || strings.HasPrefix(arg, "--")) {
+			if opt.arg != "" && !hasValue {
+				if i+1 >= len(args) {
+					return fmt.Errorf("option -%s requires an argument", name)
+				}
+				i++
+				value = args[i]
+			}
+			if err := opt.set(c, value); err != nil {
+				return optionError(name, err)
+			}
+			continue
+		}
+		if strings.HasPrefix(arg, "--") {
+			return fmt.Errorf("unknown option %q", arg)
+		}
+
+		// -abc, -p11211 or -p 11211 of short options
+		for j := 1; j < len(arg); j++ {
+			short := arg[j]
+			opt := findShort(short)
+			if opt == nil {
+				return fmt.Errorf("unknown option -%c", short)
+			}
+			value := ""
+			if opt.arg != "" {
+				switch {
+				case j+1 < len(arg):
+					value = arg[j+1:]
+				case i+1 < len(args):
+					i++
+					value = args[i]
+				default:
+					return fmt.Errorf("option -%c requires an argument", short)
+				}
+				j = len(arg)
+			}
+			if err := opt.set(c, value); err != nil {
+				return optionError(string(short), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func findLong(name string) *option {
+	for i := range options {
+		if options[i].long == name || (len(name) == 1 && options[i].short == name[0]) {
+			return &options[i]
+		}
+	}
+	return nil
+}
+
+func findShort(name byte) *option {
+	for i := range options {
+		if options[i].short == name {
+			return &options[i]
+		}
+	}
+	return nil
+}
+
+func optionError(name string, err error) error {
+	if err == ErrHelp {
+		return err
+	}
+	return fmt.Errorf("option -%s: %w", name, err)
+}
+
+// validate check option combinations, as memcached does on start
+func (c *Config) validate() error {
+	if c.ItemSizeLimit < 1024 {
+		return fmt.Errorf("item size limit %d is below minimum of 1k", c.ItemSizeLimit)
+	}
+	if c.ItemSizeLimit > c.MemoryLimit/2 {
+		return fmt.Errorf("item size limit %d is higher than 1/2 of memory limit", c.ItemSizeLimit)
+	}
+	if c.ItemSizeLimit > 1024*1024*1024 {
+		return fmt.Errorf("item size limit %d is above maximum of 1g", c.ItemSizeLimit)
+	}
+	if !slices.Contains(memstore.EvictionPolicies, c.Eviction) {
+		return fmt.Errorf("unknown eviction policy %q, expected one of %s", c.Eviction, strings.Join(memstore.EvictionPolicies, ", "))
+	}
+	if c.TLS && (c.TLSCert == "" || c.TLSKey == "") {
+		return errors.New("TLS requires certificate and key, -o ssl_chain_cert and ssl_key")
+	}
+	if c.TLSVerifyMode > 0 && c.TLSClientCA == "" {
+		return errors.New("client certificate verification requires client CA, -o ssl_ca_cert")
+	}
+
+	return nil
+}
+
+// Addresses return TCP listen addresses, interfaces without port use -p
+func (c *Config) Addresses() []string {
+	if len(c.Listen) == 0 {
+		if c.Port == 0 {
+			return nil
+		}
+		return []string{net.JoinHostPort("", strconv.Itoa(c.Port))}
+	}
+
+	addresses := []string{}
+	for _, address := range c.Listen {
+		if _, _, err := net.SplitHostPort(address); err == nil {
+			addresses = append(addresses, address)
+			continue
+		}
+		if c.Port == 0 {
+			continue
+		}
+		addresses = append(addresses, net.JoinHostPort(trimBrackets(address), strconv.Itoa(c.Port)))
+	}
+
+	return addresses
+}
+
+// UDPAddresses return UDP listen addresses, -U port on each interface of -l
+func (c *Config) UDPAddresses() []string {
+	if c.UDPPort == 0 {
+		return nil
+	}
+	if len(c.Listen) == 0 {
+		return []string{net.JoinHostPort("", strconv.Itoa(c.UDPPort))}
+	}
+
+	addresses := []string{}
+	for _, address := range c.Listen {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			address = host
+		}
+		addresses = append(addresses, net.JoinHostPort(trimBrackets(address), strconv.Itoa(c.UDPPort)))
+	}
+
+	return addresses
+}
+
+func trimBrackets(host string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// Usage write options help
+func Usage(w io.Writer) {
+	for _, opt := range options {
+		name := "-" + opt.long
+		if opt.short != 0 {
+			name = fmt.Sprintf("-%c, --%s", opt.short, opt.long)
+		}
+		if opt.arg != "" {
+			name += " <" + opt.arg + ">"
+		}
+		fmt.Fprintf(w, "  %-32s %s\n", name, opt.usage)
+	}
+}
+
+// TLSClientAuth return client certificate policy of verify mode, as
+// memcached ssl_verify_mode: 0 none, 1 verify if given, 2 and 3 required
+func (c *Config) TLSClientAuth() tls.ClientAuthType {
+	switch {
+	case c.TLSVerifyMode < 0 && c.TLSClientCA != "":
+		return tls.RequireAndVerifyClientCert
+	case c.TLSVerifyMode == 1:
+		return tls.VerifyClientCertIfGiven
+	case c.TLSVerifyMode >= 2:
+		return tls.RequireAndVerifyClientCert
+	}
+	return tls.NoClientCert
+}
+
+// setExtended apply -o options, options of memcached which have no effect
+// here are accepted, so its command lines work unchanged
+func (c *Config) setExtended(v string) error {
+	for _, opt := range splitList(v) {
+		name, value, _ := strings.Cut(opt, "=")
+		switch name {
+		case "slab_automove":
+			automove, err := strconv.Atoi(value)
+			if err != nil || automove < 0 || automove > 2 {
+				return fmt.Errorf("invalid slab_automove %q", value)
+			}
+			c.SlabAutomove = automove
+		// ext_path=/path/file:64G
+		case "ext_path":
+			path, size, ok := strings.Cut(value, ":")
+			if !ok || path == "" {
+				return fmt.Errorf("ext_path must be <path>:<size>")
+			}
+			if err := parseSize(size, &c.ExtSize); err != nil {
+				return err
+			}
+			c.ExtPath = path
+		case "ext_item_size":
+			if err := parsePositive(value, &c.ExtItemSize); err != nil {
+				return err
+			}
+		case "ssl_chain_cert":
+			c.TLSCert = value
+		case "ssl_key":
+			c.TLSKey = value
+		case "ssl_ca_cert":
+			c.TLSClientCA = value
+		case "ssl_verify_mode":
+			if err := parseVerifyMode(value, &c.TLSVerifyMode); err != nil {
+				return err
+			}
+		case "ssl_min_version":
+			if err := parseTLSVersion(value, &c.TLSMinVersion); err != nil {
+				return err
+			}
+		// ssl_ciphers=A:B, suites are colon separated as in OpenSSL cipher list
+		case "ssl_ciphers":
+			if err := parseCipherSuites(value, &c.TLSCiphers); err != nil {
+				return err
+			}
+		default:
+			if !ignoredExtended[name] {
+				return fmt.Errorf("illegal suboption %q", opt)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ignoredExtended are memcached extended options with no effect on this server
+var ignoredExtended = map[string]bool{
+	"modern": true, "maxconns_fast": true, "no_maxconns_fast": true, "hashpower": true,
+	"tail_repair_time": true, "hash_algorithm": true, "lru_crawler": true, "no_lru_crawler": true,
+	"lru_maintainer": true, "no_lru_maintainer": true, "lru_segmented": true, "no_lru_segmented": true,
+	"slab_reassign": true, "no_slab_reassign": true, "slab_automove_ratio": true, "slab_automove_window": true,
+	"slab_chunk_max": true, "slab_sizes": true, "track_sizes": true, "temporary_ttl": true,
+	"idle_timeout": true, "watcher_logbuf_size": true, "worker_logbuf_size": true, "read_buf_mem_limit": true,
+	"resp_obj_mem_limit": true, "no_inline_ascii_resp": true, "drop_privileges": true, "no_drop_privileges": true,
+	"ext_page_size": true, "ext_wbuf_size": true, "ext_threads": true, "ext_io_threadcount": true,
+	"ext_compact_under": true, "ext_drop_under": true, "ext_max_frag": true, "ext_drop_unread": true,
+	"ext_recache_rate": true, "ext_max_sleep": true, "ext_low_ttl": true, "no_hashexpand": true,
+	"ssl_keyformat": true, "ssl_wbuf_size": true, "ssl_session_cache": true, "ssl_kernel_tls": true,
+	"hot_lru_pct": true, "warm_lru_pct": true, "hot_max_factor": true, "warm_max_factor": true,
+}
+
+func splitList(v string) []string {
+	list := []string{}
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func parsePort(v string, port *int) error {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %q", v)
+	}
+	*port = n
+	return nil
+}
+
+func parsePositive(v string, n *int) error {
+	value, err := strconv.Atoi(v)
+	if err != nil || value <= 0 {
+		return fmt.Errorf("invalid value %q, positive number expected", v)
+	}
+	*n = value
+	return nil
+}
+
+func parseNonNegative(v string, n *int) error {
+	value, err := strconv.Atoi(v)
+	if err != nil || value < 0 {
+		return fmt.Errorf("invalid value %q, non-negative number expected", v)
+	}
+	*n = value
+	return nil
+}
+
+// parseSize parse bytes with optional k, m, g suffix, case insensitive
+func parseSize(v string, size *int64) error {
+	shift := 0
+	switch strings.ToLower(v[len(v)-min(len(v), 1):]) {
+	case "k":
+		shift = 10
+	case "m":
+		shift = 20
+	case "g":
+		shift = 30
+	}
+	if shift != 0 {
+		v = v[:len(v)-1]
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 || n > (1<<62)>>shift {
+		return fmt.Errorf("invalid size %q", v)
+	}
+	*size = n << shift
+	return nil
+}
+
+func parseVerifyMode(v string, mode *int) error {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || n > 3 {
+		return fmt.Errorf("invalid TLS verify mode %q", v)
+	}
+	*mode = n
+	return nil
+}
+
+// parseTLSVersion parse 1.2 or tlsv1.2 of memcached ssl_min_version
+func parseTLSVersion(v string, version *uint16) error {
+	switch strings.TrimPrefix(strings.ToLower(v), "tlsv") {
+	case "1", "1.0":
+		*version = tls.VersionTLS10
+	case "1.1":
+		*version = tls.VersionTLS11
+	case "1.2":
+		*version = tls.VersionTLS12
+	case "1.3":
+		*version = tls.VersionTLS13
+	default:
+		return fmt.Errorf("unsupported TLS version %q", v)
+	}
+	return nil
+}
+
+func parseCipherSuites(v string, suites *[]uint16) error {
+	ids := map[string]uint16{}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		ids[suite.Name] = suite.ID
+	}
+
+	list := []uint16{}
+	for _, name := range splitList(strings.ReplaceAll(v, ":", ",")) {
+		id, ok := ids[name]
+		if !ok {
+			return fmt.Errorf("unknown TLS cipher suite %q", name)
+		}
+		list = append(list, id)
+	}
+	*suites = list
+	return nil
+}
+
+func parseBool(v string, b *bool) error {
+	if v == "" {
+		*b = true
+		return nil
+	}
+	value, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("invalid boolean %q", v)
+	}
+	*b = value
+	return nil
+}
+
+func parseDuration(v string, d *time.Duration) error {
+	value, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	*d = value
+	return nil
+}
@@ -0,0 +1,239 @@
+package config
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMemcachedFlags(t *testing.T) {
+	c, err := Parse(strings.Fields("-p11212 -l 127.0.0.1,::1 -l [::2]:11300 -c 64 -t 2 -U 0 -s /tmp/mc.sock -a 0770 -vv -m 64 -I 512k -o slab_automove=2,modern,ext_path=/ssd/ext:2G"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Port != 11212 || c.MaxConns != 64 || c.Threads != 2 || c.UnixSocket != "/tmp/mc.sock" || c.UnixMask != 0770 || c.Verbosity != 2 {
+		t.Fatalf("Unexpected config %+v", c)
+	}
+	if c.MemoryLimit != 64<<20 || c.ItemSizeLimit != 512<<10 {
+		t.Fatalf("Unexpected memory %d and item size %d", c.MemoryLimit, c.ItemSizeLimit)
+	}
+	if c.SlabAutomove != 2 || c.ExtPath != "/ssd/ext" || c.ExtSize != 2<<30 {
+		t.Fatalf("Unexpected extended options %+v", c)
+	}
+
+	expected := []string{"127.0.0.1:11212", "[::1]:11212", "[::2]:11300"}
+	if addresses := c.Addresses(); !reflect.DeepEqual(addresses, expected) {
+		t.Fatalf("Expected addresses %v, got %v", expected, addresses)
+	}
+	// UDP is off by -U 0
+	if addresses := c.UDPAddresses(); addresses != nil {
+		t.Fatalf("Unexpected UDP addresses %v", addresses)
+	}
+	c.UDPPort = 11213
+	expected = []string{"127.0.0.1:11213", "[::1]:11213", "[::2]:11213"}
+	if addresses := c.UDPAddresses(); !reflect.DeepEqual(addresses, expected) {
+		t.Fatalf("Expected UDP addresses %v, got %v", expected, addresses)
+	}
+}
+
+func TestParseLongFlags(t *testing.T) {
+	c, err := Parse([]string{
+		"--port=0", "--listen", "10.0.0.1:11211", "--max-item-size=2m", "--memory-limit", "1g", "--verbose",
+		"-loglevel", "2", "-pprof", "-snapshot-interval=1m", "-ext-size", "10", "--replica-read-only=false",
+		"-peers", "a:1, b:2", "-proxy=mc1:11211,mc2:11211",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Port != 0 || c.ItemSizeLimit != 2<<20 || c.MemoryLimit != 1<<30 || c.Verbosity != 1 || c.LogLevel != 2 {
+		t.Fatalf("Unexpected config %+v", c)
+	}
+	if !c.Pprof || c.ReplicaReadOnly || c.SnapshotInterval != time.Minute || c.ExtSize != 10<<20 {
+		t.Fatalf("Unexpected config %+v", c)
+	}
+	if !reflect.DeepEqual(c.Peers, []string{"a:1", "b:2"}) || len(c.ProxyBackends) != 2 {
+		t.Fatalf("Unexpected lists %v %v", c.Peers, c.ProxyBackends)
+	}
+	// Interface with own port is kept when TCP port is off
+	if addresses := c.Addresses(); !reflect.DeepEqual(addresses, []string{"10.0.0.1:11211"}) {
+		t.Fatalf("Unexpected addresses %v", addresses)
+	}
+}
+
+func TestParseDefaults(t *testing.T) {
+	c, err := Parse(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, Default()) {
+		t.Fatalf("Expected defaults, got %+v", c)
+	}
+	if addresses := c.Addresses(); !reflect.DeepEqual(addresses, []string{":11211"}) {
+		t.Fatalf("Unexpected addresses %v", addresses)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, args := range []string{
+		"-x",
+		"--bogus",
+		"-p",
+		"-p 70000",
+		"-c 0",
+		"-a 999",
+		"-I 512",
+		"-I 1m -m 1",
+		"-I 2g -m 8g",
+		"-o no_such_option",
+		"-o slab_automove=5",
+		"-o ext_path=/no/size",
+		"-loglevel 9",
+		"-eviction random",
+		"positional",
+	} {
+		if _, err := Parse(strings.Fields(args)); err == nil || err == ErrHelp {
+			t.Fatalf("Expected error for %q, got %v", args, err)
+		}
+	}
+
+	if _, err := Parse([]string{"-h"}); err != ErrHelp {
+		t.Fatalf("Expected help, got %v", err)
+	}
+	if _, err := Parse([]string{"-vh"}); err != ErrHelp {
+		t.Fatalf("Expected help, got %v", err)
+	}
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseConfigFile(t *testing.T) {
+	path := writeFile(t, "memcached.conf", `
+# Listeners
+[listen]
+port = 11300
+listen: 127.0.0.1
+conn_limit = 100
+
+[memory]
+memory-limit = "1g" # per node
+max_item_size = 2m ; default is 1m
+eviction = 'lfu'
+extended = slab_automove=0,ext_path=/ssd/ext:1G
+
+[auth]
+auth-file = "/etc/memcached/users#1"
+
+[logging]
+verbose = 2
+pprof = true
+`)
+
+	c, err := Parse([]string{"-config", path, "-c", "200", "-l", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Port != 11300 || c.MemoryLimit != 1<<30 || c.ItemSizeLimit != 2<<20 || c.Eviction != "lfu" || c.Verbosity != 2 || !c.Pprof {
+		t.Fatalf("Unexpected config %+v", c)
+	}
+	if c.AuthFile != "/etc/memcached/users#1" || c.SlabAutomove != 0 || c.ExtPath != "/ssd/ext" {
+		t.Fatalf("Unexpected config %+v", c)
+	}
+	// Flags override file, lists are combined
+	if c.MaxConns != 200 || !reflect.DeepEqual(c.Listen, []string{"127.0.0.1", "::1"}) {
+		t.Fatalf("Expected flags over file, got %+v", c)
+	}
+
+	for _, content := range []string{"bogus = 1", "p = 1", "help = true", "config = other", "port", "port = x", "max-item-size =", "max-item-size = # 2m"} {
+		if _, err := Parse([]string{"--config=" + writeFile(t, "bad.conf", content)}); err == nil {
+			t.Fatalf("Expected error for %q", content)
+		}
+	}
+	if _, err := Parse([]string{"-config", filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Fatal("Expected error for missing file")
+	}
+}
+
+func TestReload(t *testing.T) {
+	current := Default()
+	next := Default()
+	next.MemoryLimit = 1 << 30
+	next.LogLevel = 4
+	next.Port = 11300
+	next.Peers = []string{"a:1"}
+
+	reloaded, changed := current.Reload(next)
+	if reloaded.MemoryLimit != 1<<30 || reloaded.LogLevel != 4 {
+		t.Fatalf("Expected reloadable options applied, got %+v", reloaded)
+	}
+	if reloaded.Port != 11211 || reloaded.Peers != nil || current.MemoryLimit == 1<<30 {
+		t.Fatalf("Expected other options kept, got %+v", reloaded)
+	}
+	if !reflect.DeepEqual(changed, []string{"Port", "Peers"}) {
+		t.Fatalf("Unexpected changed options %v", changed)
+	}
+}
+
+func TestLoadAuthFile(t *testing.T) {
+	users, err := LoadAuthFile(writeFile(t, "users", "user:secret\n\nother:pa:ss\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(users, map[string]string{"user": "secret", "other": "pa:ss"}) {
+		t.Fatalf("Unexpected users %v", users)
+	}
+
+	for _, content := range []string{"", "nocolon\n", ":password\n"} {
+		if _, err := LoadAuthFile(writeFile(t, "users", content)); err == nil {
+			t.Fatalf("Expected error for %q", content)
+		}
+	}
+}
+
+func TestParseTLS(t *testing.T) {
+	c, err := Parse(strings.Fields("-Z -o ssl_chain_cert=/etc/mc.crt,ssl_key=/etc/mc.key,ssl_min_version=tlsv1.3,ssl_ciphers=TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,ssl_session_cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.TLS || c.TLSCert != "/etc/mc.crt" || c.TLSKey != "/etc/mc.key" || c.TLSMinVersion != tls.VersionTLS13 {
+		t.Fatalf("Unexpected TLS config %+v", c)
+	}
+	ciphers := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	if !reflect.DeepEqual(c.TLSCiphers, ciphers) || c.TLSClientAuth() != tls.NoClientCert {
+		t.Fatalf("Unexpected TLS ciphers %v and client auth %v", c.TLSCiphers, c.TLSClientAuth())
+	}
+
+	// Client CA requires client certificate unless verify mode is set
+	c, err = Parse(strings.Fields("--enable-ssl --tls-cert a.crt --tls-key a.key --tls-client-ca ca.crt"))
+	if err != nil || c.TLSClientAuth() != tls.RequireAndVerifyClientCert || c.TLSMinVersion != tls.VersionTLS12 {
+		t.Fatalf("Unexpected TLS config %+v, %v", c, err)
+	}
+	c, err = Parse(strings.Fields("-Z -tls-cert a.crt -tls-key a.key -tls-client-ca ca.crt -tls-verify-mode 1"))
+	if err != nil || c.TLSClientAuth() != tls.VerifyClientCertIfGiven {
+		t.Fatalf("Unexpected TLS config %+v, %v", c, err)
+	}
+
+	for _, args := range []string{
+		"-Z",
+		"-Z -o ssl_chain_cert=a.crt",
+		"-o ssl_verify_mode=2",
+		"-o ssl_verify_mode=4",
+		"-o ssl_min_version=tlsv2",
+		"-tls-ciphers TLS_NO_SUCH_CIPHER",
+	} {
+		if _, err := Parse(strings.Fields(args)); err == nil {
+			t.Fatalf("Expected error for %q", args)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// load apply options of config file over c. Lines are "key = value" or
+// "key: value", keys are long option names with - or _, "[section]" headers
+// only group options and # or ; start comments, at line start or after
+// whitespace following value, e.g. "memory-limit = 64m # per node", quoted
+// values keep them. Switches take true or false, list options take comma
+// separated values.
+func (c *Config) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' || text[0] == ';' || (text[0] == '[' && text[len(text)-1] == ']') {
+			continue
+		}
+
+		i := strings.IndexAny(text, "=:")
+		if i < 0 {
+			return fmt.Errorf("%s:%d: expected key = value, got %q", path, line, text)
+		}
+		name := strings.ReplaceAll(strings.TrimSpace(text[:i]), "_", "-")
+		value := unquote(stripComment(strings.TrimSpace(text[i+1:])))
+
+		opt := findLong(name)
+		if opt == nil || len(name) == 1 || name == "help" || name == "config" {
+			return fmt.Errorf("%s:%d: unknown option %q", path, line, name)
+		}
+		if opt.arg != "" && value == "" {
+			return fmt.Errorf("%s:%d: option %s requires a value", path, line, name)
+		}
+		if err := opt.set(c, value); err != nil {
+			return fmt.Errorf("%s:%d: option %s: %w", path, line, name, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// stripComment cut inline comment of value, # or ; starts it at value start
+// or after whitespace, outside of quotes
+func stripComment(v string) string {
+	start := 0
+	if len(v) > 0 && (v[0] == '"' || v[0] == '\'') {
+		if end := strings.IndexByte(v[1:], v[0]); end >= 0 {
+			start = end + 2
+		}
+	}
+	for i := start; i < len(v); i++ {
+		if (v[i] == '#' || v[i] == ';') && (i == 0 || v[i-1] == ' ' || v[i-1] == '\t') {
+			return strings.TrimSpace(v[:i])
+		}
+	}
+	return v
+}
+
+// unquote strip quotes of TOML and YAML strings
+func unquote(v string) string {
+	if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+		return v[1 : len(v)-1]
+	}
+	return v
+}
+
+// reloadable are options applied by Reload without restart
+var reloadable = map[string]bool{
+	"MemoryLimit":   true,
+	"ItemSizeLimit": true,
+	"LogLevel":      true,
+	"Verbosity":     true,
+	"AuthFile":      true,
+	"TLSCert":       true,
+	"TLSKey":        true,
+	"TLSClientCA":   true,
+	"TLSVerifyMode": true,
+	"TLSMinVersion": true,
+	"TLSCiphers":    true,
+}
+
+// Reload return running configuration with reloadable options taken from
+// next, and names of other options which differ and wait for restart
+func (c *Config) Reload(next *Config) (*Config, []string) {
+	reloaded := *c
+	changed := []string{}
+
+	current, updated, result := reflect.ValueOf(c).Elem(), reflect.ValueOf(next).Elem(), reflect.ValueOf(&reloaded).Elem()
+	for i := 0; i < current.NumField(); i++ {
+		name := current.Type().Field(i).Name
+		if reloadable[name] {
+			result.Field(i).Set(updated.Field(i))
+			continue
+		}
+		if !reflect.DeepEqual(current.Field(i).Interface(), updated.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+
+	return &reloaded, changed
+}
+
+// LoadAuthFile read users of memcached auth file, one user:password per line
+func LoadAuthFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if text == "" {
+			continue
+		}
+		user, password, ok := strings.Cut(text, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:password", path, line)
+		}
+		users[user] = password
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("%s: no users", path)
+	}
+
+	return users, nil
+}
@@ -1,26 +1,35 @@
 package main
 
 import (
-	"flag"
 	"fmt"
+	"io/fs"
+	"nefelim4ag/go-memcached-server/cluster"
+	"nefelim4ag/go-memcached-server/config"
 	"nefelim4ag/go-memcached-server/memcachedprotocol"
 	"nefelim4ag/go-memcached-server/memstore"
+	"nefelim4ag/go-memcached-server/metrics"
+	"nefelim4ag/go-memcached-server/proxy"
 	"nefelim4ag/go-memcached-server/tcpserver"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"strings"
 	"syscall"
 
 	"log/slog"
 )
 
 type memcachedServer struct {
-	store *memstore.SharedStore
+	store  *memstore.SharedStore
+	router *proxy.Router  // nil unless server runs in router mode
+	tls    *tcpserver.TLS // nil unless TLS is enabled
 }
 
-func (mS *memcachedServer) ConnectionHandler(conn *net.TCPConn, err error) {
+func (mS *memcachedServer) ConnectionHandler(conn net.Conn, err error) {
 	if err != nil {
 		slog.Error(err.Error())
 		return
@@ -31,46 +40,118 @@ func (mS *memcachedServer) ConnectionHandler(conn *net.TCPConn, err error) {
 	// Reuse context between binary commands
 	Processor := memcachedprotocol.CreateProcessor(conn, mS.store)
 	defer Processor.CloseProcessor()
+	if mS.router != nil {
+		Processor.SetRouter(mS.router)
+	}
 	Processor.Handle()
 }
 
-func main() {
-	rawMemstoreSize := flag.Uint64("m", 512, "items memory in megabytes, default is 512")
-	rawMemstoreItemSize := flag.Uint("I", 1024*1024, "max item sizem, default is 1m")
-	logLevel := flag.Int("loglevel", 3, "log level, 4=debug, 3=info, 2=warning, 1=error")
-	pprof := flag.Bool("pprof", false, "enable pprof server")
-	flag.Parse()
-
-	programLevel := new(slog.LevelVar)
-
-	switch *logLevel {
+// logLevel return level of -loglevel or -v, whichever is more verbose,
+// -v keeps default info level, -vv logs commands as memcached does
+func logLevel(cfg *config.Config) slog.Level {
+	switch max(cfg.LogLevel, min(2+cfg.Verbosity, 4)) {
 	case 4:
-		programLevel.Set(slog.LevelDebug)
-		fmt.Println("Set debug")
+		return slog.LevelDebug
 	case 3:
-		programLevel.Set(slog.LevelInfo)
-		fmt.Println("Set info")
+		return slog.LevelInfo
 	case 2:
-		programLevel.Set(slog.LevelWarn)
-		fmt.Println("Set warn")
-	case 1:
-		programLevel.Set(slog.LevelError)
-		fmt.Println("Set error")
-	default:
-		panic("Unsupported log level")
+		return slog.LevelWarn
+	}
+	return slog.LevelError
+}
+
+// setMemoryLimit set store limit and Go soft memory limit above it
+func (mS *memcachedServer) setMemoryLimit(limit int64) {
+	mS.store.SetMemoryLimit(limit)
+	// Replaced items are garbage until next GC, soft limit makes GC run before heap
+	// doubles, headroom is for connection buffers and runtime
+	if os.Getenv("GOMEMLIMIT") == "" {
+		debug.SetMemoryLimit(limit + limit/8 + 64*1024*1024)
+	}
+}
+
+// tlsConfig return TLS settings of listeners
+func tlsConfig(cfg *config.Config) tcpserver.TLSConfig {
+	return tcpserver.TLSConfig{
+		CertFile:     cfg.TLSCert,
+		KeyFile:      cfg.TLSKey,
+		ClientCAFile: cfg.TLSClientCA,
+		ClientAuth:   cfg.TLSClientAuth(),
+		MinVersion:   cfg.TLSMinVersion,
+		CipherSuites: cfg.TLSCiphers,
+	}
+}
+
+// reload apply settings which are safe to change at runtime from config file
+// and flags, connections stay open. Running config is returned, on error it
+// is kept unchanged.
+func (mS *memcachedServer) reload(current *config.Config, level *slog.LevelVar) *config.Config {
+	next, err := config.Parse(os.Args[1:])
+	if err != nil {
+		slog.Error("Config reload failed", "error", err)
+		return current
+	}
+	var users map[string]string
+	if next.AuthFile != "" {
+		if users, err = config.LoadAuthFile(next.AuthFile); err != nil {
+			slog.Error("Config reload failed", "error", err)
+			return current
+		}
+	}
+	// Certificates are loaded first, so failed reload changes nothing,
+	// turning TLS off waits for restart as other listener changes
+	if mS.tls != nil && next.TLS {
+		if err := mS.tls.Reload(tlsConfig(next)); err != nil {
+			slog.Error("Config reload failed", "error", err)
+			return current
+		}
 	}
 
+	cfg, changed := current.Reload(next)
+	// Items over new limit are evicted by following writes
+	mS.setMemoryLimit(cfg.MemoryLimit)
+	mS.store.SetItemSizeLimit(int32(cfg.ItemSizeLimit))
+	level.Set(logLevel(cfg))
+	memcachedprotocol.SetAuthUsers(users)
+
+	slog.Info("Config reloaded", "memory_limit", cfg.MemoryLimit, "item_size_limit", cfg.ItemSizeLimit,
+		"log_level", level.Level(), "auth_users", len(users))
+	if len(changed) > 0 {
+		slog.Warn("Changed settings are applied on restart", "settings", changed)
+	}
+
+	return cfg
+}
+
+func main() {
+	cfg, err := config.Parse(os.Args[1:])
+	switch {
+	case err == config.ErrHelp:
+		config.Usage(os.Stdout)
+		os.Exit(0)
+	case err != nil:
+		fmt.Fprintln(os.Stderr, err)
+		config.Usage(os.Stderr)
+		os.Exit(64)
+	}
+
+	programLevel := new(slog.LevelVar)
+	programLevel.Set(logLevel(cfg))
+	fmt.Println("Set " + strings.ToLower(programLevel.Level().String()))
+
 	logger := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: programLevel})
 	slog.SetDefault(slog.New(logger))
 
-	memstoreSize := int64(*rawMemstoreSize) * 1024 * 1024
-	memstoreItemSize := int32(*rawMemstoreItemSize)
+	if cfg.Threads > 0 {
+		runtime.GOMAXPROCS(cfg.Threads)
+	}
 
-	// Wait for a SIGINT or SIGTERM signal to gracefully shut down the server
+	// Wait for a SIGINT or SIGTERM signal to gracefully shut down the server,
+	// SIGHUP reloads config
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	if *pprof {
+	if cfg.Pprof {
 		go func() {
 			slog.Error(http.ListenAndServe("127.0.0.1:6060", nil).Error())
 		}()
@@ -79,17 +160,203 @@ func main() {
 	memcachedSrv := &memcachedServer{
 		store: memstore.NewSharedStore(),
 	}
-	memcachedSrv.store.SetMemoryLimit(memstoreSize)
-	memcachedSrv.store.SetItemSizeLimit(memstoreItemSize)
-
-	srvInstance := tcpserver.Server{}
-	err := srvInstance.ListenAndServe(":11211", memcachedSrv.ConnectionHandler)
+	err = memcachedSrv.store.SetEvictionPolicy(cfg.Eviction)
 	if err != nil {
-		slog.Error(err.Error())
+		panic(err)
+	}
+	memcachedSrv.setMemoryLimit(cfg.MemoryLimit)
+	memcachedSrv.store.SetItemSizeLimit(int32(cfg.ItemSizeLimit))
+	if cfg.AuthFile != "" {
+		users, err := config.LoadAuthFile(cfg.AuthFile)
+		if err != nil {
+			slog.Error("Auth file load failed", "error", err)
+			os.Exit(1)
+		}
+		memcachedprotocol.SetAuthUsers(users)
+	}
+	if cfg.SlabAutomove >= 0 {
+		memcachedSrv.store.SetAutomove(cfg.SlabAutomove)
 	}
 
-	<-sigChan
+	if cfg.ExtPath != "" {
+		err := memcachedSrv.store.EnableExtstore(memstore.ExtstoreConfig{
+			Path:     cfg.ExtPath,
+			Size:     cfg.ExtSize,
+			ItemSize: cfg.ExtItemSize,
+		})
+		if err != nil {
+			slog.Error("Extstore init failed", "path", cfg.ExtPath, "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// Operation log has all changes, snapshot would only load stale items
+	if cfg.OpLogPath != "" {
+		records, err := memcachedSrv.store.EnableOpLog(cfg.OpLogPath, cfg.OpLogFsync)
+		if err != nil {
+			slog.Error("Oplog replay failed", "path", cfg.OpLogPath, "records", records, "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Oplog replayed", "path", cfg.OpLogPath, "records", records, "fsync", cfg.OpLogFsync)
+	}
+
+	if cfg.SnapshotPath != "" {
+		if cfg.OpLogPath != "" {
+			slog.Warn("Snapshot is not loaded, items are replayed from oplog", "path", cfg.SnapshotPath)
+		} else if items, err := memcachedSrv.store.LoadSnapshot(cfg.SnapshotPath); err != nil {
+			slog.Error("Snapshot load failed", "path", cfg.SnapshotPath, "items", items, "error", err)
+		} else {
+			slog.Info("Snapshot loaded", "path", cfg.SnapshotPath, "items", items)
+		}
+
+		memcachedSrv.store.SetSnapshotPath(cfg.SnapshotPath)
+		if cfg.SnapshotInterval > 0 {
+			go memcachedSrv.store.Snapshotter(cfg.SnapshotInterval)
+		}
+	}
+
+	// Replica items are replaced by primary snapshot, local snapshot and oplog only fill it until sync
+	if cfg.ReplicateFrom != "" {
+		memcachedSrv.store.SetReadOnly(cfg.ReplicaReadOnly)
+		if cfg.ReplicateAuthFile != "" {
+			users, err := config.LoadAuthFile(cfg.ReplicateAuthFile)
+			if err == nil && len(users) != 1 {
+				err = fmt.Errorf("%s: expected single user:password line", cfg.ReplicateAuthFile)
+			}
+			if err != nil {
+				slog.Error("Replicate auth file load failed", "path", cfg.ReplicateAuthFile, "error", err)
+				os.Exit(1)
+			}
+			for user, password := range users {
+				memcachedSrv.store.SetPrimaryAuth(user, password)
+			}
+		}
+		go memcachedSrv.store.ReplicateFrom(cfg.ReplicateFrom)
+	}
+
+	// Changes of this node clients delete keys on peers, so nodes don't serve stale values
+	var node *cluster.Node
+	if cfg.PeerListen != "" {
+		node = cluster.NewNode(memcachedSrv.store)
+		if err := node.Listen(cfg.PeerListen); err != nil {
+			slog.Error("Peer channel init failed", "error", err)
+			os.Exit(1)
+		}
+		node.Serve(cfg.Peers)
+		memcachedprotocol.SetCluster(node)
+	}
+
+	if len(cfg.ProxyBackends) > 0 {
+		memcachedSrv.router, err = proxy.NewRouter(proxy.Config{
+			Backends:       cfg.ProxyBackends,
+			Timeout:        cfg.ProxyTimeout,
+			HealthInterval: cfg.ProxyHealthInterval,
+		})
+		if err != nil {
+			slog.Error("Router init failed", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// TCP, unix socket and UDP are served together, -p 0 turns TCP off
+	srvInstance := tcpserver.Server{MaxConns: cfg.MaxConns}
+	if cfg.TLS {
+		memcachedSrv.tls, err = tcpserver.NewTLS(tlsConfig(cfg))
+		if err != nil {
+			slog.Error("TLS init failed", "error", err)
+			os.Exit(1)
+		}
+		srvInstance.TLS = memcachedSrv.tls
+	}
+	addresses := cfg.Addresses()
+	if len(addresses) == 0 && cfg.UnixSocket == "" && cfg.UDPPort == 0 {
+		slog.Error("No listen address, TCP port is 0")
+		os.Exit(1)
+	}
+	for _, address := range addresses {
+		if err := srvInstance.ListenAndServe(address, memcachedSrv.ConnectionHandler); err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+	if cfg.UnixSocket != "" {
+		if err := srvInstance.ListenUnixAndServe(cfg.UnixSocket, fs.FileMode(cfg.UnixMask), memcachedSrv.ConnectionHandler); err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+	udpInstance := tcpserver.UDPServer{Workers: cfg.Threads}
+	for _, address := range cfg.UDPAddresses() {
+		err := udpInstance.ListenAndServe(address, func() tcpserver.PacketHandler {
+			return memcachedprotocol.NewPacketProcessor(memcachedSrv.store, memcachedSrv.router).HandlePacket
+		})
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	settings := memcachedprotocol.ServerSettings{
+		MaxConns:   cfg.MaxConns,
+		UDPPort:    cfg.UDPPort,
+		Interfaces: strings.Join(cfg.Listen, ","),
+		UnixSocket: cfg.UnixSocket,
+		UnixMask:   cfg.UnixMask,
+		Verbosity:  cfg.Verbosity,
+		Rejected:   srvInstance.Rejected,
+
+		TLS:                cfg.TLS,
+		TLSClientAuth:      cfg.TLSClientAuth(),
+		TLSMinVersion:      cfg.TLSMinVersion,
+		TLSHandshakeErrors: srvInstance.TLSHandshakeErrors,
+	}
+	memcachedprotocol.SetServerSettings(settings)
+
+	if cfg.Metrics != "" {
+		collectors := []metrics.Collector{
+			memcachedSrv.store.WriteMetrics,
+			srvInstance.WriteMetrics,
+			memcachedprotocol.WriteMetrics,
+		}
+		if node != nil {
+			collectors = append(collectors, node.WriteMetrics)
+		}
+		if memcachedSrv.router != nil {
+			collectors = append(collectors, memcachedSrv.router.WriteMetrics)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler(collectors...))
+		go func() {
+			slog.Info("Metrics listening", "address", cfg.Metrics)
+			slog.Error(http.ListenAndServe(cfg.Metrics, mux).Error())
+		}()
+	}
+
+	for sig := <-sigChan; sig == syscall.SIGHUP; sig = <-sigChan {
+		cfg = memcachedSrv.reload(cfg, programLevel)
+		settings.Verbosity = cfg.Verbosity
+		settings.TLSClientAuth = cfg.TLSClientAuth()
+		settings.TLSMinVersion = cfg.TLSMinVersion
+		memcachedprotocol.SetServerSettings(settings)
+	}
 	slog.Info("Shutting down server...")
 	srvInstance.Stop()
+	udpInstance.Stop()
+	if node != nil {
+		node.Stop()
+	}
+	if memcachedSrv.router != nil {
+		memcachedSrv.router.Close()
+	}
 	slog.Info("Server stopped.")
+
+	if cfg.SnapshotPath != "" {
+		if err := memcachedSrv.store.Snapshot(); err != nil {
+			slog.Error("Snapshot save failed", "path", cfg.SnapshotPath, "error", err)
+		}
+	}
+
+	if err := memcachedSrv.store.CloseOpLog(); err != nil {
+		slog.Error("Oplog close failed", "path", cfg.OpLogPath, "error", err)
+	}
 }
@@ -5,10 +5,8 @@ import (
 	"fmt"
 	"io"
 	"nefelim4ag/go-memcached-server/memstore"
-	"os"
 	"strconv"
 	"strings"
-	"time"
 	"unsafe"
 
 	"log/slog"
@@ -50,13 +48,24 @@ func (ctx *Processor) CommandAscii() error {
 	args := request_parsed[1:]
 
 	slog.Debug("", "cmd", command, "args", args)
+	ctx.command = command
+
+	if !ctx.authorized() {
+		return ctx.asciiAuth(command, args)
+	}
+
+	if ctx.router != nil {
+		if routed, err := ctx.routeAscii(command, args); routed {
+			return err
+		}
+	}
 
 	switch command {
 	case "quit":
-		return fmt.Errorf("quit")
+		return errQuit
 
 	case "version":
-		ctx.wb.Write([]byte("VERSION 1.6.2\r\n"))
+		ctx.wb.Write([]byte("VERSION " + serverVersion + "\r\n"))
 		return nil
 
 	case "verbosity":
@@ -88,46 +97,91 @@ func (ctx *Processor) CommandAscii() error {
 
 		for _, v := range args {
 			entry, exist := ctx.store.Get(v)
+			counters[cmdGet].Add(1)
+			countHit(exist, getHits, getMisses)
 			if !exist {
 				continue
 			}
+			ctx.sendValue(entry, command == "gets")
+		}
+
+		return ctx.sendEnd()
+
+	// gat|gats <exptime> <key>*\r\n
+	case "gat", "gats":
+		if len(args) < 2 {
+			return ctx.sendError()
+		}
 
-			// VALUE <key> <Flags> <bytes> [<cas unique>]\r\n
-			// <data block>\r\n
-			_flags := unsafe.Slice(&entry.Flags[0], len(entry.Flags))
-			flags := binary.BigEndian.Uint32(_flags)
-			if command == "get" {
-				resp := fmt.Sprintf("VALUE %s %d %d\r\n", entry.Key, flags, entry.Size)
-				ctx.wb.Write([]byte(resp))
-			} else {
-				resp := fmt.Sprintf("VALUE %s %d %d %d\r\n", entry.Key, flags, entry.Size, entry.Cas)
-				ctx.wb.Write([]byte(resp))
+		exptime, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return ctx.sendClientError("invalid exptime argument")
+		}
+
+		for _, v := range args[1:] {
+			entry, err := ctx.store.Touch(v, ctx.store.ExpTime(exptime))
+			counters[cmdGet].Add(1)
+			counters[cmdTouch].Add(1)
+			countHit(err == nil, getHits, getMisses)
+			countHit(err == nil, touchHits, touchMisses)
+			if err != nil {
+				continue
 			}
-			ctx.wb.Write(entry.Value)
-			ctx.wb.Write([]byte("\r\n"))
+			ctx.store.Bump(entry)
+			ctx.sendValue(entry, command == "gats")
 		}
 
 		return ctx.sendEnd()
+
+	// touch <key> <exptime> [noreply]\r\n
+	case "touch":
+		if len(args) < 2 {
+			return ctx.sendError()
+		}
+
+		exptime, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return ctx.sendClientError("invalid exptime argument")
+		}
+
+		_, err = ctx.store.Touch(args[0], ctx.store.ExpTime(exptime))
+		counters[cmdTouch].Add(1)
+		countHit(err == nil, touchHits, touchMisses)
+		if args[len(args)-1] == "noreply" {
+			return nil
+		}
+		if err != nil {
+			ctx.wb.Write([]byte("NOT_FOUND\r\n"))
+			return nil
+		}
+		ctx.wb.Write([]byte("TOUCHED\r\n"))
+		return nil
+
 	case "delete": //delete <key> [noreply]\r\n
+		if len(args) > 0 && ctx.store.ReadOnly() {
+			ctx.wb.Write([]byte("SERVER_ERROR " + memstore.ErrReadOnly.Error() + "\r\n"))
+			return nil
+		}
 		switch len(args) {
 		case 0:
 			return ctx.sendError()
 		case 1:
 			key := args[0]
-			_, exist := ctx.store.Get(key)
+			_, exist := ctx.store.Delete(key)
+			countHit(exist, deleteHits, deleteMisses)
 			if !exist {
 				ctx.wb.Write([]byte("NOT_FOUND\r\n"))
 				return nil
 			}
 
-			ctx.store.Delete(key)
 			ctx.wb.Write([]byte("DELETED\r\n"))
 		default:
 			if args[1] != "noreply" || len(args) > 2 {
 				ctx.sendError()
 			}
 			key := args[0]
-			ctx.store.Delete(key)
+			_, exist := ctx.store.Delete(key)
+			countHit(exist, deleteHits, deleteMisses)
 		}
 
 		return nil
@@ -136,8 +190,23 @@ func (ctx *Processor) CommandAscii() error {
 	case "incr", "decr":
 		return ctx.incr_decr(command, args)
 
+	// flush_all [delay] [noreply]\r\n
 	case "flush_all":
-		ctx.store.Flush()
+		delay := int64(0)
+		if len(args) > 0 && args[0] != "noreply" {
+			delay, err = strconv.ParseInt(args[0], 10, 64)
+			if err != nil {
+				ctx.wb.Write([]byte("CLIENT_ERROR bad command line format\r\n"))
+				return nil
+			}
+		}
+		if ctx.store.ReadOnly() {
+			ctx.wb.Write([]byte("SERVER_ERROR " + memstore.ErrReadOnly.Error() + "\r\n"))
+			return nil
+		}
+
+		ctx.store.Flush(delay)
+		counters[cmdFlush].Add(1)
 		if len(args) > 0 && args[len(args)-1] == "noreply" {
 			return nil
 		}
@@ -146,6 +215,43 @@ func (ctx *Processor) CommandAscii() error {
 	case "stats":
 		return ctx.stats(args)
 
+	case "slabs":
+		return ctx.slabs(args)
+
+	// snapshot\r\n, starts background snapshot
+	case "snapshot":
+		switch ctx.store.BackgroundSnapshot() {
+		case nil:
+			ctx.wb.Write([]byte("OK\r\n"))
+		case memstore.ErrSnapshotBusy:
+			ctx.wb.Write([]byte("BUSY snapshot in progress\r\n"))
+		default:
+			ctx.wb.Write([]byte("SERVER_ERROR snapshot is not configured\r\n"))
+		}
+		return nil
+
+	// oplog compact\r\n, rewrites operation log in background
+	case "oplog":
+		if len(args) != 1 || args[0] != "compact" {
+			return ctx.sendError()
+		}
+		switch ctx.store.BackgroundCompactOpLog() {
+		case nil:
+			ctx.wb.Write([]byte("OK\r\n"))
+		case memstore.ErrCompactBusy:
+			ctx.wb.Write([]byte("BUSY oplog compaction in progress\r\n"))
+		default:
+			ctx.wb.Write([]byte("SERVER_ERROR oplog is not enabled\r\n"))
+		}
+		return nil
+
+	// replicate\r\n, connection streams store to replica until it is closed
+	case "replicate":
+		return ctx.replicate()
+
+	case "mg", "ms", "md", "ma", "mn", "me":
+		return ctx.CommandMeta(command, args)
+
 	default:
 		return ctx.sendError()
 	}
@@ -158,14 +264,34 @@ func (ctx *Processor) CommandAscii() error {
 	// }
 }
 
+// VALUE <key> <Flags> <bytes> [<cas unique>]\r\n
+// <data block>\r\n
+func (ctx *Processor) sendValue(entry *memstore.MEntry, withCas bool) {
+	_flags := unsafe.Slice(&entry.Flags[0], len(entry.Flags))
+	flags := binary.BigEndian.Uint32(_flags)
+	if withCas {
+		resp := fmt.Sprintf("VALUE %s %d %d %d\r\n", entry.Key, flags, entry.Size, entry.Cas)
+		ctx.wb.Write([]byte(resp))
+	} else {
+		resp := fmt.Sprintf("VALUE %s %d %d\r\n", entry.Key, flags, entry.Size)
+		ctx.wb.Write([]byte(resp))
+	}
+	ctx.wb.Write(entry.Value[:entry.Size])
+	ctx.wb.Write([]byte("\r\n"))
+}
+
 // <command name> <key> <Flags> <ExpTime> <bytes> [noreply]\r\n
 func (ctx *Processor) set_add_replace(command string, args []string) error {
+	if len(args) < 4 {
+		return ctx.sendError()
+	}
+
 	key := args[0]
 	Flags, err := strconv.ParseUint(args[1], 10, 32)
 	if err != nil {
 		return ctx.sendClientError(err.Error())
 	}
-	ExpTime, err := strconv.ParseUint(args[2], 10, 32)
+	ExpTime, err := strconv.ParseInt(args[2], 10, 64)
 	if err != nil {
 		return ctx.sendClientError(err.Error())
 	}
@@ -176,9 +302,9 @@ func (ctx *Processor) set_add_replace(command string, args []string) error {
 
 	entry := memstore.MEntry{
 		Key:     key,
-		ExpTime: uint32(ExpTime),
+		ExpTime: ctx.store.ExpTime(ExpTime),
 		Size:    uint32(nbytes),
-		Value:   make([]byte, nbytes),
+		Value:   ctx.valueBuffer(int(nbytes)),
 	}
 
 	_f := unsafe.Slice(&entry.Flags[0], len(entry.Flags))
@@ -193,48 +319,62 @@ func (ctx *Processor) set_add_replace(command string, args []string) error {
 	// Read message last \r\n possibly
 	ctx.rb.ReadString('\n')
 
-	_, exist := ctx.store.Get(key)
 	switch command {
 	case "add":
-		if exist {
-			if args[len(args)-1] == "noreply" {
-				return nil
-			}
-			ctx.wb.Write([]byte("NOT_STORED\r\n"))
-			return nil
-		}
+		err = ctx.store.Add(entry.Key, &entry)
 	case "replace":
-		if !exist {
-			if args[len(args)-1] == "noreply" {
-				return nil
-			}
-			ctx.wb.Write([]byte("NOT_STORED\r\n"))
-			return nil
-		}
+		err = ctx.store.Replace(entry.Key, &entry)
+	default:
+		err = ctx.store.Set(entry.Key, &entry)
 	}
-
-	err = ctx.store.Set(entry.Key, &entry)
-	if err != nil {
-		return ctx.sendClientError(err.Error())
+	countStore(err)
+	if err == memstore.ErrExists || err == memstore.ErrNotFound {
+		err = errNotStored
 	}
 
-	if args[len(args)-1] == "noreply" {
-		return nil
-	}
+	return ctx.sendStoreResult(err, args[len(args)-1] == "noreply")
+}
 
-	ctx.wb.Write([]byte("STORED\r\n"))
+// sendStoreResult reply to storage command by store error
+func (ctx *Processor) sendStoreResult(err error, noreply bool) error {
+	switch err {
+	case nil:
+		if !noreply {
+			ctx.wb.Write([]byte("STORED\r\n"))
+		}
+	case memstore.ErrExists:
+		if !noreply {
+			ctx.wb.Write([]byte("EXISTS\r\n"))
+		}
+	case memstore.ErrNotFound:
+		if !noreply {
+			ctx.wb.Write([]byte("NOT_FOUND\r\n"))
+		}
+	case errNotStored:
+		if !noreply {
+			ctx.wb.Write([]byte("NOT_STORED\r\n"))
+		}
+	case memstore.ErrTooLarge, memstore.ErrReadOnly:
+		ctx.wb.Write([]byte("SERVER_ERROR " + err.Error() + "\r\n"))
+	default:
+		return ctx.sendServerError(err.Error())
+	}
 
 	return nil
 }
 
 // <command name> <key> <Flags> <ExpTime> <bytes> [noreply]\r\n
 func (ctx *Processor) append_prepend(command string, args []string) error {
+	if len(args) < 4 {
+		return ctx.sendError()
+	}
+
 	key := args[0]
 	Flags, err := strconv.ParseUint(args[1], 10, 32)
 	if err != nil {
 		return ctx.sendClientError(err.Error())
 	}
-	ExpTime, err := strconv.ParseUint(args[2], 10, 32)
+	ExpTime, err := strconv.ParseInt(args[2], 10, 64)
 	if err != nil {
 		return ctx.sendClientError(err.Error())
 	}
@@ -245,10 +385,9 @@ func (ctx *Processor) append_prepend(command string, args []string) error {
 
 	entry := memstore.MEntry{
 		Key:     key,
-		ExpTime: uint32(ExpTime),
+		ExpTime: ctx.store.ExpTime(ExpTime),
 		Size:    uint32(nbytes),
-		Cas:     uint64(time.Now().UnixNano()),
-		Value:   make([]byte, nbytes),
+		Value:   ctx.valueBuffer(int(nbytes)),
 	}
 	_f := unsafe.Slice(&entry.Flags[0], len(entry.Flags))
 	binary.BigEndian.PutUint32(_f, uint32(Flags))
@@ -262,42 +401,31 @@ func (ctx *Processor) append_prepend(command string, args []string) error {
 	// Read message last \r\n possibly
 	ctx.rb.ReadString('\n')
 
-	v, exist := ctx.store.Get(key)
-	if !exist {
-		if args[len(args)-1] == "noreply" {
-			return nil
+	data := entry.Value
+	_, err = ctx.store.Update(key, func(old *memstore.MEntry) (*memstore.MEntry, error) {
+		if old == nil {
+			return nil, errNotStored
 		}
-		ctx.wb.Write([]byte("NOT_STORED\r\n"))
-		return nil
-	}
-
-	entry.Flags = v.Flags
-	entry.ExpTime = v.ExpTime
 
-	switch command {
-	case "append":
-		old_data := v.Value
-		new_data := entry.Value
-		entry.Value = append(old_data, new_data[:]...)
-	case "prepend":
-		old_data := v.Value
-		new_data := entry.Value
-		entry.Value = append(new_data, old_data[:]...)
-	}
-	entry.Size = uint32(len(entry.Value))
-
-	err = ctx.store.Set(entry.Key, &entry)
-	if err != nil {
-		return ctx.sendClientError(err.Error())
-	}
-
-	if args[len(args)-1] == "noreply" {
-		return nil
-	}
-
-	ctx.wb.Write([]byte("STORED\r\n"))
+		value := make([]byte, 0, int(old.Size)+len(data))
+		switch command {
+		case "append":
+			value = append(append(value, old.Value[:old.Size]...), data...)
+		case "prepend":
+			value = append(append(value, data...), old.Value[:old.Size]...)
+		}
 
-	return nil
+		return &memstore.MEntry{
+			Key:     key,
+			Flags:   old.Flags,
+			ExpTime: old.ExpTime,
+			Size:    uint32(len(value)),
+			Value:   value,
+		}, nil
+	})
+	countStore(err)
+
+	return ctx.sendStoreResult(err, args[len(args)-1] == "noreply")
 }
 
 // cas <key> <Flags> <ExpTime> <bytes> <cas unique> [noreply]\r\n
@@ -311,7 +439,7 @@ func (ctx *Processor) cas(args []string) error {
 	if err != nil {
 		return ctx.sendClientError(err.Error())
 	}
-	ExpTime, err := strconv.ParseUint(args[2], 10, 32)
+	ExpTime, err := strconv.ParseInt(args[2], 10, 64)
 	if err != nil {
 		return ctx.sendClientError(err.Error())
 	}
@@ -326,10 +454,9 @@ func (ctx *Processor) cas(args []string) error {
 
 	entry := memstore.MEntry{
 		Key:     key,
-		ExpTime: uint32(ExpTime),
+		ExpTime: ctx.store.ExpTime(ExpTime),
 		Size:    uint32(bytes),
-		Cas:     uint64(time.Now().UnixNano()),
-		Value:   make([]byte, bytes),
+		Value:   ctx.valueBuffer(int(bytes)),
 	}
 	_f := unsafe.Slice(&entry.Flags[0], len(entry.Flags))
 	binary.BigEndian.PutUint32(_f, uint32(Flags))
@@ -343,199 +470,118 @@ func (ctx *Processor) cas(args []string) error {
 	// Read message last \r\n possibly
 	ctx.rb.ReadString('\n')
 
-	// Racy implementation item can be modified between get & set
-	v, exist := ctx.store.Get(key)
-	if !exist {
-		if args[len(args)-1] == "noreply" {
-			return nil
-		}
-
-		ctx.wb.Write([]byte("NOT_FOUND\r\n"))
-		return nil
-	}
+	err = ctx.store.CompareAndSwap(entry.Key, &entry, cas)
+	countStore(err)
+	countCas(err)
 
-	if v.Cas != cas {
-		if args[len(args)-1] == "noreply" {
-			return nil
-		}
+	return ctx.sendStoreResult(err, args[len(args)-1] == "noreply")
+}
 
-		ctx.wb.Write([]byte("EXISTS\r\n"))
-		return nil
+func (ctx *Processor) incr_decr(command string, args []string) error {
+	if len(args) < 2 {
+		return ctx.sendError()
 	}
 
-	err = ctx.store.Set(entry.Key, &entry)
+	key := args[0]
+	change, err := strconv.ParseUint(args[1], 10, 64)
 	if err != nil {
 		return ctx.sendClientError(err.Error())
 	}
 
-	if args[len(args)-1] == "noreply" {
+	var new_value uint64
+	if command == "incr" {
+		new_value, _, err = ctx.store.Incr(key, change)
+		countHit(err != memstore.ErrNotFound, incrHits, incrMisses)
+	} else {
+		new_value, _, err = ctx.store.Decr(key, change)
+		countHit(err != memstore.ErrNotFound, decrHits, decrMisses)
+	}
+
+	noreply := args[len(args)-1] == "noreply"
+	switch err {
+	case nil:
+	case memstore.ErrNotFound:
+		if !noreply {
+			ctx.wb.Write([]byte("NOT_FOUND\r\n"))
+		}
+		return nil
+	case memstore.ErrNotNumeric:
+		ctx.wb.Write([]byte("CLIENT_ERROR " + err.Error() + "\r\n"))
 		return nil
+	case memstore.ErrReadOnly:
+		ctx.wb.Write([]byte("SERVER_ERROR " + err.Error() + "\r\n"))
+		return nil
+	default:
+		return ctx.sendServerError(err.Error())
 	}
 
-	ctx.wb.Write([]byte("STORED\r\n"))
+	if noreply {
+		return nil
+	}
+
+	ctx.wb.Write([]byte(fmt.Sprintf("%d\r\n", new_value)))
 
 	return nil
 }
 
-func (ctx *Processor) incr_decr(command string, args []string) error {
-	key := args[0]
-	change, err := strconv.ParseUint(args[1], 10, 64)
-	if err != nil {
-		return ctx.sendClientError(err.Error())
+// stats [settings|items|sizes|conns|slabs|peers|proxy|reset]\r\n
+func (ctx *Processor) stats(args []string) error {
+	group := ""
+	if len(args) > 0 {
+		group = args[0]
 	}
 
-	_v, exist := ctx.store.Get(key)
-	if !exist {
-		ctx.wb.Write([]byte("NOT_FOUND\r\n"))
+	if group == "reset" {
+		ctx.resetStats()
+		ctx.wb.Write([]byte("RESET\r\n"))
 		return nil
 	}
 
-	v := _v
-	old_value, err := strconv.ParseUint(string(v.Value), 10, 64)
-	if err != nil {
-		return ctx.sendClientError(err.Error())
+	stats, ok := ctx.statsGroup(group)
+	if !ok {
+		return ctx.sendError()
 	}
 
-	const MaxUint = ^uint64(0)
-	const MinUint = uint64(0)
-
-	new_value := uint64(0)
-	if command == "incr" {
-		if MaxUint-old_value < change {
-			new_value = MaxUint
-		} else {
-			new_value = old_value + change
-		}
-	} else {
-		if MinUint+old_value < change {
-			new_value = MinUint
-		} else {
-			new_value = old_value - change
-		}
+	for _, stat := range stats {
+		ctx.wb.Write([]byte("STAT " + stat[0] + " " + stat[1] + "\r\n"))
 	}
 
-	v.Value = []byte(fmt.Sprintf("%d", new_value))
-	v.Size = uint32(len(v.Value))
-	ctx.store.Set(key, v)
-
-	if args[len(args)-1] == "noreply" {
-		return nil
-	}
+	return ctx.sendEnd()
+}
 
-	ctx.wb.Write([]byte(fmt.Sprintf("%d\r\n", new_value)))
+// slabs reassign <source class> <dest class>\r\n
+// slabs automove <0|1|2>\r\n
+func (ctx *Processor) slabs(args []string) error {
+	switch {
+	case len(args) == 3 && args[0] == "reassign":
+		src, err1 := strconv.Atoi(args[1])
+		dst, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			return ctx.sendClientError("bad command line format")
+		}
 
-	return nil
-}
+		switch ctx.store.SlabReassign(src, dst) {
+		case nil:
+			ctx.wb.Write([]byte("OK\r\n"))
+		case memstore.ErrBadClass:
+			ctx.wb.Write([]byte("BADCLASS invalid src or dst class id\r\n"))
+		case memstore.ErrNoSpare:
+			ctx.wb.Write([]byte("NOSPARE source class has no spare pages\r\n"))
+		case memstore.ErrSame:
+			ctx.wb.Write([]byte("SAME src and dst class are identical\r\n"))
+		}
+		return nil
 
-func (ctx *Processor) stats(args []string) error {
-	if len(args) == 0 {
-		ctx.wb.Write([]byte(fmt.Sprintf("STAT pid %d\r\n", os.Getpid())))
-		// STAT uptime 6710
-		ctx.wb.Write([]byte(fmt.Sprintf("STAT time %d\r\n", time.Now().Unix())))
-		ctx.wb.Write([]byte("STAT version 1.6.19\r\n"))
-		return ctx.sendError()
+	case len(args) == 2 && args[0] == "automove":
+		mode, err := strconv.Atoi(args[1])
+		if err != nil || ctx.store.SetAutomove(mode) != nil {
+			return ctx.sendError()
+		}
+		ctx.wb.Write([]byte("OK\r\n"))
+		return nil
 	}
 
-	switch args[0] {
-	case "noreply":
-		return ctx.sendError()
-	case "items":
-		return fmt.Errorf("not supported")
-	case "slabs":
-		return fmt.Errorf("not supported")
-	case "sizes":
-		return fmt.Errorf("not supported")
-	default:
-		return fmt.Errorf("not supported")
-	}
-	// STAT libevent 2.1.12-stable
-	// STAT pointer_size 64
-	// STAT rusage_user 0.508315
-	// STAT rusage_system 0.202256
-	// STAT max_connections 1024
-	// STAT curr_connections 2
-	// STAT total_connections 20
-	// STAT rejected_connections 0
-	// STAT connection_structures 3
-	// STAT response_obj_oom 0
-	// STAT response_obj_count 1
-	// STAT response_obj_bytes 65536
-	// STAT read_buf_count 8
-	// STAT read_buf_bytes 131072
-	// STAT read_buf_bytes_free 49152
-	// STAT read_buf_oom 0
-	// STAT reserved_fds 20
-	// STAT cmd_get 1
-	// STAT cmd_set 8
-	// STAT cmd_flush 2
-	// STAT cmd_touch 0
-	// STAT cmd_meta 0
-	// STAT get_hits 1
-	// STAT get_misses 0
-	// STAT get_expired 0
-	// STAT get_flushed 0
-	// STAT delete_misses 1
-	// STAT delete_hits 1
-	// STAT incr_misses 1
-	// STAT incr_hits 3
-	// STAT decr_misses 0
-	// STAT decr_hits 0
-	// STAT cas_misses 0
-	// STAT cas_hits 0
-	// STAT cas_badval 0
-	// STAT touch_hits 0
-	// STAT touch_misses 0
-	// STAT store_too_large 0
-	// STAT store_no_memory 0
-	// STAT auth_cmds 0
-	// STAT auth_errors 0
-	// STAT bytes_read 945
-	// STAT bytes_written 482
-	// STAT limit_maxbytes 2147483648
-	// STAT accepting_conns 1
-	// STAT listen_disabled_num 0
-	// STAT time_in_listen_disabled_us 0
-	// STAT threads 4
-	// STAT conn_yields 0
-	// STAT hash_power_level 16
-	// STAT hash_bytes 524288
-	// STAT hash_is_expanding 0
-	// STAT slab_reassign_rescues 0
-	// STAT slab_reassign_chunk_rescues 0
-	// STAT slab_reassign_evictions_nomem 0
-	// STAT slab_reassign_inline_reclaim 0
-	// STAT slab_reassign_busy_items 0
-	// STAT slab_reassign_busy_deletes 0
-	// STAT slab_reassign_running 0
-	// STAT slabs_moved 0
-	// STAT lru_crawler_running 0
-	// STAT lru_crawler_starts 15
-	// STAT lru_maintainer_juggles 8743
-	// STAT malloc_fails 0
-	// STAT log_worker_dropped 0
-	// STAT log_worker_written 0
-	// STAT log_watcher_skipped 0
-	// STAT log_watcher_sent 0
-	// STAT log_watchers 0
-	// STAT unexpected_napi_ids 0
-	// STAT round_robin_fallback 0
-	// STAT bytes 153
-	// STAT curr_items 2
-	// STAT total_items 6
-	// STAT slab_global_page_pool 0
-	// STAT expired_unfetched 0
-	// STAT evicted_unfetched 0
-	// STAT evicted_active 0
-	// STAT evictions 0
-	// STAT reclaimed 0
-	// STAT crawler_reclaimed 0
-	// STAT crawler_items_checked 3
-	// STAT lrutail_reflocked 0
-	// STAT moves_to_cold 6
-	// STAT moves_to_warm 0
-	// STAT moves_within_lru 0
-	// STAT direct_reclaims 0
-	// STAT lru_bumps_dropped 0
+	return ctx.sendError()
 }
 
 // func HandleCommand(request string, client *bufio.ReadWriter) error {
@@ -543,23 +589,6 @@ func (ctx *Processor) stats(args []string) error {
 
 // 	switch command {
 
-// 	case "touch": //touch <key> <ExpTime> [noreply]\r\n
-// 		key := args[0]
-// 		ExpTime, err := strconv.ParseUint(args[1], 10, 32)
-// 		if err != nil {
-// 			return err
-// 		}
-
-// 		_v, exist := store.Get(key)
-// 		v := _v.(MemcachedEntry)
-// 		if ExpTime > 0 && exist {
-// 			v.ExpTime = uint32(ExpTime)
-// 			store.Set(key, v)
-// 			ctx.wb.Write([]byte("TOUCHED\r\n"))
-// 		} else {
-// 			ctx.wb.Write([]byte("NOT_FOUND\r\n"))
-// 		}
-
 // 	case "lru_crawler":
 // 		switch args[0] {
 // 		case "metadump":
@@ -0,0 +1,238 @@
+package memcachedprotocol
+
+import (
+	"bufio"
+	"fmt"
+	"nefelim4ag/go-memcached-server/memstore"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAsciiExpiration(t *testing.T) {
+	c := newASCIIClient(t)
+
+	c.expect("set relative 0 60 3\r\nbar\r\n", "STORED")
+	c.expect("get relative\r\n", "VALUE relative 0 3", "bar", "END")
+
+	c.expect("set negative 0 -1 3\r\nbar\r\n", "STORED")
+	c.expect("get negative\r\n", "END")
+
+	past := time.Now().Unix() - 60
+	c.expect(fmt.Sprintf("set past 0 %d 3\r\nbar\r\n", past), "STORED")
+	c.expect("get past\r\n", "END")
+
+	future := time.Now().Unix() + 3600
+	c.expect(fmt.Sprintf("set future 0 %d 3\r\nbar\r\n", future), "STORED")
+	c.expect("get future\r\n", "VALUE future 0 3", "bar", "END")
+
+	// Expired item is missing for add
+	c.expect("add negative 0 0 3\r\nbaz\r\n", "STORED")
+	c.expect("get negative\r\n", "VALUE negative 0 3", "baz", "END")
+}
+
+func TestAsciiShortArguments(t *testing.T) {
+	c := newASCIIClient(t)
+
+	for _, request := range []string{"set k", "add k 0 0", "append k", "prepend k 0", "incr k", "decr"} {
+		c.expect(request+"\r\n", "ERROR")
+	}
+	// Connection stays usable
+	c.expect("set k 0 0 1\r\n1\r\n", "STORED")
+	c.expect("incr k 2\r\n", "3")
+}
+
+func TestAsciiTouchGat(t *testing.T) {
+	c := newASCIIClient(t)
+
+	c.expect("touch foo 10\r\n", "NOT_FOUND")
+	c.expect("set foo 5 0 3\r\nbar\r\n", "STORED")
+	c.expect("touch foo -1\r\n", "TOUCHED")
+	c.expect("get foo\r\n", "END")
+
+	c.expect("set foo 5 0 3\r\nbar\r\n", "STORED")
+	c.expect("gat 100 foo missing\r\n", "VALUE foo 5 3", "bar", "END")
+	c.expect("mg foo t\r\n", "HD t100")
+
+	c.send("gats 0 foo\r\n")
+	if line := c.line(); !strings.HasPrefix(line, "VALUE foo 5 3 ") {
+		t.Fatalf("Unexpected gats response %q", line)
+	}
+	c.expect("", "bar", "END")
+	c.expect("mg foo t\r\n", "HD t-1")
+}
+
+// stats read stats group response into map
+func (c *asciiClient) stats(group string) map[string]string {
+	c.t.Helper()
+
+	c.send(strings.TrimSpace("stats "+group) + "\r\n")
+	stats := map[string]string{}
+	for {
+		line := c.line()
+		if line == "END" {
+			return stats
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 || fields[0] != "STAT" {
+			c.t.Fatalf("Unexpected stats line %q", line)
+		}
+		stats[fields[1]] = fields[2]
+	}
+}
+
+func TestAsciiStats(t *testing.T) {
+	c := newASCIIClient(t)
+
+	c.expect("stats reset\r\n", "RESET")
+	c.expect("set foo 0 0 3\r\nbar\r\n", "STORED")
+	c.expect("get foo bar\r\n", "VALUE foo 0 3", "bar", "END")
+	c.expect("delete bar\r\n", "NOT_FOUND")
+	c.expect("incr foo 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value")
+	c.expect("touch foo 0\r\n", "TOUCHED")
+
+	expected := map[string]string{
+		"cmd_get":       "2",
+		"get_hits":      "1",
+		"get_misses":    "1",
+		"cmd_set":       "1",
+		"delete_misses": "1",
+		"incr_hits":     "1",
+		"cmd_touch":     "1",
+		"touch_hits":    "1",
+		"curr_items":    "1",
+		"total_items":   "1",
+		"version":       serverVersion,
+	}
+	stats := c.stats("")
+	for name, value := range expected {
+		if stats[name] != value {
+			t.Fatalf("Expected %s %s, got %q", name, value, stats[name])
+		}
+	}
+	if stats["curr_connections"] == "0" || stats["bytes_read"] == "0" {
+		t.Fatalf("Connection counters are not updated: %v", stats)
+	}
+
+	if settings := c.stats("settings"); settings["item_size_max"] == "" || settings["maxconns"] == "" || settings["domain_socket"] != "NULL" {
+		t.Fatalf("Expected item_size_max and listener settings in stats settings, got %v", settings)
+	}
+	if c.stats("items")["items:1:number"] != "1" {
+		t.Fatal("Expected 1 item in stats items")
+	}
+	if sizes := c.stats("sizes"); len(sizes) != 1 {
+		t.Fatalf("Expected 1 size bucket, got %v", sizes)
+	}
+
+	if slabs := c.stats("slabs"); slabs["active_slabs"] != "1" || slabs["1:used_chunks"] != "1" {
+		t.Fatalf("Expected 1 used chunk in stats slabs, got %v", slabs)
+	}
+
+	conns := c.stats("conns")
+	found := false
+	for name, value := range conns {
+		if strings.HasSuffix(name, ":addr") && value == "tcp:"+c.conn.LocalAddr().String() {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("Client connection is missing in stats conns: %v", conns)
+	}
+
+	c.expect("slabs automove 2\r\n", "OK")
+	if c.stats("settings")["slab_automove"] != "2" {
+		t.Fatal("Expected slab_automove 2 in stats settings")
+	}
+	c.expect("slabs automove 0\r\n", "OK")
+	c.expect("slabs automove 3\r\n", "ERROR")
+	c.expect("slabs reassign 1 1\r\n", "SAME src and dst class are identical")
+	c.expect("slabs reassign 1 1000\r\n", "BADCLASS invalid src or dst class id")
+
+	c.expect("snapshot\r\n", "SERVER_ERROR snapshot is not configured")
+	if c.stats("")["snapshot_in_progress"] != "0" {
+		t.Fatal("Expected snapshot_in_progress in stats")
+	}
+	c.expect("oplog compact\r\n", "SERVER_ERROR oplog is not enabled")
+	c.expect("oplog\r\n", "ERROR")
+	if c.stats("settings")["oplog_fsync"] != "off" {
+		t.Fatal("Expected oplog_fsync off in stats settings")
+	}
+	c.expect("stats unknown\r\n", "ERROR")
+	c.expect("stats reset\r\n", "RESET")
+	if c.stats("")["cmd_get"] != "0" {
+		t.Fatal("Expected cmd_get to be reset")
+	}
+}
+
+func TestCommandLatencyMetrics(t *testing.T) {
+	c := newASCIIClient(t)
+
+	before := commandLatency["version"].Count()
+	c.expect("version\r\n", "VERSION "+serverVersion)
+	// Latency is observed after response flush, next command waits for it
+	c.expect("bogus\r\n", "ERROR")
+	if commandLatency["version"].Count() != before+1 {
+		t.Fatal("Expected version latency to be observed")
+	}
+}
+
+func TestAsciiReplicate(t *testing.T) {
+	c := newASCIIClient(t)
+
+	c.expect("set foo 0 0 3\r\nbar\r\n", "STORED")
+	// Connection is handed over to replication stream, snapshot follows
+	c.expect("replicate\r\n", "REPLICATING")
+	if magic, err := c.rb.Peek(4); err != nil || string(magic) != "GMCS" {
+		t.Fatalf("Expected snapshot after reply, got %q, err %v", magic, err)
+	}
+}
+
+func TestAsciiUnixSocket(t *testing.T) {
+	store := memstore.NewSharedStore()
+	store.SetMemoryLimit(64 * 1024 * 1024)
+
+	path := filepath.Join(t.TempDir(), "memcached.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				processor := CreateProcessor(conn, store)
+				defer processor.CloseProcessor()
+				processor.Handle()
+			}()
+		}
+	}()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &asciiClient{t: t, conn: conn, rb: bufio.NewReader(conn)}
+
+	c.expect("set key 0 0 1\r\na\r\n", "STORED")
+	c.expect("get key\r\n", "VALUE key 0 1", "a", "END")
+
+	// Unix socket clients are unnamed, socket path is reported
+	conns := c.stats("conns")
+	found := false
+	for name, value := range conns {
+		if strings.HasSuffix(name, ":addr") && value == "unix:"+path && conns[strings.TrimSuffix(name, "addr")+"listen_addr"] == "unix:"+path {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("Unix socket connection is missing in stats conns: %v", conns)
+	}
+}
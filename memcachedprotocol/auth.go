@@ -0,0 +1,149 @@
+package memcachedprotocol
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"log/slog"
+)
+
+// authTable is users allowed to connect, gen changes each time authentication
+// is turned on, so clients authorized before must authenticate
+type authTable struct {
+	users map[string]string
+	gen   uint64
+}
+
+// authUsers are users allowed to connect, nil disables authentication
+var authUsers atomic.Pointer[authTable]
+
+// authGens is source of auth table generations, 0 is never used
+var authGens atomic.Uint64
+
+// SetAuthUsers replace users table, as memcached -Y auth file. Authenticated
+// connections stay open when users are replaced, but once authentication is
+// turned on all open connections must authenticate. Nil or empty table
+// disables authentication.
+func SetAuthUsers(users map[string]string) {
+	if len(users) == 0 {
+		authUsers.Store(nil)
+		return
+	}
+	table := &authTable{users: users}
+	if old := authUsers.Load(); old != nil {
+		table.gen = old.gen
+	} else {
+		table.gen = authGens.Add(1)
+	}
+	authUsers.Store(table)
+}
+
+func authEnabled() bool {
+	return authUsers.Load() != nil
+}
+
+// authorized report whether client may run commands, it is rechecked per
+// command, so reload which turns authentication on applies to open connections
+func (ctx *Processor) authorized() bool {
+	table := authUsers.Load()
+	return table == nil || ctx.authGen == table.gen
+}
+
+// checkAuth compare password in constant time, so it can't be guessed by timing,
+// returns generation of users table client is authenticated in, 0 on failure
+func checkAuth(user string, password []byte) uint64 {
+	counters[authCmds].Add(1)
+	table := authUsers.Load()
+	if table != nil {
+		if expected, ok := table.users[user]; ok && subtle.ConstantTimeCompare([]byte(expected), password) == 1 {
+			return table.gen
+		}
+	}
+
+	counters[authErrors].Add(1)
+	return 0
+}
+
+// asciiAuth handle command of unauthenticated text protocol connection, only
+// set with "<user> <password>" value is accepted, connection is closed on failure
+func (ctx *Processor) asciiAuth(command string, args []string) error {
+	switch command {
+	case "quit":
+		return errQuit
+	case "set":
+	default:
+		return ctx.sendClientError("unauthenticated")
+	}
+
+	// set <key> <flags> <exptime> <bytes>
+	if len(args) < 4 {
+		return ctx.sendClientError("unauthenticated")
+	}
+	size, err := strconv.Atoi(args[3])
+	if err != nil || size < 0 || size > 1024 {
+		return ctx.sendClientError("authentication failure")
+	}
+	value := ctx.valueBuffer(size + 2)
+	if _, err := io.ReadFull(ctx.rb, value); err != nil {
+		return err
+	}
+
+	user, password, ok := strings.Cut(strings.TrimSpace(string(value)), " ")
+	gen := uint64(0)
+	if ok {
+		gen = checkAuth(user, []byte(password))
+	}
+	if gen == 0 {
+		slog.Warn("Authentication failed", "user", user, ctx.client())
+		return ctx.sendClientError("authentication failure")
+	}
+
+	ctx.authGen = gen
+	ctx.wb.Write([]byte("STORED\r\n"))
+	return nil
+}
+
+// binaryAuth handle SASL list mechanisms and PLAIN authentication, value of
+// SASLAuth is [authzid] \0 user \0 password
+func (ctx *Processor) binaryAuth() error {
+	if ctx.request.opcode == SASLlistmechs {
+		if _, err := ctx.rb.Discard(int(ctx.request.totalBody)); err != nil {
+			return err
+		}
+		ctx.response.totalBody = uint32(len("PLAIN"))
+		return ctx.Response([]byte("PLAIN"))
+	}
+
+	if ctx.request.extrasLen != 0 || ctx.valueLen() < 0 || ctx.valueLen() > 1024 {
+		return ctx.invalidRequest()
+	}
+	mechanism, err := ctx.readKey()
+	if err != nil {
+		return err
+	}
+	value := ctx.valueBuffer(ctx.valueLen())
+	if _, err := io.ReadFull(ctx.rb, value); err != nil {
+		return err
+	}
+
+	if string(mechanism) != "PLAIN" || ctx.request.opcode != SASLAuth {
+		return ctx.ResponseStatus(EAuth)
+	}
+	fields := bytes.Split(value, []byte{0})
+	gen := uint64(0)
+	if len(fields) == 3 {
+		gen = checkAuth(string(fields[1]), fields[2])
+	}
+	if gen == 0 {
+		slog.Warn("Authentication failed", ctx.client())
+		return ctx.ResponseStatus(EAuth)
+	}
+
+	ctx.authGen = gen
+	ctx.response.totalBody = uint32(len("Authenticated"))
+	return ctx.Response([]byte("Authenticated"))
+}
@@ -0,0 +1,59 @@
+package memcachedprotocol
+
+import (
+	"io"
+	"testing"
+)
+
+func TestAsciiAuth(t *testing.T) {
+	SetAuthUsers(map[string]string{"user": "secret"})
+	t.Cleanup(func() { SetAuthUsers(nil) })
+
+	c := newASCIIClient(t)
+	c.expect("set auth 0 0 11\r\nuser secret\r\n", "STORED")
+	c.expect("set key 0 0 1\r\na\r\n", "STORED")
+	c.expect("get key\r\n", "VALUE key 0 1", "a", "END")
+	if stats := c.stats("settings"); stats["auth_enabled_ascii"] != "yes" {
+		t.Fatalf("Expected auth in stats settings: %v", stats)
+	}
+
+	// Authenticated connections stay open when users are replaced
+	SetAuthUsers(map[string]string{"other": "pass"})
+	c.expect("get key\r\n", "VALUE key 0 1", "a", "END")
+
+	// Connections opened without authentication must authenticate once it is turned on
+	SetAuthUsers(nil)
+	open := newASCIIClient(t)
+	open.expect("get key\r\n", "END")
+	SetAuthUsers(map[string]string{"other": "pass"})
+	open.expect("get key\r\n", "CLIENT_ERROR unauthenticated")
+	c.expect("get key\r\n", "CLIENT_ERROR unauthenticated")
+
+	d := newASCIIClient(t)
+	d.expect("set auth 0 0 11\r\nuser secret\r\n", "CLIENT_ERROR authentication failure")
+	if _, err := d.rb.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected connection closed after failure, got %v", err)
+	}
+
+	e := newASCIIClient(t)
+	e.expect("get key\r\n", "CLIENT_ERROR unauthenticated")
+}
+
+func TestBinaryAuth(t *testing.T) {
+	SetAuthUsers(map[string]string{"user": "secret"})
+	t.Cleanup(func() { SetAuthUsers(nil) })
+
+	cmds, errors := counters[authCmds].Load(), counters[authErrors].Load()
+	conn := newTestConn(t)
+	expectStatus(t, binaryCall(t, conn, Get, nil, "key", "", 0), EAuth)
+	if rsp := binaryCall(t, conn, SASLlistmechs, nil, "", "", 0); string(rsp.value) != "PLAIN" {
+		t.Fatalf("Expected PLAIN mechanism, got %q", rsp.value)
+	}
+	expectStatus(t, binaryCall(t, conn, SASLAuth, nil, "PLAIN", "\x00user\x00wrong", 0), EAuth)
+	expectStatus(t, binaryCall(t, conn, SASLAuth, nil, "PLAIN", "\x00user\x00secret", 0), NoErr)
+	expectStatus(t, binaryCall(t, conn, Get, nil, "key", "", 0), NEnt)
+
+	if counters[authCmds].Load()-cmds != 2 || counters[authErrors].Load()-errors != 1 {
+		t.Fatalf("Expected 2 auth commands and 1 error, got %d and %d", counters[authCmds].Load()-cmds, counters[authErrors].Load()-errors)
+	}
+}
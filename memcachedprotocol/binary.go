@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"nefelim4ag/go-memcached-server/memstore"
+	"strconv"
 	"unsafe"
 
 	"log/slog"
@@ -48,6 +49,8 @@ const (
 	SASLlistmechs              OpcodeType = 0x20
 	SASLAuth                   OpcodeType = 0x21
 	SASLStep                   OpcodeType = 0x22
+	GATKUnstable               OpcodeType = 0x23
+	GATKQUnstable              OpcodeType = 0x24
 	RGet                       OpcodeType = 0x30
 	RSet                       OpcodeType = 0x31
 	RSetQ                      OpcodeType = 0x32
@@ -86,8 +89,8 @@ const (
 	ItemNoStor ResponseStatus = 0x0005 // Item not stored
 	EType      ResponseStatus = 0x0006 // Incr/Decr on non-numeric value.
 	// 0x0007	The vbucket belongs to another server
-	// 0x0008	Authentication error
-	// 0x0009	Authentication continue
+	EAuth ResponseStatus = 0x0020 // Authentication error
+	// 0x0021	Authentication continue
 	EUnknown ResponseStatus = 0x0081 // Unknown command
 	EOOM     ResponseStatus = 0x0082 //	Out of memory
 	ENSupp   ResponseStatus = 0x0083 // Not supported
@@ -128,6 +131,22 @@ type ResponseHeader struct {
 	cas       uint64
 }
 
+var statusMessage = map[ResponseStatus]string{
+	NEnt:       "Not found",
+	Exist:      "Data exists for key.",
+	TooLarg:    "Too large.",
+	InvArg:     "Invalid arguments",
+	ItemNoStor: "Not stored.",
+	EType:      "Non-numeric server-side value for incr or decr",
+	EAuth:      "Auth failure.",
+	EUnknown:   "Unknown command",
+	EOOM:       "Out of memory",
+	ENSupp:     "Not supported",
+	EInter:     "Internal error",
+	EBusy:      "Busy",
+	ETmpF:      "Temporary failure",
+}
+
 func (ctx *Processor) CommandBinary() error {
 	err := ctx.ReadRequest()
 	if err != nil {
@@ -135,6 +154,7 @@ func (ctx *Processor) CommandBinary() error {
 	}
 
 	ctx.decodeRequestHeader()
+	ctx.command = binaryCommand(ctx.request.opcode)
 
 	// By protocol opcode & opaque same as client request
 	ctx.response = ResponseHeader{
@@ -145,153 +165,541 @@ func (ctx *Processor) CommandBinary() error {
 	}
 
 	switch ctx.request.opcode {
-	case Set, SetQ, Add, AddQ:
-		flags := unsafe.Slice(&ctx.flags[0], len(ctx.flags))
-		exptime := unsafe.Slice(&ctx.exptime[0], len(ctx.exptime))
-
-		if uint16(len(ctx.key)) < ctx.request.keyLen {
-			ctx.key = make([]byte, ctx.request.keyLen)
-		}
-		key := unsafe.Slice(&ctx.key[0], ctx.request.keyLen)
-
-		bodyLen := ctx.request.totalBody - uint32(ctx.request.keyLen) - uint32(ctx.request.extrasLen)
-		__value := ctx.store.ValuePool.Get().(*[]byte)
-		_value := *__value
-		if len(_value) < int(bodyLen) {
-			_value = append(_value, make([]byte, int(bodyLen)-len(_value))...)
-		}
-		value := unsafe.Slice(&_value[0], int(bodyLen))
-		err_s := make([]error, 4)
-		_, err_s[0] = ctx.rb.Read(flags)
-		_, err_s[1] = ctx.rb.Read(exptime)
-		_, err_s[2] = ctx.rb.Read(key)
-		if bodyLen > 0 {
-			_, err_s[3] = io.ReadFull(ctx.rb, value)
+	case SASLlistmechs, SASLAuth, SASLStep:
+		if authEnabled() {
+			return ctx.binaryAuth()
 		}
-		for _, err := range err_s {
-			if err != nil {
-				ctx.response.status = EInter
-				ctx.Response()
+	case Version, NoOp, Quit, QuitQ:
+	default:
+		if !ctx.authorized() {
+			if _, err := ctx.rb.Discard(int(ctx.request.totalBody)); err != nil {
 				return err
 			}
+			return ctx.ResponseStatus(EAuth)
 		}
+	}
 
-		if ctx.debug {
-			slog.Debug("Set/Add",
-				"Flags", fmt.Sprintf("0x%08x", flags),
-				"ExpTime", fmt.Sprintf("0x%08x", exptime),
-				"Key", key,
-			)
+	// Router forwards text protocol only
+	if ctx.router != nil {
+		switch ctx.request.opcode {
+		case Version, NoOp, Quit, QuitQ, Stat:
+		default:
+			if _, err := ctx.rb.Discard(int(ctx.request.totalBody)); err != nil {
+				return err
+			}
+			return ctx.ResponseStatus(ENSupp)
 		}
+	}
 
-		entry := memstore.MEntry{
-			Key:     string(key[:]),
-			ExpTime: binary.BigEndian.Uint32(exptime),
-			Size:    bodyLen,
-			Value:   value,
+	switch ctx.request.opcode {
+	case Set, SetQ, Add, AddQ, Replace, ReplaceQ:
+		return ctx.binarySet()
+	case Get, GetQ, GetK, GetKQ, GATUnstable, GATQUnstable, GATKUnstable, GATKQUnstable:
+		return ctx.binaryGet()
+	case TouchUnstable:
+		return ctx.binaryTouch()
+	case Delete, DeleteQ:
+		return ctx.binaryDelete()
+	case Increment, IncrementQ, Decrement, DecrementQ:
+		return ctx.binaryIncrDecr()
+	case Append, AppendQ, Prepend, PrependQ:
+		return ctx.binaryAppendPrepend()
+	case Stat:
+		return ctx.binaryStat()
+	case Flush, FlushQ:
+		// Flush has no key and value, body of optional delay only
+		if (ctx.request.extrasLen != 0 && ctx.request.extrasLen != 4) || ctx.request.totalBody != uint32(ctx.request.extrasLen) {
+			return ctx.invalidRequest()
 		}
-		copy(unsafe.Slice(&entry.Flags[0], len(entry.Flags)), flags)
-
-		if ctx.request.cas != 0 {
-			_v, ok := ctx.store.Get(entry.Key)
-			if ok {
-				v := *_v
-				if ctx.request.cas != v.Cas {
-					ctx.response.status = Exist
-					return ctx.Response()
-				}
+		exptime := unsafe.Slice(&ctx.exptime[0], len(ctx.exptime))
+		delay := int64(0)
+		if ctx.request.extrasLen == 4 {
+			_, err = io.ReadFull(ctx.rb, exptime)
+			if err != nil {
+				return err
 			}
-		}
 
-		if ctx.request.opcode == Add || ctx.request.opcode == AddQ {
-			_, ok := ctx.store.Get(entry.Key)
-			if ok {
-				ctx.response.status = Exist
-				// v := _v.(memstore.MEntry)
-				ctx.Response()
-				// ctx.wb.Write(v.value)
-				return nil
-			}
+			delay = int64(binary.BigEndian.Uint32(exptime))
+			slog.Debug("Flush", "ExpTime", fmt.Sprintf("0x%08x", exptime))
 		}
-
-		err = ctx.store.Set(entry.Key, &entry)
-		if err != nil {
-			return err
+		if ctx.store.ReadOnly() {
+			return ctx.ResponseStoreError(memstore.ErrReadOnly)
 		}
-		ctx.response.cas = entry.Cas
 
-		if ctx.request.opcode == SetQ || ctx.request.opcode == AddQ {
+		ctx.store.Flush(delay)
+		counters[cmdFlush].Add(1)
+
+		if ctx.request.opcode == FlushQ {
 			return nil
 		}
 
 		return ctx.Response()
-	case Get, GetQ:
-		if uint16(len(ctx.key)) < ctx.request.keyLen {
-			ctx.key = make([]byte, ctx.request.keyLen)
+	case VerbosityUnstable:
+		if ctx.request.extrasLen != 4 || ctx.request.totalBody != 4 {
+			return ctx.invalidRequest()
 		}
-		key := unsafe.Slice(&ctx.key[0], ctx.request.keyLen)
-		_, err = ctx.rb.Read(key)
+		_, err = ctx.rb.Discard(4)
 		if err != nil {
-			ctx.response.status = EInter
-			ctx.Response()
 			return err
 		}
+		return ctx.Response()
+	case Version:
+		if ctx.request.totalBody != 0 {
+			return ctx.invalidRequest()
+		}
+		ctx.response.totalBody = uint32(len(serverVersion))
+		return ctx.Response([]byte(serverVersion))
+	case Quit:
+		ctx.Response()
+		return errQuit
+	case QuitQ:
+		return errQuit
+	case NoOp:
+		return ctx.Response()
+	}
 
+	slog.Debug("Not implemented", "opcode", fmt.Sprintf("0x%02x", ctx.request.opcode))
+	_, err = ctx.rb.Discard(int(ctx.request.totalBody))
+	if err != nil {
+		return err
+	}
+
+	return ctx.ResponseStatus(EUnknown)
+}
+
+// quiet reports whether success response must be omitted for request opcode
+func (ctx *Processor) quiet() bool {
+	switch ctx.request.opcode {
+	case GetQ, GetKQ, GATQUnstable, GATKQUnstable, SetQ, AddQ, ReplaceQ, DeleteQ, IncrementQ, DecrementQ, QuitQ, FlushQ, AppendQ, PrependQ:
+		return true
+	}
+
+	return false
+}
+
+// valueLen is size of request body without extras & key
+func (ctx *Processor) valueLen() int {
+	return int(ctx.request.totalBody) - int(ctx.request.keyLen) - int(ctx.request.extrasLen)
+}
+
+// validRequest check request layout, key is always required
+func (ctx *Processor) validRequest(extrasLen uint8, valueAllowed bool) bool {
+	if ctx.request.extrasLen != extrasLen || ctx.request.keyLen == 0 {
+		return false
+	}
+	if ctx.valueLen() < 0 || (!valueAllowed && ctx.valueLen() > 0) {
+		return false
+	}
+
+	return true
+}
+
+// invalidRequest drop request body and reply with InvArg
+func (ctx *Processor) invalidRequest() error {
+	_, err := ctx.rb.Discard(int(ctx.request.totalBody))
+	if err != nil {
+		return err
+	}
+
+	return ctx.ResponseStatus(InvArg)
+}
+
+func (ctx *Processor) readExtras() ([]byte, error) {
+	extras := unsafe.Slice(&ctx.extras[0], ctx.request.extrasLen)
+	_, err := io.ReadFull(ctx.rb, extras)
+
+	return extras, err
+}
+
+func (ctx *Processor) readKey() ([]byte, error) {
+	if uint16(len(ctx.key)) < ctx.request.keyLen {
+		ctx.key = make([]byte, ctx.request.keyLen)
+	}
+	key := ctx.key[:ctx.request.keyLen]
+	_, err := io.ReadFull(ctx.rb, key)
+
+	return key, err
+}
+
+// Set, Add, Replace: extras <flags:4> <exptime:4>
+func (ctx *Processor) binarySet() error {
+	if !ctx.validRequest(8, true) {
+		return ctx.invalidRequest()
+	}
+
+	flags := unsafe.Slice(&ctx.flags[0], len(ctx.flags))
+	exptime := unsafe.Slice(&ctx.exptime[0], len(ctx.exptime))
+
+	if uint16(len(ctx.key)) < ctx.request.keyLen {
+		ctx.key = make([]byte, ctx.request.keyLen)
+	}
+	key := unsafe.Slice(&ctx.key[0], ctx.request.keyLen)
+
+	bodyLen := uint32(ctx.valueLen())
+	value := ctx.valueBuffer(int(bodyLen))
+	err_s := make([]error, 4)
+	_, err_s[0] = io.ReadFull(ctx.rb, flags)
+	_, err_s[1] = io.ReadFull(ctx.rb, exptime)
+	_, err_s[2] = io.ReadFull(ctx.rb, key)
+	if bodyLen > 0 {
+		_, err_s[3] = io.ReadFull(ctx.rb, value)
+	}
+	for _, err := range err_s {
+		if err != nil {
+			return err
+		}
+	}
+
+	if ctx.debug {
+		slog.Debug("Set/Add/Replace",
+			"Flags", fmt.Sprintf("0x%08x", flags),
+			"ExpTime", fmt.Sprintf("0x%08x", exptime),
+			"Key", key,
+		)
+	}
+
+	entry := memstore.MEntry{
+		Key:     string(key[:]),
+		ExpTime: ctx.store.ExpTime(int64(binary.BigEndian.Uint32(exptime))),
+		Size:    bodyLen,
+		Value:   value,
+	}
+	copy(unsafe.Slice(&entry.Flags[0], len(entry.Flags)), flags)
+
+	var err error
+	switch {
+	case ctx.request.cas != 0:
+		err = ctx.store.CompareAndSwap(entry.Key, &entry, ctx.request.cas)
+	case ctx.request.opcode == Add || ctx.request.opcode == AddQ:
+		err = ctx.store.Add(entry.Key, &entry)
+	case ctx.request.opcode == Replace || ctx.request.opcode == ReplaceQ:
+		err = ctx.store.Replace(entry.Key, &entry)
+	default:
+		err = ctx.store.Set(entry.Key, &entry)
+	}
+	countStore(err)
+	if ctx.request.cas != 0 {
+		countCas(err)
+	}
+	if err != nil {
+		return ctx.ResponseStoreError(err)
+	}
+
+	if ctx.quiet() {
+		return nil
+	}
+
+	ctx.response.cas = entry.Cas
+	return ctx.Response()
+}
+
+// Get, GetQ, GetK, GetKQ, and GAT family with extras <exptime:4>
+func (ctx *Processor) binaryGet() error {
+	touch := false
+	withKey := false
+	switch ctx.request.opcode {
+	case GATUnstable, GATQUnstable:
+		touch = true
+	case GATKUnstable, GATKQUnstable:
+		touch = true
+		withKey = true
+	case GetK, GetKQ:
+		withKey = true
+	}
+
+	extrasLen := uint8(0)
+	if touch {
+		extrasLen = 4
+	}
+	if !ctx.validRequest(extrasLen, false) {
+		return ctx.invalidRequest()
+	}
+
+	extras, err := ctx.readExtras()
+	if err != nil {
+		return err
+	}
+	key, err := ctx.readKey()
+	if err != nil {
+		return err
+	}
+
+	var v *memstore.MEntry
+	ok := false
+	if touch {
+		exptime := int64(binary.BigEndian.Uint32(extras))
+		v, err = ctx.store.Touch(string(key), ctx.store.ExpTime(exptime))
+		if err == nil {
+			ctx.store.Bump(v)
+			ok = true
+		}
+	} else {
 		_key := unsafe.String(&key[0], len(key))
-		_v, ok := ctx.store.Get(_key)
+		v, ok = ctx.store.Get(_key)
+	}
+	counters[cmdGet].Add(1)
+	countHit(ok, getHits, getMisses)
+	if touch {
+		counters[cmdTouch].Add(1)
+		countHit(ok, touchHits, touchMisses)
+	}
 
-		if !ok {
-			if ctx.request.opcode == GetQ {
-				return nil
-			}
+	if !ok {
+		if ctx.quiet() {
+			return nil
+		}
+		if withKey {
 			ctx.response.status = NEnt
-			return ctx.Response()
+			ctx.response.keyLen = uint16(len(key))
+			ctx.response.totalBody = uint32(len(key))
+			return ctx.Response(key)
 		}
-		v := _v
+		return ctx.ResponseStatus(NEnt)
+	}
+
+	ctx.response.cas = v.Cas
+	ctx.response.extrasLen = 4
+	flags := unsafe.Slice(&v.Flags[0], len(v.Flags))
+	value := v.Value[:v.Size]
+
+	if withKey {
+		ctx.response.keyLen = uint16(len(key))
+		ctx.response.totalBody = 4 + uint32(len(key)) + uint32(len(value))
+		return ctx.Response(flags, key, value)
+	}
+
+	ctx.response.totalBody = 4 + uint32(len(value))
+	return ctx.Response(flags, value)
+}
+
+// Touch: extras <exptime:4>
+func (ctx *Processor) binaryTouch() error {
+	if !ctx.validRequest(4, false) {
+		return ctx.invalidRequest()
+	}
+
+	extras, err := ctx.readExtras()
+	if err != nil {
+		return err
+	}
+	key, err := ctx.readKey()
+	if err != nil {
+		return err
+	}
+
+	exptime := int64(binary.BigEndian.Uint32(extras))
+	v, err := ctx.store.Touch(string(key), ctx.store.ExpTime(exptime))
+	counters[cmdTouch].Add(1)
+	countHit(err == nil, touchHits, touchMisses)
+	if err != nil {
+		return ctx.ResponseStoreError(err)
+	}
+
+	ctx.response.cas = v.Cas
+	return ctx.Response()
+}
 
-		ctx.response.cas = v.Cas
-		ctx.response.extrasLen = 4
-		ctx.response.totalBody = 4 + uint32(len(v.Value))
-		flags := unsafe.Slice(&v.Flags[0], len(v.Flags))
+// Delete, DeleteQ
+func (ctx *Processor) binaryDelete() error {
+	if !ctx.validRequest(0, false) {
+		return ctx.invalidRequest()
+	}
 
-		ctx.Response(flags, unsafe.Slice(&v.Value[0], v.Size))
+	key, err := ctx.readKey()
+	if err != nil {
+		return err
+	}
 
+	var deleted *memstore.MEntry
+	_, err = ctx.store.Update(string(key), func(old *memstore.MEntry) (*memstore.MEntry, error) {
+		if old == nil {
+			return nil, memstore.ErrNotFound
+		}
+		if ctx.request.cas != 0 && ctx.request.cas != old.Cas {
+			return nil, memstore.ErrExists
+		}
+		deleted = old
+		return nil, nil
+	})
+	countHit(err != memstore.ErrNotFound, deleteHits, deleteMisses)
+	if err != nil {
+		return ctx.ResponseStoreError(err)
+	}
+
+	if ctx.quiet() {
 		return nil
-	case Flush, FlushQ:
-		exptime := unsafe.Slice(&ctx.exptime[0], len(ctx.exptime))
-		if ctx.request.extrasLen == 4 {
-			_, err = ctx.rb.Read(exptime)
-			if err != nil {
-				ctx.response.status = EInter
-				ctx.Response()
-				return err
+	}
+
+	ctx.response.cas = deleted.Cas
+	return ctx.Response()
+}
+
+// Increment, Decrement: extras <delta:8> <initial:8> <exptime:4>
+func (ctx *Processor) binaryIncrDecr() error {
+	if !ctx.validRequest(20, false) {
+		return ctx.invalidRequest()
+	}
+
+	extras, err := ctx.readExtras()
+	if err != nil {
+		return err
+	}
+	key, err := ctx.readKey()
+	if err != nil {
+		return err
+	}
+
+	delta := binary.BigEndian.Uint64(extras[0:8])
+	initial := binary.BigEndian.Uint64(extras[8:16])
+	exptime := binary.BigEndian.Uint32(extras[16:20])
+	incr := ctx.request.opcode == Increment || ctx.request.opcode == IncrementQ
+
+	_key := string(key)
+	var newValue uint64
+	hit := false
+	entry, err := ctx.store.Update(_key, func(old *memstore.MEntry) (*memstore.MEntry, error) {
+		entry := &memstore.MEntry{
+			Key: _key,
+		}
+
+		if old == nil {
+			// All bits set in exptime means no autovivification
+			if exptime == 0xffffffff {
+				return nil, memstore.ErrNotFound
+			}
+			newValue = initial
+			entry.ExpTime = ctx.store.ExpTime(int64(exptime))
+		} else {
+			if ctx.request.cas != 0 && ctx.request.cas != old.Cas {
+				return nil, memstore.ErrExists
 			}
+			hit = true
 
-			slog.Debug("ExpTim: 0x%08x\n", exptime)
+			oldValue, err := strconv.ParseUint(string(old.Value[:old.Size]), 10, 64)
+			if err != nil {
+				return nil, memstore.ErrNotNumeric
+			}
+			newValue = memstore.ApplyDelta(oldValue, delta, incr)
+			entry.Flags = old.Flags
+			entry.ExpTime = old.ExpTime
 		}
 
-		ctx.store.Flush()
+		entry.Value = strconv.AppendUint(nil, newValue, 10)
+		entry.Size = uint32(len(entry.Value))
+		return entry, nil
+	})
+	if incr {
+		countHit(hit, incrHits, incrMisses)
+	} else {
+		countHit(hit, decrHits, decrMisses)
+	}
+	if err != nil {
+		return ctx.ResponseStoreError(err)
+	}
 
-		if ctx.request.opcode == FlushQ {
-			return nil
+	if ctx.quiet() {
+		return nil
+	}
+
+	ctx.response.cas = entry.Cas
+	ctx.response.totalBody = 8
+	body := unsafe.Slice(&ctx.extras[0], 8)
+	binary.BigEndian.PutUint64(body, newValue)
+	return ctx.Response(body)
+}
+
+// Append, Prepend: no extras, flags & exptime are preserved
+func (ctx *Processor) binaryAppendPrepend() error {
+	if !ctx.validRequest(0, true) {
+		return ctx.invalidRequest()
+	}
+
+	key, err := ctx.readKey()
+	if err != nil {
+		return err
+	}
+	data := ctx.valueBuffer(ctx.valueLen())
+	_, err = io.ReadFull(ctx.rb, data)
+	if err != nil {
+		return err
+	}
+
+	_key := string(key)
+	entry, err := ctx.store.Update(_key, func(old *memstore.MEntry) (*memstore.MEntry, error) {
+		if old == nil {
+			return nil, errNotStored
+		}
+		if ctx.request.cas != 0 && ctx.request.cas != old.Cas {
+			return nil, memstore.ErrExists
 		}
 
-		return ctx.Response()
-	case Quit:
-		ctx.Response()
-		return fmt.Errorf("Quit")
-	case QuitQ:
-		return fmt.Errorf("QuitQ")
-	case NoOp:
+		value := make([]byte, 0, int(old.Size)+len(data))
+		switch ctx.request.opcode {
+		case Append, AppendQ:
+			value = append(append(value, old.Value[:old.Size]...), data...)
+		default:
+			value = append(append(value, data...), old.Value[:old.Size]...)
+		}
+
+		return &memstore.MEntry{
+			Key:     _key,
+			Flags:   old.Flags,
+			ExpTime: old.ExpTime,
+			Size:    uint32(len(value)),
+			Value:   value,
+		}, nil
+	})
+	countStore(err)
+	if err != nil {
+		return ctx.ResponseStoreError(err)
+	}
+
+	if ctx.quiet() {
+		return nil
+	}
+
+	ctx.response.cas = entry.Cas
+	return ctx.Response()
+}
+
+// Stat, response is a sequence of key/value packets terminated by empty one
+func (ctx *Processor) binaryStat() error {
+	if ctx.request.extrasLen != 0 || ctx.valueLen() != 0 {
+		return ctx.invalidRequest()
+	}
+
+	key, err := ctx.readKey()
+	if err != nil {
+		return err
+	}
+
+	group := string(key)
+	if group == "reset" {
+		ctx.resetStats()
 		return ctx.Response()
 	}
 
-	return fmt.Errorf("not implemented opcode: 0x%02x", ctx.request.opcode)
+	stats, ok := ctx.statsGroup(group)
+	if !ok {
+		return ctx.ResponseStatus(NEnt)
+	}
+	for _, stat := range stats {
+		ctx.response.keyLen = uint16(len(stat[0]))
+		ctx.response.totalBody = uint32(len(stat[0]) + len(stat[1]))
+		err = ctx.Response([]byte(stat[0]), []byte(stat[1]))
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx.response.keyLen = 0
+	ctx.response.totalBody = 0
+	return ctx.Response()
 }
 
 func (ctx *Processor) ReadRequest() error {
 	raw_request := unsafe.Slice(&ctx.raw_request[0], len(ctx.raw_request))
-	_, err := ctx.rb.Read(raw_request)
+	_, err := io.ReadFull(ctx.rb, raw_request)
 
 	if err != nil {
 		return err
@@ -319,6 +727,36 @@ func (ctx *Processor) Response(bytes ...[]byte) error {
 	return nil
 }
 
+// ResponseStatus reply with error status and status message as body
+func (ctx *Processor) ResponseStatus(status ResponseStatus) error {
+	msg := statusMessage[status]
+	ctx.response.status = status
+	ctx.response.keyLen = 0
+	ctx.response.extrasLen = 0
+	ctx.response.cas = 0
+	ctx.response.totalBody = uint32(len(msg))
+
+	return ctx.Response([]byte(msg))
+}
+
+// ResponseStoreError map store error to response status
+func (ctx *Processor) ResponseStoreError(err error) error {
+	switch err {
+	case memstore.ErrNotFound:
+		return ctx.ResponseStatus(NEnt)
+	case memstore.ErrExists:
+		return ctx.ResponseStatus(Exist)
+	case memstore.ErrNotNumeric:
+		return ctx.ResponseStatus(EType)
+	case memstore.ErrTooLarge:
+		return ctx.ResponseStatus(TooLarg)
+	case errNotStored:
+		return ctx.ResponseStatus(ItemNoStor)
+	}
+
+	return ctx.ResponseStatus(EInter)
+}
+
 func (ctx *Processor) decodeRequestHeader() {
 	ctx.request.magic = Magic(ctx.raw_request[0])
 	ctx.request.opcode = OpcodeType(ctx.raw_request[1])
@@ -0,0 +1,300 @@
+package memcachedprotocol
+
+import (
+	"encoding/binary"
+	"io"
+	"nefelim4ag/go-memcached-server/memstore"
+	"net"
+	"testing"
+)
+
+func newTestConn(t *testing.T) net.Conn {
+	t.Helper()
+
+	store := memstore.NewSharedStore()
+	store.SetMemoryLimit(64 * 1024 * 1024)
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				processor := CreateProcessor(conn, store)
+				defer processor.CloseProcessor()
+				processor.Handle()
+			}()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+type binaryResponse struct {
+	opcode OpcodeType
+	status ResponseStatus
+	cas    uint64
+	extras []byte
+	key    []byte
+	value  []byte
+}
+
+func binaryRequest(t *testing.T, conn net.Conn, opcode OpcodeType, extras []byte, key string, value string, cas uint64) {
+	t.Helper()
+
+	header := make([]byte, 24)
+	header[0] = byte(RequestMagic)
+	header[1] = byte(opcode)
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(key)))
+	header[4] = uint8(len(extras))
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint64(header[16:24], cas)
+
+	packet := append(header, extras...)
+	packet = append(packet, key...)
+	packet = append(packet, value...)
+	if _, err := conn.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readBinaryResponse(t *testing.T, conn net.Conn) binaryResponse {
+	t.Helper()
+
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	if Magic(header[0]) != ResponseMagic {
+		t.Fatalf("Expected response magic, got 0x%02x", header[0])
+	}
+
+	keyLen := binary.BigEndian.Uint16(header[2:4])
+	extrasLen := header[4]
+	body := make([]byte, binary.BigEndian.Uint32(header[8:12]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		t.Fatal(err)
+	}
+
+	return binaryResponse{
+		opcode: OpcodeType(header[1]),
+		status: ResponseStatus(binary.BigEndian.Uint16(header[6:8])),
+		cas:    binary.BigEndian.Uint64(header[16:24]),
+		extras: body[:extrasLen],
+		key:    body[extrasLen : uint16(extrasLen)+keyLen],
+		value:  body[uint16(extrasLen)+keyLen:],
+	}
+}
+
+func binaryCall(t *testing.T, conn net.Conn, opcode OpcodeType, extras []byte, key string, value string, cas uint64) binaryResponse {
+	t.Helper()
+
+	binaryRequest(t, conn, opcode, extras, key, value, cas)
+	rsp := readBinaryResponse(t, conn)
+	if rsp.opcode != opcode {
+		t.Fatalf("Expected opcode 0x%02x, got 0x%02x", opcode, rsp.opcode)
+	}
+
+	return rsp
+}
+
+func setExtras(flags uint32, exptime uint32) []byte {
+	extras := make([]byte, 8)
+	binary.BigEndian.PutUint32(extras[0:4], flags)
+	binary.BigEndian.PutUint32(extras[4:8], exptime)
+	return extras
+}
+
+func incrExtras(delta uint64, initial uint64, exptime uint32) []byte {
+	extras := make([]byte, 20)
+	binary.BigEndian.PutUint64(extras[0:8], delta)
+	binary.BigEndian.PutUint64(extras[8:16], initial)
+	binary.BigEndian.PutUint32(extras[16:20], exptime)
+	return extras
+}
+
+func expectStatus(t *testing.T, rsp binaryResponse, status ResponseStatus) {
+	t.Helper()
+
+	if rsp.status != status {
+		t.Fatalf("Expected status 0x%04x, got 0x%04x (%s)", status, rsp.status, rsp.value)
+	}
+}
+
+func TestBinaryReplaceDelete(t *testing.T) {
+	conn := newTestConn(t)
+
+	expectStatus(t, binaryCall(t, conn, Replace, setExtras(0, 0), "foo", "bar", 0), NEnt)
+	set := binaryCall(t, conn, Set, setExtras(1, 0), "foo", "bar", 0)
+	expectStatus(t, set, NoErr)
+	expectStatus(t, binaryCall(t, conn, Replace, setExtras(2, 0), "foo", "baz", set.cas+100), Exist)
+	expectStatus(t, binaryCall(t, conn, Replace, setExtras(2, 0), "foo", "baz", set.cas), NoErr)
+
+	get := binaryCall(t, conn, GetK, nil, "foo", "", 0)
+	expectStatus(t, get, NoErr)
+	if string(get.key) != "foo" || string(get.value) != "baz" || binary.BigEndian.Uint32(get.extras) != 2 {
+		t.Fatalf("Unexpected GetK response %+v", get)
+	}
+
+	del := binaryCall(t, conn, Delete, nil, "foo", "", 0)
+	expectStatus(t, del, NoErr)
+	if del.cas == 0 {
+		t.Fatal("Expected non zero cas on delete")
+	}
+	expectStatus(t, binaryCall(t, conn, Delete, nil, "foo", "", 0), NEnt)
+	expectStatus(t, binaryCall(t, conn, Get, nil, "foo", "", 0), NEnt)
+}
+
+func TestBinaryIncrDecr(t *testing.T) {
+	conn := newTestConn(t)
+
+	expectStatus(t, binaryCall(t, conn, Increment, incrExtras(1, 0, 0xffffffff), "cnt", "", 0), NEnt)
+
+	rsp := binaryCall(t, conn, Increment, incrExtras(1, 10, 0), "cnt", "", 0)
+	expectStatus(t, rsp, NoErr)
+	if v := binary.BigEndian.Uint64(rsp.value); v != 10 {
+		t.Fatalf("Expected initial 10, got %d", v)
+	}
+	rsp = binaryCall(t, conn, Increment, incrExtras(5, 0, 0), "cnt", "", 0)
+	if v := binary.BigEndian.Uint64(rsp.value); v != 15 {
+		t.Fatalf("Expected 15, got %d", v)
+	}
+	rsp = binaryCall(t, conn, Decrement, incrExtras(100, 0, 0), "cnt", "", 0)
+	if v := binary.BigEndian.Uint64(rsp.value); v != 0 {
+		t.Fatalf("Expected decr to stop at 0, got %d", v)
+	}
+
+	expectStatus(t, binaryCall(t, conn, Set, setExtras(0, 0), "str", "abc", 0), NoErr)
+	expectStatus(t, binaryCall(t, conn, Increment, incrExtras(1, 0, 0), "str", "", 0), EType)
+}
+
+func TestBinaryAppendPrepend(t *testing.T) {
+	conn := newTestConn(t)
+
+	expectStatus(t, binaryCall(t, conn, Append, nil, "foo", "bar", 0), ItemNoStor)
+	expectStatus(t, binaryCall(t, conn, Set, setExtras(7, 0), "foo", "b", 0), NoErr)
+	expectStatus(t, binaryCall(t, conn, Append, nil, "foo", "c", 0), NoErr)
+	expectStatus(t, binaryCall(t, conn, Prepend, nil, "foo", "a", 0), NoErr)
+
+	get := binaryCall(t, conn, Get, nil, "foo", "", 0)
+	if string(get.value) != "abc" || binary.BigEndian.Uint32(get.extras) != 7 {
+		t.Fatalf("Unexpected Get response %+v", get)
+	}
+}
+
+func TestBinaryQuietCommands(t *testing.T) {
+	conn := newTestConn(t)
+
+	// Quiet commands reply only on error, NoOp acts as pipeline barrier
+	binaryRequest(t, conn, SetQ, setExtras(0, 0), "foo", "bar", 0)
+	binaryRequest(t, conn, GetQ, nil, "missing", "", 0)
+	binaryRequest(t, conn, DeleteQ, nil, "missing", "", 0)
+	binaryRequest(t, conn, GetKQ, nil, "foo", "", 0)
+	binaryRequest(t, conn, NoOp, nil, "", "", 0)
+
+	expectStatus(t, readBinaryResponse(t, conn), NEnt)
+	rsp := readBinaryResponse(t, conn)
+	if rsp.opcode != GetKQ || string(rsp.value) != "bar" {
+		t.Fatalf("Unexpected GetKQ response %+v", rsp)
+	}
+	if rsp := readBinaryResponse(t, conn); rsp.opcode != NoOp {
+		t.Fatalf("Expected NoOp response, got 0x%02x", rsp.opcode)
+	}
+}
+
+func TestBinaryStatGroups(t *testing.T) {
+	conn := newTestConn(t)
+
+	expectStatus(t, binaryCall(t, conn, Stat, nil, "reset", "", 0), NoErr)
+	binaryCall(t, conn, Get, nil, "foo", "", 0)
+
+	binaryRequest(t, conn, Stat, nil, "", "", 0)
+	stats := map[string]string{}
+	for {
+		rsp := readBinaryResponse(t, conn)
+		expectStatus(t, rsp, NoErr)
+		if len(rsp.key) == 0 {
+			break
+		}
+		stats[string(rsp.key)] = string(rsp.value)
+	}
+	if stats["get_misses"] != "1" {
+		t.Fatalf("Expected get_misses 1, got %q", stats["get_misses"])
+	}
+
+	expectStatus(t, binaryCall(t, conn, Stat, nil, "unknown", "", 0), NEnt)
+}
+
+func TestBinaryVersionStatUnknown(t *testing.T) {
+	conn := newTestConn(t)
+
+	rsp := binaryCall(t, conn, Version, nil, "", "", 0)
+	if string(rsp.value) != serverVersion {
+		t.Fatalf("Unexpected version %s", rsp.value)
+	}
+
+	binaryRequest(t, conn, Stat, nil, "", "", 0)
+	for {
+		rsp := readBinaryResponse(t, conn)
+		expectStatus(t, rsp, NoErr)
+		if len(rsp.key) == 0 {
+			break
+		}
+	}
+
+	expectStatus(t, binaryCall(t, conn, RGet, nil, "foo", "", 0), EUnknown)
+	// Connection must stay usable
+	expectStatus(t, binaryCall(t, conn, NoOp, nil, "", "", 0), NoErr)
+}
+
+func TestBinaryTouchGat(t *testing.T) {
+	conn := newTestConn(t)
+
+	exptime := make([]byte, 4)
+	binary.BigEndian.PutUint32(exptime, 100)
+
+	expectStatus(t, binaryCall(t, conn, TouchUnstable, exptime, "foo", "", 0), NEnt)
+	expectStatus(t, binaryCall(t, conn, Set, setExtras(3, 0), "foo", "bar", 0), NoErr)
+
+	touch := binaryCall(t, conn, TouchUnstable, exptime, "foo", "", 0)
+	expectStatus(t, touch, NoErr)
+	if touch.cas == 0 {
+		t.Fatal("Expected non zero cas on touch")
+	}
+
+	gat := binaryCall(t, conn, GATKUnstable, exptime, "foo", "", 0)
+	expectStatus(t, gat, NoErr)
+	if string(gat.key) != "foo" || string(gat.value) != "bar" || binary.BigEndian.Uint32(gat.extras) != 3 {
+		t.Fatalf("Unexpected GATK response %+v", gat)
+	}
+
+	binaryRequest(t, conn, GATQUnstable, exptime, "missing", "", 0)
+	expectStatus(t, binaryCall(t, conn, NoOp, nil, "", "", 0), NoErr)
+}
+
+func TestBinaryFlush(t *testing.T) {
+	conn := newTestConn(t)
+
+	expectStatus(t, binaryCall(t, conn, Set, setExtras(0, 0), "foo", "bar", 0), NoErr)
+	// Key or value of flush is dropped with request, connection stays in sync
+	expectStatus(t, binaryCall(t, conn, Flush, nil, "foo", "", 0), InvArg)
+	expectStatus(t, binaryCall(t, conn, Flush, []byte{0, 0, 0, 0}, "", "value", 0), InvArg)
+	expectStatus(t, binaryCall(t, conn, Get, nil, "foo", "", 0), NoErr)
+
+	expectStatus(t, binaryCall(t, conn, Flush, []byte{0, 0, 0, 0}, "", "", 0), NoErr)
+	expectStatus(t, binaryCall(t, conn, Get, nil, "foo", "", 0), NEnt)
+}
@@ -0,0 +1,611 @@
+package memcachedprotocol
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"nefelim4ag/go-memcached-server/memstore"
+	"strconv"
+	"unsafe"
+)
+
+const maxKeyLength = 250
+
+// metaRequest is parsed meta command: <cmd> <key> [datalen] <flags>*\r\n
+type metaRequest struct {
+	key     string
+	rawKey  string
+	tokens  []string
+	base64  bool
+	quiet   bool
+	retKey  bool
+	noBump  bool
+	value   bool
+	invalid bool
+	retHit  bool
+	retLA   bool
+	dropVal bool
+
+	compareCas *uint64
+	newCas     *uint64
+	clientFlag *uint32
+	ttl        *int64
+	vivify     *int64
+	recache    *int64
+	initial    uint64
+	delta      uint64
+	mode       byte
+}
+
+// parseMetaRequest parse key and flags, tokens with argument share first char as flag
+func parseMetaRequest(key string, tokens []string) (*metaRequest, error) {
+	req := &metaRequest{
+		rawKey: key,
+		tokens: tokens,
+		delta:  1,
+	}
+
+	parseUint := func(token string) (uint64, error) {
+		return strconv.ParseUint(token[1:], 10, 64)
+	}
+	parseInt := func(token string) (*int64, error) {
+		v, err := strconv.ParseInt(token[1:], 10, 64)
+		return &v, err
+	}
+
+	for _, token := range tokens {
+		if len(token) == 0 {
+			continue
+		}
+
+		var err error
+		switch token[0] {
+		case 'b':
+			req.base64 = true
+		case 'q':
+			req.quiet = true
+		case 'O', 'c', 'f', 's', 't':
+			// Returned as is or filled from item by sendMeta
+		case 'k':
+			req.retKey = true
+		case 'u':
+			req.noBump = true
+		case 'v':
+			req.value = true
+		case 'I':
+			req.invalid = true
+		case 'h':
+			req.retHit = true
+		case 'l':
+			req.retLA = true
+		case 'x':
+			req.dropVal = true
+		case 'C':
+			var cas uint64
+			cas, err = parseUint(token)
+			req.compareCas = &cas
+		case 'E':
+			var cas uint64
+			cas, err = parseUint(token)
+			req.newCas = &cas
+		case 'F':
+			var flags uint64
+			flags, err = strconv.ParseUint(token[1:], 10, 32)
+			f := uint32(flags)
+			req.clientFlag = &f
+		case 'T':
+			req.ttl, err = parseInt(token)
+		case 'N':
+			req.vivify, err = parseInt(token)
+		case 'R':
+			req.recache, err = parseInt(token)
+		case 'J':
+			req.initial, err = parseUint(token)
+		case 'D':
+			req.delta, err = parseUint(token)
+		case 'M':
+			if len(token) != 2 {
+				return nil, fmt.Errorf("bad token in command line format")
+			}
+			req.mode = token[1]
+		default:
+			return nil, fmt.Errorf("invalid flag")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad token in command line format")
+		}
+	}
+
+	if req.base64 {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding key")
+		}
+		key = string(decoded)
+	}
+	if len(key) == 0 || len(key) > maxKeyLength {
+		return nil, fmt.Errorf("bad command line format")
+	}
+	req.key = key
+
+	return req, nil
+}
+
+// sendMeta write response code with return flags requested by client
+func (ctx *Processor) sendMeta(code string, req *metaRequest, e *memstore.MEntry, extra ...string) {
+	resp := []byte(code)
+
+	for _, token := range req.tokens {
+		if len(token) == 0 {
+			continue
+		}
+
+		switch token[0] {
+		case 'O':
+			resp = append(resp, ' ')
+			resp = append(resp, token...)
+		case 'k':
+			resp = append(resp, " k"...)
+			resp = append(resp, req.rawKey...)
+		case 'b':
+			if req.retKey {
+				resp = append(resp, " b"...)
+			}
+		}
+
+		if e == nil {
+			continue
+		}
+
+		switch token[0] {
+		case 'c':
+			resp = append(resp, " c"...)
+			resp = strconv.AppendUint(resp, e.Cas, 10)
+		case 'f':
+			resp = append(resp, " f"...)
+			resp = strconv.AppendUint(resp, uint64(binary.BigEndian.Uint32(e.Flags[:])), 10)
+		case 's':
+			resp = append(resp, " s"...)
+			resp = strconv.AppendUint(resp, uint64(e.Size), 10)
+		case 't':
+			resp = append(resp, " t"...)
+			resp = strconv.AppendInt(resp, ctx.store.TTL(e), 10)
+		}
+	}
+
+	for _, flag := range extra {
+		resp = append(resp, ' ')
+		resp = append(resp, flag...)
+	}
+
+	resp = append(resp, "\r\n"...)
+	ctx.wb.Write(resp)
+}
+
+// sendMetaValue write VA response with data block
+func (ctx *Processor) sendMetaValue(req *metaRequest, e *memstore.MEntry, extra ...string) {
+	ctx.sendMeta(fmt.Sprintf("VA %d", e.Size), req, e, extra...)
+	ctx.wb.Write(e.Value[:e.Size])
+	ctx.wb.Write([]byte("\r\n"))
+}
+
+func (ctx *Processor) CommandMeta(command string, args []string) error {
+	if command == "mn" {
+		ctx.wb.Write([]byte("MN\r\n"))
+		return nil
+	}
+
+	if len(args) == 0 {
+		return ctx.sendMetaClientError("bad command line format")
+	}
+
+	counters[cmdMeta].Add(1)
+	switch command {
+	case "mg":
+		return ctx.metaGet(args)
+	case "ms":
+		return ctx.metaSet(args)
+	case "md":
+		return ctx.metaDelete(args)
+	case "ma":
+		return ctx.metaArithmetic(args)
+	case "me":
+		return ctx.metaDebug(args)
+	}
+
+	return ctx.sendError()
+}
+
+// sendMetaClientError keep connection open, meta clients pipeline requests
+func (ctx *Processor) sendMetaClientError(msg string) error {
+	ctx.sendClientError(msg)
+	return nil
+}
+
+// sendMetaStoreError reply to meta command by store error
+func (ctx *Processor) sendMetaStoreError(err error, req *metaRequest) error {
+	switch err {
+	case memstore.ErrNotFound:
+		if !req.quiet {
+			ctx.sendMeta("NF", req, nil)
+		}
+	case memstore.ErrExists:
+		ctx.sendMeta("EX", req, nil)
+	case errNotStored:
+		ctx.sendMeta("NS", req, nil)
+	case memstore.ErrNotNumeric:
+		return ctx.sendMetaClientError(err.Error())
+	default:
+		ctx.wb.Write([]byte("SERVER_ERROR " + err.Error() + "\r\n"))
+	}
+
+	return nil
+}
+
+// metaWin check whether client must get recache win token for entry
+func (ctx *Processor) metaWin(req *metaRequest, e *memstore.MEntry) bool {
+	if e.TokenSent {
+		return false
+	}
+	if e.Stale {
+		return true
+	}
+
+	return req.recache != nil && ctx.store.TTL(e) != -1 && ctx.store.TTL(e) < *req.recache
+}
+
+// mg <key> <flags>*\r\n
+func (ctx *Processor) metaGet(args []string) error {
+	req, err := parseMetaRequest(args[0], args[1:])
+	if err != nil {
+		return ctx.sendMetaClientError(err.Error())
+	}
+
+	var hit, win bool
+	var lastAccess int64
+
+	e, ok := ctx.store.Peek(req.key)
+	if ok {
+		hit = e.Fetched()
+		lastAccess = e.LastAccess()
+	}
+
+	// Slow path, item state must be changed atomically
+	if !ok && req.vivify != nil || ok && (req.ttl != nil || ctx.metaWin(req, e)) {
+		e, err = ctx.store.Update(req.key, func(old *memstore.MEntry) (*memstore.MEntry, error) {
+			if old == nil {
+				if req.vivify == nil {
+					return nil, memstore.ErrNotFound
+				}
+
+				// Miss with autovivify, create empty item and make client a winner
+				win = true
+				return &memstore.MEntry{
+					Key:       req.key,
+					ExpTime:   ctx.store.ExpTime(*req.vivify),
+					Value:     []byte{},
+					TokenSent: true,
+				}, nil
+			}
+
+			hit = old.Fetched()
+			lastAccess = old.LastAccess()
+			win = ctx.metaWin(req, old)
+
+			updated := *old
+			updated.TokenSent = old.TokenSent || win
+			if req.ttl != nil {
+				updated.ExpTime = ctx.store.ExpTime(*req.ttl)
+			}
+			return &updated, nil
+		})
+		ok = err == nil
+	}
+	counters[cmdGet].Add(1)
+	countHit(ok, getHits, getMisses)
+
+	if !ok {
+		if !req.quiet {
+			ctx.wb.Write([]byte("EN\r\n"))
+		}
+		return nil
+	}
+
+	if !req.noBump {
+		ctx.store.Bump(e)
+	}
+
+	extra := make([]string, 0, 5)
+	if req.retHit {
+		if hit {
+			extra = append(extra, "h1")
+		} else {
+			extra = append(extra, "h0")
+		}
+	}
+	if req.retLA {
+		extra = append(extra, fmt.Sprintf("l%d", ctx.store.Now()-lastAccess))
+	}
+	if win {
+		extra = append(extra, "W")
+	}
+	if e.Stale {
+		extra = append(extra, "X")
+	}
+	if e.TokenSent && !win {
+		extra = append(extra, "Z")
+	}
+
+	if req.value {
+		ctx.sendMetaValue(req, e, extra...)
+	} else {
+		ctx.sendMeta("HD", req, e, extra...)
+	}
+
+	return nil
+}
+
+// ms <key> <datalen> <flags>*\r\n<data>\r\n
+func (ctx *Processor) metaSet(args []string) error {
+	if len(args) < 2 {
+		return ctx.sendMetaClientError("bad command line format")
+	}
+
+	nbytes, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		return ctx.sendMetaClientError("bad data chunk")
+	}
+
+	data := ctx.valueBuffer(int(nbytes))
+	_, err = io.ReadFull(ctx.rb, data)
+	if err != nil {
+		return err
+	}
+	// Read message last \r\n possibly
+	ctx.rb.ReadString('\n')
+
+	req, err := parseMetaRequest(args[0], args[2:])
+	if err != nil {
+		return ctx.sendMetaClientError(err.Error())
+	}
+
+	mode := req.mode
+	switch mode {
+	case 0, 'S', 's', 'E', 'e', 'R', 'r', 'A', 'a', 'P', 'p':
+	default:
+		return ctx.sendMetaClientError("invalid mode for ms")
+	}
+
+	entry, err := ctx.store.Update(req.key, func(old *memstore.MEntry) (*memstore.MEntry, error) {
+		entry := &memstore.MEntry{
+			Key:   req.key,
+			Size:  uint32(nbytes),
+			Value: data,
+		}
+		if req.clientFlag != nil {
+			_f := unsafe.Slice(&entry.Flags[0], len(entry.Flags))
+			binary.BigEndian.PutUint32(_f, *req.clientFlag)
+		}
+		if req.ttl != nil {
+			entry.ExpTime = ctx.store.ExpTime(*req.ttl)
+		}
+		if req.newCas != nil {
+			entry.Cas = *req.newCas
+		}
+
+		if req.compareCas != nil {
+			if old == nil {
+				return nil, memstore.ErrNotFound
+			}
+			if old.Cas != *req.compareCas {
+				// Invalidation with outdated cas still stores item, but as stale
+				if !req.invalid || *req.compareCas > old.Cas {
+					return nil, memstore.ErrExists
+				}
+				entry.Stale = true
+			}
+		}
+
+		switch mode {
+		case 'E', 'e':
+			if old != nil {
+				return nil, errNotStored
+			}
+		case 'R', 'r':
+			if old == nil {
+				return nil, errNotStored
+			}
+		case 'A', 'a', 'P', 'p':
+			if old == nil {
+				if req.vivify == nil {
+					return nil, errNotStored
+				}
+				entry.ExpTime = ctx.store.ExpTime(*req.vivify)
+				break
+			}
+
+			value := make([]byte, 0, int(old.Size)+len(data))
+			if mode == 'A' || mode == 'a' {
+				value = append(append(value, old.Value[:old.Size]...), data...)
+			} else {
+				value = append(append(value, data...), old.Value[:old.Size]...)
+			}
+			entry.Flags = old.Flags
+			entry.ExpTime = old.ExpTime
+			entry.Value = value
+			entry.Size = uint32(len(value))
+		}
+
+		return entry, nil
+	})
+	countStore(err)
+	if req.compareCas != nil {
+		countCas(err)
+	}
+	if err != nil {
+		if err == memstore.ErrNotFound {
+			// NF is not hidden by quiet mode for ms
+			ctx.sendMeta("NF", req, nil)
+			return nil
+		}
+		return ctx.sendMetaStoreError(err, req)
+	}
+
+	if req.quiet {
+		return nil
+	}
+
+	ctx.sendMeta("HD", req, entry)
+	return nil
+}
+
+// md <key> <flags>*\r\n
+func (ctx *Processor) metaDelete(args []string) error {
+	req, err := parseMetaRequest(args[0], args[1:])
+	if err != nil {
+		return ctx.sendMetaClientError(err.Error())
+	}
+
+	_, err = ctx.store.Update(req.key, func(old *memstore.MEntry) (*memstore.MEntry, error) {
+		if old == nil {
+			return nil, memstore.ErrNotFound
+		}
+		if req.compareCas != nil && *req.compareCas != old.Cas {
+			return nil, memstore.ErrExists
+		}
+		if !req.invalid && !req.dropVal {
+			return nil, nil
+		}
+
+		// Keep item in place, mark it stale or drop the value only
+		updated := *old
+		updated.Cas = 0
+		if req.newCas != nil {
+			updated.Cas = *req.newCas
+		}
+		if req.invalid {
+			updated.Stale = true
+			updated.TokenSent = false
+			if req.ttl != nil {
+				updated.ExpTime = ctx.store.ExpTime(*req.ttl)
+			}
+		}
+		if req.dropVal {
+			updated.Value = []byte{}
+			updated.Size = 0
+			updated.Flags = [4]byte{}
+		}
+		return &updated, nil
+	})
+	countHit(err != memstore.ErrNotFound, deleteHits, deleteMisses)
+	if err != nil {
+		return ctx.sendMetaStoreError(err, req)
+	}
+
+	if req.quiet {
+		return nil
+	}
+
+	ctx.sendMeta("HD", req, nil)
+	return nil
+}
+
+// ma <key> <flags>*\r\n
+func (ctx *Processor) metaArithmetic(args []string) error {
+	req, err := parseMetaRequest(args[0], args[1:])
+	if err != nil {
+		return ctx.sendMetaClientError(err.Error())
+	}
+
+	incr := true
+	switch req.mode {
+	case 0, 'I', 'i', '+':
+	case 'D', 'd', '-':
+		incr = false
+	default:
+		return ctx.sendMetaClientError("invalid mode for ma")
+	}
+
+	entry, err := ctx.store.Update(req.key, func(old *memstore.MEntry) (*memstore.MEntry, error) {
+		entry := &memstore.MEntry{
+			Key: req.key,
+		}
+
+		var newValue uint64
+		if old == nil {
+			if req.vivify == nil {
+				return nil, memstore.ErrNotFound
+			}
+			newValue = req.initial
+			entry.ExpTime = ctx.store.ExpTime(*req.vivify)
+		} else {
+			if req.compareCas != nil && *req.compareCas != old.Cas {
+				return nil, memstore.ErrExists
+			}
+
+			oldValue, err := strconv.ParseUint(string(old.Value[:old.Size]), 10, 64)
+			if err != nil {
+				return nil, memstore.ErrNotNumeric
+			}
+			newValue = memstore.ApplyDelta(oldValue, req.delta, incr)
+			entry.Flags = old.Flags
+			entry.ExpTime = old.ExpTime
+		}
+
+		if req.ttl != nil {
+			entry.ExpTime = ctx.store.ExpTime(*req.ttl)
+		}
+		if req.newCas != nil {
+			entry.Cas = *req.newCas
+		}
+		entry.Value = strconv.AppendUint(nil, newValue, 10)
+		entry.Size = uint32(len(entry.Value))
+		return entry, nil
+	})
+	if incr {
+		countHit(err != memstore.ErrNotFound, incrHits, incrMisses)
+	} else {
+		countHit(err != memstore.ErrNotFound, decrHits, decrMisses)
+	}
+	if err != nil {
+		return ctx.sendMetaStoreError(err, req)
+	}
+
+	if req.value {
+		ctx.sendMetaValue(req, entry)
+		return nil
+	}
+
+	if req.quiet {
+		return nil
+	}
+
+	ctx.sendMeta("HD", req, entry)
+	return nil
+}
+
+// me <key> [b]\r\n
+func (ctx *Processor) metaDebug(args []string) error {
+	req, err := parseMetaRequest(args[0], args[1:])
+	if err != nil {
+		return ctx.sendMetaClientError(err.Error())
+	}
+
+	e, ok := ctx.store.Peek(req.key)
+	if !ok {
+		ctx.wb.Write([]byte("EN\r\n"))
+		return nil
+	}
+
+	fetch := "no"
+	if e.Fetched() {
+		fetch = "yes"
+	}
+
+	resp := fmt.Sprintf("ME %s exp=%d la=%d cas=%d fetch=%s cls=%d size=%d\r\n",
+		req.rawKey, ctx.store.TTL(e), ctx.store.Now()-e.LastAccess(), e.Cas, fetch, e.SlabClass(), e.Size)
+	ctx.wb.Write([]byte(resp))
+
+	return nil
+}
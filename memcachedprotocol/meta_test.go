@@ -0,0 +1,134 @@
+package memcachedprotocol
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type asciiClient struct {
+	t    *testing.T
+	conn net.Conn
+	rb   *bufio.Reader
+}
+
+func newASCIIClient(t *testing.T) *asciiClient {
+	conn := newTestConn(t)
+	return &asciiClient{t: t, conn: conn, rb: bufio.NewReader(conn)}
+}
+
+func (c *asciiClient) send(request string) {
+	c.t.Helper()
+
+	if _, err := c.conn.Write([]byte(request)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *asciiClient) line() string {
+	c.t.Helper()
+
+	line, err := c.rb.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+func (c *asciiClient) expect(request string, lines ...string) {
+	c.t.Helper()
+
+	c.send(request)
+	for _, expected := range lines {
+		if got := c.line(); got != expected {
+			c.t.Fatalf("%q: expected %q, got %q", request, expected, got)
+		}
+	}
+}
+
+func TestMetaSetGet(t *testing.T) {
+	c := newASCIIClient(t)
+
+	c.expect("mg foo v\r\n", "EN")
+	c.expect("mg foo v q\r\nmn\r\n", "MN")
+	c.expect("ms foo 3 F5 T0\r\nbar\r\n", "HD")
+	c.expect("mg foo s f v k Oabc\r\n", "VA 3 s3 f5 kfoo Oabc", "bar")
+	c.expect("mg foo h\r\n", "HD h1")
+
+	c.expect("ms Zm9v 3 b k\r\nbaz\r\n", "HD b kZm9v")
+	c.expect("mg foo v\r\n", "VA 3", "baz")
+
+	c.expect("ms foo 1 ME\r\nx\r\n", "NS")
+	c.expect("ms new 1 MR\r\nx\r\n", "NS")
+	c.expect("ms foo 1 MA\r\nz\r\n", "HD")
+	c.expect("ms foo 1 MP\r\na\r\n", "HD")
+	c.expect("mg foo v\r\n", "VA 5", "abazz")
+
+	c.expect("ms foo 1 C1\r\nx\r\n", "EX")
+	c.expect("md foo q\r\nmd foo\r\n", "NF")
+	c.expect("mg foo\r\n", "EN")
+}
+
+func TestMetaArithmetic(t *testing.T) {
+	c := newASCIIClient(t)
+
+	c.expect("ma cnt\r\n", "NF")
+	c.expect("ma cnt N0 J10 v\r\n", "VA 2", "10")
+	c.expect("ma cnt D5 v\r\n", "VA 2", "15")
+	c.expect("ma cnt MD D20 v\r\n", "VA 1", "0")
+	c.expect("ma cnt q\r\nmn\r\n", "MN")
+
+	c.expect("ms str 1\r\nx\r\n", "HD")
+	c.expect("ma str\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value")
+}
+
+func TestMetaStaleWhileRevalidate(t *testing.T) {
+	c := newASCIIClient(t)
+
+	// Vivify on miss, first client wins, others see Z
+	c.expect("mg foo N30 v\r\n", "VA 0 W", "")
+	c.expect("mg foo N30 v\r\n", "VA 0 Z", "")
+
+	c.expect("ms foo 3\r\nbar\r\n", "HD")
+	c.expect("mg foo v\r\n", "VA 3", "bar")
+
+	// Invalidate keeps value served as stale with one winner
+	c.expect("md foo I\r\n", "HD")
+	c.expect("mg foo v\r\n", "VA 3 W X", "bar")
+	c.expect("mg foo v\r\n", "VA 3 X Z", "bar")
+
+	c.expect("ms foo 3\r\nnew\r\n", "HD")
+	c.expect("mg foo v\r\n", "VA 3", "new")
+}
+
+func TestMetaDebug(t *testing.T) {
+	c := newASCIIClient(t)
+
+	c.expect("me foo\r\n", "EN")
+	classes := map[string]bool{}
+	for _, size := range []int{3, 3000} {
+		key := "key" + strconv.Itoa(size)
+		c.expect("ms "+key+" "+strconv.Itoa(size)+"\r\n"+strings.Repeat("v", size)+"\r\n", "HD")
+		c.send("me " + key + "\r\n")
+		var cls string
+		for _, field := range strings.Fields(c.line()) {
+			if value, ok := strings.CutPrefix(field, "cls="); ok {
+				cls = value
+			}
+		}
+		classes[cls] = true
+
+		// Item is reported in slab class it is stored in
+		if used := c.stats("slabs")[cls+":used_chunks"]; used != "1" {
+			t.Fatalf("Expected item %s in slab class %s, got %s used chunks", key, cls, used)
+		}
+		if number := c.stats("items")["items:"+cls+":number"]; number != "1" {
+			t.Fatalf("Expected item %s in stats items of class %s, got %s", key, cls, number)
+		}
+	}
+	if len(classes) != 2 {
+		t.Fatalf("Expected items in different slab classes, got %v", classes)
+	}
+}
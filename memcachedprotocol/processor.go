@@ -2,40 +2,76 @@ package memcachedprotocol
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"nefelim4ag/go-memcached-server/memstore"
+	"nefelim4ag/go-memcached-server/proxy"
+	"nefelim4ag/go-memcached-server/tcpserver"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"log/slog"
 )
 
+const serverVersion = "1.6.2"
+
+var (
+	// errQuit is returned by command handlers when client asks to close connection
+	errQuit = errors.New("quit")
+	// errNotStored is returned from store update callbacks when condition is not met
+	errNotStored = errors.New("not stored")
+)
+
 type Processor struct {
-	store *memstore.SharedStore
-	rb    *bufio.Reader
-	wb    *bufio.Writer
-	conn  *net.TCPConn
+	store  *memstore.SharedStore
+	router *proxy.Router // key commands are forwarded to backends if set
+	rb     *bufio.Reader
+	wb     *bufio.Writer
+	conn   net.Conn
 
 	raw_request  [24]byte
 	flags        [4]byte
 	exptime      [4]byte
+	extras       [20]byte
 	request      RequestHeader
 	response     ResponseHeader
 	raw_response [24]byte
 	key          []byte
 	debug        bool
+	command      string // current command name for latency accounting
+	value        []byte // reusable request value buffer, store copies values
+	pin          uint64 // store pin of current command
+
+	authGen  uint64 // auth table generation client authenticated in, 0 if it did not
+	udp      bool   // requests are read from datagrams, connection is not kept
+	identity string // common name of TLS client certificate
+
+	// Connection state for stats conns
+	id      uint64
+	busy    atomic.Bool
+	lastCmd atomic.Int64
 }
 
-func CreateProcessor(conn *net.TCPConn, store *memstore.SharedStore) *Processor {
-	rb := bufio.NewReaderSize(conn, 64*1024)
-	wb := bufio.NewWriterSize(conn, 4*1024)
+func CreateProcessor(conn net.Conn, store *memstore.SharedStore) *Processor {
+	rb := bufio.NewReaderSize(countingReader{conn}, 64*1024)
+	wb := bufio.NewWriterSize(countingWriter{conn}, 4*1024)
 	b := Processor{
 		store: store,
 		rb:    rb,
 		wb:    wb,
 		conn:  conn,
 		debug: slog.Default().Handler().Enabled(nil, slog.LevelDebug),
+		id:    connID.Add(1),
+
+		identity: tcpserver.ClientIdentity(conn),
 	}
+	b.lastCmd.Store(store.Now())
+
+	conns.Store(b.id, &b)
+	currConnections.Add(1)
+	counters[totalConnections].Add(1)
 
 	return &b
 }
@@ -48,36 +84,104 @@ func (ctx *Processor) Handle() {
 		switch err {
 		case nil:
 		case io.EOF:
-			slog.Debug("Closed", "connection", ctx.conn.RemoteAddr())
+			slog.Debug("Closed", ctx.client())
 			return
 		default:
 			slog.Error(err.Error())
 			return
 		}
 
+		ctx.busy.Store(true)
+		ctx.lastCmd.Store(ctx.store.Now())
+
+		if magic > 0x80 {
+			slog.Error("Unsupported protocol", "magic", fmt.Sprintf("%02x", magic), ctx.client())
+			return
+		}
+
+		var cmdErr error
 		if magic < 0x80 {
-			err = ctx.CommandAscii()
-			if err != nil {
-				return
-			}
-		} else if magic == 0x80 {
-			err = ctx.CommandBinary()
-			if err != nil {
-				slog.Error(err.Error())
-				return
-			}
+			cmdErr = ctx.execute(ctx.CommandAscii)
 		} else {
-			slog.Error("Unsupported protocol", "magic", fmt.Sprintf("%02x", magic), "client", ctx.conn.RemoteAddr())
+			cmdErr = ctx.execute(ctx.CommandBinary)
+			if cmdErr != nil && cmdErr != errQuit {
+				slog.Error(cmdErr.Error())
+			}
 		}
 
+		// Flush response even if connection will be closed, e.g. on quit
 		err = ctx.wb.Flush()
 		if err != nil {
 			slog.Error(err.Error())
 			return
 		}
+		if cmdErr != nil {
+			return
+		}
+		ctx.busy.Store(false)
 	}
 }
 
-func (ctx *Processor) CloseProcessor() {
+// client return client address for logs, with identity of TLS client certificate
+func (ctx *Processor) client() slog.Attr {
+	if ctx.identity == "" {
+		return slog.Any("client", ctx.conn.RemoteAddr())
+	}
+	return slog.Group("client", "addr", ctx.conn.RemoteAddr(), "identity", ctx.identity)
+}
+
+// execute run command handler with latency accounting
+func (ctx *Processor) execute(command func() error) error {
+	start := time.Now()
+	ctx.command = "unknown"
+
+	// Values of store entries stay valid while pinned, responses are
+	// copied to write buffer or written directly during command
+	ctx.pin = ctx.store.Pin()
+	defer func() {
+		// Unpinned on panic too, so recovered UDP request doesn't hold back memory reuse
+		ctx.store.Unpin(ctx.pin)
+		observeLatency(ctx.command, time.Since(start))
+	}()
+
+	return command()
+}
+
+// Larger request values are not kept in connection buffer
+const maxValueBuffer = 64 * 1024
+
+// valueBuffer return buffer for request value, it is reused by next request
+func (ctx *Processor) valueBuffer(n int) []byte {
+	if n > maxValueBuffer {
+		return make([]byte, n)
+	}
+	if cap(ctx.value) < n {
+		ctx.value = make([]byte, n, max(n, 1024))
+	}
+	return ctx.value[:n]
+}
+
+// replicate hand connection over to replication stream, it is closed once stream ends
+func (ctx *Processor) replicate() error {
+	if ctx.udp {
+		return ctx.sendClientError("replication is not supported over UDP")
+	}
+	if err := ctx.wb.Flush(); err != nil {
+		return err
+	}
+
+	// Stream runs for connection lifetime, it must not hold back memory reuse
+	ctx.store.Unpin(ctx.pin)
+	defer func() { ctx.pin = ctx.store.Pin() }()
 
+	slog.Info("Replica connected", "replica", ctx.conn.RemoteAddr())
+	err := ctx.store.ServeReplica(countingWriter{ctx.conn})
+	slog.Info("Replica disconnected", "replica", ctx.conn.RemoteAddr(), "error", err)
+
+	return errQuit
+}
+
+func (ctx *Processor) CloseProcessor() {
+	conns.Delete(ctx.id)
+	currConnections.Add(-1)
 }
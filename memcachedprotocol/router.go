@@ -0,0 +1,486 @@
+package memcachedprotocol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"nefelim4ag/go-memcached-server/memstore"
+	"nefelim4ag/go-memcached-server/proxy"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"log/slog"
+)
+
+var (
+	// errBadReply is returned when backend reply does not match request
+	errBadReply = errors.New("unexpected backend reply")
+	// errBadFormat is returned for request which would be rejected by backend
+	errBadFormat = errors.New("bad command line format")
+)
+
+// SetRouter make processor forward key commands to backends of router instead of local store
+func (ctx *Processor) SetRouter(r *proxy.Router) {
+	ctx.router = r
+}
+
+// routeAscii forward text command to backends, false if command is served locally.
+// Backends always reply, noreply and meta q are applied by router, so replies never
+// get out of sync with pooled connection.
+func (ctx *Processor) routeAscii(command string, args []string) (bool, error) {
+	switch command {
+	case "get", "gets":
+		if len(args) == 0 {
+			return true, ctx.sendError()
+		}
+		if err := checkRouted(command, args); err != nil {
+			return true, ctx.sendClientError(err.Error())
+		}
+		return true, ctx.routeRetrieval(command, args)
+
+	// gat|gats <exptime> <key>*\r\n
+	case "gat", "gats":
+		if len(args) < 2 {
+			return true, ctx.sendError()
+		}
+		if err := checkRouted(command, args); err != nil {
+			return true, ctx.sendClientError(err.Error())
+		}
+		counters[cmdTouch].Add(uint64(len(args) - 1))
+		return true, ctx.routeRetrieval(command+" "+args[0], args[1:])
+
+	case "set", "add", "replace", "append", "prepend", "cas":
+		if len(args) < 4 || (command == "cas" && len(args) < 5) {
+			return true, ctx.sendError()
+		}
+		if err := checkRouted(command, args); err != nil {
+			return true, ctx.sendClientError(err.Error())
+		}
+		nbytes, err := strconv.ParseUint(args[3], 10, 32)
+		if err != nil {
+			return true, ctx.sendClientError(err.Error())
+		}
+		if ctx.tooLarge(nbytes) {
+			return true, ctx.swallowTooLarge(nbytes)
+		}
+		value := ctx.valueBuffer(int(nbytes) + 2)
+		if _, err := io.ReadFull(ctx.rb, value[:nbytes]); err != nil {
+			return true, ctx.sendClientError(err.Error())
+		}
+		// Read message last \r\n possibly
+		ctx.rb.ReadString('\n')
+		copy(value[nbytes:], "\r\n")
+
+		counters[cmdSet].Add(1)
+		args, noreply := stripNoreply(args)
+		return true, ctx.routeKey(args[0], command, args, value, noreply)
+
+	// delete <key> [noreply], touch <key> <exptime> [noreply], incr|decr <key> <value> [noreply]
+	case "delete", "touch", "incr", "decr":
+		if len(args) == 0 || (command != "delete" && len(args) < 2) {
+			return true, ctx.sendError()
+		}
+		if err := checkRouted(command, args); err != nil {
+			return true, ctx.sendClientError(err.Error())
+		}
+		if command == "touch" {
+			counters[cmdTouch].Add(1)
+		}
+		args, noreply := stripNoreply(args)
+		return true, ctx.routeKey(args[0], command, args, nil, noreply)
+
+	case "flush_all":
+		counters[cmdFlush].Add(1)
+		args, noreply := stripNoreply(args)
+		if err := checkRouted(command, args); err != nil {
+			return true, ctx.sendClientError(err.Error())
+		}
+		return true, ctx.routeFlush(args, noreply)
+
+	case "mg", "ms", "md", "ma", "me":
+		if len(args) == 0 {
+			return true, ctx.sendMetaClientError("bad command line format")
+		}
+		counters[cmdMeta].Add(1)
+		return true, ctx.routeMeta(command, args)
+
+	case "quit", "version", "verbosity", "stats", "mn":
+		return false, nil
+	}
+
+	return true, ctx.sendError()
+}
+
+// checkRouted validate keys and numeric arguments of text command before it is
+// forwarded, so backend never rejects request and malformed one can't be taken
+// for backend failure
+func checkRouted(command string, args []string) error {
+	var keys, numbers []string
+	switch command {
+	case "get", "gets":
+		keys = args
+	case "gat", "gats":
+		keys, numbers = args[1:], args[:1]
+	case "set", "add", "replace", "append", "prepend":
+		keys, numbers = args[:1], args[1:4]
+	case "cas":
+		keys, numbers = args[:1], args[1:5]
+	case "delete":
+		keys = args[:1]
+	case "touch", "incr", "decr":
+		keys, numbers = args[:1], args[1:2]
+	case "flush_all":
+		numbers = args[:min(len(args), 1)]
+	}
+
+	for _, key := range keys {
+		if len(key) == 0 || len(key) > maxKeyLength {
+			return errBadFormat
+		}
+	}
+	for _, number := range numbers {
+		// exptime and delay may be negative, cas and incr value may not fit int64
+		if _, err := strconv.ParseInt(number, 10, 64); err != nil {
+			if _, err := strconv.ParseUint(number, 10, 64); err != nil {
+				return errBadFormat
+			}
+		}
+	}
+
+	return nil
+}
+
+// isErrorReply report whether backend rejected request, connection stays in sync
+func isErrorReply(code string) bool {
+	return code == "ERROR" || code == "CLIENT_ERROR" || code == "SERVER_ERROR"
+}
+
+// stripNoreply remove trailing noreply from request arguments, reports whether it was present
+func stripNoreply(args []string) ([]string, bool) {
+	if len(args) > 0 && args[len(args)-1] == "noreply" {
+		return args[:len(args)-1], true
+	}
+
+	return args, false
+}
+
+// writeRequest write command line and optional data block to backend
+func writeRequest(c *proxy.Conn, command string, args []string, data []byte) error {
+	c.W.WriteString(command)
+	for _, arg := range args {
+		c.W.WriteByte(' ')
+		c.W.WriteString(arg)
+	}
+	c.W.WriteString("\r\n")
+	c.W.Write(data)
+
+	return c.W.Flush()
+}
+
+// appendReply append reply line of backend with data block of VALUE and VA
+// replies to buf, returns reply code
+func appendReply(r *bufio.Reader, buf []byte) ([]byte, string, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return buf, "", err
+	}
+	buf = append(buf, line...)
+
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return buf, "", errBadReply
+	}
+
+	// Size is unsigned, negative one would leave data block unread
+	var size uint64
+	data := false
+	switch {
+	case fields[0] == "VALUE" && len(fields) >= 4:
+		size, err = strconv.ParseUint(fields[3], 10, 32)
+		data = true
+	case fields[0] == "VA" && len(fields) >= 2:
+		size, err = strconv.ParseUint(fields[1], 10, 32)
+		data = true
+	}
+	if err != nil {
+		return buf, fields[0], fmt.Errorf("%w: %q", errBadReply, strings.TrimSpace(string(line)))
+	}
+	if data {
+		start := len(buf)
+		buf = append(buf, make([]byte, size+2)...)
+		if _, err := io.ReadFull(r, buf[start:]); err != nil {
+			return buf, fields[0], err
+		}
+	}
+
+	return buf, fields[0], nil
+}
+
+// sendBackendError reply to command which failed on backend
+func (ctx *Processor) sendBackendError(err error) error {
+	slog.Debug("Backend request failed", "error", err)
+	if errors.Is(err, proxy.ErrUnavailable) {
+		ctx.wb.Write([]byte("SERVER_ERROR no backend available\r\n"))
+	} else {
+		ctx.wb.Write([]byte("SERVER_ERROR backend failure\r\n"))
+	}
+
+	return nil
+}
+
+// routeKey forward single key command, reply is single line or VA, ME with data block
+func (ctx *Processor) routeKey(key string, command string, args []string, data []byte, noreply bool) error {
+	return ctx.routeKeyFilter(key, command, args, data, func(string) bool { return noreply })
+}
+
+// routeKeyFilter forward single key command, reply is dropped if drop returns true for its code
+func (ctx *Processor) routeKeyFilter(key string, command string, args []string, data []byte, drop func(code string) bool) error {
+	b, err := ctx.router.Pick(key)
+	if err != nil {
+		return ctx.sendBackendError(err)
+	}
+
+	var reply []byte
+	var code string
+	err = ctx.router.Do(b, func(c *proxy.Conn) error {
+		if err := writeRequest(c, command, args, data); err != nil {
+			return err
+		}
+		reply, code, err = appendReply(c.R, nil)
+		return err
+	})
+	if err != nil {
+		return ctx.sendBackendError(err)
+	}
+
+	if !drop(code) {
+		ctx.wb.Write(reply)
+	}
+
+	return nil
+}
+
+// routeRetrieval split keys of get by backend, request backends concurrently
+// and reply with values of all of them. Keys of failed backend are misses.
+func (ctx *Processor) routeRetrieval(command string, keys []string) error {
+	type batch struct {
+		backend *proxy.Backend
+		keys    []string
+		reply   []byte
+		hits    int
+		failure []byte // error reply of backend
+	}
+
+	batches := []*batch{}
+	byBackend := map[*proxy.Backend]*batch{}
+	for _, key := range keys {
+		b, err := ctx.router.Pick(key)
+		if err != nil {
+			continue
+		}
+		if byBackend[b] == nil {
+			byBackend[b] = &batch{backend: b}
+			batches = append(batches, byBackend[b])
+		}
+		byBackend[b].keys = append(byBackend[b].keys, key)
+	}
+
+	var wg sync.WaitGroup
+	for _, bt := range batches {
+		wg.Add(1)
+		go func(bt *batch) {
+			defer wg.Done()
+
+			err := ctx.router.Do(bt.backend, func(c *proxy.Conn) error {
+				if err := writeRequest(c, command, bt.keys, nil); err != nil {
+					return err
+				}
+				for {
+					end := len(bt.reply)
+					var code string
+					var err error
+					bt.reply, code, err = appendReply(c.R, bt.reply)
+					switch {
+					case err != nil:
+						return err
+					case code == "END":
+						bt.reply = bt.reply[:end]
+						return nil
+					case isErrorReply(code):
+						bt.reply, bt.failure = bt.reply[:end], bt.reply[end:]
+						return nil
+					case code != "VALUE":
+						return fmt.Errorf("%w: %q", errBadReply, strings.TrimSpace(string(bt.reply[end:])))
+					}
+					bt.hits++
+				}
+			})
+			if err != nil {
+				slog.Debug("Backend request failed", "error", err)
+				bt.reply, bt.hits = nil, 0
+			}
+		}(bt)
+	}
+	wg.Wait()
+
+	hits := 0
+	var failure []byte
+	for _, bt := range batches {
+		ctx.wb.Write(bt.reply)
+		hits += bt.hits
+		if failure == nil {
+			failure = bt.failure
+		}
+	}
+	counters[cmdGet].Add(uint64(len(keys)))
+	counters[getHits].Add(uint64(hits))
+	counters[getMisses].Add(uint64(len(keys) - hits))
+
+	// Error of backend ends reply instead of END, as it does on backend
+	if failure != nil {
+		ctx.wb.Write(failure)
+		return nil
+	}
+	return ctx.sendEnd()
+}
+
+// routeFlush forward flush_all to every backend which is up
+func (ctx *Processor) routeFlush(args []string, noreply bool) error {
+	failed := 0
+	var rejected []byte
+	for _, b := range ctx.router.Backends() {
+		if !b.Up() {
+			continue
+		}
+		err := ctx.router.Do(b, func(c *proxy.Conn) error {
+			if err := writeRequest(c, "flush_all", args, nil); err != nil {
+				return err
+			}
+			reply, code, err := appendReply(c.R, nil)
+			switch {
+			case err != nil:
+				return err
+			case isErrorReply(code):
+				rejected = reply
+			case code != "OK":
+				return fmt.Errorf("%w: %q", errBadReply, strings.TrimSpace(string(reply)))
+			}
+			return nil
+		})
+		if err != nil {
+			slog.Warn("Backend flush failed", "error", err)
+			failed++
+		}
+	}
+
+	switch {
+	case failed > 0:
+		ctx.wb.Write([]byte(fmt.Sprintf("SERVER_ERROR flush failed on %d backends\r\n", failed)))
+	case rejected != nil:
+		ctx.wb.Write(rejected)
+	case !noreply:
+		ctx.wb.Write([]byte("OK\r\n"))
+	}
+
+	return nil
+}
+
+// tooLarge report whether value is over item size limit, so router rejects
+// it before buffering, as backends would do after
+func (ctx *Processor) tooLarge(size uint64) bool {
+	limit := ctx.store.ItemSizeLimit()
+	return limit > 0 && size > uint64(limit)
+}
+
+// swallowTooLarge skip value of rejected storage command, connection stays in sync
+func (ctx *Processor) swallowTooLarge(size uint64) error {
+	if _, err := ctx.rb.Discard(int(size)); err != nil {
+		return err
+	}
+	// Read message last \r\n possibly
+	ctx.rb.ReadString('\n')
+
+	counters[storeTooLarge].Add(1)
+	ctx.wb.Write([]byte("SERVER_ERROR " + memstore.ErrTooLarge.Error() + "\r\n"))
+	return nil
+}
+
+// metaQuietCodes are replies dropped in quiet mode, same as served by local store
+var metaQuietCodes = map[string][]string{
+	"mg": {"EN"},
+	"ms": {"HD"},
+	"md": {"HD", "NF"},
+	"ma": {"HD", "NF"},
+}
+
+// routeMeta forward meta command by its key, base64 keys are hashed decoded
+func (ctx *Processor) routeMeta(command string, args []string) error {
+	tokens := args[1:]
+	var data []byte
+	if command == "ms" {
+		if len(args) < 2 {
+			return ctx.sendMetaClientError("bad command line format")
+		}
+		size, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return ctx.sendMetaClientError("bad data chunk")
+		}
+		tokens = args[2:]
+		if ctx.tooLarge(size) {
+			return ctx.swallowTooLarge(size)
+		}
+
+		data = ctx.valueBuffer(int(size) + 2)
+		if _, err := io.ReadFull(ctx.rb, data[:size]); err != nil {
+			return ctx.sendClientError(err.Error())
+		}
+		// Read message last \r\n possibly
+		ctx.rb.ReadString('\n')
+		copy(data[size:], "\r\n")
+	}
+
+	req, err := parseMetaRequest(args[0], tokens)
+	if err != nil {
+		return ctx.sendMetaClientError(err.Error())
+	}
+
+	forward := args[:len(args)-len(tokens)]
+	quiet := false
+	for _, token := range tokens {
+		if token == "q" {
+			quiet = true
+			continue
+		}
+		forward = append(forward[:len(forward):len(forward)], token)
+	}
+	return ctx.routeKeyFilter(req.key, command, forward, data, func(code string) bool {
+		return quiet && slices.Contains(metaQuietCodes[command], code)
+	})
+}
+
+// statsProxy report router backends as backend:<address>:<stat>
+func (ctx *Processor) statsProxy() [][2]string {
+	if ctx.router == nil {
+		return nil
+	}
+
+	u := func(v uint64) string { return strconv.FormatUint(v, 10) }
+	stats := [][2]string{}
+	for _, b := range ctx.router.Stats() {
+		prefix := "backend:" + b.Address + ":"
+		stats = append(stats, [][2]string{
+			{prefix + "up", boolStat(b.Up)},
+			{prefix + "idle_conns", strconv.Itoa(b.Idle)},
+			{prefix + "requests", u(b.Requests)},
+			{prefix + "errors", u(b.Errors)},
+			{prefix + "failovers", u(b.Failovers)},
+			{prefix + "downs", u(b.Downs)},
+			{prefix + "health_checks", u(b.Checks)},
+		}...)
+	}
+
+	return stats
+}
@@ -0,0 +1,280 @@
+package memcachedprotocol
+
+import (
+	"bufio"
+	"nefelim4ag/go-memcached-server/memstore"
+	"nefelim4ag/go-memcached-server/proxy"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveTestStore serve store on localhost, router mode if router is set, returns listener
+func serveTestStore(t *testing.T, store *memstore.SharedStore, router *proxy.Router) net.Listener {
+	t.Helper()
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				processor := CreateProcessor(conn, store)
+				defer processor.CloseProcessor()
+				if router != nil {
+					processor.SetRouter(router)
+				}
+				processor.Handle()
+			}()
+		}
+	}()
+
+	return listener
+}
+
+func newTestBackends(t *testing.T, count int) ([]*memstore.SharedStore, []string) {
+	stores := []*memstore.SharedStore{}
+	addresses := []string{}
+	for i := 0; i < count; i++ {
+		store := memstore.NewSharedStore()
+		store.SetMemoryLimit(64 * 1024 * 1024)
+		stores = append(stores, store)
+		addresses = append(addresses, serveTestStore(t, store, nil).Addr().String())
+	}
+
+	return stores, addresses
+}
+
+func newTestRouter(t *testing.T, config proxy.Config) *proxy.Router {
+	router, err := proxy.NewRouter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(router.Close)
+
+	return router
+}
+
+func newRouterClient(t *testing.T, router *proxy.Router) *asciiClient {
+	store := memstore.NewSharedStore()
+	store.SetMemoryLimit(64 * 1024 * 1024)
+	conn, err := net.Dial("tcp", serveTestStore(t, store, router).Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &asciiClient{t: t, conn: conn, rb: bufio.NewReader(conn)}
+}
+
+// backendKey return key which router maps to backend
+func backendKey(router *proxy.Router, backend int) string {
+	for i := 0; ; i++ {
+		key := "key:" + strconv.Itoa(i)
+		if b, _ := router.Pick(key); b == router.Backends()[backend] {
+			return key
+		}
+	}
+}
+
+func TestRouterAscii(t *testing.T) {
+	stores, addresses := newTestBackends(t, 3)
+	router := newTestRouter(t, proxy.Config{Backends: addresses})
+	c := newRouterClient(t, router)
+
+	keys := []string{}
+	for i := 0; i < 30; i++ {
+		key := "key:" + strconv.Itoa(i)
+		keys = append(keys, key)
+		c.expect("set "+key+" 5 0 "+strconv.Itoa(len(key))+"\r\n"+key+"\r\n", "STORED")
+	}
+
+	// Keys are spread by ketama hash, each is stored on its backend only
+	for _, key := range keys {
+		b, _ := router.Pick(key)
+		for i, store := range stores {
+			_, ok := store.Get(key)
+			if owner := router.Backends()[i] == b; ok != owner {
+				t.Fatalf("Key %s is stored on backend %d: %v, owner: %v", key, i, ok, owner)
+			}
+		}
+	}
+	for i, store := range stores {
+		if store.Stats().CurrItems == 0 {
+			t.Fatalf("Backend %d got no keys", i)
+		}
+	}
+
+	// Multi-key get is answered by all backends
+	c.send("get missing " + strings.Join(keys, " ") + "\r\n")
+	values := map[string]bool{}
+	for line := c.line(); line != "END"; line = c.line() {
+		fields := strings.Fields(line)
+		if len(fields) != 4 || fields[0] != "VALUE" || fields[2] != "5" {
+			t.Fatalf("Unexpected value line %q", line)
+		}
+		if value := c.line(); value != fields[1] {
+			t.Fatalf("Expected value %q, got %q", fields[1], value)
+		}
+		values[fields[1]] = true
+	}
+	if len(values) != len(keys) {
+		t.Fatalf("Expected %d values, got %d", len(keys), len(values))
+	}
+
+	c.expect("incr key:1 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value")
+	c.expect("set cnt 0 0 1 noreply\r\n1\r\n")
+	c.expect("incr cnt 5\r\n", "6")
+	c.expect("delete cnt noreply\r\n")
+	c.expect("delete cnt\r\n", "NOT_FOUND")
+	c.expect("touch key:2 100\r\n", "TOUCHED")
+
+	// Meta commands, quiet replies are dropped by router
+	c.expect("ms meta 2 T0 F3\r\nhi\r\n", "HD")
+	c.expect("mg meta v f\r\n", "VA 2 f3", "hi")
+	c.expect("mg missing v q\r\nmg meta s q\r\nmn\r\n", "HD s2", "MN")
+	c.expect("md meta q\r\nmd meta q\r\nmn\r\n", "MN")
+	c.expect("mg bWV0YQ== b v\r\n", "EN")
+
+	c.expect("flush_all\r\n", "OK")
+	c.expect("get key:1\r\n", "END")
+	c.expect("slabs automove 1\r\n", "ERROR")
+
+	stats := c.stats("proxy")
+	for _, address := range addresses {
+		if stats["backend:"+address+":up"] != "1" || stats["backend:"+address+":requests"] == "0" {
+			t.Fatalf("Backend %s is missing in stats proxy: %v", address, stats)
+		}
+	}
+}
+
+func TestRouterFailover(t *testing.T) {
+	_, addresses := newTestBackends(t, 1)
+	// Nothing listens on closed listener port
+	down := serveTestStore(t, nil, nil)
+	down.Close()
+	addresses = append(addresses, down.Addr().String())
+
+	router := newTestRouter(t, proxy.Config{Backends: addresses, FailureLimit: 1, HealthInterval: time.Hour})
+	c := newRouterClient(t, router)
+
+	key := backendKey(router, 1)
+	c.expect("set "+key+" 0 0 1\r\na\r\n", "SERVER_ERROR backend failure")
+	c.expect("set "+key+" 0 0 1\r\na\r\n", "STORED")
+	c.expect("get "+key+"\r\n", "VALUE "+key+" 0 1", "a", "END")
+
+	stats := c.stats("proxy")
+	if prefix := "backend:" + down.Addr().String() + ":"; stats[prefix+"up"] != "0" || stats[prefix+"errors"] != "1" || stats[prefix+"failovers"] != "2" {
+		t.Fatalf("Expected failed backend in stats proxy: %v", stats)
+	}
+
+	none := newTestRouter(t, proxy.Config{Backends: addresses[1:], FailureLimit: 1, HealthInterval: time.Hour})
+	d := newRouterClient(t, none)
+	// Failed get marks only backend down, keys of failed backends are misses
+	d.expect("get "+key+"\r\n", "END")
+	d.expect("set "+key+" 0 0 1\r\na\r\n", "SERVER_ERROR no backend available")
+}
+
+// serveStaticBackend reply to every request line with reply
+func serveStaticBackend(t *testing.T, reply string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					if _, err := r.ReadString('\n'); err != nil {
+						return
+					}
+					conn.Write([]byte(reply))
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestRouterBackendErrors(t *testing.T) {
+	stores, addresses := newTestBackends(t, 1)
+	router := newTestRouter(t, proxy.Config{Backends: addresses, FailureLimit: 1, HealthInterval: time.Hour})
+
+	// Malformed requests are rejected by router, client connection is closed
+	newRouterClient(t, router).expect("get "+strings.Repeat("k", 251)+"\r\n", "CLIENT_ERROR bad command line format")
+	newRouterClient(t, router).expect("set key 0 never 1\r\na\r\n", "CLIENT_ERROR bad command line format")
+	newRouterClient(t, router).expect("flush_all soon\r\n", "CLIENT_ERROR bad command line format")
+
+	// Error replies of backends are passed to client, backends stay up
+	stores[0].SetReadOnly(true)
+	c := newRouterClient(t, router)
+	c.expect("flush_all\r\n", "SERVER_ERROR "+memstore.ErrReadOnly.Error())
+	c.expect("get key\r\n", "END")
+
+	failing := newTestRouter(t, proxy.Config{Backends: []string{serveStaticBackend(t, "SERVER_ERROR out of memory\r\n")}, FailureLimit: 1, HealthInterval: time.Hour})
+	d := newRouterClient(t, failing)
+	d.expect("get key\r\n", "SERVER_ERROR out of memory")
+	d.expect("get key\r\n", "SERVER_ERROR out of memory")
+
+	for _, stats := range []map[string]string{c.stats("proxy"), d.stats("proxy")} {
+		for name, value := range stats {
+			if (strings.HasSuffix(name, ":up") && value != "1") || (strings.HasSuffix(name, ":errors") && value != "0") {
+				t.Fatalf("Expected backends up without errors: %v", stats)
+			}
+		}
+	}
+}
+
+func TestRouterNegativeValueSize(t *testing.T) {
+	address := serveStaticBackend(t, "VALUE key 0 -1\r\nEND\r\n")
+	router := newTestRouter(t, proxy.Config{Backends: []string{address}, FailureLimit: 1, HealthInterval: time.Hour})
+	c := newRouterClient(t, router)
+
+	// Malformed reply fails backend, pooled connection is not reused out of sync
+	c.expect("get key\r\n", "END")
+	c.expect("get key\r\n", "END")
+	if stats := c.stats("proxy"); stats["backend:"+address+":up"] != "0" || stats["backend:"+address+":errors"] != "1" {
+		t.Fatalf("Expected failed backend in stats proxy: %v", stats)
+	}
+}
+
+func TestRouterValueTooLarge(t *testing.T) {
+	stores, addresses := newTestBackends(t, 1)
+	router := newTestRouter(t, proxy.Config{Backends: addresses, HealthInterval: time.Hour})
+	store := memstore.NewSharedStore()
+	store.SetItemSizeLimit(1024)
+	conn, err := net.Dial("tcp", serveTestStore(t, store, router).Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &asciiClient{t: t, conn: conn, rb: bufio.NewReader(conn)}
+
+	// Value over limit is skipped, next command is read in sync
+	value := strings.Repeat("v", 2048)
+	c.expect("set key 0 0 2048\r\n"+value+"\r\n", "SERVER_ERROR object too large for cache")
+	c.expect("ms key 2048\r\n"+value+"\r\n", "SERVER_ERROR object too large for cache")
+	c.expect("set key 0 0 1\r\na\r\n", "STORED")
+	if e, ok := stores[0].Get("key"); !ok || string(e.Value) != "a" {
+		t.Fatal("Expected only small value forwarded to backend")
+	}
+}
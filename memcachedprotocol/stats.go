@@ -0,0 +1,675 @@
+package memcachedprotocol
+
+import (
+	"crypto/tls"
+	"io"
+	"nefelim4ag/go-memcached-server/cluster"
+	"nefelim4ag/go-memcached-server/memstore"
+	"nefelim4ag/go-memcached-server/metrics"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statCounter is index of protocol counter
+type statCounter int
+
+const (
+	cmdGet statCounter = iota
+	cmdSet
+	cmdFlush
+	cmdTouch
+	cmdMeta
+	getHits
+	getMisses
+	deleteMisses
+	deleteHits
+	incrMisses
+	incrHits
+	decrMisses
+	decrHits
+	casMisses
+	casHits
+	casBadval
+	touchHits
+	touchMisses
+	storeTooLarge
+	authCmds
+	authErrors
+	bytesRead
+	bytesWritten
+	totalConnections
+	udpRequests
+	udpResponses
+	udpErrors
+	statCount
+)
+
+var statNames = [statCount]string{
+	cmdGet:           "cmd_get",
+	cmdSet:           "cmd_set",
+	cmdFlush:         "cmd_flush",
+	cmdTouch:         "cmd_touch",
+	cmdMeta:          "cmd_meta",
+	getHits:          "get_hits",
+	getMisses:        "get_misses",
+	deleteMisses:     "delete_misses",
+	deleteHits:       "delete_hits",
+	incrMisses:       "incr_misses",
+	incrHits:         "incr_hits",
+	decrMisses:       "decr_misses",
+	decrHits:         "decr_hits",
+	casMisses:        "cas_misses",
+	casHits:          "cas_hits",
+	casBadval:        "cas_badval",
+	touchHits:        "touch_hits",
+	touchMisses:      "touch_misses",
+	storeTooLarge:    "store_too_large",
+	authCmds:         "auth_cmds",
+	authErrors:       "auth_errors",
+	bytesRead:        "bytes_read",
+	bytesWritten:     "bytes_written",
+	totalConnections: "total_connections",
+	udpRequests:      "udp_requests",
+	udpResponses:     "udp_response_datagrams",
+	udpErrors:        "udp_errors",
+}
+
+var (
+	// counters shared by all connections
+	counters        [statCount]atomic.Uint64
+	currConnections atomic.Int64
+	startTime       = time.Now()
+
+	// conns is registry of open connections for stats conns
+	conns  sync.Map
+	connID atomic.Uint64
+
+	// commandLatency is per command latency, read only after init
+	commandLatency = newCommandLatency()
+
+	// clusterNode is reported by stats peers, nil unless peers are configured
+	clusterNode atomic.Pointer[cluster.Node]
+
+	// serverSettings is reported by stats, nil until set
+	serverSettings atomic.Pointer[ServerSettings]
+)
+
+// ServerSettings are listener settings reported by stats settings
+type ServerSettings struct {
+	MaxConns   int
+	UDPPort    int
+	Interfaces string // -l as given, empty for all interfaces
+	UnixSocket string
+	UnixMask   uint32
+	Verbosity  int
+	Rejected   func() uint64 // connections closed over MaxConns, may be nil
+
+	TLS                bool
+	TLSClientAuth      tls.ClientAuthType
+	TLSMinVersion      uint16
+	TLSHandshakeErrors func() uint64 // may be nil
+}
+
+// SetServerSettings report listener settings in stats
+func SetServerSettings(settings ServerSettings) {
+	serverSettings.Store(&settings)
+}
+
+// getServerSettings return listener settings, defaults of memcached until set
+func getServerSettings() *ServerSettings {
+	if settings := serverSettings.Load(); settings != nil {
+		return settings
+	}
+	return &ServerSettings{MaxConns: 1024, UnixMask: 0700}
+}
+
+// SetCluster report peers of node in stats peers
+func SetCluster(n *cluster.Node) {
+	clusterNode.Store(n)
+}
+
+// latencyCommands have own latency histogram, other commands are accounted as unknown
+var latencyCommands = []string{
+	"get", "gets", "gat", "gats", "touch", "set", "add", "replace", "append", "prepend", "cas",
+	"delete", "incr", "decr", "flush_all", "stats", "slabs", "snapshot", "oplog", "version", "verbosity", "noop", "quit",
+	"mg", "ms", "md", "ma", "mn", "me", "unknown",
+}
+
+func newCommandLatency() map[string]*metrics.Histogram {
+	latency := make(map[string]*metrics.Histogram, len(latencyCommands))
+	for _, command := range latencyCommands {
+		latency[command] = metrics.NewHistogram(metrics.LatencyBuckets)
+	}
+
+	return latency
+}
+
+// observeLatency account command execution time
+func observeLatency(command string, d time.Duration) {
+	h, ok := commandLatency[command]
+	if !ok {
+		h = commandLatency["unknown"]
+	}
+	h.Observe(d)
+}
+
+// binaryCommand return command name of binary opcode for latency accounting
+func binaryCommand(opcode OpcodeType) string {
+	switch opcode {
+	case Get, GetQ, GetK, GetKQ:
+		return "get"
+	case GATUnstable, GATQUnstable, GATKUnstable, GATKQUnstable:
+		return "gat"
+	case TouchUnstable:
+		return "touch"
+	case Set, SetQ:
+		return "set"
+	case Add, AddQ:
+		return "add"
+	case Replace, ReplaceQ:
+		return "replace"
+	case Append, AppendQ:
+		return "append"
+	case Prepend, PrependQ:
+		return "prepend"
+	case Delete, DeleteQ:
+		return "delete"
+	case Increment, IncrementQ:
+		return "incr"
+	case Decrement, DecrementQ:
+		return "decr"
+	case Flush, FlushQ:
+		return "flush_all"
+	case Stat:
+		return "stats"
+	case Version:
+		return "version"
+	case VerbosityUnstable:
+		return "verbosity"
+	case NoOp:
+		return "noop"
+	case Quit, QuitQ:
+		return "quit"
+	}
+
+	return "unknown"
+}
+
+// WriteMetrics is metrics collector of protocol counters and command latency,
+// connection metrics are exported by tcpserver
+func WriteMetrics(w *metrics.Writer) {
+	for i := range counters {
+		if statCounter(i) == totalConnections {
+			continue
+		}
+		w.Counter("memcached_"+statNames[i]+"_total", "Memcached "+statNames[i]+" counter.", counters[i].Load())
+	}
+
+	w.Header("memcached_command_duration_seconds", "Command execution time.", "histogram")
+	for _, command := range latencyCommands {
+		w.Histogram("memcached_command_duration_seconds", `command="`+command+`"`, commandLatency[command])
+	}
+}
+
+// countHit increment hits or misses counter
+func countHit(hit bool, hits statCounter, misses statCounter) {
+	if hit {
+		counters[hits].Add(1)
+	} else {
+		counters[misses].Add(1)
+	}
+}
+
+// countStore account storage command result
+func countStore(err error) {
+	counters[cmdSet].Add(1)
+	if err == memstore.ErrTooLarge {
+		counters[storeTooLarge].Add(1)
+	}
+}
+
+// countCas account cas command result
+func countCas(err error) {
+	switch err {
+	case nil:
+		counters[casHits].Add(1)
+	case memstore.ErrExists:
+		counters[casBadval].Add(1)
+	case memstore.ErrNotFound:
+		counters[casMisses].Add(1)
+	}
+}
+
+// resetStats zero protocol and store counters, as stats reset
+func (ctx *Processor) resetStats() {
+	for i := range counters {
+		counters[i].Store(0)
+	}
+	ctx.store.ResetStats()
+}
+
+// countingReader account bytes read from connection
+type countingReader struct {
+	r io.Reader
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	counters[bytesRead].Add(uint64(n))
+	return n, err
+}
+
+// countingWriter account bytes written to connection
+type countingWriter struct {
+	w io.Writer
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	counters[bytesWritten].Add(uint64(n))
+	return n, err
+}
+
+// statsGroup return stats for stats subcommand, false if group is unknown
+func (ctx *Processor) statsGroup(group string) ([][2]string, bool) {
+	switch group {
+	case "":
+		return ctx.statsGeneral(), true
+	case "settings":
+		return ctx.statsSettings(), true
+	case "items":
+		return ctx.statsItems(), true
+	case "sizes":
+		return ctx.statsSizes(), true
+	case "conns":
+		return ctx.statsConns(), true
+	case "slabs":
+		return ctx.statsSlabs(), true
+	case "peers":
+		return statsPeers(), true
+	case "proxy":
+		return ctx.statsProxy(), true
+	}
+
+	return nil, false
+}
+
+func (ctx *Processor) statsGeneral() [][2]string {
+	now := time.Now()
+	s := ctx.store.Stats()
+	_, slabs := ctx.store.SlabStats()
+	snapshots := ctx.store.SnapshotStats()
+	oplog := ctx.store.OpLogStats()
+	repl := ctx.store.ReplicationStats()
+	server := getServerSettings()
+	rejected, tlsErrors := uint64(0), uint64(0)
+	if server.Rejected != nil {
+		rejected = server.Rejected()
+	}
+	if server.TLSHandshakeErrors != nil {
+		tlsErrors = server.TLSHandshakeErrors()
+	}
+	u := func(v uint64) string { return strconv.FormatUint(v, 10) }
+	c := func(i statCounter) [2]string { return [2]string{statNames[i], u(counters[i].Load())} }
+
+	stats := [][2]string{
+		{"pid", strconv.Itoa(os.Getpid())},
+		{"uptime", strconv.FormatInt(int64(now.Sub(startTime)/time.Second), 10)},
+		{"time", strconv.FormatInt(now.Unix(), 10)},
+		{"version", serverVersion},
+		{"pointer_size", strconv.Itoa(strconv.IntSize)},
+		{"max_connections", strconv.Itoa(server.MaxConns)},
+		{"curr_connections", strconv.FormatInt(currConnections.Load(), 10)},
+		c(totalConnections),
+		{"rejected_connections", u(rejected)},
+		{"ssl_handshake_errors", u(tlsErrors)},
+		c(udpRequests),
+		c(udpResponses),
+		c(udpErrors),
+		c(cmdGet),
+		c(cmdSet),
+		c(cmdFlush),
+		c(cmdTouch),
+		c(cmdMeta),
+		c(getHits),
+		c(getMisses),
+		{"get_expired", u(s.GetExpired)},
+		{"get_flushed", u(s.GetFlushed)},
+		c(deleteMisses),
+		c(deleteHits),
+		c(incrMisses),
+		c(incrHits),
+		c(decrMisses),
+		c(decrHits),
+		c(casMisses),
+		c(casHits),
+		c(casBadval),
+		c(touchHits),
+		c(touchMisses),
+		c(storeTooLarge),
+		c(authCmds),
+		c(authErrors),
+		c(bytesRead),
+		c(bytesWritten),
+		{"limit_maxbytes", u(s.LimitMaxbytes)},
+		{"threads", strconv.Itoa(runtime.GOMAXPROCS(0))},
+		{"bytes", u(s.Bytes)},
+		{"logical_bytes", u(s.LogicalBytes)},
+		{"curr_items", u(s.CurrItems)},
+		{"total_items", u(s.TotalItems)},
+		{"expired_unfetched", u(s.ExpiredUnfetched)},
+		{"evicted_unfetched", u(s.EvictedUnfetched)},
+		{"evictions", u(s.Evictions)},
+		{"reclaimed", u(s.Reclaimed)},
+		{"crawler_reclaimed", u(s.CrawlerReclaimed)},
+		{"moves_to_cold", u(s.MovesToCold)},
+		{"moves_to_warm", u(s.MovesToWarm)},
+		{"moves_within_lru", u(s.MovesWithinLRU)},
+		{"slabs_moved", u(slabs.PagesMoved)},
+		{"slab_reassign_rescues", u(slabs.Rescues)},
+		{"slab_reassign_evictions", u(slabs.ReassignEvictions)},
+		{"slab_global_page_pool", strconv.Itoa(slabs.SparePages)},
+		{"snapshot_in_progress", boolStat(snapshots.InProgress)},
+		{"snapshots", u(snapshots.Count)},
+		{"snapshot_failures", u(snapshots.Failures)},
+		{"snapshot_last_time", strconv.FormatInt(snapshots.LastTime, 10)},
+		{"snapshot_last_duration_us", strconv.FormatInt(snapshots.LastDuration.Microseconds(), 10)},
+		{"snapshot_last_bytes", strconv.FormatInt(snapshots.LastBytes, 10)},
+		{"snapshot_last_items", strconv.FormatInt(snapshots.LastItems, 10)},
+		{"oplog_enabled", boolStat(oplog.Enabled)},
+		{"oplog_bytes", strconv.FormatInt(oplog.Bytes, 10)},
+		{"oplog_records", u(oplog.Records)},
+		{"oplog_rewrites", u(oplog.Compactions)},
+		{"oplog_rewrite_in_progress", boolStat(oplog.Compacting)},
+		{"repl_role", replRole(repl)},
+		{"repl_connected_replicas", strconv.Itoa(repl.Replicas)},
+		{"repl_backlog_bytes", strconv.FormatInt(repl.BacklogBytes, 10)},
+		{"repl_full_syncs", u(repl.FullSyncs)},
+	}
+
+	if repl.Primary != "" {
+		stats = append(stats, [][2]string{
+			{"repl_primary", repl.Primary},
+			{"repl_link_up", boolStat(repl.LinkUp)},
+			{"repl_link_downs", u(repl.LinkDowns)},
+			{"repl_syncs", u(repl.Syncs)},
+			{"repl_records_applied", u(repl.RecordsApplied)},
+			{"repl_lag_us", strconv.FormatInt(repl.Lag.Microseconds(), 10)},
+			{"repl_last_io", strconv.FormatInt(repl.LastIO, 10)},
+		}...)
+	}
+
+	// As memcached, extstore stats are reported only if it is enabled
+	if ext := ctx.store.ExtstoreStats(); ext.Enabled {
+		i := func(v int64) string { return strconv.FormatInt(v, 10) }
+		stats = append(stats, [][2]string{
+			{"extstore_page_evictions", u(ext.PageEvictions)},
+			{"extstore_page_reclaims", u(ext.PageReclaims)},
+			{"extstore_pages_free", strconv.Itoa(ext.PagesFree)},
+			{"extstore_pages_used", strconv.Itoa(ext.PagesUsed)},
+			{"extstore_objects_evicted", u(ext.ObjectsEvicted)},
+			{"extstore_objects_read", u(ext.ObjectsRead)},
+			{"extstore_objects_written", u(ext.ObjectsWritten)},
+			{"extstore_objects_used", i(ext.ObjectsUsed)},
+			{"extstore_bytes_written", u(ext.BytesWritten)},
+			{"extstore_bytes_read", u(ext.BytesRead)},
+			{"extstore_bytes_used", i(ext.BytesUsed)},
+			{"extstore_bytes_fragmented", i(ext.BytesFragmented)},
+			{"extstore_limit_maxbytes", i(ext.LimitBytes)},
+			{"extstore_compact_rescues", u(ext.CompactRescues)},
+			{"extstore_compact_lost", u(ext.CompactLost)},
+			{"extstore_io_errors", u(ext.IOErrors)},
+		}...)
+	}
+
+	return stats
+}
+
+func replRole(s memstore.ReplicationStats) string {
+	if s.Primary != "" {
+		return "replica"
+	}
+	return "primary"
+}
+
+func oplogFsync(s memstore.OpLogStats) string {
+	if !s.Enabled {
+		return "off"
+	}
+	return s.Policy
+}
+
+func boolStat(v bool) string {
+	if v {
+		return "1"
+	}
+	return "0"
+}
+
+// tlsVersion format version as memcached ssl_min_version, e.g. tlsv1.2
+func tlsVersion(version uint16) string {
+	if version == 0 {
+		return "NULL"
+	}
+	return strings.ToLower(strings.ReplaceAll(tls.VersionName(version), " ", "v"))
+}
+
+// verifyMode return memcached ssl_verify_mode of client certificate policy
+func verifyMode(auth tls.ClientAuthType) int {
+	switch auth {
+	case tls.VerifyClientCertIfGiven:
+		return 1
+	case tls.RequireAndVerifyClientCert:
+		return 2
+	}
+	return 0
+}
+
+func yesNo(v bool) string {
+	if v {
+		return "yes"
+	}
+	return "no"
+}
+
+func (ctx *Processor) statsSettings() [][2]string {
+	_, slabs := ctx.store.SlabStats()
+	port := 0
+	if addr, ok := ctx.conn.LocalAddr().(*net.TCPAddr); ok {
+		port = addr.Port
+	}
+
+	server := getServerSettings()
+	null := func(v string) string {
+		if v == "" {
+			return "NULL"
+		}
+		return v
+	}
+
+	settings := [][2]string{
+		{"maxbytes", strconv.FormatInt(ctx.store.MemoryLimit(), 10)},
+		{"maxconns", strconv.Itoa(server.MaxConns)},
+		{"tcpport", strconv.Itoa(port)},
+		{"udpport", strconv.Itoa(server.UDPPort)},
+		{"inter", null(server.Interfaces)},
+		{"verbosity", strconv.Itoa(server.Verbosity)},
+		{"domain_socket", null(server.UnixSocket)},
+		{"umask", strconv.FormatUint(uint64(server.UnixMask), 8)},
+		{"num_threads", strconv.Itoa(runtime.GOMAXPROCS(0))},
+		{"evictions", "on"},
+		{"eviction_policy", ctx.store.Stats().Policy},
+		{"cas_enabled", "yes"},
+		{"item_size_max", strconv.FormatInt(int64(ctx.store.ItemSizeLimit()), 10)},
+		{"binding_protocol", "auto-negotiate"},
+		{"auth_enabled_sasl", yesNo(authEnabled())},
+		{"auth_enabled_ascii", yesNo(authEnabled())},
+		{"ssl_enabled", yesNo(server.TLS)},
+		{"ssl_verify_mode", strconv.Itoa(verifyMode(server.TLSClientAuth))},
+		{"ssl_min_version", tlsVersion(server.TLSMinVersion)},
+		{"flush_enabled", "yes"},
+		{"lru_crawler", "yes"},
+		{"slab_reassign", "yes"},
+		{"slab_automove", strconv.Itoa(slabs.Automove)},
+		{"oplog_fsync", oplogFsync(ctx.store.OpLogStats())},
+		{"repl_read_only", boolStat(ctx.store.ReadOnly())},
+	}
+
+	if ext := ctx.store.ExtstoreStats(); ext.Enabled {
+		settings = append(settings, [][2]string{
+			{"ext_item_size", strconv.Itoa(ext.ItemSize)},
+			{"ext_page_size", strconv.FormatInt(ext.SegmentSize/(1024*1024), 10)},
+		}...)
+	}
+
+	return settings
+}
+
+// statsPeers report invalidation events exchanged with each peer as peer:<address>:<stat>
+func statsPeers() [][2]string {
+	n := clusterNode.Load()
+	if n == nil {
+		return nil
+	}
+
+	u := func(v uint64) string { return strconv.FormatUint(v, 10) }
+	stats := [][2]string{}
+	for _, p := range n.Stats() {
+		prefix := "peer:" + p.Address + ":"
+		stats = append(stats, [][2]string{
+			{prefix + "connected", boolStat(p.Connected)},
+			{prefix + "queued", strconv.Itoa(p.Queued)},
+			{prefix + "backoff_ms", strconv.FormatInt(p.Backoff.Milliseconds(), 10)},
+			{prefix + "sent", u(p.Sent)},
+			{prefix + "dropped", u(p.Dropped)},
+			{prefix + "failures", u(p.Failures)},
+			{prefix + "received", u(p.Received)},
+			{prefix + "invalidated", u(p.Invalidated)},
+		}...)
+	}
+
+	return stats
+}
+
+// statsItems report slab classes with items, large and empty values are class 0
+func (ctx *Processor) statsItems() [][2]string {
+	classes := ctx.store.ItemStats()
+	u := func(v uint64) string { return strconv.FormatUint(v, 10) }
+
+	stats := make([][2]string, 0, len(classes)*13)
+	for _, c := range classes {
+		id := "items:" + strconv.Itoa(c.Class) + ":"
+		stats = append(stats,
+			[2]string{id + "number", u(c.Number)},
+			[2]string{id + "number_hot", u(c.NumberHot)},
+			[2]string{id + "number_warm", u(c.NumberWarm)},
+			[2]string{id + "number_cold", u(c.NumberCold)},
+			[2]string{id + "age", strconv.FormatInt(c.Age, 10)},
+			[2]string{id + "evicted", u(c.Evicted)},
+			[2]string{id + "evicted_unfetched", u(c.EvictedUnfetched)},
+			[2]string{id + "expired_unfetched", u(c.ExpiredUnfetched)},
+			[2]string{id + "reclaimed", u(c.Reclaimed)},
+			[2]string{id + "crawler_reclaimed", u(c.CrawlerReclaimed)},
+			[2]string{id + "moves_to_cold", u(c.MovesToCold)},
+			[2]string{id + "moves_to_warm", u(c.MovesToWarm)},
+			[2]string{id + "moves_within_lru", u(c.MovesWithinLRU)},
+		)
+	}
+
+	return stats
+}
+
+func (ctx *Processor) statsSizes() [][2]string {
+	sizes := ctx.store.Sizes()
+	keys := make([]uint64, 0, len(sizes))
+	for size := range sizes {
+		keys = append(keys, size)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	stats := make([][2]string, 0, len(keys))
+	for _, size := range keys {
+		stats = append(stats, [2]string{strconv.FormatUint(size, 10), strconv.FormatUint(sizes[size], 10)})
+	}
+
+	return stats
+}
+
+// statsSlabs report slab classes with allocated pages, values above max chunk are large items
+func (ctx *Processor) statsSlabs() [][2]string {
+	classes, totals := ctx.store.SlabStats()
+	itoa := strconv.Itoa
+	i64 := func(v int64) string { return strconv.FormatInt(v, 10) }
+
+	stats := make([][2]string, 0, len(classes)*10+6)
+	for _, c := range classes {
+		id := itoa(c.Class)
+		stats = append(stats,
+			[2]string{id + ":chunk_size", itoa(c.ChunkSize)},
+			[2]string{id + ":chunks_per_page", itoa(c.ChunksPerPage)},
+			[2]string{id + ":total_pages", itoa(c.TotalPages)},
+			[2]string{id + ":total_chunks", itoa(c.TotalChunks)},
+			[2]string{id + ":used_chunks", itoa(c.UsedChunks)},
+			[2]string{id + ":free_chunks", itoa(c.FreeChunks)},
+			[2]string{id + ":mem_requested", i64(c.MemRequested)},
+			[2]string{id + ":quota_bytes", i64(c.QuotaBytes)},
+			[2]string{id + ":usage_bytes", i64(c.UsageBytes)},
+			[2]string{id + ":evicted", strconv.FormatUint(c.Evicted, 10)},
+		)
+	}
+
+	return append(stats,
+		[2]string{"active_slabs", itoa(len(classes))},
+		[2]string{"total_malloced", i64(totals.TotalMalloced)},
+		[2]string{"large_items", i64(totals.LargeItems)},
+		[2]string{"large_bytes", i64(totals.LargeBytes)},
+		[2]string{"large_quota_bytes", i64(totals.LargeQuota)},
+		[2]string{"quota_pool_bytes", i64(totals.QuotaPool)},
+	)
+}
+
+// connAddr format address as network:address, unix socket clients are unnamed,
+// shown as empty or @ name, and report socket path, as in memcached
+func connAddr(addr net.Addr, local net.Addr) string {
+	if addr == nil || addr.String() == "" || addr.String() == "@" {
+		addr = local
+	}
+	return addr.Network() + ":" + addr.String()
+}
+
+func (ctx *Processor) statsConns() [][2]string {
+	var list []*Processor
+	conns.Range(func(key, value any) bool {
+		list = append(list, value.(*Processor))
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+
+	now := ctx.store.Now()
+	stats := make([][2]string, 0, len(list)*4)
+	for _, p := range list {
+		id := strconv.FormatUint(p.id, 10)
+		state := "conn_waiting"
+		if p.busy.Load() {
+			state = "conn_parse_cmd"
+		}
+		stats = append(stats,
+			[2]string{id + ":addr", connAddr(p.conn.RemoteAddr(), p.conn.LocalAddr())},
+			[2]string{id + ":listen_addr", connAddr(p.conn.LocalAddr(), p.conn.LocalAddr())},
+			[2]string{id + ":state", state},
+			[2]string{id + ":secs_since_last_cmd", strconv.FormatInt(now-p.lastCmd.Load(), 10)},
+		)
+		if p.identity != "" {
+			stats = append(stats, [2]string{id + ":identity", p.identity})
+		}
+	}
+
+	return stats
+}
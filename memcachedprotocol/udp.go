@@ -0,0 +1,155 @@
+package memcachedprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"nefelim4ag/go-memcached-server/memstore"
+	"nefelim4ag/go-memcached-server/proxy"
+	"net"
+	"time"
+
+	"log/slog"
+)
+
+const (
+	// udpHeaderSize is frame header of each datagram: request id, sequence
+	// number, datagrams in message and reserved, big endian uint16 each
+	udpHeaderSize = 8
+	// udpMaxDatagram is max datagram size with header, as in memcached
+	udpMaxDatagram = 1400
+)
+
+// PacketProcessor run text protocol commands of UDP datagrams, it is not safe
+// for concurrent use, each reading goroutine has own processor
+type PacketProcessor struct {
+	ctx  *Processor
+	conn *packetConn
+}
+
+func NewPacketProcessor(store *memstore.SharedStore, router *proxy.Router) *PacketProcessor {
+	conn := &packetConn{}
+	return &PacketProcessor{
+		conn: conn,
+		ctx: &Processor{
+			store:  store,
+			router: router,
+			rb:     bufio.NewReaderSize(countingReader{conn}, 64*1024),
+			wb:     bufio.NewWriterSize(countingWriter{conn}, 4*1024),
+			conn:   conn,
+			debug:  slog.Default().Handler().Enabled(nil, slog.LevelDebug),
+			udp:    true,
+		},
+	}
+}
+
+// HandlePacket run commands of request datagram and send response split to
+// datagrams of same request id by write. Requests of several datagrams are not
+// supported, as in memcached.
+func (pp *PacketProcessor) HandlePacket(request []byte, local net.Addr, remote net.Addr, write func([]byte) error) {
+	if len(request) < udpHeaderSize {
+		counters[udpErrors].Add(1)
+		return
+	}
+	id := binary.BigEndian.Uint16(request[0:2])
+	seq := binary.BigEndian.Uint16(request[2:4])
+	total := binary.BigEndian.Uint16(request[4:6])
+	counters[udpRequests].Add(1)
+
+	var response []byte
+	if seq != 0 || total != 1 {
+		counters[udpErrors].Add(1)
+		response = []byte("SERVER_ERROR multi-packet request not supported\r\n")
+	} else {
+		response = pp.run(request[udpHeaderSize:], local, remote)
+	}
+
+	const payload = udpMaxDatagram - udpHeaderSize
+	count := (len(response) + payload - 1) / payload
+	if count > 0xffff {
+		response = []byte("SERVER_ERROR object too large for UDP\r\n")
+		count = 1
+	}
+
+	datagram := make([]byte, 0, udpMaxDatagram)
+	for i := 0; i < count; i++ {
+		datagram = binary.BigEndian.AppendUint16(datagram[:0], id)
+		datagram = binary.BigEndian.AppendUint16(datagram, uint16(i))
+		datagram = binary.BigEndian.AppendUint16(datagram, uint16(count))
+		datagram = binary.BigEndian.AppendUint16(datagram, 0)
+		datagram = append(datagram, response[i*payload:min((i+1)*payload, len(response))]...)
+		if err := write(datagram); err != nil {
+			slog.Debug("UDP response failed", "client", remote, "error", err)
+			return
+		}
+		counters[udpResponses].Add(1)
+	}
+}
+
+// run process text commands of payload, command with error stops processing
+// as it would close TCP connection
+func (pp *PacketProcessor) run(payload []byte, local net.Addr, remote net.Addr) []byte {
+	ctx := pp.ctx
+	pp.conn.reset(payload, local, remote)
+	ctx.rb.Reset(countingReader{pp.conn})
+	ctx.wb.Reset(countingWriter{pp.conn})
+	// Datagram must authenticate on its own
+	ctx.authGen = 0
+
+	for {
+		magic, err := ctx.rb.ReadByte()
+		if err != nil {
+			break
+		}
+		ctx.rb.UnreadByte()
+		if magic >= 0x80 {
+			ctx.sendServerError("binary protocol is not supported over UDP")
+			break
+		}
+		if err := pp.execute(); err != nil {
+			break
+		}
+	}
+	ctx.wb.Flush()
+
+	return pp.conn.response.Bytes()
+}
+
+// execute run one command, panic of malformed request fails only its datagram,
+// as there is no connection to close
+func (pp *PacketProcessor) execute() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			counters[udpErrors].Add(1)
+			slog.Error("UDP request failed", "client", pp.conn.remote, "panic", r)
+			err = pp.ctx.sendServerError("internal error")
+		}
+	}()
+
+	return pp.ctx.execute(pp.ctx.CommandAscii)
+}
+
+// packetConn is connection of one datagram for processor, reads return
+// request payload and writes collect response
+type packetConn struct {
+	request  bytes.Reader
+	response bytes.Buffer
+	local    net.Addr
+	remote   net.Addr
+}
+
+func (c *packetConn) reset(payload []byte, local net.Addr, remote net.Addr) {
+	c.request.Reset(payload)
+	c.response.Reset()
+	c.local = local
+	c.remote = remote
+}
+
+func (c *packetConn) Read(p []byte) (int, error)         { return c.request.Read(p) }
+func (c *packetConn) Write(p []byte) (int, error)        { return c.response.Write(p) }
+func (c *packetConn) Close() error                       { return nil }
+func (c *packetConn) LocalAddr() net.Addr                { return c.local }
+func (c *packetConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *packetConn) SetDeadline(t time.Time) error      { return nil }
+func (c *packetConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *packetConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,118 @@
+package memcachedprotocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"nefelim4ag/go-memcached-server/memstore"
+	"net"
+	"strings"
+	"testing"
+)
+
+// udpCall send request with frame header to processor, returns response datagrams
+func udpCall(t *testing.T, pp *PacketProcessor, id uint16, seq uint16, total uint16, payload string) [][]byte {
+	t.Helper()
+
+	request := binary.BigEndian.AppendUint16(nil, id)
+	request = binary.BigEndian.AppendUint16(request, seq)
+	request = binary.BigEndian.AppendUint16(request, total)
+	request = binary.BigEndian.AppendUint16(request, 0)
+	request = append(request, payload...)
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 11211}
+	datagrams := [][]byte{}
+	pp.HandlePacket(request, addr, addr, func(datagram []byte) error {
+		datagrams = append(datagrams, bytes.Clone(datagram))
+		return nil
+	})
+
+	return datagrams
+}
+
+// udpResponse check frame headers and join payloads of response datagrams
+func udpResponse(t *testing.T, id uint16, datagrams [][]byte) string {
+	t.Helper()
+
+	response := []byte{}
+	for i, datagram := range datagrams {
+		if len(datagram) > udpMaxDatagram {
+			t.Fatalf("Datagram %d is over max size: %d", i, len(datagram))
+		}
+		header := []uint16{id, uint16(i), uint16(len(datagrams)), 0}
+		for j, expected := range header {
+			if got := binary.BigEndian.Uint16(datagram[j*2:]); got != expected {
+				t.Fatalf("Datagram %d header field %d: expected %d, got %d", i, j, expected, got)
+			}
+		}
+		response = append(response, datagram[udpHeaderSize:]...)
+	}
+
+	return string(response)
+}
+
+func TestUDPRequests(t *testing.T) {
+	store := memstore.NewSharedStore()
+	store.SetMemoryLimit(64 * 1024 * 1024)
+	pp := NewPacketProcessor(store, nil)
+	requests, responses, errors := counters[udpRequests].Load(), counters[udpResponses].Load(), counters[udpErrors].Load()
+
+	if response := udpResponse(t, 1, udpCall(t, pp, 1, 0, 1, "set a 0 0 1\r\nx\r\nget a b\r\n")); response != "STORED\r\nVALUE a 0 1\r\nx\r\nEND\r\n" {
+		t.Fatalf("Unexpected response %q", response)
+	}
+	if datagrams := udpCall(t, pp, 2, 0, 1, "set b 0 0 1 noreply\r\ny\r\n"); len(datagrams) != 0 {
+		t.Fatalf("Expected no response for noreply, got %q", datagrams)
+	}
+
+	// Large value is split over datagrams
+	value := strings.Repeat("v", 5000)
+	udpCall(t, pp, 3, 0, 1, "set large 0 0 5000\r\n"+value+"\r\n")
+	datagrams := udpCall(t, pp, 0xfffe, 0, 1, "get large\r\n")
+	if len(datagrams) != 4 {
+		t.Fatalf("Expected 4 datagrams, got %d", len(datagrams))
+	}
+	if response := udpResponse(t, 0xfffe, datagrams); response != "VALUE large 0 5000\r\n"+value+"\r\nEND\r\n" {
+		t.Fatalf("Unexpected large response of %d bytes", len(response))
+	}
+
+	// Commands after quit and replication are not run
+	if response := udpResponse(t, 4, udpCall(t, pp, 4, 0, 1, "get a\r\nquit\r\nget a\r\n")); response != "VALUE a 0 1\r\nx\r\nEND\r\n" {
+		t.Fatalf("Expected one value response, got %q", response)
+	}
+	if response := udpResponse(t, 5, udpCall(t, pp, 5, 0, 1, "replicate\r\n")); !strings.HasPrefix(response, "CLIENT_ERROR") {
+		t.Fatalf("Expected replication rejected, got %q", response)
+	}
+
+	if response := udpResponse(t, 7, udpCall(t, pp, 7, 0, 1, "set k\r\nincr k\r\n")); response != "ERROR\r\nERROR\r\n" {
+		t.Fatalf("Expected errors for short commands, got %q", response)
+	}
+	if response := udpResponse(t, 6, udpCall(t, pp, 6, 0, 2, "get a\r\n")); response != "SERVER_ERROR multi-packet request not supported\r\n" {
+		t.Fatalf("Expected multi-packet error, got %q", response)
+	}
+	pp.HandlePacket([]byte{0, 1}, nil, nil, func([]byte) error {
+		t.Fatal("Unexpected response to short datagram")
+		return nil
+	})
+
+	if n := counters[udpRequests].Load() - requests; n != 8 {
+		t.Fatalf("Expected 8 UDP requests, got %d", n)
+	}
+	if n := counters[udpResponses].Load() - responses; n != 10 {
+		t.Fatalf("Expected 10 UDP response datagrams, got %d", n)
+	}
+	if n := counters[udpErrors].Load() - errors; n != 2 {
+		t.Fatalf("Expected 2 UDP errors, got %d", n)
+	}
+}
+
+func TestUDPRequestPanic(t *testing.T) {
+	// Processor without store panics on any command
+	pp := NewPacketProcessor(nil, nil)
+	errors := counters[udpErrors].Load()
+
+	if response := udpResponse(t, 1, udpCall(t, pp, 1, 0, 1, "get a\r\nget b\r\n")); response != "SERVER_ERROR internal error\r\n" {
+		t.Fatalf("Expected internal error, got %q", response)
+	}
+	if n := counters[udpErrors].Load() - errors; n != 1 {
+		t.Fatalf("Expected 1 UDP error, got %d", n)
+	}
+}
@@ -0,0 +1,441 @@
+package memstore
+
+import (
+	"errors"
+	"hash/crc32"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// Extstore defaults, as memcached ext_page_size and ext_item_size
+const (
+	extDefaultSegmentSize = 64 * 1024 * 1024
+	extMinSegments        = 8
+	extDefaultItemSize    = 512
+)
+
+// Segments kept free by background maintenance, last free segment is reserved for compaction
+const (
+	extFreeSegments    = 2
+	extReservedSegment = 1
+)
+
+var (
+	ErrExtFull    = errors.New("extstore is full")
+	ErrExtLost    = errors.New("extstore segment was reused")
+	ErrExtCorrupt = errors.New("extstore value checksum mismatch")
+)
+
+type (
+	// ExtstoreConfig is external storage tier settings
+	ExtstoreConfig struct {
+		Path        string
+		Size        int64 // file size, split to segments
+		SegmentSize int64 // 0 picks default, reduced to have at least extMinSegments segments
+		ItemSize    int   // minimal value size moved to file
+	}
+
+	// extStore keep values of evicted items in file split to fixed segments,
+	// values are appended to active segment, segment is reused once all its
+	// values are dead, moved to other segment by compaction or evicted
+	extStore struct {
+		f           *os.File
+		path        string
+		segmentSize int64
+		itemSize    int
+
+		lock     sync.Mutex
+		segments []*extSegment
+		free     []int
+		active   int    // segment values are appended to, -1 if none
+		sealSeq  uint64 // order of sealed segments, oldest is evicted first
+		recycle  sync.RWMutex
+		maintain sync.Mutex // one segment is freed at time
+
+		objectsWritten  atomic.Uint64
+		objectsRead     atomic.Uint64
+		objectsEvicted  atomic.Uint64
+		bytesWritten    atomic.Uint64
+		bytesRead       atomic.Uint64
+		segmentReclaims atomic.Uint64
+		segmentEvicts   atomic.Uint64
+		compactRescues  atomic.Uint64
+		compactLost     atomic.Uint64
+		ioErrors        atomic.Uint64
+	}
+
+	// extSegment is part of file, protected by extStore lock, gen is changed under recycle lock
+	extSegment struct {
+		gen    uint64 // incremented on reuse, stale locations are detected by it
+		used   int64  // append offset
+		live   int64  // bytes of alive values
+		items  int
+		sealed uint64 // seal sequence, 0 for free and active segments
+		owners []extOwner
+	}
+
+	// extOwner is key of value written to segment, to move it out on compaction
+	extOwner struct {
+		key    string
+		offset int64
+	}
+
+	// extItem is location of item value in file, item keeps Size
+	extItem struct {
+		segment uint32
+		gen     uint64
+		offset  int64
+		crc     uint32
+	}
+
+	// ExtstoreStats is external storage usage, as memcached extstore stats
+	ExtstoreStats struct {
+		Enabled         bool
+		LimitBytes      int64
+		SegmentSize     int64
+		ItemSize        int
+		PagesUsed       int
+		PagesFree       int
+		ObjectsUsed     int64
+		BytesUsed       int64
+		BytesFragmented int64
+		ObjectsWritten  uint64
+		ObjectsRead     uint64
+		ObjectsEvicted  uint64
+		BytesWritten    uint64
+		BytesRead       uint64
+		PageReclaims    uint64
+		PageEvictions   uint64
+		CompactRescues  uint64
+		CompactLost     uint64
+		IOErrors        uint64
+	}
+)
+
+// EnableExtstore create external storage file, values of items above item size are
+// written to it instead of being evicted. File content is not kept between restarts.
+func (s *SharedStore) EnableExtstore(config ExtstoreConfig) error {
+	segmentSize := config.SegmentSize
+	if segmentSize <= 0 {
+		segmentSize = extDefaultSegmentSize
+	}
+	segmentSize = min(segmentSize, config.Size/extMinSegments)
+	if segmentSize < slabPageSize {
+		return errors.New("extstore size is too small")
+	}
+	itemSize := config.ItemSize
+	if itemSize <= 0 {
+		itemSize = extDefaultItemSize
+	}
+
+	f, err := os.OpenFile(config.Path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	count := int(config.Size / segmentSize)
+	if err := f.Truncate(int64(count) * segmentSize); err != nil {
+		f.Close()
+		return err
+	}
+
+	x := &extStore{f: f, path: config.Path, segmentSize: segmentSize, itemSize: itemSize, active: -1}
+	for i := 0; i < count; i++ {
+		x.segments = append(x.segments, &extSegment{})
+		x.free = append(x.free, count-1-i)
+	}
+	s.ext.Store(x)
+
+	return nil
+}
+
+// write append value of key to active segment, reserve is number of free segments
+// which can't be taken, so compaction always has segment to move values to
+func (x *extStore) write(key string, value []byte, reserve int) (*extItem, error) {
+	if int64(len(value)) > x.segmentSize {
+		return nil, ErrExtFull
+	}
+
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	if x.active < 0 || x.segments[x.active].used+int64(len(value)) > x.segmentSize {
+		if len(x.free) <= reserve {
+			return nil, ErrExtFull
+		}
+		if x.active >= 0 {
+			x.sealSeq++
+			x.segments[x.active].sealed = x.sealSeq
+		}
+		x.active = x.free[len(x.free)-1]
+		x.free = x.free[:len(x.free)-1]
+	}
+
+	seg := x.segments[x.active]
+	item := &extItem{
+		segment: uint32(x.active),
+		gen:     seg.gen,
+		offset:  seg.used,
+		crc:     crc32.Checksum(value, crc32c),
+	}
+	if _, err := x.f.WriteAt(value, int64(x.active)*x.segmentSize+seg.used); err != nil {
+		x.ioErrors.Add(1)
+		return nil, err
+	}
+
+	seg.used += int64(len(value))
+	seg.live += int64(len(value))
+	seg.items++
+	seg.owners = append(seg.owners, extOwner{key: key, offset: item.offset})
+	x.objectsWritten.Add(1)
+	x.bytesWritten.Add(uint64(len(value)))
+	return item, nil
+}
+
+// read load value from file, ErrExtLost if its segment was reused meanwhile
+func (x *extStore) read(item *extItem, size uint32) ([]byte, error) {
+	x.recycle.RLock()
+	defer x.recycle.RUnlock()
+
+	x.lock.Lock()
+	gen := x.segments[item.segment].gen
+	x.lock.Unlock()
+	if gen != item.gen {
+		return nil, ErrExtLost
+	}
+
+	value := make([]byte, size)
+	if _, err := x.f.ReadAt(value, int64(item.segment)*x.segmentSize+item.offset); err != nil {
+		x.ioErrors.Add(1)
+		return nil, err
+	}
+	if crc32.Checksum(value, crc32c) != item.crc {
+		x.ioErrors.Add(1)
+		return nil, ErrExtCorrupt
+	}
+
+	x.objectsRead.Add(1)
+	x.bytesRead.Add(uint64(size))
+	return value, nil
+}
+
+// release account value as dead, called when item is deleted or replaced
+func (x *extStore) release(item *extItem, size uint32) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	seg := x.segments[item.segment]
+	if seg.gen != item.gen {
+		return
+	}
+	seg.live -= int64(size)
+	seg.items--
+}
+
+// reclaim return segment to free list, stale readers see generation change
+func (x *extStore) reclaim(id int) {
+	x.recycle.Lock()
+	defer x.recycle.Unlock()
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	seg := x.segments[id]
+	*seg = extSegment{gen: seg.gen + 1}
+	x.free = append(x.free, id)
+	x.segmentReclaims.Add(1)
+}
+
+// victim pick sealed segment to free: without alive values, fragmented one
+// to compact or oldest one to evict
+func (x *extStore) victim() (id int, owners []extOwner, compact bool, ok bool) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	if len(x.free) >= extFreeSegments {
+		return 0, nil, false, false
+	}
+
+	sparse, oldest := -1, -1
+	for i, seg := range x.segments {
+		if seg.sealed == 0 {
+			continue
+		}
+		if sparse < 0 || seg.live < x.segments[sparse].live {
+			sparse = i
+		}
+		if oldest < 0 || seg.sealed < x.segments[oldest].sealed {
+			oldest = i
+		}
+	}
+	if sparse < 0 {
+		return 0, nil, false, false
+	}
+
+	// Alive values of fragmented segment fit to reserved segment
+	if x.segments[sparse].live*2 <= x.segmentSize {
+		return sparse, x.segments[sparse].owners, true, true
+	}
+	return oldest, x.segments[oldest].owners, false, true
+}
+
+// spill move value of evicted item to extstore, returns item with value pointer
+// or nil if value must be evicted, must be called under bucket lock of the key and evictLock
+func (s *SharedStore) spill(old *MEntry) *MEntry {
+	x := s.ext.Load()
+	if x == nil || old.ext != nil || int(old.Size) < x.itemSize || !s.alive(old) {
+		return nil
+	}
+
+	item, err := x.write(old.Key, old.Value[:old.Size], extReservedSegment)
+	if err != nil {
+		if err != ErrExtFull {
+			slog.Error("memstore - extstore write", "error", err)
+		}
+		return nil
+	}
+
+	// Item header moves to large class, value memory is freed
+	class := old.chunk.class
+	s.addFootprint(old, -1)
+	s.evictionPolicy(class).Remove(old.node)
+	s.freeValue(old)
+
+	spilled := *old
+	spilled.Value = nil
+	spilled.chunk = slabChunk{}
+	spilled.ext = item
+	spilled.node = s.evictionPolicy(slabLargeClass).Insert(old.Key)
+	s.addFootprint(&spilled, 1)
+
+	// Headers take quota of class values are spilled from, else large class evicts them
+	src, large := s.slabs.classes[class], s.slabs.classes[slabLargeClass]
+	if src != large && large.usage.Load() > large.quota.Load() {
+		take := min(src.quota.Load(), s.quotaUnit())
+		src.quota.Add(-take)
+		large.quota.Add(take)
+	}
+	return &spilled
+}
+
+// loadValue return copy of item with value read from extstore, item itself if value is in memory
+func (s *SharedStore) loadValue(e *MEntry) (*MEntry, error) {
+	x := s.ext.Load()
+	if e.ext == nil || x == nil {
+		return e, nil
+	}
+
+	value, err := x.read(e.ext, e.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := *e
+	loaded.Value = value
+	loaded.origin = e
+	return &loaded, nil
+}
+
+// rangeValue return item found by map walk with value loaded, value moved by
+// compaction meanwhile is looked up again
+func (s *SharedStore) rangeValue(key string, e *MEntry) (*MEntry, bool) {
+	loaded, err := s.loadValue(e)
+	if err == ErrExtLost {
+		return s.Peek(key)
+	}
+
+	return loaded, err == nil
+}
+
+// extMaintain keep free segments for new values, called by crawler
+func (s *SharedStore) extMaintain() {
+	x := s.ext.Load()
+	if x == nil {
+		return
+	}
+
+	x.maintain.Lock()
+	defer x.maintain.Unlock()
+
+	for {
+		id, owners, compact, ok := x.victim()
+		if !ok {
+			return
+		}
+
+		for _, owner := range owners {
+			s.extMove(x, id, owner, compact)
+		}
+		if compact {
+			slog.Debug("memstore - extstore segment compacted", "segment", id)
+		} else {
+			x.segmentEvicts.Add(1)
+			slog.Debug("memstore - extstore segment evicted", "segment", id)
+		}
+		x.reclaim(id)
+	}
+}
+
+// extMove move value of owner out of segment, or evict item if segment is evicted
+func (s *SharedStore) extMove(x *extStore, id int, owner extOwner, compact bool) {
+	s.coolmap.Compute(owner.key, func(old *MEntry, loaded bool) *MEntry {
+		if !loaded || old.ext == nil || int(old.ext.segment) != id || old.ext.offset != owner.offset {
+			return old
+		}
+
+		if compact && s.alive(old) {
+			value, err := x.read(old.ext, old.Size)
+			if err == nil {
+				var item *extItem
+				if item, err = x.write(old.Key, value, 0); err == nil {
+					moved := *old
+					moved.ext = item
+					x.compactRescues.Add(1)
+					return &moved
+				}
+			}
+			x.compactLost.Add(1)
+		}
+
+		s.account(old, nil)
+		x.objectsEvicted.Add(1)
+		return nil
+	})
+}
+
+// ExtstoreStats return external storage usage
+func (s *SharedStore) ExtstoreStats() ExtstoreStats {
+	x := s.ext.Load()
+	if x == nil {
+		return ExtstoreStats{}
+	}
+
+	stats := ExtstoreStats{
+		Enabled:        true,
+		LimitBytes:     int64(len(x.segments)) * x.segmentSize,
+		SegmentSize:    x.segmentSize,
+		ItemSize:       x.itemSize,
+		ObjectsWritten: x.objectsWritten.Load(),
+		ObjectsRead:    x.objectsRead.Load(),
+		ObjectsEvicted: x.objectsEvicted.Load(),
+		BytesWritten:   x.bytesWritten.Load(),
+		BytesRead:      x.bytesRead.Load(),
+		PageReclaims:   x.segmentReclaims.Load(),
+		PageEvictions:  x.segmentEvicts.Load(),
+		CompactRescues: x.compactRescues.Load(),
+		CompactLost:    x.compactLost.Load(),
+		IOErrors:       x.ioErrors.Load(),
+	}
+
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	stats.PagesFree = len(x.free)
+	stats.PagesUsed = len(x.segments) - len(x.free)
+	for _, seg := range x.segments {
+		stats.ObjectsUsed += int64(seg.items)
+		stats.BytesUsed += seg.live
+		stats.BytesFragmented += seg.used - seg.live
+	}
+
+	return stats
+}
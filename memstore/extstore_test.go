@@ -0,0 +1,107 @@
+package memstore
+
+import (
+	"bytes"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func newExtTestStore(t *testing.T, size int64) *SharedStore {
+	s := NewSharedStore()
+	s.SetMemoryLimit(4 * 1024 * 1024)
+	err := s.EnableExtstore(ExtstoreConfig{
+		Path:        filepath.Join(t.TempDir(), "extstore"),
+		Size:        size,
+		SegmentSize: 1024 * 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func extValue(i int) []byte {
+	return bytes.Repeat([]byte{byte(i)}, 50*1024)
+}
+
+func setExtItems(s *SharedStore, items int) {
+	for i := 0; i < items; i++ {
+		key := "key:" + strconv.Itoa(i)
+		s.Set(key, &MEntry{Key: key, Value: extValue(i), Size: uint32(len(extValue(i)))})
+	}
+}
+
+func TestExtstoreSpill(t *testing.T) {
+	s := newExtTestStore(t, 16*1024*1024)
+	// Twice the memory limit, nothing is lost
+	setExtItems(s, 160)
+
+	if s.ExtstoreStats().ObjectsWritten == 0 {
+		t.Fatal("Expected values written to extstore")
+	}
+	if s.Stats().Evictions != 0 {
+		t.Fatalf("Expected no evictions, got %d", s.Stats().Evictions)
+	}
+	for i := 0; i < 160; i++ {
+		e, ok := s.Get("key:" + strconv.Itoa(i))
+		if !ok || !bytes.Equal(e.Value[:e.Size], extValue(i)) {
+			t.Fatalf("Item %d is not read back", i)
+		}
+	}
+
+	// Changes of spilled item work on its value and move it back to memory
+	if _, err := s.Touch("key:0", s.ExpTime(100)); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := s.coolmap.Get("key:0"); e.ext != nil || !bytes.Equal(e.Value[:e.Size], extValue(0)) {
+		t.Fatal("Touched item is not moved back to memory")
+	}
+	used := s.ExtstoreStats().ObjectsUsed
+	s.Delete("key:1")
+	if s.ExtstoreStats().ObjectsUsed != used-1 {
+		t.Fatal("Deleted value is not released")
+	}
+}
+
+func TestExtstoreCompaction(t *testing.T) {
+	s := newExtTestStore(t, 8*1024*1024)
+	// Crawler maintenance waits till values are deleted
+	x := s.ext.Load()
+	x.maintain.Lock()
+	// Ten times the memory limit, extstore is full and evicts
+	setExtItems(s, 800)
+
+	// Three of four values in each segment are dead, fragmented segments are compacted
+	dead, kept := []string{}, []string{}
+	s.coolmap.Range(func(key string, e *MEntry) bool {
+		if e.ext != nil {
+			if e.ext.offset/int64(len(extValue(0)))%4 != 0 {
+				dead = append(dead, key)
+			} else {
+				kept = append(kept, key)
+			}
+		}
+		return true
+	})
+	for _, key := range dead {
+		s.Delete(key)
+	}
+	if len(kept) == 0 {
+		t.Fatal("Expected spilled items")
+	}
+
+	x.maintain.Unlock()
+	s.extMaintain()
+	stats := s.ExtstoreStats()
+	if stats.PagesFree < extFreeSegments || stats.PageEvictions != 0 || stats.CompactRescues == 0 {
+		t.Fatalf("Expected segments compacted, got %+v", stats)
+	}
+
+	for _, key := range kept {
+		i, _ := strconv.Atoi(key[len("key:"):])
+		if e, ok := s.Get(key); !ok || !bytes.Equal(e.Value[:e.Size], extValue(i)) {
+			t.Fatalf("Item %d is lost by compaction", i)
+		}
+	}
+}
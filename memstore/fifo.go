@@ -0,0 +1,54 @@
+package memstore
+
+import "sync"
+
+// fifo evict keys in insertion order, access is ignored
+type fifo struct {
+	lock  sync.Mutex
+	queue policyList
+}
+
+func newFIFO() *fifo {
+	f := &fifo{}
+	f.queue.init()
+
+	return f
+}
+
+func (f *fifo) Insert(key string) *policyNode {
+	n := newPolicyNode(key)
+
+	f.lock.Lock()
+	f.queue.pushFront(n, segCold)
+	f.lock.Unlock()
+
+	return n
+}
+
+func (f *fifo) Remove(n *policyNode) {
+	f.lock.Lock()
+	if n.linked {
+		f.queue.unlink(n)
+	}
+	f.lock.Unlock()
+}
+
+func (f *fifo) Victim() *policyNode {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	n := f.queue.tail()
+	if n != nil {
+		f.queue.unlink(n)
+	}
+	return n
+}
+
+func (f *fifo) Stats() PolicyStats {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return PolicyStats{Policy: "fifo", NumberCold: uint64(f.queue.len)}
+}
+
+func (f *fifo) ResetStats() {}
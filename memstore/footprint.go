@@ -0,0 +1,48 @@
+package memstore
+
+import (
+	"math/bits"
+	"unsafe"
+)
+
+// allocSize return approximate size of Go heap allocation of n bytes,
+// runtime rounds small objects to size classes with up to 12.5% waste
+func allocSize(n int) int64 {
+	switch {
+	case n == 0:
+		return 0
+	case n <= 16:
+		return int64(n+7) &^ 7
+	case n <= 256:
+		return int64(n+15) &^ 15
+	}
+
+	step := 1 << (bits.Len(uint(n-1)) - 3)
+	return int64((n + step - 1) &^ (step - 1))
+}
+
+// itemOverhead return memory of item besides key and value: entry header,
+// eviction policy node and share of index, old entry versions waiting for GC are not counted
+func (s *SharedStore) itemOverhead() int64 {
+	return allocSize(int(unsafe.Sizeof(MEntry{}))) +
+		allocSize(int(unsafe.Sizeof(policyNode{}))) +
+		int64(s.coolmap.EntryOverhead())
+}
+
+// footprint return logical bytes of item, key and value, and estimated physical bytes,
+// value is accounted by slab chunk size, entry must have its value allocated by store
+func (s *SharedStore) footprint(e *MEntry) (logical int64, physical int64) {
+	logical = int64(len(e.Key)) + int64(e.Size)
+	physical = s.overhead + allocSize(len(e.Key))
+
+	switch {
+	case e.ext != nil:
+		physical += allocSize(int(unsafe.Sizeof(extItem{})))
+	case e.chunk.class != slabLargeClass:
+		physical += int64(s.slabs.classes[e.chunk.class].size)
+	default:
+		physical += allocSize(len(e.Value))
+	}
+
+	return logical, physical
+}
@@ -0,0 +1,71 @@
+package memstore
+
+import (
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestAllocSize(t *testing.T) {
+	for _, tc := range [][2]int64{{0, 0}, {1, 8}, {9, 16}, {17, 32}, {250, 256}, {257, 320}, {1000, 1024}, {1025, 1280}} {
+		if size := allocSize(int(tc[0])); size != tc[1] {
+			t.Fatalf("Expected alloc size of %d to be %d, got %d", tc[0], tc[1], size)
+		}
+	}
+}
+
+func TestMemoryAccounting(t *testing.T) {
+	s := newTestStore()
+
+	s.Set("foo", &MEntry{Key: "foo", Value: []byte("bar"), Size: 3})
+	s.Set("foo", &MEntry{Key: "foo", Value: make([]byte, 1000), Size: 1000})
+	s.Touch("foo", 100)
+	s.Set("cnt", &MEntry{Key: "cnt", Value: []byte("9"), Size: 1})
+	s.Incr("cnt", 1)
+	s.Set("large", &MEntry{Key: "large", Value: make([]byte, slabMaxChunk+1), Size: slabMaxChunk + 1})
+	s.Set("empty", &MEntry{Key: "empty"})
+
+	logical := int64(3+1000) + int64(3+2) + int64(5+slabMaxChunk+1) + int64(5)
+	if s.logical.Load() != logical {
+		t.Fatalf("Expected %d logical bytes, got %d", logical, s.logical.Load())
+	}
+	if s.size.Load() < logical+4*s.overhead {
+		t.Fatalf("Physical size %d is less than logical %d with overhead", s.size.Load(), logical)
+	}
+
+	for _, key := range []string{"foo", "cnt", "large", "empty"} {
+		s.Delete(key)
+	}
+	if s.size.Load() != 0 || s.logical.Load() != 0 {
+		t.Fatalf("Expected empty store, got size %d logical %d", s.size.Load(), s.logical.Load())
+	}
+}
+
+// Estimated size must be close to real heap usage, so memory limit holds
+func TestMemoryAccountingMatchesHeap(t *testing.T) {
+	const items = 50000
+	keys := make([]string, items)
+	for i := range keys {
+		keys[i] = "key:" + strconv.Itoa(i)
+	}
+	value := make([]byte, 100)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	s := newTestStore()
+	for _, key := range keys {
+		s.Set(key, &MEntry{Key: key, Value: value, Size: uint32(len(value))})
+	}
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	heap := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	estimated := s.size.Load()
+	runtime.KeepAlive(s)
+
+	if estimated < heap*3/4 || estimated > heap*5/4 {
+		t.Fatalf("Estimated size %d is too far from heap growth %d", estimated, heap)
+	}
+}
@@ -0,0 +1,102 @@
+package memstore
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// Number of keys compared to pick least frequently used one, as in redis
+const lfuSamples = 8
+
+// sampledLFU evict least frequently used key among random samples.
+// Hits are halved each time number of inserts reaches number of keys,
+// so old popularity fades away.
+type sampledLFU struct {
+	lock    sync.Mutex
+	nodes   []*policyNode
+	inserts int
+	rnd     *rand.Rand
+}
+
+func newSampledLFU() *sampledLFU {
+	return &sampledLFU{rnd: rand.New(rand.NewSource(1))}
+}
+
+func (l *sampledLFU) Insert(key string) *policyNode {
+	n := newPolicyNode(key)
+	// New key must not lose to keys which were never read again
+	n.hits.Store(1)
+
+	l.lock.Lock()
+	n.index = len(l.nodes)
+	n.linked = true
+	l.nodes = append(l.nodes, n)
+
+	l.inserts++
+	if l.inserts >= len(l.nodes) {
+		l.inserts = 0
+		l.age()
+	}
+	l.lock.Unlock()
+
+	return n
+}
+
+// age halve hits of all keys, must hold lock
+func (l *sampledLFU) age() {
+	for _, n := range l.nodes {
+		for {
+			hits := n.hits.Load()
+			if n.hits.CompareAndSwap(hits, hits/2) {
+				break
+			}
+		}
+	}
+}
+
+// unlink remove node by swapping it with last one, must hold lock
+func (l *sampledLFU) unlink(n *policyNode) {
+	last := l.nodes[len(l.nodes)-1]
+	l.nodes[n.index] = last
+	last.index = n.index
+	l.nodes[len(l.nodes)-1] = nil
+	l.nodes = l.nodes[:len(l.nodes)-1]
+	n.linked = false
+}
+
+func (l *sampledLFU) Remove(n *policyNode) {
+	l.lock.Lock()
+	if n.linked {
+		l.unlink(n)
+	}
+	l.lock.Unlock()
+}
+
+func (l *sampledLFU) Victim() *policyNode {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if len(l.nodes) == 0 {
+		return nil
+	}
+
+	victim := l.nodes[l.rnd.Intn(len(l.nodes))]
+	for i := 1; i < lfuSamples && i < len(l.nodes); i++ {
+		n := l.nodes[l.rnd.Intn(len(l.nodes))]
+		if n.hits.Load() < victim.hits.Load() {
+			victim = n
+		}
+	}
+	l.unlink(victim)
+
+	return victim
+}
+
+func (l *sampledLFU) Stats() PolicyStats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return PolicyStats{Policy: "lfu", NumberCold: uint64(len(l.nodes))}
+}
+
+func (l *sampledLFU) ResetStats() {}
@@ -0,0 +1,148 @@
+package memstore
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// LRU segments, as in memcached segmented LRU
+const (
+	segHot int8 = iota
+	segWarm
+	segCold
+	segCount
+)
+
+// Share of items in hot and warm segments, percent
+const (
+	hotPercent  = 20
+	warmPercent = 40
+)
+
+// segmentedLRU is hot/warm/cold LRU, new items go to hot, cold tail is evicted.
+// Access only counts hits, items are moved lazily on segment tail.
+type segmentedLRU struct {
+	lock sync.Mutex
+	segs [segCount]policyList
+
+	movesToCold    atomic.Uint64
+	movesToWarm    atomic.Uint64
+	movesWithinLRU atomic.Uint64
+}
+
+func newSegmentedLRU() *segmentedLRU {
+	l := &segmentedLRU{}
+	for i := range l.segs {
+		l.segs[i].init()
+	}
+
+	return l
+}
+
+// move relink node to segment head, must hold lock
+func (l *segmentedLRU) move(n *policyNode, seg int8) {
+	l.segs[n.seg].unlink(n)
+	l.segs[seg].pushFront(n, seg)
+}
+
+// Insert add new key at hot head
+func (l *segmentedLRU) Insert(key string) *policyNode {
+	n := newPolicyNode(key)
+
+	l.lock.Lock()
+	l.segs[segHot].pushFront(n, segHot)
+	l.balance()
+	l.lock.Unlock()
+
+	return n
+}
+
+// Remove drop node from LRU, safe to call for already unlinked node
+func (l *segmentedLRU) Remove(n *policyNode) {
+	l.lock.Lock()
+	if n.linked {
+		l.segs[n.seg].unlink(n)
+	}
+	l.lock.Unlock()
+}
+
+// balance move overflowed hot and warm tails down, must hold lock
+func (l *segmentedLRU) balance() {
+	total := l.segs[segHot].len + l.segs[segWarm].len + l.segs[segCold].len
+
+	for l.segs[segHot].len > total*hotPercent/100 {
+		n := l.segs[segHot].tail()
+		if n.hits.Swap(0) > 0 {
+			l.move(n, segWarm)
+			l.movesToWarm.Add(1)
+		} else {
+			l.move(n, segCold)
+			l.movesToCold.Add(1)
+		}
+	}
+
+	// Active warm items stay in warm, bounded by warm size
+	for i := l.segs[segWarm].len; i > 0 && l.segs[segWarm].len > total*warmPercent/100; i-- {
+		n := l.segs[segWarm].tail()
+		if n.hits.Swap(0) > 0 {
+			l.move(n, segWarm)
+			l.movesWithinLRU.Add(1)
+		} else {
+			l.move(n, segCold)
+			l.movesToCold.Add(1)
+		}
+	}
+	for l.segs[segWarm].len > total*warmPercent/100 {
+		l.move(l.segs[segWarm].tail(), segCold)
+		l.movesToCold.Add(1)
+	}
+}
+
+// Victim unlink and return eviction candidate, active cold items get second chance in warm
+func (l *segmentedLRU) Victim() *policyNode {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for {
+		n := l.segs[segCold].tail()
+		if n == nil {
+			// Cold is empty, e.g. few items, take from upper segments
+			if n = l.segs[segWarm].tail(); n == nil {
+				n = l.segs[segHot].tail()
+			}
+			if n != nil {
+				l.segs[n.seg].unlink(n)
+			}
+			return n
+		}
+
+		if n.hits.Swap(0) == 0 {
+			l.segs[segCold].unlink(n)
+			return n
+		}
+		l.move(n, segWarm)
+		l.movesToWarm.Add(1)
+		l.balance()
+	}
+}
+
+func (l *segmentedLRU) Stats() PolicyStats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return PolicyStats{
+		Policy:         "lru",
+		NumberHot:      uint64(l.segs[segHot].len),
+		NumberWarm:     uint64(l.segs[segWarm].len),
+		NumberCold:     uint64(l.segs[segCold].len),
+		MovesToCold:    l.movesToCold.Load(),
+		MovesToWarm:    l.movesToWarm.Load(),
+		MovesWithinLRU: l.movesWithinLRU.Load(),
+	}
+}
+
+func (l *segmentedLRU) ResetStats() {
+	l.movesToCold.Store(0)
+	l.movesToWarm.Store(0)
+	l.movesWithinLRU.Store(0)
+}
@@ -1,63 +1,142 @@
 package memstore
 
 import (
-	"fmt"
+	"errors"
+	"nefelim4ag/go-memcached-server/metrics"
 	"nefelim4ag/go-memcached-server/recursemap"
-	"runtime"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
 
 	"log/slog"
 )
 
-// Overhead size cost accounting for values
-const mEntrySize = 44
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrExists     = errors.New("exists")
+	ErrNotNumeric = errors.New("cannot increment or decrement non-numeric value")
+	ErrTooLarge   = errors.New("object too large for cache")
+	ErrReadOnly   = errors.New("replica is read-only")
+)
 
 type (
 	// SharedStore is
 	SharedStore struct {
-		storeSizeLimit int64
-		itemSizeLimit  int32
+		storeSizeLimit atomic.Int64
+		itemSizeLimit  atomic.Int32
+
+		count    atomic.Int64
+		size     atomic.Int64  // estimated physical bytes of items, it is checked against memory limit
+		logical  atomic.Int64  // bytes of keys and values
+		overhead int64         // physical bytes of item besides key and value
+		casSrc   atomic.Uint64 // cas source monotonically increasing
+
+		flushLock    sync.Mutex
+		flushed      atomic.Int64 // items stored before it are invalid, unix micro
+		pendingFlush atomic.Int64 // delayed flush time, unix micro
+		ctime        atomic.Int64 // coarse clock, unix seconds
+
+		stats     storeStats
+		policies  atomic.Pointer[[]evictionPolicy] // by size class
+		evictLock sync.Mutex                       // one evictor at time, so none returns while other is mid eviction
+		slabs     *slabAllocator
+		quotaPool atomic.Int64 // memory limit not assigned to size classes
+		automove  atomic.Int32
+		moveState automoveState
+		snapshots snapshotter
+		oplog     atomic.Pointer[opLog]    // nil unless durable mode is enabled
+		ext       atomic.Pointer[extStore] // nil unless external storage is enabled
+		repl      replication
+		onChange  atomic.Pointer[func(key string, deleted bool)] // client change hook, nil if unset
 
-		count  atomic.Int64
-		size   atomic.Int64
-		casSrc atomic.Uint64 // cas source monotonically increasing
+		coolmap *recursemap.NodeType[MEntry]
+	}
 
-		flush     int64
-		ctime     int64
-		ValuePool sync.Pool
+	// storeStats is store internal counters
+	storeStats struct {
+		totalItems       atomic.Uint64
+		getExpired       atomic.Uint64
+		getFlushed       atomic.Uint64
+		evictions        atomic.Uint64
+		evictedUnfetched atomic.Uint64
+		expiredUnfetched atomic.Uint64
+		reclaimed        atomic.Uint64
+		crawlerReclaimed atomic.Uint64
+	}
 
-		coolmap *recursemap.NodeType[MEntry]
+	// Stats is snapshot of store counters
+	Stats struct {
+		CurrItems        uint64
+		TotalItems       uint64
+		Bytes            uint64 // estimated physical memory of items
+		LogicalBytes     uint64 // keys and values only
+		LimitMaxbytes    uint64
+		GetExpired       uint64
+		GetFlushed       uint64
+		Evictions        uint64
+		EvictedUnfetched uint64
+		ExpiredUnfetched uint64
+		Reclaimed        uint64
+		CrawlerReclaimed uint64
+		PolicyStats
+	}
+
+	// ItemStats is items of one slab class, as memcached stats items,
+	// large and empty values are class 0
+	ItemStats struct {
+		Class            int
+		Number           uint64
+		Age              int64 // seconds since access of least recently used item
+		Evicted          uint64
+		EvictedUnfetched uint64
+		ExpiredUnfetched uint64
+		Reclaimed        uint64
+		CrawlerReclaimed uint64
+		PolicyStats
 	}
 
 	// MEntry is base memcached record
 	MEntry struct {
 		Flags   [4]byte
-		ExpTime uint32
+		ExpTime int64 // absolute unix time, 0 means never expire
 		Size    uint32
 		Cas     uint64
 		Key     string
 		Value   []byte
 
-		atime int64
+		// Meta protocol item state
+		Stale     bool // invalidated, but still served until recache
+		TokenSent bool // recache win token was handed to a client
+
+		atime   int64 // last access time, unix micro
+		stime   int64 // store time, unix micro
+		fetched bool
+		node    *policyNode
+		chunk   slabChunk
+		ext     *extItem // value location in extstore, Value is nil
+		origin  *MEntry  // stored entry of copy with value loaded from extstore
 	}
 )
 
 // NewSharedStore init a new SharedStore
 func NewSharedStore() *SharedStore {
 	S := SharedStore{
-		flush: time.Now().UnixMicro(),
-		ctime: time.Now().Unix(),
-		ValuePool: sync.Pool{
-			New: func() interface{} {
-				b := make([]byte, 8)
-				return &b
-			},
-		},
 		coolmap: recursemap.NewRecurseMap[MEntry](),
+		slabs:   newSlabAllocator(),
 	}
+	S.overhead = S.itemOverhead()
+	S.automove.Store(AutomoveSustained)
+	policies := make([]evictionPolicy, len(S.slabs.classes))
+	for i := range policies {
+		policies[i] = newSegmentedLRU()
+	}
+	S.policies.Store(&policies)
+
+	S.ctime.Store(time.Now().Unix())
 
+	go S.clock()
 	go S.LRUCrawler()
 
 	return &S
@@ -65,124 +144,872 @@ func NewSharedStore() *SharedStore {
 
 // Set set or update value in shared store
 func (s *SharedStore) Set(key string, entry *MEntry) error {
-	if s.itemSizeLimit > 0 && s.itemSizeLimit < int32(entry.Size) {
-		return fmt.Errorf("SERVER_ERROR object too large for cache")
+	entry.Cas = 0
+	_, err := s.Update(key, func(old *MEntry) (*MEntry, error) {
+		return entry, nil
+	})
+
+	return err
+}
+
+// SetKeepCas set or update value in shared store with cas provided by caller,
+// it restores items, so read-only mode does not apply
+func (s *SharedStore) SetKeepCas(key string, entry *MEntry) error {
+	_, err := s.update(key, func(old *MEntry) (*MEntry, error) {
+		return entry, nil
+	})
+
+	return err
+}
+
+// Add store entry only if key is missing
+func (s *SharedStore) Add(key string, entry *MEntry) error {
+	entry.Cas = 0
+	_, err := s.Update(key, func(old *MEntry) (*MEntry, error) {
+		if old != nil {
+			return nil, ErrExists
+		}
+		return entry, nil
+	})
+
+	return err
+}
+
+// Replace store entry only if key is present
+func (s *SharedStore) Replace(key string, entry *MEntry) error {
+	entry.Cas = 0
+	_, err := s.Update(key, func(old *MEntry) (*MEntry, error) {
+		if old == nil {
+			return nil, ErrNotFound
+		}
+		return entry, nil
+	})
+
+	return err
+}
+
+// CompareAndSwap store entry only if current entry cas is equal to cas
+func (s *SharedStore) CompareAndSwap(key string, entry *MEntry, cas uint64) error {
+	entry.Cas = 0
+	_, err := s.Update(key, func(old *MEntry) (*MEntry, error) {
+		if old == nil {
+			return nil, ErrNotFound
+		}
+		if old.Cas != cas {
+			return nil, ErrExists
+		}
+		return entry, nil
+	})
+
+	return err
+}
+
+// Touch atomically update entry expiration time, value and cas are kept as is
+func (s *SharedStore) Touch(key string, exptime int64) (*MEntry, error) {
+	return s.Update(key, func(old *MEntry) (*MEntry, error) {
+		if old == nil {
+			return nil, ErrNotFound
+		}
+
+		touched := *old
+		touched.ExpTime = exptime
+		return &touched, nil
+	})
+}
+
+// Incr atomically increment numeric value, saturate on overflow
+func (s *SharedStore) Incr(key string, delta uint64) (uint64, *MEntry, error) {
+	return s.incrDecr(key, delta, true)
+}
+
+// Decr atomically decrement numeric value, stops at zero
+func (s *SharedStore) Decr(key string, delta uint64) (uint64, *MEntry, error) {
+	return s.incrDecr(key, delta, false)
+}
+
+func (s *SharedStore) incrDecr(key string, delta uint64, incr bool) (uint64, *MEntry, error) {
+	var value uint64
+	e, err := s.Update(key, func(old *MEntry) (*MEntry, error) {
+		if old == nil {
+			return nil, ErrNotFound
+		}
+		v, err := strconv.ParseUint(string(old.Value[:old.Size]), 10, 64)
+		if err != nil {
+			return nil, ErrNotNumeric
+		}
+
+		value = ApplyDelta(v, delta, incr)
+		entry := &MEntry{
+			Key:     key,
+			Flags:   old.Flags,
+			ExpTime: old.ExpTime,
+			Value:   strconv.AppendUint(nil, value, 10),
+		}
+		entry.Size = uint32(len(entry.Value))
+		return entry, nil
+	})
+
+	return value, e, err
+}
+
+// ApplyDelta incr saturate on overflow, decr stops at zero
+func ApplyDelta(value uint64, delta uint64, incr bool) uint64 {
+	const MaxUint = ^uint64(0)
+
+	if incr {
+		if MaxUint-value < delta {
+			return MaxUint
+		}
+		return value + delta
+	}
+
+	if value < delta {
+		return 0
+	}
+	return value - delta
+}
+
+// Update atomically replace entry by fn result, fn gets nil if key is missing or expired
+// Returned entry is stored, nil deletes key, same entry keeps it as is,
+// on error nothing changes. New entries with zero Cas get next cas value.
+func (s *SharedStore) Update(key string, fn func(old *MEntry) (*MEntry, error)) (*MEntry, error) {
+	if s.repl.readOnly.Load() {
+		return nil, ErrReadOnly
+	}
+
+	hook := s.onChange.Load()
+	if hook == nil {
+		return s.update(key, fn)
+	}
+
+	// Hook sees changes of value, copies of item with same value, e.g. on touch, are skipped
+	var changed, deleted bool
+	result, err := s.update(key, func(old *MEntry) (*MEntry, error) {
+		entry, err := fn(old)
+		changed = err == nil && entry != old && (old == nil || entry == nil || !sameValue(old, entry))
+		deleted = entry == nil
+		return entry, err
+	})
+	if err == nil && changed {
+		(*hook)(key, deleted)
+	}
+
+	return result, err
+}
+
+// SetChangeHook set function called after key is changed or deleted by client,
+// changes applied by Invalidate, replication and restore are not reported
+func (s *SharedStore) SetChangeHook(hook func(key string, deleted bool)) {
+	if hook == nil {
+		s.onChange.Store(nil)
+		return
+	}
+	s.onChange.Store(&hook)
+}
+
+// Invalidate delete key changed on other node, returns whether key was present
+func (s *SharedStore) Invalidate(key string) bool {
+	var present bool
+	s.update(key, func(old *MEntry) (*MEntry, error) {
+		present = old != nil
+		return nil, nil
+	})
+
+	return present
+}
+
+func sameValue(a *MEntry, b *MEntry) bool {
+	return a.Size == b.Size && len(a.Value) > 0 && len(b.Value) > 0 && unsafe.SliceData(a.Value) == unsafe.SliceData(b.Value)
+}
+
+// update is Update of replicated and restored changes, read-only mode does not apply
+func (s *SharedStore) update(key string, fn func(old *MEntry) (*MEntry, error)) (*MEntry, error) {
+	var fnErr error
+
+	result, _ := s.coolmap.Compute(key, func(current *MEntry, loaded bool) *MEntry {
+		var old *MEntry
+		if loaded && s.alive(current) {
+			old = current
+		}
+		dead := loaded && old == nil
+
+		// Value of item in extstore is loaded for fn, unreadable value is a miss
+		view := old
+		if old != nil && old.ext != nil {
+			var err error
+			if view, err = s.loadValue(old); err != nil {
+				old, view, dead = nil, nil, true
+			}
+		}
+
+		entry, err := fn(view)
+		if err != nil {
+			fnErr = err
+			return current
+		}
+		if entry == view {
+			entry = old
+		}
+
+		if entry != nil && entry != old {
+			if limit := s.itemSizeLimit.Load(); limit > 0 && limit < int32(entry.Size) {
+				fnErr = ErrTooLarge
+				return current
+			}
+			// Changed copy of item with loaded value goes back to memory
+			entry.ext, entry.origin = nil, nil
+
+			if entry.Cas == 0 {
+				entry.Cas = s.casSrc.Add(1)
+			} else {
+				s.bumpCas(entry.Cas)
+			}
+			entry.atime = time.Now().UnixMicro()
+			// Copies of old entry keep store time, e.g. on touch
+			if entry.stime == 0 {
+				entry.stime = entry.atime
+				// Item stored in same microsecond as flush must survive it
+				if f := s.flushed.Load(); entry.stime <= f {
+					entry.stime = f + 1
+				}
+				s.stats.totalItems.Add(1)
+			}
+			// Memory of dead item reused by new one
+			if dead {
+				s.countReclaimed(current)
+			}
+		}
+
+		s.account(current, entry)
+		return entry
+	})
+
+	if fnErr != nil {
+		return nil, fnErr
+	}
+
+	if l := s.oplog.Load(); l != nil {
+		l.commit()
+	}
+
+	// Evict after bucket lock is released, eviction deletes keys
+	if result != nil {
+		s.evict(s.slabs.classes[result.chunk.class])
 	}
 
-	entry.atime = time.Now().UnixMicro()
+	return result, nil
+}
 
-	if s.size.Load() > s.storeSizeLimit {
-		s.unsafeEvictItem()
+// bumpCas keep cas source ahead of externally provided cas values
+func (s *SharedStore) bumpCas(cas uint64) {
+	for {
+		current := s.casSrc.Load()
+		if current >= cas || s.casSrc.CompareAndSwap(current, cas) {
+			return
+		}
 	}
-	s.casSrc.Add(1)
-	entry.Cas = s.casSrc.Load()
-	old, ok := s.coolmap.Set(key, entry)
-	if !ok {
+}
+
+// account update counters, LRU and slab memory on entry replace, must be called under bucket lock
+func (s *SharedStore) account(old *MEntry, entry *MEntry) {
+	switch {
+	case old == entry:
+	case old == nil:
 		s.count.Add(1)
-		s.size.Add(int64(entry.Size) + mEntrySize)
-	} else {
-		s.ValuePool.Put(&old.Value)
-		s.size.Add(int64(entry.Size) - int64(old.Size))
+		s.allocValue(entry)
+		entry.node = s.evictionPolicy(entry.chunk.class).Insert(entry.Key)
+		s.addFootprint(entry, 1)
+	case entry == nil:
+		s.count.Add(-1)
+		s.addFootprint(old, -1)
+		s.evictionPolicy(old.chunk.class).Remove(old.node)
+		s.freeValue(old)
+	default:
+		s.addFootprint(old, -1)
+		// Copy of old entry, e.g. on touch, keeps its value memory
+		if len(entry.Value) > 0 && len(old.Value) > 0 && unsafe.SliceData(entry.Value) == unsafe.SliceData(old.Value) {
+			entry.chunk = old.chunk
+		} else {
+			s.freeValue(old)
+			s.allocValue(entry)
+		}
+		// New version of key keeps policy position, unless it moved to other size class
+		if entry.chunk.class == old.chunk.class {
+			entry.node = old.node
+		} else {
+			s.evictionPolicy(old.chunk.class).Remove(old.node)
+			entry.node = s.evictionPolicy(entry.chunk.class).Insert(entry.Key)
+		}
+		s.addFootprint(entry, 1)
 	}
 
-	return nil
+	if old != nil && old.ext != nil && (entry == nil || entry.ext != old.ext) {
+		if x := s.ext.Load(); x != nil {
+			x.release(old.ext, old.Size)
+		}
+	}
+	if l := s.oplog.Load(); l != nil && old != entry {
+		l.appendEntry(old, entry)
+	}
+	if old != entry && s.repl.feeding() {
+		s.repl.appendEntry(old, entry)
+	}
+}
+
+// addFootprint add or subtract item bytes from store and its size class
+func (s *SharedStore) addFootprint(e *MEntry, sign int64) {
+	logical, physical := s.footprint(e)
+	s.logical.Add(sign * logical)
+	s.size.Add(sign * physical)
+
+	c := s.slabs.classes[e.chunk.class]
+	c.usage.Add(sign * physical)
+	c.items.Add(sign)
+}
+
+// allocValue move entry value to slab memory, caller buffer can be reused after store
+func (s *SharedStore) allocValue(e *MEntry) {
+	e.chunk = slabChunk{}
+	if e.Size == 0 {
+		e.Value = []byte{}
+		return
+	}
+	e.Value, e.chunk = s.slabs.Alloc(e.Key, e.Value[:e.Size])
+}
+
+// freeValue retire entry value memory, it is reused once pinned readers are gone
+func (s *SharedStore) freeValue(e *MEntry) {
+	if len(e.Value) == 0 {
+		return
+	}
+	s.slabs.Free(e.Value, e.chunk)
+}
+
+// Pin protect values of entries returned by store from reuse until Unpin,
+// readers must not hold entries for long, it delays memory reuse
+func (s *SharedStore) Pin() uint64 {
+	return s.slabs.epochs.pin()
+}
+
+// Unpin release token returned by Pin
+func (s *SharedStore) Unpin(token uint64) {
+	s.slabs.epochs.unpin(token)
+}
+
+// SlabStats return per class slab usage and allocator totals
+func (s *SharedStore) SlabStats() ([]SlabStats, SlabTotals) {
+	a := s.slabs
+	a.spareLock.Lock()
+	spare := len(a.spare)
+	a.spareLock.Unlock()
+
+	return a.Stats(), SlabTotals{
+		TotalMalloced:     a.totalMalloced.Load(),
+		LargeItems:        a.largeItems.Load(),
+		LargeBytes:        a.largeBytes.Load(),
+		LargeQuota:        a.classes[slabLargeClass].quota.Load(),
+		QuotaPool:         s.quotaPool.Load(),
+		SparePages:        spare,
+		PagesMoved:        a.pagesMoved.Load(),
+		Rescues:           a.rescues.Load(),
+		ReassignEvictions: a.reassignEvict.Load(),
+		Automove:          int(s.automove.Load()),
+	}
 }
 
 // Get return current value from store
 func (s *SharedStore) Get(key string) (value *MEntry, ok bool) {
-	e, ok := s.coolmap.Get(key)
+	e, ok := s.Peek(key)
 	if ok {
-		if s.flush > e.atime {
+		s.Bump(e)
+		return e, ok
+	}
+
+	return nil, false
+}
+
+// Longest expiration time treated as offset from now, as in memcached
+const maxRelativeExpTime = 60 * 60 * 24 * 30
+
+// ExpTime convert client exptime to absolute unix time
+// Up to 30 days it is relative offset, above it is absolute unix time,
+// negative values means already expired
+func (s *SharedStore) ExpTime(exptime int64) int64 {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return -1
+	case exptime <= maxRelativeExpTime:
+		return s.ctime.Load() + exptime
+	}
+
+	return exptime
+}
+
+// TTL return remaining entry time to live in seconds, -1 means never expire
+func (s *SharedStore) TTL(e *MEntry) int64 {
+	if e.ExpTime == 0 {
+		return -1
+	}
+
+	ttl := e.ExpTime - s.ctime.Load()
+	if ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
+// Now return store clock in unix seconds
+func (s *SharedStore) Now() int64 {
+	return s.ctime.Load()
+}
+
+func (s *SharedStore) clock() {
+	for {
+		time.Sleep(time.Second)
+		s.ctime.Store(time.Now().Unix())
+	}
+}
+
+// Peek return current value from store without access time update
+func (s *SharedStore) Peek(key string) (value *MEntry, ok bool) {
+	// Value in extstore can be moved by compaction meanwhile, item is loaded again
+	for i := 0; i < 3; i++ {
+		e, ok := s.coolmap.Get(key)
+		if !ok {
 			return nil, false
 		}
-		if e.ExpTime > 0 && s.ctime > int64(e.ExpTime) {
-			return nil, false
+
+		switch {
+		case s.flushedEntry(e):
+			s.stats.getFlushed.Add(1)
+		case s.expired(e):
+			s.stats.getExpired.Add(1)
+		default:
+			loaded, err := s.loadValue(e)
+			if err == ErrExtLost {
+				continue
+			}
+			if err != nil {
+				slog.Error("memstore - extstore read", "key", key, "error", err)
+				return nil, false
+			}
+			return loaded, true
 		}
 
-		// Dirty hacky test of update items concurently =(
-		e.atime = time.Now().UnixMicro()
-		value := e
-		return value, ok
+		return nil, false
 	}
 
 	return nil, false
 }
 
-func (s *SharedStore) Delete(key string) {
-	s.unsafeDelete(key)
+// alive check entry is not expired or flushed
+func (s *SharedStore) alive(e *MEntry) bool {
+	return !s.flushedEntry(e) && !s.expired(e)
+}
+
+// flushedEntry check entry was stored before flush
+func (s *SharedStore) flushedEntry(e *MEntry) bool {
+	if e.stime <= s.flushed.Load() {
+		return true
+	}
+	p := s.pendingFlush.Load()
+
+	return p != 0 && e.stime <= p && p <= time.Now().UnixMicro()
+}
+
+// expired check entry exptime passed
+func (s *SharedStore) expired(e *MEntry) bool {
+	return e.ExpTime != 0 && e.ExpTime <= s.ctime.Load()
+}
+
+// Bump mark entry as fetched and update access time
+func (s *SharedStore) Bump(e *MEntry) {
+	if e.origin != nil {
+		e = e.origin
+	}
+	// Dirty hacky test of update items concurently =(
+	e.atime = time.Now().UnixMicro()
+	e.fetched = true
+	if e.node != nil {
+		e.node.hits.Add(1)
+	}
+}
+
+// Fetched report whether entry was read since it was stored
+func (e *MEntry) Fetched() bool {
+	return e.fetched
+}
+
+// LastAccess return last access time in unix seconds
+func (e *MEntry) LastAccess() int64 {
+	return e.atime / int64(time.Second/time.Microsecond)
+}
+
+// SlabClass return slab class of value, 0 for large and empty values
+func (e *MEntry) SlabClass() int {
+	return int(e.chunk.class)
+}
+
+// Delete remove key from store, returns removed entry
+func (s *SharedStore) Delete(key string) (*MEntry, bool) {
+	var deleted *MEntry
+	s.Update(key, func(old *MEntry) (*MEntry, error) {
+		deleted = old
+		return nil, nil
+	})
+
+	return deleted, deleted != nil
+}
+
+// remove delete key of replicated and restored changes
+func (s *SharedStore) remove(key string) {
+	s.update(key, func(old *MEntry) (*MEntry, error) {
+		return nil, nil
+	})
+}
+
+// Flush invalidate all items stored before now plus delay, delay is exptime like
+func (s *SharedStore) Flush(delay int64) {
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+
+	now := time.Now().UnixMicro()
+	at := now
+	if delay > 0 {
+		at = s.ExpTime(delay) * int64(time.Second/time.Microsecond)
+	}
+
+	s.flushAt(now, at)
+	if l := s.oplog.Load(); l != nil {
+		l.appendFlush(at)
+		l.commit()
+	}
+	if s.repl.feeding() {
+		s.repl.appendFlush(at)
+	}
+}
+
+// flushAt invalidate items stored before at, unix micro, must hold flushLock
+func (s *SharedStore) flushAt(now int64, at int64) {
+	s.promoteFlush(now)
+	if at <= now {
+		if at > s.flushed.Load() {
+			s.flushed.Store(at)
+		}
+		return
+	}
+
+	s.pendingFlush.Store(at)
 }
 
-func (s *SharedStore) Flush() {
-	s.flush = time.Now().UnixMicro()
+// promoteFlush make delayed flush permanent once its time passed, must hold flushLock
+func (s *SharedStore) promoteFlush(now int64) {
+	p := s.pendingFlush.Load()
+	if p != 0 && p <= now {
+		if p > s.flushed.Load() {
+			s.flushed.Store(p)
+		}
+		s.pendingFlush.Store(0)
+	}
 }
 
+// SetMemoryLimit set store limit, on shrink class quotas are reduced proportionally
 func (s *SharedStore) SetMemoryLimit(limit int64) {
-	s.storeSizeLimit = limit
+	s.evictLock.Lock()
+	defer s.evictLock.Unlock()
+
+	old := s.storeSizeLimit.Swap(limit)
+	assigned := int64(0)
+	for _, c := range s.slabs.classes {
+		if limit < old && limit > 0 {
+			c.quota.Store(c.quota.Load() * limit / old)
+		}
+		assigned += c.quota.Load()
+	}
+	s.quotaPool.Store(limit - assigned)
 }
 
+// SetItemSizeLimit set max item size, stored items above new limit are kept
 func (s *SharedStore) SetItemSizeLimit(limit int32) {
-	s.itemSizeLimit = limit
+	s.itemSizeLimit.Store(limit)
 }
 
-func (s *SharedStore) unsafeDelete(k string) {
-	v, ok := s.coolmap.Delete(k)
-	if ok {
-		s.count.Add(-1)
-		s.size.Add(-(int64(v.Size) + mEntrySize))
+// SetEvictionPolicy select eviction policy by name, store must be empty
+func (s *SharedStore) SetEvictionPolicy(name string) error {
+	policies := make([]evictionPolicy, len(s.slabs.classes))
+	for i := range policies {
+		policy, err := newEvictionPolicy(name)
+		if err != nil {
+			return err
+		}
+		policies[i] = policy
+	}
+	if s.count.Load() != 0 {
+		return errors.New("eviction policy can't be changed for non empty store")
 	}
+
+	s.policies.Store(&policies)
+	return nil
 }
 
-func (s *SharedStore) tryExpireRandItem(flush int64) (expired bool) {
-	deleted := false
+// evictionPolicy return policy of size class, each class has own LRU as in memcached
+func (s *SharedStore) evictionPolicy(class uint8) evictionPolicy {
+	return (*s.policies.Load())[class]
+}
 
-	k, v := s.coolmap.ForEach()
-	if k != nil {
-		if flush > v.atime {
-			s.unsafeDelete(*k)
-			deleted = true
-		}
+// MemoryLimit return store memory limit in bytes
+func (s *SharedStore) MemoryLimit() int64 {
+	return s.storeSizeLimit.Load()
+}
+
+// ItemSizeLimit return max item size in bytes
+func (s *SharedStore) ItemSizeLimit() int32 {
+	return s.itemSizeLimit.Load()
+}
+
+// Stats return snapshot of store counters
+func (s *SharedStore) Stats() Stats {
+	return Stats{
+		CurrItems:        uint64(s.count.Load()),
+		TotalItems:       s.stats.totalItems.Load(),
+		Bytes:            uint64(s.size.Load()),
+		LogicalBytes:     uint64(s.logical.Load()),
+		LimitMaxbytes:    uint64(s.storeSizeLimit.Load()),
+		GetExpired:       s.stats.getExpired.Load(),
+		GetFlushed:       s.stats.getFlushed.Load(),
+		Evictions:        s.stats.evictions.Load(),
+		EvictedUnfetched: s.stats.evictedUnfetched.Load(),
+		ExpiredUnfetched: s.stats.expiredUnfetched.Load(),
+		Reclaimed:        s.stats.reclaimed.Load(),
+		CrawlerReclaimed: s.stats.crawlerReclaimed.Load(),
+		PolicyStats:      sumPolicyStats(*s.policies.Load()),
+	}
+}
+
+// ResetStats zero store counters, current items and bytes are kept
+func (s *SharedStore) ResetStats() {
+	s.stats.totalItems.Store(0)
+	s.stats.getExpired.Store(0)
+	s.stats.getFlushed.Store(0)
+	s.stats.evictions.Store(0)
+	s.stats.evictedUnfetched.Store(0)
+	s.stats.expiredUnfetched.Store(0)
+	s.stats.reclaimed.Store(0)
+	s.stats.crawlerReclaimed.Store(0)
+	for _, policy := range *s.policies.Load() {
+		policy.ResetStats()
 	}
+}
+
+// Sizes return histogram of item sizes rounded up to 32 bytes, as memcached stats sizes
+func (s *SharedStore) Sizes() map[uint64]uint64 {
+	sizes := map[uint64]uint64{}
+	s.coolmap.Range(func(key string, value *MEntry) bool {
+		if s.alive(value) {
+			_, size := s.footprint(value)
+			sizes[(uint64(size)+31)/32*32]++
+		}
+		return true
+	})
 
-	return deleted
+	return sizes
 }
 
-func (s *SharedStore) unsafeEvictItem() {
-	_, v := s.coolmap.ForEach()
-	oldest := *v
-	for i := 0; i < 1024; i++ {
-		_, v = s.coolmap.ForEach()
-		if v.atime < oldest.atime {
-			oldest = *v
+// ItemStats return item stats of slab classes with items
+func (s *SharedStore) ItemStats() []ItemStats {
+	oldest := make([]int64, len(s.slabs.classes))
+	s.coolmap.Range(func(key string, value *MEntry) bool {
+		if c := value.chunk.class; s.alive(value) && (oldest[c] == 0 || value.atime < oldest[c]) {
+			oldest[c] = value.atime
 		}
+		return true
+	})
+
+	var stats []ItemStats
+	for _, c := range s.slabs.classes {
+		items := c.items.Load()
+		if items <= 0 {
+			continue
+		}
+		age := int64(0)
+		if oldest[c.id] > 0 {
+			age = s.Now() - oldest[c.id]/int64(time.Second/time.Microsecond)
+		}
+		stats = append(stats, ItemStats{
+			Class:            c.id,
+			Number:           uint64(items),
+			Age:              age,
+			Evicted:          c.evicted.Load(),
+			EvictedUnfetched: c.evictedUnfetched.Load(),
+			ExpiredUnfetched: c.expiredUnfetched.Load(),
+			Reclaimed:        c.reclaimed.Load(),
+			CrawlerReclaimed: c.crawlerReclaimed.Load(),
+			PolicyStats:      s.evictionPolicy(uint8(c.id)).Stats(),
+		})
 	}
 
-	s.unsafeDelete(oldest.Key)
+	return stats
+}
+
+// reclaimFlushed delete all flushed items, returns number of deleted items
+func (s *SharedStore) reclaimFlushed() int {
+	reclaimed := 0
+	s.coolmap.Range(func(key string, value *MEntry) bool {
+		if s.alive(value) {
+			return true
+		}
+
+		// Recheck under lock, key can be set again concurrently
+		s.coolmap.Compute(key, func(old *MEntry, loaded bool) *MEntry {
+			if !loaded || s.alive(old) {
+				return old
+			}
+			s.account(old, nil)
+			c := s.slabs.classes[old.chunk.class]
+			if !old.fetched && s.expired(old) {
+				s.stats.expiredUnfetched.Add(1)
+				c.expiredUnfetched.Add(1)
+			}
+			c.crawlerReclaimed.Add(1)
+			reclaimed++
+			return nil
+		})
+		return true
+	})
+
+	return reclaimed
+}
+
+// evictNode delete key of LRU victim, dead items are accounted as reclaimed
+func (s *SharedStore) evictNode(n *policyNode) {
+	s.coolmap.Compute(n.key, func(old *MEntry, loaded bool) *MEntry {
+		// Key was deleted and stored again with new LRU node
+		if !loaded || old.node != n {
+			return old
+		}
+
+		// Large value is moved to extstore instead of eviction
+		if spilled := s.spill(old); spilled != nil {
+			return spilled
+		}
+
+		s.account(old, nil)
+		switch {
+		case !s.alive(old):
+			s.countReclaimed(old)
+		default:
+			c := s.slabs.classes[old.chunk.class]
+			s.stats.evictions.Add(1)
+			c.evicted.Add(1)
+			if !old.fetched {
+				s.stats.evictedUnfetched.Add(1)
+				c.evictedUnfetched.Add(1)
+			}
+		}
+		return nil
+	})
+}
+
+// countReclaimed count dead item which memory is freed or reused
+func (s *SharedStore) countReclaimed(e *MEntry) {
+	c := s.slabs.classes[e.chunk.class]
+	s.stats.reclaimed.Add(1)
+	c.reclaimed.Add(1)
+	if !e.fetched && s.expired(e) {
+		s.stats.expiredUnfetched.Add(1)
+		c.expiredUnfetched.Add(1)
+	}
 }
 
 func (s *SharedStore) LRUCrawler() {
-	last_flush := s.flush
+	last_flush := s.flushed.Load()
 
 	for {
-		s.ctime = time.Now().Unix()
+		s.flushLock.Lock()
+		s.promoteFlush(time.Now().UnixMicro())
+		s.flushLock.Unlock()
 
-		if last_flush < s.flush {
-			flushExpired := 0
-			for i := 0; i < int(s.count.Load()); i++ {
-				if s.tryExpireRandItem(s.flush) {
-					flushExpired++
-				}
-			}
+		if last_flush < s.flushed.Load() {
+			last_flush = s.flushed.Load()
+			flushExpired := s.reclaimFlushed()
+			s.stats.crawlerReclaimed.Add(uint64(flushExpired))
 
 			slog.Info("memstore - flushed", "expired", flushExpired, "total", s.count.Load())
-			last_flush = s.flush
-			runtime.GC()
 		}
 
-		sizeLimit := s.storeSizeLimit
-		if sizeLimit > 0 && s.size.Load() > sizeLimit {
-			s.unsafeEvictItem()
+		s.slabs.Reclaim()
+		s.trimSlabs()
+
+		// Memory limit can be lowered at runtime
+		for _, c := range s.slabs.classes {
+			s.evict(c)
 		}
+		s.automoveTick()
+		s.extMaintain()
 
 		time.Sleep(time.Second)
 	}
 }
+
+// WriteMetrics is metrics collector of store counters
+func (s *SharedStore) WriteMetrics(w *metrics.Writer) {
+	stats := s.Stats()
+	w.Gauge("memcached_current_items", "Current number of items stored.", float64(stats.CurrItems))
+	w.Gauge("memcached_current_bytes", "Current number of bytes used to store items.", float64(stats.Bytes))
+	w.Gauge("memcached_current_logical_bytes", "Current number of bytes of item keys and values.", float64(stats.LogicalBytes))
+	w.Gauge("memcached_limit_bytes", "Number of bytes this server is allowed to use for storage.", float64(stats.LimitMaxbytes))
+	w.Counter("memcached_items_total", "Total number of items stored.", stats.TotalItems)
+	w.Counter("memcached_items_evicted_total", "Number of valid items removed from cache to free memory.", stats.Evictions)
+	w.Counter("memcached_items_evicted_unfetched_total", "Number of evicted items which were never fetched.", stats.EvictedUnfetched)
+	w.Counter("memcached_items_expired_unfetched_total", "Number of expired items which were never fetched.", stats.ExpiredUnfetched)
+	w.Counter("memcached_items_reclaimed_total", "Number of times an entry was stored using memory from an expired entry.", stats.Reclaimed)
+	w.Counter("memcached_items_crawler_reclaimed_total", "Number of items freed by LRU crawler.", stats.CrawlerReclaimed)
+	w.Counter("memcached_get_expired_total", "Number of get requests for expired items.", stats.GetExpired)
+	w.Counter("memcached_get_flushed_total", "Number of get requests for flushed items.", stats.GetFlushed)
+
+	_, slabs := s.SlabStats()
+	w.Counter("memcached_slabs_moved_total", "Number of quota pages moved between slab classes.", slabs.PagesMoved)
+	w.Counter("memcached_slab_reassign_rescues_total", "Number of items moved out of released slab pages.", slabs.Rescues)
+	w.Counter("memcached_slab_reassign_evictions_total", "Number of items evicted because slab class quota was moved.", slabs.ReassignEvictions)
+
+	snapshots := s.SnapshotStats()
+	w.Counter("memcached_snapshots_total", "Number of successful snapshots.", snapshots.Count)
+	w.Counter("memcached_snapshot_failures_total", "Number of failed snapshots.", snapshots.Failures)
+	w.Gauge("memcached_snapshot_last_timestamp_seconds", "Time of last successful snapshot.", float64(snapshots.LastTime))
+	w.Gauge("memcached_snapshot_last_duration_seconds", "Duration of last successful snapshot.", snapshots.LastDuration.Seconds())
+	w.Gauge("memcached_snapshot_last_bytes", "Size of last successful snapshot.", float64(snapshots.LastBytes))
+
+	oplog := s.OpLogStats()
+	w.Gauge("memcached_oplog_bytes", "Size of operation log.", float64(oplog.Bytes))
+	w.Counter("memcached_oplog_records_total", "Number of records appended to operation log.", oplog.Records)
+	w.Counter("memcached_oplog_rewrites_total", "Number of operation log compactions.", oplog.Compactions)
+
+	repl := s.ReplicationStats()
+	w.Gauge("memcached_repl_connected_replicas", "Number of connected replicas.", float64(repl.Replicas))
+	w.Gauge("memcached_repl_backlog_bytes", "Bytes of changes not yet sent to replicas.", float64(repl.BacklogBytes))
+	w.Counter("memcached_repl_full_syncs_total", "Number of snapshots sent to replicas.", repl.FullSyncs)
+	if repl.Primary != "" {
+		up := 0.0
+		if repl.LinkUp {
+			up = 1
+		}
+		w.Gauge("memcached_repl_link_up", "Whether replica is connected to primary.", up)
+		w.Gauge("memcached_repl_lag_seconds", "Time since last primary heartbeat was applied by replica.", repl.Lag.Seconds())
+		w.Counter("memcached_repl_records_applied_total", "Number of primary changes applied by replica.", repl.RecordsApplied)
+	}
+
+	if ext := s.ExtstoreStats(); ext.Enabled {
+		w.Gauge("memcached_extstore_bytes_used", "Bytes of alive values in extstore.", float64(ext.BytesUsed))
+		w.Gauge("memcached_extstore_bytes_fragmented", "Bytes of dead values in extstore segments.", float64(ext.BytesFragmented))
+		w.Gauge("memcached_extstore_objects_used", "Number of alive values in extstore.", float64(ext.ObjectsUsed))
+		w.Gauge("memcached_extstore_pages_free", "Number of free extstore segments.", float64(ext.PagesFree))
+		w.Counter("memcached_extstore_objects_written_total", "Number of values written to extstore.", ext.ObjectsWritten)
+		w.Counter("memcached_extstore_objects_read_total", "Number of values read from extstore.", ext.ObjectsRead)
+		w.Counter("memcached_extstore_objects_evicted_total", "Number of values evicted from extstore.", ext.ObjectsEvicted)
+		w.Counter("memcached_extstore_bytes_written_total", "Bytes written to extstore.", ext.BytesWritten)
+		w.Counter("memcached_extstore_bytes_read_total", "Bytes read from extstore.", ext.BytesRead)
+		w.Counter("memcached_extstore_io_errors_total", "Number of extstore read and write errors.", ext.IOErrors)
+	}
+}
@@ -0,0 +1,267 @@
+package memstore
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestStore() *SharedStore {
+	s := NewSharedStore()
+	s.SetMemoryLimit(64 * 1024 * 1024)
+	return s
+}
+
+func TestConcurrentIncr(t *testing.T) {
+	s := newTestStore()
+	s.Set("cnt", &MEntry{Key: "cnt", Value: []byte("0"), Size: 1})
+
+	const workers = 16
+	const iterations = 1000
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				if _, _, err := s.Incr("cnt", 1); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	e, ok := s.Get("cnt")
+	if !ok {
+		t.Fatal("Key cnt not found")
+	}
+	if v, _ := strconv.Atoi(string(e.Value)); v != workers*iterations {
+		t.Fatalf("Expected %d, got %d", workers*iterations, v)
+	}
+}
+
+func TestConcurrentAdd(t *testing.T) {
+	s := newTestStore()
+
+	var stored sync.Map
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := s.Add("foo", &MEntry{Key: "foo", Value: []byte("bar"), Size: 3})
+			if err == nil {
+				stored.Store(i, true)
+			} else if err != ErrExists {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	winners := 0
+	stored.Range(func(k, v any) bool {
+		winners++
+		return true
+	})
+	if winners != 1 {
+		t.Fatalf("Expected exactly one successful add, got %d", winners)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	s := newTestStore()
+
+	if err := s.CompareAndSwap("foo", &MEntry{Key: "foo"}, 1); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+
+	e := &MEntry{Key: "foo", Value: []byte("bar"), Size: 3}
+	s.Set("foo", e)
+	if err := s.CompareAndSwap("foo", &MEntry{Key: "foo"}, e.Cas+1); err != ErrExists {
+		t.Fatalf("Expected ErrExists, got %v", err)
+	}
+
+	swapped := &MEntry{Key: "foo", Value: []byte("baz"), Size: 3}
+	if err := s.CompareAndSwap("foo", swapped, e.Cas); err != nil {
+		t.Fatal(err)
+	}
+	if swapped.Cas <= e.Cas {
+		t.Fatalf("Expected new cas greater than %d, got %d", e.Cas, swapped.Cas)
+	}
+}
+
+func TestReplaceDelete(t *testing.T) {
+	s := newTestStore()
+
+	if err := s.Replace("foo", &MEntry{Key: "foo"}); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+	if _, ok := s.Delete("foo"); ok {
+		t.Fatal("Delete of missing key reported success")
+	}
+
+	s.Set("foo", &MEntry{Key: "foo", Value: []byte("bar"), Size: 3})
+	if err := s.Replace("foo", &MEntry{Key: "foo", Value: []byte("baz"), Size: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := s.Delete("foo"); !ok || string(e.Value) != "baz" {
+		t.Fatal("Delete must return replaced entry")
+	}
+	if s.count.Load() != 0 || s.size.Load() != 0 {
+		t.Fatalf("Expected empty store, got count %d size %d", s.count.Load(), s.size.Load())
+	}
+}
+
+func TestExpTime(t *testing.T) {
+	s := newTestStore()
+	now := s.Now()
+
+	cases := []struct {
+		exptime  int64
+		expected int64
+	}{
+		{0, 0},
+		{-1, -1},
+		{60, now + 60},
+		{maxRelativeExpTime, now + maxRelativeExpTime},
+		{maxRelativeExpTime + 1, maxRelativeExpTime + 1},
+		{now + 3600, now + 3600},
+	}
+	for _, c := range cases {
+		if got := s.ExpTime(c.exptime); got != c.expected {
+			t.Errorf("ExpTime(%d): expected %d, got %d", c.exptime, c.expected, got)
+		}
+	}
+
+	alive := map[string]int64{"relative": 60, "absolute": now + 60, "never": 0}
+	expired := map[string]int64{"negative": -1, "past": now - 60}
+	for k, v := range alive {
+		s.Set(k, &MEntry{Key: k, ExpTime: s.ExpTime(v)})
+		if _, ok := s.Get(k); !ok {
+			t.Errorf("Key %s must be alive", k)
+		}
+	}
+	for k, v := range expired {
+		s.Set(k, &MEntry{Key: k, ExpTime: s.ExpTime(v)})
+		if _, ok := s.Get(k); ok {
+			t.Errorf("Key %s must be expired", k)
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	s := newTestStore()
+
+	s.Set("old", &MEntry{Key: "old"})
+	s.Flush(0)
+	// Access time must not resurrect flushed item
+	s.Get("old")
+	if _, ok := s.Get("old"); ok {
+		t.Fatal("Item stored before flush must be invalid")
+	}
+
+	s.Set("new", &MEntry{Key: "new"})
+	if _, ok := s.Get("new"); !ok {
+		t.Fatal("Item stored after flush must be valid")
+	}
+
+	if reclaimed := s.reclaimFlushed(); reclaimed != 1 {
+		t.Fatalf("Expected 1 reclaimed item, got %d", reclaimed)
+	}
+	if s.count.Load() != 1 {
+		t.Fatalf("Expected 1 item, got %d", s.count.Load())
+	}
+}
+
+func TestDelayedFlush(t *testing.T) {
+	s := newTestStore()
+
+	s.Set("foo", &MEntry{Key: "foo"})
+	s.Flush(1)
+	if _, ok := s.Get("foo"); !ok {
+		t.Fatal("Item must be valid until delayed flush")
+	}
+
+	time.Sleep(2100 * time.Millisecond)
+	if _, ok := s.Get("foo"); ok {
+		t.Fatal("Item must be invalid after delayed flush")
+	}
+
+	s.Set("bar", &MEntry{Key: "bar"})
+	s.Flush(60)
+	if _, ok := s.Get("foo"); ok {
+		t.Fatal("Later delayed flush must not resurrect flushed item")
+	}
+	if _, ok := s.Get("bar"); !ok {
+		t.Fatal("Item must be valid until delayed flush")
+	}
+}
+
+func TestEvictionKeepsMemoryLimit(t *testing.T) {
+	s := NewSharedStore()
+	const limit = 64 * 1024
+	s.SetMemoryLimit(limit)
+
+	value := make([]byte, 1000)
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		s.Set(key, &MEntry{Key: key, Value: value, Size: uint32(len(value))})
+		// Hot key is accessed between writes and must survive
+		s.Get("0")
+		if s.size.Load() > limit {
+			t.Fatalf("Store size %d is over limit %d after %d sets", s.size.Load(), limit, i+1)
+		}
+	}
+
+	if _, ok := s.Get("0"); !ok {
+		t.Fatal("Frequently accessed key must not be evicted")
+	}
+	if _, ok := s.Get("1"); ok {
+		t.Fatal("Least recently used key must be evicted")
+	}
+
+	stats := s.Stats()
+	if stats.Evictions == 0 || stats.Evictions != stats.TotalItems-stats.CurrItems {
+		t.Fatalf("Unexpected evictions %d, total %d, current %d", stats.Evictions, stats.TotalItems, stats.CurrItems)
+	}
+	if stats.NumberHot+stats.NumberWarm+stats.NumberCold != stats.CurrItems {
+		t.Fatalf("LRU segments %d/%d/%d do not match %d items", stats.NumberHot, stats.NumberWarm, stats.NumberCold, stats.CurrItems)
+	}
+}
+
+func TestEvictionConcurrent(t *testing.T) {
+	s := NewSharedStore()
+	const limit = 256 * 1024
+	s.SetMemoryLimit(limit)
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			value := make([]byte, 100)
+			for i := 0; i < 5000; i++ {
+				key := strconv.Itoa(w*5000 + i%2000)
+				s.Set(key, &MEntry{Key: key, Value: value, Size: uint32(len(value))})
+				s.Get(strconv.Itoa(w * 5000))
+				if i%7 == 0 {
+					s.Delete(key)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if s.size.Load() > limit {
+		t.Fatalf("Store size %d is over limit %d", s.size.Load(), limit)
+	}
+	stats := s.Stats()
+	if stats.NumberHot+stats.NumberWarm+stats.NumberCold != stats.CurrItems {
+		t.Fatalf("LRU segments %d/%d/%d do not match %d items", stats.NumberHot, stats.NumberWarm, stats.NumberCold, stats.CurrItems)
+	}
+}
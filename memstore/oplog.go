@@ -0,0 +1,580 @@
+package memstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Operation log file format, all numbers are little endian:
+//
+//	header: magic "GMCL", version uint32
+//	record: payload length uint32, CRC-32C of payload uint32, payload
+//
+// Payload is operation and resulting item state, so replay is idempotent:
+//
+//	set:    op 1, key length uint16, key, flags [4]byte, exptime int64, cas uint64, store time int64, value length uint32, value
+//	delete: op 2, key length uint16, key
+//	flush:  op 3, flush time unix micro int64
+const (
+	opLogMagic   = "GMCL"
+	opLogVersion = 1
+)
+
+const (
+	opSet    byte = 1
+	opDelete byte = 2
+	opFlush  byte = 3
+)
+
+// Fsync policies of operation log
+const (
+	FsyncAlways   = "always"   // fsync before reply
+	FsyncEverySec = "everysec" // write before reply, fsync every second
+	FsyncNever    = "never"    // write before reply, fsync is up to OS
+)
+
+// Log is compacted when it grows twice since last compaction and is above min size, as in redis
+const opLogCompactMinSize = 64 * 1024 * 1024
+
+var (
+	ErrBadOpLog      = errors.New("bad operation log")
+	ErrOpLogDisabled = errors.New("operation log is not enabled")
+	ErrCompactBusy   = errors.New("operation log compaction in progress")
+)
+
+type (
+	// opLog is append only log of store changes, records are appended under
+	// bucket lock of the key, so log order matches store order per key
+	opLog struct {
+		path   string
+		policy string
+
+		lock    sync.Mutex
+		f       *os.File
+		w       *bufio.Writer
+		size    int64
+		seq     uint64        // appended records
+		rewrite *bytes.Buffer // records appended during compaction, nil if not compacting
+		record  []byte
+
+		syncLock sync.Mutex
+		synced   atomic.Uint64
+
+		compactLock sync.Mutex
+		compacting  atomic.Bool
+		compactSize atomic.Int64 // size after last compaction
+		compactions atomic.Uint64
+		records     atomic.Uint64
+		bytes       atomic.Int64
+	}
+
+	// OpLogStats is operation log state
+	OpLogStats struct {
+		Enabled     bool
+		Policy      string
+		Bytes       int64
+		Records     uint64
+		Compactions uint64
+		Compacting  bool
+	}
+)
+
+// EnableOpLog replay operation log from path and append further changes to it,
+// torn record at log end, e.g. after crash, is truncated. Returns number of replayed records.
+func (s *SharedStore) EnableOpLog(path string, policy string) (int, error) {
+	switch policy {
+	case FsyncAlways, FsyncEverySec, FsyncNever:
+	default:
+		return 0, fmt.Errorf("unknown fsync policy %s", policy)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return 0, err
+	}
+
+	replayed, size, err := s.replayOpLog(f)
+	if err != nil {
+		f.Close()
+		return replayed, err
+	}
+	if size == 0 {
+		size, err = writeOpLogHeader(f)
+	} else {
+		err = f.Truncate(size)
+	}
+	if err == nil {
+		_, err = f.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return replayed, err
+	}
+
+	l := &opLog{path: path, policy: policy, f: f, w: bufio.NewWriter(f), size: size}
+	l.compactSize.Store(size)
+	l.bytes.Store(size)
+	s.oplog.Store(l)
+	go l.background(s)
+
+	return replayed, nil
+}
+
+func writeOpLogHeader(w io.Writer) (int64, error) {
+	header := append([]byte(opLogMagic), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(header[len(opLogMagic):], opLogVersion)
+	_, err := w.Write(header)
+	return int64(len(header)), err
+}
+
+// replayOpLog apply log records to store, returns size of valid log prefix, 0 for empty file
+func (s *SharedStore) replayOpLog(f *os.File) (int, int64, error) {
+	r := bufio.NewReader(f)
+	header := make([]byte, len(opLogMagic)+4)
+	if _, err := io.ReadFull(r, header); err == io.EOF {
+		return 0, 0, nil
+	} else if err != nil || string(header[:len(opLogMagic)]) != opLogMagic {
+		return 0, 0, fmt.Errorf("%w: wrong magic", ErrBadOpLog)
+	}
+	if v := binary.LittleEndian.Uint32(header[len(opLogMagic):]); v != opLogVersion {
+		return 0, 0, fmt.Errorf("%w: unsupported version %d", ErrBadOpLog, v)
+	}
+
+	size := int64(len(header))
+	replayed := 0
+	frame := make([]byte, 8)
+	var payload []byte
+	for {
+		if _, err := io.ReadFull(r, frame); err != nil {
+			if err != io.EOF {
+				slog.Warn("memstore - operation log has torn record, truncated", "offset", size)
+			}
+			return replayed, size, nil
+		}
+
+		length := binary.LittleEndian.Uint32(frame)
+		if cap(payload) < int(length) {
+			payload = make([]byte, length)
+		}
+		payload = payload[:length]
+		if _, err := io.ReadFull(r, payload); err != nil || crc32.Checksum(payload, crc32c) != binary.LittleEndian.Uint32(frame[4:]) {
+			slog.Warn("memstore - operation log has torn record, truncated", "offset", size)
+			return replayed, size, nil
+		}
+
+		if err := s.applyOpRecord(payload); err != nil {
+			return replayed, size, err
+		}
+		size += int64(len(frame) + len(payload))
+		replayed++
+	}
+}
+
+// applyOpRecord replay one log record
+func (s *SharedStore) applyOpRecord(p []byte) error {
+	bad := fmt.Errorf("%w: malformed record", ErrBadOpLog)
+	if len(p) < 1 {
+		return bad
+	}
+
+	switch p[0] {
+	case opSet:
+		key, p, ok := readOpKey(p[1:])
+		if !ok || len(p) < 4+8+8+8+4 {
+			return bad
+		}
+		e := &MEntry{Key: key}
+		copy(e.Flags[:], p)
+		e.ExpTime = int64(binary.LittleEndian.Uint64(p[4:]))
+		e.Cas = binary.LittleEndian.Uint64(p[12:])
+		e.stime = int64(binary.LittleEndian.Uint64(p[20:]))
+		e.Size = binary.LittleEndian.Uint32(p[28:])
+		if len(p[32:]) != int(e.Size) {
+			return bad
+		}
+		// Store copies value to slab memory
+		e.Value = p[32:]
+		s.SetKeepCas(key, e)
+
+	case opDelete:
+		key, _, ok := readOpKey(p[1:])
+		if !ok {
+			return bad
+		}
+		s.remove(key)
+
+	case opFlush:
+		if len(p) != 1+8 {
+			return bad
+		}
+		s.flushLock.Lock()
+		s.flushAt(time.Now().UnixMicro(), int64(binary.LittleEndian.Uint64(p[1:])))
+		s.flushLock.Unlock()
+
+	default:
+		return bad
+	}
+
+	return nil
+}
+
+func readOpKey(p []byte) (string, []byte, bool) {
+	if len(p) < 2 {
+		return "", nil, false
+	}
+	n := int(binary.LittleEndian.Uint16(p))
+	if len(p) < 2+n {
+		return "", nil, false
+	}
+	return string(p[2 : 2+n]), p[2+n:], true
+}
+
+// appendEntry log entry change, must be called under bucket lock of the key
+func (l *opLog) appendEntry(old *MEntry, entry *MEntry) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if entry == nil {
+		l.record = appendOpKey(append(l.record[:0], opDelete), old.Key)
+	} else {
+		l.record = encodeOpSet(l.record[:0], entry)
+	}
+	l.append(l.record)
+}
+
+func (l *opLog) appendFlush(at int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.record = binary.LittleEndian.AppendUint64(append(l.record[:0], opFlush), uint64(at))
+	l.append(l.record)
+}
+
+func encodeOpSet(b []byte, e *MEntry) []byte {
+	b = appendOpKey(append(b, opSet), e.Key)
+	b = append(b, e.Flags[:]...)
+	b = binary.LittleEndian.AppendUint64(b, uint64(e.ExpTime))
+	b = binary.LittleEndian.AppendUint64(b, e.Cas)
+	b = binary.LittleEndian.AppendUint64(b, uint64(e.stime))
+	b = binary.LittleEndian.AppendUint32(b, e.Size)
+	return append(b, e.Value[:e.Size]...)
+}
+
+func appendOpKey(b []byte, key string) []byte {
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(key)))
+	return append(b, key...)
+}
+
+// append write framed record to log buffer and to compaction buffer, must hold lock
+func (l *opLog) append(payload []byte) {
+	var frame [8]byte
+	binary.LittleEndian.PutUint32(frame[:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:], crc32.Checksum(payload, crc32c))
+
+	l.w.Write(frame[:])
+	l.w.Write(payload)
+	if l.rewrite != nil {
+		l.rewrite.Write(frame[:])
+		l.rewrite.Write(payload)
+	}
+
+	l.size += int64(len(frame) + len(payload))
+	l.seq++
+	l.records.Add(1)
+	l.bytes.Store(l.size)
+}
+
+// commit make appended records durable according to fsync policy, called before reply
+func (l *opLog) commit() {
+	if l.policy == FsyncAlways {
+		l.sync()
+		return
+	}
+
+	l.lock.Lock()
+	if err := l.w.Flush(); err != nil {
+		slog.Error("memstore - operation log write", "error", err)
+	}
+	l.lock.Unlock()
+}
+
+// sync flush and fsync log, concurrent callers share one fsync
+func (l *opLog) sync() {
+	l.lock.Lock()
+	seq := l.seq
+	l.lock.Unlock()
+
+	l.syncLock.Lock()
+	defer l.syncLock.Unlock()
+	if l.synced.Load() >= seq {
+		return
+	}
+
+	l.lock.Lock()
+	seq = l.seq
+	err := l.w.Flush()
+	f := l.f
+	l.lock.Unlock()
+
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		slog.Error("memstore - operation log sync", "error", err)
+		return
+	}
+	l.synced.Store(seq)
+}
+
+// background fsync log every second and compact it once it grows
+func (l *opLog) background(s *SharedStore) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Closed or replaced log
+		if s.oplog.Load() != l {
+			return
+		}
+
+		switch l.policy {
+		case FsyncEverySec:
+			l.sync()
+		case FsyncNever:
+			l.commit()
+		}
+
+		size, compacted := l.bytes.Load(), l.compactSize.Load()
+		if size > opLogCompactMinSize && size > 2*compacted {
+			if err := s.BackgroundCompactOpLog(); err != nil && err != ErrCompactBusy {
+				slog.Error("memstore - operation log compaction", "error", err)
+			}
+		}
+	}
+}
+
+// CompactOpLog rewrite log from current store content, waits for running compaction to finish
+func (s *SharedStore) CompactOpLog() error {
+	l := s.oplog.Load()
+	if l == nil {
+		return ErrOpLogDisabled
+	}
+
+	l.compactLock.Lock()
+	defer l.compactLock.Unlock()
+
+	return s.compactOpLog(l)
+}
+
+// BackgroundCompactOpLog start compaction in background, ErrCompactBusy if one is running
+func (s *SharedStore) BackgroundCompactOpLog() error {
+	l := s.oplog.Load()
+	if l == nil {
+		return ErrOpLogDisabled
+	}
+	if !l.compactLock.TryLock() {
+		return ErrCompactBusy
+	}
+
+	go func() {
+		defer l.compactLock.Unlock()
+		if err := s.compactOpLog(l); err != nil {
+			slog.Error("memstore - operation log compaction", "error", err)
+		}
+	}()
+	return nil
+}
+
+// compactOpLog rewrite log, changes made meanwhile are collected and appended
+// to new log before it replaces old one, must hold compact lock
+func (s *SharedStore) compactOpLog(l *opLog) error {
+	// Log was closed while waiting for lock
+	if s.oplog.Load() != l {
+		return ErrOpLogDisabled
+	}
+	l.compacting.Store(true)
+	defer l.compacting.Store(false)
+
+	f, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	l.lock.Lock()
+	l.rewrite = &bytes.Buffer{}
+	l.lock.Unlock()
+
+	size, err := s.writeOpLogFrom(f, l)
+	if err == nil {
+		err = l.swap(f, size)
+	}
+	if err != nil {
+		l.lock.Lock()
+		l.rewrite = nil
+		l.lock.Unlock()
+		f.Close()
+		return err
+	}
+
+	l.compactions.Add(1)
+	slog.Info("memstore - operation log compacted", "path", l.path, "bytes", l.compactSize.Load())
+	return nil
+}
+
+// writeOpLogFrom write header, pending flush and alive items as set records,
+// then drain records collected meanwhile, returns written size
+func (s *SharedStore) writeOpLogFrom(f *os.File, l *opLog) (int64, error) {
+	w := &countingWriter{w: f}
+	bw := bufio.NewWriter(w)
+	if _, err := writeOpLogHeader(bw); err != nil {
+		return 0, err
+	}
+
+	var record []byte
+	writeRecord := func(payload []byte) error {
+		var frame [8]byte
+		binary.LittleEndian.PutUint32(frame[:], uint32(len(payload)))
+		binary.LittleEndian.PutUint32(frame[4:], crc32.Checksum(payload, crc32c))
+		bw.Write(frame[:])
+		_, err := bw.Write(payload)
+		return err
+	}
+
+	if at := s.pendingFlush.Load(); at != 0 {
+		record = binary.LittleEndian.AppendUint64(append(record[:0], opFlush), uint64(at))
+		writeRecord(record)
+	}
+
+	// Pin is renewed between items as in snapshot
+	pin := s.Pin()
+	items := 0
+	var err error
+	s.coolmap.Range(func(key string, e *MEntry) bool {
+		if !s.alive(e) {
+			return true
+		}
+		e, ok := s.rangeValue(key, e)
+		if !ok {
+			return true
+		}
+		record = encodeOpSet(record[:0], e)
+		err = writeRecord(record)
+		if items++; items%snapshotPinItems == 0 {
+			renewed := s.Pin()
+			s.Unpin(pin)
+			pin = renewed
+		}
+		return err == nil
+	})
+	s.Unpin(pin)
+	if err != nil {
+		return 0, err
+	}
+
+	// Drain changes made meanwhile without blocking writers, rest is drained on swap
+	for {
+		l.lock.Lock()
+		pending := l.rewrite
+		l.rewrite = &bytes.Buffer{}
+		l.lock.Unlock()
+
+		n, err := pending.WriteTo(bw)
+		if err != nil {
+			return 0, err
+		}
+		if n < 64*1024 {
+			break
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	return w.n, nil
+}
+
+// swap append last collected records to new log, sync it and replace old log
+func (l *opLog) swap(f *os.File, size int64) error {
+	l.syncLock.Lock()
+	defer l.syncLock.Unlock()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	n, err := l.rewrite.WriteTo(f)
+	if err != nil {
+		return err
+	}
+	size += n
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), l.path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(l.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	// Records of old log are in new one, unwritten buffer is dropped with old file
+	l.f.Close()
+	l.f = f
+	l.w.Reset(f)
+	l.size = size
+	l.rewrite = nil
+	l.synced.Store(l.seq)
+	l.compactSize.Store(size)
+	l.bytes.Store(size)
+	return nil
+}
+
+// OpLogStats return operation log state
+func (s *SharedStore) OpLogStats() OpLogStats {
+	l := s.oplog.Load()
+	if l == nil {
+		return OpLogStats{}
+	}
+
+	return OpLogStats{
+		Enabled:     true,
+		Policy:      l.policy,
+		Bytes:       l.bytes.Load(),
+		Records:     l.records.Load(),
+		Compactions: l.compactions.Load(),
+		Compacting:  l.compacting.Load(),
+	}
+}
+
+// CloseOpLog sync and close operation log, store changes are not logged anymore
+func (s *SharedStore) CloseOpLog() error {
+	l := s.oplog.Swap(nil)
+	if l == nil {
+		return nil
+	}
+
+	l.compactLock.Lock()
+	defer l.compactLock.Unlock()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	err := l.w.Flush()
+	if err == nil {
+		err = l.f.Sync()
+	}
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
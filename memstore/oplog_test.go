@@ -0,0 +1,193 @@
+package memstore
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// reopenOpLog close log of s and replay it to new store
+func reopenOpLog(t *testing.T, s *SharedStore, path string) (*SharedStore, int) {
+	t.Helper()
+	if err := s.CloseOpLog(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestStore()
+	records, err := restored.EnableOpLog(path, FsyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { restored.CloseOpLog() })
+	return restored, records
+}
+
+func TestOpLogReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "oplog")
+	s := newTestStore()
+	if _, err := s.EnableOpLog(path, FsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+
+	set := func(key string, value string) {
+		s.Set(key, &MEntry{Key: key, Value: []byte(value), Size: uint32(len(value))})
+	}
+	set("foo", "bar")
+	set("counter", "10")
+	set("gone", "x")
+	s.Add("added", &MEntry{Key: "added", Value: []byte("1"), Size: 1, Flags: [4]byte{0, 0, 0, 7}})
+	s.Replace("foo", &MEntry{Key: "foo", Value: []byte("baz"), Size: 3})
+	s.Incr("counter", 5)
+	s.Decr("counter", 2)
+	s.Touch("added", s.ExpTime(1000))
+	s.Delete("gone")
+	foo, _ := s.Get("foo")
+
+	restored, records := reopenOpLog(t, s, path)
+	if records != 9 {
+		t.Fatalf("Expected 9 replayed records, got %d", records)
+	}
+	if e, ok := restored.Get("foo"); !ok || string(e.Value) != "baz" || e.Cas != foo.Cas {
+		t.Fatal("Replaced item is not restored with its cas")
+	}
+	if e, ok := restored.Get("counter"); !ok || string(e.Value) != "13" {
+		t.Fatal("Counter is not restored")
+	}
+	if e, ok := restored.Get("added"); !ok || e.Flags[3] != 7 || e.ExpTime == 0 {
+		t.Fatal("Touched item is not restored")
+	}
+	if _, ok := restored.Get("gone"); ok {
+		t.Fatal("Deleted item is restored")
+	}
+
+	// Restored log is appended
+	restored.Set("next", &MEntry{Key: "next"})
+	again, records := reopenOpLog(t, restored, path)
+	if _, ok := again.Get("next"); !ok || records != 10 {
+		t.Fatalf("Expected appended record, got %d records", records)
+	}
+}
+
+func TestOpLogReplayFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "oplog")
+	s := newTestStore()
+	if _, err := s.EnableOpLog(path, FsyncNever); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Set("old", &MEntry{Key: "old"})
+	s.Flush(0)
+	s.Set("new", &MEntry{Key: "new"})
+
+	restored, _ := reopenOpLog(t, s, path)
+	if _, ok := restored.Get("old"); ok {
+		t.Fatal("Flushed item is restored")
+	}
+	if _, ok := restored.Get("new"); !ok {
+		t.Fatal("Item stored after flush is not restored")
+	}
+}
+
+func TestOpLogTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "oplog")
+	s := newTestStore()
+	if _, err := s.EnableOpLog(path, FsyncNever); err != nil {
+		t.Fatal(err)
+	}
+	s.Set("foo", &MEntry{Key: "foo", Value: []byte("bar"), Size: 3})
+	s.Set("torn", &MEntry{Key: "torn", Value: []byte("value"), Size: 5})
+	s.CloseOpLog()
+
+	// Crash in middle of last record
+	info, _ := os.Stat(path)
+	if err := os.Truncate(path, info.Size()-2); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestStore()
+	records, err := restored.EnableOpLog(path, FsyncNever)
+	if err != nil || records != 1 {
+		t.Fatalf("Expected 1 replayed record, got %d, err %v", records, err)
+	}
+	if _, ok := restored.Get("torn"); ok {
+		t.Fatal("Torn record is replayed")
+	}
+
+	// Torn tail is cut, new records follow last good one
+	restored.Set("after", &MEntry{Key: "after"})
+	again, records := reopenOpLog(t, restored, path)
+	if _, ok := again.Get("after"); !ok || records != 2 {
+		t.Fatalf("Expected record after truncated tail, got %d records", records)
+	}
+}
+
+func TestOpLogCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "oplog")
+	s := newTestStore()
+	if _, err := s.EnableOpLog(path, FsyncEverySec); err != nil {
+		t.Fatal(err)
+	}
+
+	// Many versions of few keys
+	for i := 0; i < 1000; i++ {
+		key := "key:" + strconv.Itoa(i%10)
+		value := bytes.Repeat([]byte(strconv.Itoa(i)), 50)
+		s.Set(key, &MEntry{Key: key, Value: value, Size: uint32(len(value))})
+	}
+	before := s.OpLogStats().Bytes
+
+	// Writers are not blocked by compaction, their changes get to new log
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			key := "during:" + strconv.Itoa(i)
+			s.Set(key, &MEntry{Key: key})
+			s.Delete("key:" + strconv.Itoa(i%5))
+		}
+	}()
+	if err := s.CompactOpLog(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	stats := s.OpLogStats()
+	if stats.Compactions != 1 {
+		t.Fatalf("Expected 1 compaction, got %d", stats.Compactions)
+	}
+
+	restored, _ := reopenOpLog(t, s, path)
+	for i := 0; i < 10; i++ {
+		_, ok := restored.Get("key:" + strconv.Itoa(i))
+		if ok != (i >= 5) {
+			t.Fatalf("Key %d present %v after compaction", i, ok)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		if _, ok := restored.Get("during:" + strconv.Itoa(i)); !ok {
+			t.Fatalf("Item %d stored during compaction is lost", i)
+		}
+	}
+
+	// Log without concurrent writes is just alive items
+	if err := restored.CompactOpLog(); err != nil {
+		t.Fatal(err)
+	}
+	if after := restored.OpLogStats().Bytes; after >= before {
+		t.Fatalf("Expected compacted log below %d bytes, got %d", before, after)
+	}
+}
+
+func TestOpLogBadPolicy(t *testing.T) {
+	s := newTestStore()
+	if _, err := s.EnableOpLog(filepath.Join(t.TempDir(), "oplog"), "sometimes"); err == nil {
+		t.Fatal("Expected error on unknown fsync policy")
+	}
+	if err := s.CompactOpLog(); err != ErrOpLogDisabled {
+		t.Fatalf("Expected ErrOpLogDisabled, got %v", err)
+	}
+}
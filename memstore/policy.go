@@ -0,0 +1,122 @@
+package memstore
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/zeebo/xxh3"
+)
+
+type (
+	// evictionPolicy track stored keys and choose eviction victims.
+	// Insert and Remove are called under bucket lock of the key,
+	// Victim is called without bucket locks, must unlink returned node.
+	evictionPolicy interface {
+		Insert(key string) *policyNode
+		Remove(n *policyNode)
+		Victim() *policyNode
+		Stats() PolicyStats
+		ResetStats()
+	}
+
+	// PolicyStats is eviction policy segments and moves between them,
+	// meaning of segments depends on policy
+	PolicyStats struct {
+		Policy         string
+		NumberHot      uint64
+		NumberWarm     uint64
+		NumberCold     uint64
+		MovesToCold    uint64
+		MovesToWarm    uint64
+		MovesWithinLRU uint64
+	}
+
+	// policyNode is policy position of key, it is shared by all entry versions of the key
+	policyNode struct {
+		key        string
+		hash       uint64
+		prev, next *policyNode
+		seg        int8
+		linked     bool
+		index      int           // position in sampled policies
+		hits       atomic.Uint32 // accesses since last policy visit, updated without lock
+	}
+
+	// policyList is circular doubly linked list with sentinel
+	policyList struct {
+		head policyNode
+		len  int
+	}
+)
+
+// EvictionPolicies is names of supported eviction policies
+var EvictionPolicies = []string{"lru", "lfu", "fifo", "wtinylfu"}
+
+func newEvictionPolicy(name string) (evictionPolicy, error) {
+	switch name {
+	case "lru":
+		return newSegmentedLRU(), nil
+	case "lfu":
+		return newSampledLFU(), nil
+	case "fifo":
+		return newFIFO(), nil
+	case "wtinylfu":
+		return newTinyLFU(), nil
+	}
+
+	return nil, fmt.Errorf("unknown eviction policy %s", name)
+}
+
+// sumPolicyStats return stats of per class policies summed up
+func sumPolicyStats(policies []evictionPolicy) PolicyStats {
+	var sum PolicyStats
+	for _, policy := range policies {
+		stats := policy.Stats()
+		sum.Policy = stats.Policy
+		sum.NumberHot += stats.NumberHot
+		sum.NumberWarm += stats.NumberWarm
+		sum.NumberCold += stats.NumberCold
+		sum.MovesToCold += stats.MovesToCold
+		sum.MovesToWarm += stats.MovesToWarm
+		sum.MovesWithinLRU += stats.MovesWithinLRU
+	}
+
+	return sum
+}
+
+func newPolicyNode(key string) *policyNode {
+	return &policyNode{key: key, hash: xxh3.HashString(key)}
+}
+
+func (l *policyList) init() {
+	l.head.next = &l.head
+	l.head.prev = &l.head
+}
+
+// pushFront link node at list head
+func (l *policyList) pushFront(n *policyNode, seg int8) {
+	n.seg = seg
+	n.prev = &l.head
+	n.next = l.head.next
+	l.head.next.prev = n
+	l.head.next = n
+	n.linked = true
+	l.len++
+}
+
+// unlink remove node from list, node must be linked to this list
+func (l *policyList) unlink(n *policyNode) {
+	n.prev.next = n.next
+	n.next.prev = n.prev
+	n.prev, n.next = nil, nil
+	n.linked = false
+	l.len--
+}
+
+// tail return last node or nil if list is empty
+func (l *policyList) tail() *policyNode {
+	if l.head.prev == &l.head {
+		return nil
+	}
+	return l.head.prev
+}
@@ -0,0 +1,112 @@
+package memstore
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// zipfHitRatio replay get, set on miss trace with Zipf distributed keys
+// on store which fits cacheItems, returns hit ratio
+func zipfHitRatio(t testing.TB, policy string, cacheItems int, keys uint64, requests int) float64 {
+	s := NewSharedStore()
+	if err := s.SetEvictionPolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+	value := make([]byte, 100)
+	// Measure item memory on sample key of typical length
+	sample := strconv.FormatUint(keys/2, 10)
+	s.Set(sample, &MEntry{Key: sample, Value: value, Size: uint32(len(value))})
+	itemSize := s.size.Load()
+	s.Delete(sample)
+	s.SetMemoryLimit(int64(cacheItems) * itemSize)
+
+	zipf := rand.NewZipf(rand.New(rand.NewSource(42)), 1.01, 1, keys-1)
+	hits := 0
+	for i := 0; i < requests; i++ {
+		key := strconv.FormatUint(zipf.Uint64(), 10)
+		if _, ok := s.Get(key); ok {
+			hits++
+			continue
+		}
+		s.Set(key, &MEntry{Key: key, Value: value, Size: uint32(len(value))})
+	}
+
+	return float64(hits) / float64(requests)
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	for _, policy := range EvictionPolicies {
+		t.Run(policy, func(t *testing.T) {
+			s := NewSharedStore()
+			if err := s.SetEvictionPolicy(policy); err != nil {
+				t.Fatal(err)
+			}
+			const limit = 32 * 1024
+			s.SetMemoryLimit(limit)
+
+			value := make([]byte, 100)
+			for i := 0; i < 10000; i++ {
+				key := strconv.Itoa(i % 3000)
+				s.Set(key, &MEntry{Key: key, Value: value, Size: uint32(len(value))})
+				s.Get(strconv.Itoa(i % 10))
+				if i%5 == 0 {
+					s.Delete(strconv.Itoa(i % 7))
+				}
+				if s.size.Load() > limit {
+					t.Fatalf("Store size %d is over limit %d", s.size.Load(), limit)
+				}
+			}
+
+			stats := s.Stats()
+			if stats.Policy != policy {
+				t.Fatalf("Expected policy %s, got %s", policy, stats.Policy)
+			}
+			if stats.NumberHot+stats.NumberWarm+stats.NumberCold != stats.CurrItems {
+				t.Fatalf("Policy segments %d/%d/%d do not match %d items", stats.NumberHot, stats.NumberWarm, stats.NumberCold, stats.CurrItems)
+			}
+			if stats.Evictions == 0 {
+				t.Fatal("Expected evictions")
+			}
+		})
+	}
+
+	s := NewSharedStore()
+	if err := s.SetEvictionPolicy("random"); err == nil {
+		t.Fatal("Expected error for unknown policy")
+	}
+	s.Set("foo", &MEntry{Key: "foo"})
+	if err := s.SetEvictionPolicy("lfu"); err == nil {
+		t.Fatal("Expected error for non empty store")
+	}
+}
+
+func TestEvictionPolicyZipfHitRatio(t *testing.T) {
+	ratios := map[string]float64{}
+	for _, policy := range EvictionPolicies {
+		ratios[policy] = zipfHitRatio(t, policy, 1000, 100000, 200000)
+		t.Logf("%s hit ratio %.3f", policy, ratios[policy])
+	}
+
+	// Frequency aware policies must not be worse than insertion order on skewed access
+	for _, policy := range []string{"lru", "lfu", "wtinylfu"} {
+		if ratios[policy] < ratios["fifo"] {
+			t.Fatalf("%s hit ratio %.3f is worse than fifo %.3f", policy, ratios[policy], ratios["fifo"])
+		}
+	}
+	if ratios["wtinylfu"] < ratios["lru"] {
+		t.Fatalf("wtinylfu hit ratio %.3f is worse than lru %.3f", ratios["wtinylfu"], ratios["lru"])
+	}
+}
+
+func BenchmarkEvictionPolicyZipf(b *testing.B) {
+	for _, policy := range EvictionPolicies {
+		b.Run(policy, func(b *testing.B) {
+			ratio := 0.0
+			for i := 0; i < b.N; i++ {
+				ratio = zipfHitRatio(b, policy, 1000, 100000, 100000)
+			}
+			b.ReportMetric(ratio*100, "hit%")
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package memstore
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// Memory limit is split to at least quotaPages pages, page is at most slab page size
+const quotaPages = 64
+
+// Slab automove modes, as memcached slab_automove
+const (
+	AutomoveOff        = 0
+	AutomoveSustained  = 1 // move page after class evicts for automoveWindows windows in row
+	AutomoveAggressive = 2 // move page on any evictions, items of donor class are evicted
+)
+
+// Automove window length in crawler ticks and number of windows of sustained evictions
+const (
+	automoveWindowTicks = 10
+	automoveWindows     = 3
+)
+
+var (
+	ErrBadClass = errors.New("bad slab class")
+	ErrNoSpare  = errors.New("no spare quota in source class")
+	ErrSame     = errors.New("source and destination class are the same")
+)
+
+// automoveState is eviction history of classes, protected by evictLock
+type automoveState struct {
+	ticks    int
+	evicted  []uint64 // class evictions at window start
+	receiver int      // class with most evictions in last windows, -1 if none
+	windows  int      // number of windows in row receiver evicted most
+}
+
+// quotaUnit return size of quota page
+func (s *SharedStore) quotaUnit() int64 {
+	return min(slabPageSize, max(s.storeSizeLimit.Load()/quotaPages, 1))
+}
+
+// evict remove items of class until it fits its quota
+func (s *SharedStore) evict(c *slabClass) {
+	if s.storeSizeLimit.Load() <= 0 || c.usage.Load() <= c.quota.Load() {
+		return
+	}
+
+	s.evictLock.Lock()
+	defer s.evictLock.Unlock()
+
+	s.evictClass(c, false)
+}
+
+// evictClass remove items from class policy tail until it fits quota, must hold evictLock.
+// Quota grows from global pool first, class with single item takes page from largest class,
+// class which gave its quota away just evicts.
+func (s *SharedStore) evictClass(c *slabClass, reassign bool) {
+	for s.storeSizeLimit.Load() > 0 && c.usage.Load() > c.quota.Load() {
+		if !reassign && s.takeQuota(c) {
+			continue
+		}
+
+		if !reassign && c.items.Load() <= 1 {
+			donor := s.largestQuota(c)
+			if donor == nil {
+				return
+			}
+			s.moveQuota(donor, c)
+			continue
+		}
+
+		n := s.evictionPolicy(uint8(c.id)).Victim()
+		if n == nil {
+			return
+		}
+		s.evictNode(n)
+		if reassign {
+			s.slabs.reassignEvict.Add(1)
+		}
+	}
+}
+
+// takeQuota assign quota page from global pool to class, must hold evictLock
+func (s *SharedStore) takeQuota(c *slabClass) bool {
+	pool := s.quotaPool.Load()
+	if pool <= 0 {
+		return false
+	}
+
+	take := min(pool, s.quotaUnit())
+	s.quotaPool.Add(-take)
+	c.quota.Add(take)
+	return true
+}
+
+// moveQuota move quota page between classes and evict items of source over its new quota,
+// must hold evictLock
+func (s *SharedStore) moveQuota(src *slabClass, dst *slabClass) {
+	take := min(src.quota.Load(), s.quotaUnit())
+	src.quota.Add(-take)
+	dst.quota.Add(take)
+	s.slabs.pagesMoved.Add(1)
+
+	s.evictClass(src, true)
+}
+
+// largestQuota return class with biggest quota except given one
+func (s *SharedStore) largestQuota(except *slabClass) *slabClass {
+	var donor *slabClass
+	for _, c := range s.slabs.classes {
+		if c != except && c.quota.Load() > 0 && (donor == nil || c.quota.Load() > donor.quota.Load()) {
+			donor = c
+		}
+	}
+
+	return donor
+}
+
+// SlabReassign move one quota page from src to dst class, src -1 picks class with most unused quota
+func (s *SharedStore) SlabReassign(src int, dst int) error {
+	classes := s.slabs.classes
+	if dst < 0 || dst >= len(classes) || src < -1 || src >= len(classes) {
+		return ErrBadClass
+	}
+	if src == dst {
+		return ErrSame
+	}
+
+	s.evictLock.Lock()
+	defer s.evictLock.Unlock()
+
+	var donor *slabClass
+	if src >= 0 {
+		donor = classes[src]
+	} else {
+		for _, c := range classes {
+			if c.id != dst && c.quota.Load() > 0 && (donor == nil || slack(c) > slack(donor)) {
+				donor = c
+			}
+		}
+	}
+	if donor == nil || donor.quota.Load() == 0 {
+		return ErrNoSpare
+	}
+
+	s.moveQuota(donor, classes[dst])
+	return nil
+}
+
+// slack return quota not used by class items
+func slack(c *slabClass) int64 {
+	return c.quota.Load() - c.usage.Load()
+}
+
+// SetAutomove set background quota rebalancer mode
+func (s *SharedStore) SetAutomove(mode int) error {
+	if mode < AutomoveOff || mode > AutomoveAggressive {
+		return errors.New("bad automove mode")
+	}
+
+	s.automove.Store(int32(mode))
+	return nil
+}
+
+// automoveTick is rebalancer step called every crawler tick, at end of window quota page
+// moves to class which evicted most from class which did not evict at all
+func (s *SharedStore) automoveTick() {
+	mode := s.automove.Load()
+	if mode == AutomoveOff {
+		return
+	}
+
+	s.evictLock.Lock()
+	defer s.evictLock.Unlock()
+
+	st := &s.moveState
+	classes := s.slabs.classes
+	if st.evicted == nil {
+		st.evicted = make([]uint64, len(classes))
+		st.receiver = -1
+	}
+
+	st.ticks++
+	if mode == AutomoveSustained && st.ticks < automoveWindowTicks {
+		return
+	}
+	st.ticks = 0
+
+	// Class evictions in window
+	evicted := make([]uint64, len(classes))
+	receiver := -1
+	for i, c := range classes {
+		total := c.evicted.Load()
+		evicted[i] = total - st.evicted[i]
+		st.evicted[i] = total
+		if evicted[i] > 0 && (receiver < 0 || evicted[i] > evicted[receiver]) {
+			receiver = i
+		}
+	}
+
+	if receiver < 0 || receiver != st.receiver {
+		st.receiver = receiver
+		st.windows = 0
+	}
+	if receiver < 0 {
+		return
+	}
+	st.windows++
+	if mode == AutomoveSustained && st.windows < automoveWindows {
+		return
+	}
+
+	// Donor is calm class, unused quota is moved first
+	var donor *slabClass
+	for i, c := range classes {
+		if evicted[i] > 0 || c.quota.Load() == 0 {
+			continue
+		}
+		if donor == nil || slack(c) > slack(donor) || slack(c) == slack(donor) && c.quota.Load() > donor.quota.Load() {
+			donor = c
+		}
+	}
+	if donor == nil {
+		return
+	}
+
+	slog.Debug("memstore - slab automove", "src", donor.id, "dst", receiver)
+	s.moveQuota(donor, classes[receiver])
+	st.windows = 0
+}
+
+// trimSlabs release page of classes with more than page of free chunks, so slab memory
+// follows class quotas, items of released page are moved to free chunks of other pages
+func (s *SharedStore) trimSlabs() {
+	for _, c := range s.slabs.classes[slabFirstClass:] {
+		page, keys, ok := s.slabs.drain(c)
+		if !ok {
+			continue
+		}
+		for _, key := range keys {
+			s.rescue(c, page, key)
+		}
+	}
+}
+
+// rescue move item value out of draining page, dead items are deleted
+func (s *SharedStore) rescue(c *slabClass, page int, key string) {
+	s.coolmap.Compute(key, func(old *MEntry, loaded bool) *MEntry {
+		if !loaded || int(old.chunk.class) != c.id || int(old.chunk.id)/c.perPage != page {
+			return old
+		}
+
+		if !s.alive(old) {
+			s.account(old, nil)
+			s.stats.reclaimed.Add(1)
+			c.reclaimed.Add(1)
+			return nil
+		}
+
+		moved := *old
+		moved.Value, moved.chunk = s.slabs.Alloc(key, old.Value)
+		s.slabs.Free(old.Value, old.chunk)
+		s.slabs.rescues.Add(1)
+		return &moved
+	})
+}
@@ -0,0 +1,142 @@
+package memstore
+
+import (
+	"strconv"
+	"testing"
+)
+
+func fillClass(s *SharedStore, prefix string, items int, size int) {
+	value := make([]byte, size)
+	for i := 0; i < items; i++ {
+		key := prefix + strconv.Itoa(i)
+		s.Set(key, &MEntry{Key: key, Value: value, Size: uint32(size)})
+	}
+}
+
+func TestClassQuotaProtectsSmallItems(t *testing.T) {
+	s := NewSharedStore()
+	const limit = 4 * 1024 * 1024
+	s.SetMemoryLimit(limit)
+
+	fillClass(s, "small:", 5000, 100)
+	// Flood of large values evicts only large values once memory is assigned
+	fillClass(s, "large:", 200, 50*1024)
+
+	for i := 0; i < 5000; i++ {
+		if _, ok := s.Get("small:" + strconv.Itoa(i)); !ok {
+			t.Fatalf("Small item %d is evicted by large values", i)
+		}
+	}
+	if s.size.Load() > limit {
+		t.Fatalf("Store size %d is over limit %d", s.size.Load(), limit)
+	}
+
+	small := s.slabs.classFor(100)
+	large := s.slabs.classFor(50 * 1024)
+	if small.evicted.Load() != 0 || large.evicted.Load() == 0 {
+		t.Fatalf("Expected evictions in large class only, got %d small %d large", small.evicted.Load(), large.evicted.Load())
+	}
+	if small.usage.Load() > small.quota.Load() || large.usage.Load() > large.quota.Load() {
+		t.Fatal("Class usage is over its quota")
+	}
+}
+
+func TestSlabReassign(t *testing.T) {
+	s := NewSharedStore()
+	s.SetMemoryLimit(4 * 1024 * 1024)
+
+	fillClass(s, "small:", 5000, 100)
+	small := s.slabs.classFor(100)
+	large := s.slabs.classFor(50 * 1024)
+
+	if err := s.SlabReassign(small.id, small.id); err != ErrSame {
+		t.Fatalf("Expected ErrSame, got %v", err)
+	}
+	if err := s.SlabReassign(small.id, len(s.slabs.classes)); err != ErrBadClass {
+		t.Fatalf("Expected ErrBadClass, got %v", err)
+	}
+	if err := s.SlabReassign(large.id, small.id); err != ErrNoSpare {
+		t.Fatalf("Expected ErrNoSpare, got %v", err)
+	}
+
+	quota := small.quota.Load()
+	if err := s.SlabReassign(small.id, large.id); err != nil {
+		t.Fatal(err)
+	}
+	if small.quota.Load() != quota-s.quotaUnit() || large.quota.Load() != s.quotaUnit() {
+		t.Fatalf("Quota page is not moved, small %d large %d", small.quota.Load(), large.quota.Load())
+	}
+	if small.usage.Load() > small.quota.Load() {
+		t.Fatal("Source class must evict items over its new quota")
+	}
+	if _, totals := s.SlabStats(); totals.PagesMoved != 1 || totals.ReassignEvictions == 0 {
+		t.Fatalf("Unexpected counters %+v", totals)
+	}
+}
+
+func TestSlabAutomove(t *testing.T) {
+	s := NewSharedStore()
+	s.SetMemoryLimit(4 * 1024 * 1024)
+	if err := s.SetAutomove(AutomoveAggressive); err != nil {
+		t.Fatal(err)
+	}
+
+	fillClass(s, "small:", 12000, 100)
+	small := s.slabs.classFor(100)
+	large := s.slabs.classFor(50 * 1024)
+
+	// Item size mix changes, large values evict, so quota follows them
+	for round := 0; round < 5; round++ {
+		fillClass(s, "large:"+strconv.Itoa(round)+":", 20, 50*1024)
+		s.automoveTick()
+	}
+
+	if large.evicted.Load() == 0 {
+		t.Fatal("Expected evictions in large class")
+	}
+	if _, totals := s.SlabStats(); totals.PagesMoved == 0 {
+		t.Fatal("Expected quota pages moved by automove")
+	}
+	if small.quota.Load()+large.quota.Load()+s.quotaPool.Load() > 4*1024*1024 {
+		t.Fatal("Quotas exceed memory limit")
+	}
+}
+
+func TestTrimSlabsRescuesItems(t *testing.T) {
+	s := newTestStore()
+
+	fillClass(s, "key:", 30000, 100)
+	c := s.slabs.classFor(100)
+	for i := 0; i < 30000; i++ {
+		if i%10 != 0 {
+			s.Delete("key:" + strconv.Itoa(i))
+		}
+	}
+	s.slabs.Reclaim()
+	s.slabs.Reclaim()
+
+	c.lock.Lock()
+	pages := c.totalPages()
+	c.lock.Unlock()
+
+	for i := 0; i < 10; i++ {
+		s.trimSlabs()
+		s.slabs.Reclaim()
+	}
+
+	c.lock.Lock()
+	trimmed := c.totalPages()
+	c.lock.Unlock()
+	if trimmed >= pages {
+		t.Fatalf("Expected pages to be released, got %d of %d", trimmed, pages)
+	}
+	if _, totals := s.SlabStats(); totals.SparePages == 0 || totals.Rescues == 0 {
+		t.Fatalf("Unexpected counters %+v", totals)
+	}
+
+	for i := 0; i < 30000; i += 10 {
+		if e, ok := s.Get("key:" + strconv.Itoa(i)); !ok || len(e.Value) != 100 {
+			t.Fatalf("Rescued item %d is lost", i)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package memstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Replication stream, sent by primary in reply to replicate command:
+//
+//	line REPLICATING\r\n
+//	snapshot as written by WriteSnapshot, with items stored on primary
+//	records framed as in operation log: set, delete, flush and
+//	ping: op 4, primary time unix micro int64, sent after each batch and every second
+//
+// Replica lag is measured by its own clock as time since last applied ping, as
+// clocks of hosts may differ, so it is below a second on healthy link.
+//
+// Replica applies set records with cas and store time of primary.
+const opPing byte = 4
+
+// Changes of store not yet sent to replica, replica over it is disconnected and resyncs
+const replBacklogLimit = 64 * 1024 * 1024
+
+// Reconnect delay of replica, doubled on each failure
+const (
+	replMinBackoff = 100 * time.Millisecond
+	replMaxBackoff = 10 * time.Second
+)
+
+var (
+	ErrReplicaLagging = errors.New("replica backlog limit exceeded")
+	ErrBadReplication = errors.New("bad replication stream")
+)
+
+type (
+	// replication is state of primary feeds and of replica link
+	replication struct {
+		// Primary side, records are appended under bucket lock of the key,
+		// so each replica sees changes of key in store order
+		lock      sync.Mutex
+		feeds     []*replFeed
+		feedCount atomic.Int32
+		record    []byte
+		fullSyncs atomic.Uint64
+
+		// Replica side
+		readOnly  atomic.Bool
+		primary   atomic.Pointer[string]
+		auth      atomic.Pointer[primaryAuth]
+		linkUp    atomic.Bool
+		syncs     atomic.Uint64
+		applied   atomic.Uint64
+		lastPing  atomic.Int64 // unix micro of replica clock when last ping was applied
+		lastIO    atomic.Int64 // unix seconds of last received record
+		linkDowns atomic.Uint64
+	}
+
+	// primaryAuth is credentials replica sends before replicate command
+	primaryAuth struct {
+		user     string
+		password string
+	}
+
+	// replFeed is changes collected for one replica
+	replFeed struct {
+		lock     sync.Mutex
+		pending  []byte
+		spare    []byte
+		overflow bool
+		notify   chan struct{}
+	}
+
+	// ReplicationStats is replication state of primary and replica sides
+	ReplicationStats struct {
+		Replicas       int    // connected replicas
+		BacklogBytes   int64  // changes not yet sent to replicas
+		FullSyncs      uint64 // snapshots sent to replicas
+		Primary        string // empty unless store is replica
+		ReadOnly       bool
+		LinkUp         bool
+		Syncs          uint64 // snapshots loaded from primary
+		LinkDowns      uint64
+		RecordsApplied uint64
+		Lag            time.Duration // since last applied primary ping, by replica clock
+		LastIO         int64         // unix seconds
+	}
+)
+
+// feeding report whether changes must be sent to replicas
+func (r *replication) feeding() bool {
+	return r.feedCount.Load() > 0
+}
+
+func (r *replication) addFeed() *replFeed {
+	f := &replFeed{notify: make(chan struct{}, 1)}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.feeds = append(r.feeds, f)
+	r.feedCount.Store(int32(len(r.feeds)))
+	return f
+}
+
+func (r *replication) removeFeed(f *replFeed) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i, feed := range r.feeds {
+		if feed == f {
+			r.feeds = append(r.feeds[:i], r.feeds[i+1:]...)
+			break
+		}
+	}
+	r.feedCount.Store(int32(len(r.feeds)))
+}
+
+// appendEntry send entry change to replicas, must be called under bucket lock of the key
+func (r *replication) appendEntry(old *MEntry, entry *MEntry) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if entry == nil {
+		r.record = appendOpKey(append(r.record[:0], opDelete), old.Key)
+	} else {
+		r.record = encodeOpSet(r.record[:0], entry)
+	}
+	r.broadcast(r.record)
+}
+
+func (r *replication) appendFlush(at int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.record = binary.LittleEndian.AppendUint64(append(r.record[:0], opFlush), uint64(at))
+	r.broadcast(r.record)
+}
+
+// broadcast append framed record to all feeds, must hold lock
+func (r *replication) broadcast(payload []byte) {
+	for _, f := range r.feeds {
+		f.append(payload)
+	}
+}
+
+func appendFrame(b []byte, payload []byte) []byte {
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(payload)))
+	b = binary.LittleEndian.AppendUint32(b, crc32.Checksum(payload, crc32c))
+	return append(b, payload...)
+}
+
+func (f *replFeed) append(payload []byte) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.overflow {
+		return
+	}
+	if len(f.pending)+len(payload) > replBacklogLimit {
+		f.overflow = true
+		f.pending = nil
+	} else {
+		f.pending = appendFrame(f.pending, payload)
+	}
+
+	select {
+	case f.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take return collected records, buffer is reused by next take
+func (f *replFeed) take() ([]byte, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.overflow {
+		return nil, ErrReplicaLagging
+	}
+	pending := f.pending
+	f.pending, f.spare = f.spare[:0], pending
+	return pending, nil
+}
+
+func (f *replFeed) backlog() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.pending)
+}
+
+// ServeReplica stream store to replica: snapshot of items, then changes made since
+// snapshot started. Returns when write fails or replica falls behind backlog limit.
+func (s *SharedStore) ServeReplica(w io.Writer) error {
+	f := s.repl.addFeed()
+	defer s.repl.removeFeed(f)
+
+	bw := bufio.NewWriterSize(w, 64*1024)
+	bw.WriteString("REPLICATING\r\n")
+	items, err := s.WriteSnapshot(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	s.repl.fullSyncs.Add(1)
+	slog.Info("memstore - replica synced", "items", items)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var ping []byte
+	for {
+		select {
+		case <-f.notify:
+		case <-ticker.C:
+		}
+
+		pending, err := f.take()
+		if err != nil {
+			return err
+		}
+		bw.Write(pending)
+
+		ping = binary.LittleEndian.AppendUint64(append(ping[:0], opPing), uint64(time.Now().UnixMicro()))
+		bw.Write(appendFrame(nil, ping))
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// ReplicateFrom make store replica of primary at address: items are replaced by
+// primary snapshot, then primary changes are applied. Link is reconnected with
+// backoff and each reconnect loads snapshot again. Never returns.
+func (s *SharedStore) ReplicateFrom(address string) {
+	s.repl.primary.Store(&address)
+
+	backoff := replMinBackoff
+	for {
+		start := time.Now()
+		err := s.replicateOnce(address)
+		s.repl.linkUp.Store(false)
+		s.repl.linkDowns.Add(1)
+
+		// Link which worked for a while is reconnected fast
+		if time.Since(start) > replMaxBackoff {
+			backoff = replMinBackoff
+		}
+		slog.Warn("memstore - replication link down", "primary", address, "error", err, "retry", backoff)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, replMaxBackoff)
+	}
+}
+
+func (s *SharedStore) replicateOnce(address string) error {
+	conn, err := net.DialTimeout("tcp", address, replMaxBackoff)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Primary with auth enabled serves replicate only on authenticated connection
+	r := bufio.NewReaderSize(conn, 64*1024)
+	if auth := s.repl.auth.Load(); auth != nil {
+		value := auth.user + " " + auth.password
+		if _, err := fmt.Fprintf(conn, "set replica 0 0 %d\r\n%s\r\n", len(value), value); err != nil {
+			return err
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if line = strings.TrimSpace(line); line != "STORED" {
+			return fmt.Errorf("%w: primary auth replied %q", ErrBadReplication, line)
+		}
+	}
+
+	if _, err := conn.Write([]byte("replicate\r\n")); err != nil {
+		return err
+	}
+
+	return s.applyReplication(r)
+}
+
+// applyReplication read reply to replicate command and apply stream until it fails
+func (s *SharedStore) applyReplication(conn io.Reader) error {
+	r := bufio.NewReaderSize(conn, 64*1024)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line = strings.TrimSpace(line); line != "REPLICATING" {
+		return fmt.Errorf("%w: primary replied %q", ErrBadReplication, line)
+	}
+
+	// Replica keeps serving its items until snapshot is verified and loaded,
+	// then items missing on primary, not stored since sync start, are removed
+	start := time.Now().UnixMicro()
+	keys := []string{}
+	s.coolmap.Range(func(key string, e *MEntry) bool {
+		keys = append(keys, key)
+		return true
+	})
+	items, err := s.ReadSnapshot(r)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		s.update(key, func(old *MEntry) (*MEntry, error) {
+			if old != nil && old.stime < start {
+				return nil, nil
+			}
+			return old, nil
+		})
+	}
+	s.repl.syncs.Add(1)
+	s.repl.lastPing.Store(time.Now().UnixMicro())
+	s.repl.linkUp.Store(true)
+	s.repl.lastIO.Store(time.Now().Unix())
+	slog.Info("memstore - replica synced from primary", "items", items)
+
+	frame := make([]byte, 8)
+	var payload []byte
+	for {
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return err
+		}
+		length := binary.LittleEndian.Uint32(frame)
+		if cap(payload) < int(length) {
+			payload = make([]byte, length)
+		}
+		payload = payload[:length]
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+		if crc32.Checksum(payload, crc32c) != binary.LittleEndian.Uint32(frame[4:]) {
+			return fmt.Errorf("%w: checksum mismatch", ErrBadReplication)
+		}
+		s.repl.lastIO.Store(time.Now().Unix())
+
+		if len(payload) == 1+8 && payload[0] == opPing {
+			s.repl.lastPing.Store(time.Now().UnixMicro())
+			continue
+		}
+		if err := s.applyOpRecord(payload); err != nil {
+			return err
+		}
+		s.repl.applied.Add(1)
+	}
+}
+
+// SetPrimaryAuth set credentials replica authenticates with to primary
+func (s *SharedStore) SetPrimaryAuth(user, password string) {
+	s.repl.auth.Store(&primaryAuth{user: user, password: password})
+}
+
+// SetReadOnly reject client changes, replicated changes are still applied
+func (s *SharedStore) SetReadOnly(readOnly bool) {
+	s.repl.readOnly.Store(readOnly)
+}
+
+// ReadOnly report whether client changes are rejected
+func (s *SharedStore) ReadOnly() bool {
+	return s.repl.readOnly.Load()
+}
+
+// ReplicationStats return replication state
+func (s *SharedStore) ReplicationStats() ReplicationStats {
+	r := &s.repl
+	stats := ReplicationStats{
+		FullSyncs:      r.fullSyncs.Load(),
+		ReadOnly:       r.readOnly.Load(),
+		LinkUp:         r.linkUp.Load(),
+		Syncs:          r.syncs.Load(),
+		LinkDowns:      r.linkDowns.Load(),
+		RecordsApplied: r.applied.Load(),
+		LastIO:         r.lastIO.Load(),
+	}
+	if ping := r.lastPing.Load(); stats.LinkUp && ping > 0 {
+		stats.Lag = time.Since(time.UnixMicro(ping))
+	}
+	if primary := r.primary.Load(); primary != nil {
+		stats.Primary = *primary
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	stats.Replicas = len(r.feeds)
+	for _, f := range r.feeds {
+		stats.BacklogBytes += int64(f.backlog())
+	}
+	return stats
+}
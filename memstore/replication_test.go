@@ -0,0 +1,193 @@
+package memstore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// servePrimary accept replicas of s on localhost, returns primary address
+func servePrimary(t *testing.T, s *SharedStore) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if line, err := bufio.NewReader(conn).ReadString('\n'); err == nil && line == "replicate\r\n" {
+					s.ServeReplica(conn)
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// waitReplication wait until replica is synced and applied records of primary changes
+func waitReplication(t *testing.T, replica *SharedStore, records uint64) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		stats := replica.ReplicationStats()
+		if stats.LinkUp && stats.RecordsApplied >= records {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected synced replica with %d applied records, got %+v", records, stats)
+		}
+	}
+}
+
+func TestReplication(t *testing.T) {
+	primary := newTestStore()
+	for i := 0; i < 100; i++ {
+		key := "key:" + strconv.Itoa(i)
+		primary.Set(key, &MEntry{Key: key, Value: []byte(key), Size: uint32(len(key))})
+	}
+
+	replica := newTestStore()
+	replica.Set("stale", &MEntry{Key: "stale"})
+	replica.SetReadOnly(true)
+	go replica.ReplicateFrom(servePrimary(t, primary))
+
+	// Snapshot replaces replica items, cas values are kept
+	waitReplication(t, replica, 0)
+	if _, ok := replica.Get("stale"); ok {
+		t.Fatal("Replica item missing on primary survived sync")
+	}
+	for i := 0; i < 100; i++ {
+		want, _ := primary.Get("key:" + strconv.Itoa(i))
+		if e, ok := replica.Get(want.Key); !ok || e.Cas != want.Cas || string(e.Value) != want.Key {
+			t.Fatalf("Item %d is not replicated", i)
+		}
+	}
+
+	// Changes after sync are streamed
+	primary.Set("cnt", &MEntry{Key: "cnt", Value: []byte("1"), Size: 1})
+	primary.Delete("key:0")
+	primary.Incr("cnt", 1)
+	waitReplication(t, replica, 3)
+	if e, ok := replica.Get("cnt"); !ok || string(e.Value[:e.Size]) != "2" {
+		t.Fatal("Incremented item is not replicated")
+	}
+	if _, ok := replica.Get("key:0"); ok {
+		t.Fatal("Deleted item is kept on replica")
+	}
+	primary.Flush(0)
+	waitReplication(t, replica, 4)
+	if _, ok := replica.Get("key:1"); ok {
+		t.Fatal("Flushed item is kept on replica")
+	}
+
+	if err := replica.Set("local", &MEntry{Key: "local"}); err != ErrReadOnly {
+		t.Fatalf("Expected read-only replica, got %v", err)
+	}
+	stats := primary.ReplicationStats()
+	if stats.Replicas != 1 || stats.FullSyncs != 1 {
+		t.Fatalf("Expected one synced replica, got %+v", stats)
+	}
+	if stats := replica.ReplicationStats(); stats.RecordsApplied == 0 || stats.Syncs != 1 || stats.Lag <= 0 || stats.Lag > 5*time.Second {
+		t.Fatalf("Expected applied records, got %+v", stats)
+	}
+}
+
+func TestReplicationAuth(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	primary := newTestStore()
+	primary.Set("key", &MEntry{Key: "key", Value: []byte("value"), Size: 5})
+	lines := make(chan string, 3)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for i := 0; i < 2; i++ {
+			line, _ := r.ReadString('\n')
+			lines <- line
+		}
+		conn.Write([]byte("STORED\r\n"))
+		if line, _ := r.ReadString('\n'); line == "replicate\r\n" {
+			primary.ServeReplica(conn)
+		}
+	}()
+
+	replica := newTestStore()
+	replica.SetPrimaryAuth("user", "secret")
+	go replica.ReplicateFrom(l.Addr().String())
+
+	waitReplication(t, replica, 0)
+	if line := <-lines; line != "set replica 0 0 11\r\n" {
+		t.Fatalf("Unexpected auth command %q", line)
+	}
+	if line := <-lines; line != "user secret\r\n" {
+		t.Fatalf("Unexpected auth value %q", line)
+	}
+	if _, ok := replica.Get("key"); !ok {
+		t.Fatal("Item is not replicated over authenticated link")
+	}
+}
+
+func TestReplicaLagging(t *testing.T) {
+	f := &replFeed{notify: make(chan struct{}, 1)}
+	record := make([]byte, 1024*1024)
+	for i := 0; i <= replBacklogLimit/len(record); i++ {
+		f.append(record)
+	}
+
+	if _, err := f.take(); err != ErrReplicaLagging {
+		t.Fatalf("Expected lagging replica, got %v", err)
+	}
+}
+
+func TestReplicationBrokenSnapshot(t *testing.T) {
+	primary := newTestStore()
+	primary.Set("key", &MEntry{Key: "key", Value: []byte("new"), Size: 3})
+	var snapshot bytes.Buffer
+	primary.WriteSnapshot(&snapshot)
+
+	replica := newTestStore()
+	replica.Set("key", &MEntry{Key: "key", Value: []byte("old"), Size: 3})
+	replica.Set("local", &MEntry{Key: "local"})
+
+	// Truncated sync keeps replica items
+	truncated := "REPLICATING\r\n" + snapshot.String()[:snapshot.Len()-1]
+	if err := replica.applyReplication(strings.NewReader(truncated)); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("Expected ErrBadSnapshot, got %v", err)
+	}
+	if _, ok := replica.Get("local"); !ok {
+		t.Fatal("Replica item is removed by failed sync")
+	}
+
+	// Complete sync replaces items, stream end fails link afterwards
+	if err := replica.applyReplication(strings.NewReader("REPLICATING\r\n" + snapshot.String())); err != io.EOF {
+		t.Fatalf("Expected end of stream, got %v", err)
+	}
+	if e, ok := replica.Get("key"); !ok || string(e.Value[:e.Size]) != "new" {
+		t.Fatal("Item is not replaced by primary snapshot")
+	}
+	if _, ok := replica.Get("local"); ok {
+		t.Fatal("Item missing on primary survived sync")
+	}
+}
@@ -0,0 +1,393 @@
+package memstore
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Slab allocator geometry, as memcached defaults
+const (
+	slabPageSize    = 1024 * 1024
+	slabMinChunk    = 64
+	slabGrowFactor  = 1.25
+	slabMaxChunk    = slabPageSize / 2
+	slabLargeClass  = 0 // values above slabMaxChunk are allocated separately
+	slabFirstClass  = 1
+	slabMaxClassNum = 64
+)
+
+type (
+	// slabAllocator store values in big pages split to equal chunks per size class.
+	// Pages are pointer free, so GC does not scan them and they are never released.
+	// Freed chunks are reused only after all readers pinned before free are gone.
+	slabAllocator struct {
+		classes []*slabClass
+		epochs  epochReclaimer
+
+		spareLock sync.Mutex
+		spare     [][]byte // pages released by classes, reused by any class
+
+		totalMalloced atomic.Int64
+		largeBytes    atomic.Int64
+		largeItems    atomic.Int64
+		pagesMoved    atomic.Uint64 // quota pages moved between classes
+		rescues       atomic.Uint64 // items moved out of released pages
+		reassignEvict atomic.Uint64 // items evicted because class quota was moved
+	}
+
+	// slabClass is chunks of one size, zero class accounts large and empty values without pages
+	slabClass struct {
+		id      int
+		size    int
+		perPage int
+
+		lock      sync.Mutex
+		pages     [][]byte // nil for released pages
+		pageUsed  []int
+		owners    []string // keys of used chunks, to move them out of released page
+		free      []uint32 // chunk ids, page*perPage + index
+		used      int
+		requested int64
+		draining  int // page being released, -1 if none
+
+		// Memory quota of items with values in class, physical bytes as store size
+		quota   atomic.Int64
+		usage   atomic.Int64
+		items   atomic.Int64
+		evicted atomic.Uint64
+
+		// Item counters of class, as store wide ones
+		evictedUnfetched atomic.Uint64
+		expiredUnfetched atomic.Uint64
+		reclaimed        atomic.Uint64
+		crawlerReclaimed atomic.Uint64
+	}
+
+	// slabChunk is value location in slab class, zero class means not slab allocated
+	slabChunk struct {
+		class uint8
+		id    uint32
+	}
+
+	// epochReclaimer is epoch based reclamation, readers pin current epoch parity,
+	// memory retired in epoch e is reused once epoch e+2 is reached.
+	epochReclaimer struct {
+		epoch   atomic.Uint64
+		readers [2]atomic.Int64
+
+		lock    sync.Mutex
+		retired [3][]slabChunk
+	}
+
+	// SlabStats is per class slab usage, as memcached stats slabs
+	SlabStats struct {
+		Class         int
+		ChunkSize     int
+		ChunksPerPage int
+		TotalPages    int
+		TotalChunks   int
+		UsedChunks    int
+		FreeChunks    int
+		MemRequested  int64
+		QuotaBytes    int64
+		UsageBytes    int64
+		Evicted       uint64
+	}
+
+	// SlabTotals is allocator wide slab stats
+	SlabTotals struct {
+		TotalMalloced     int64
+		LargeItems        int64
+		LargeBytes        int64
+		LargeQuota        int64
+		QuotaPool         int64
+		SparePages        int
+		PagesMoved        uint64
+		Rescues           uint64
+		ReassignEvictions uint64
+		Automove          int
+	}
+)
+
+func newSlabAllocator() *slabAllocator {
+	a := &slabAllocator{
+		classes: []*slabClass{slabLargeClass: {id: slabLargeClass, draining: -1}},
+	}
+
+	size := slabMinChunk
+	for id := slabFirstClass; id < slabMaxClassNum && size < slabMaxChunk; id++ {
+		a.classes = append(a.classes, &slabClass{id: id, size: size, perPage: slabPageSize / size, draining: -1})
+		// Keep chunks 8 bytes aligned
+		size = (int(float64(size)*slabGrowFactor) + 7) &^ 7
+	}
+	a.classes = append(a.classes, &slabClass{id: len(a.classes), size: slabMaxChunk, perPage: slabPageSize / slabMaxChunk, draining: -1})
+
+	return a
+}
+
+// classFor return slab class of value size, nil for large values
+func (a *slabAllocator) classFor(size int) *slabClass {
+	if size > slabMaxChunk {
+		return nil
+	}
+
+	// Few dozens of classes, binary search is not worth it
+	for _, c := range a.classes[slabFirstClass:] {
+		if size <= c.size {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// Alloc copy value of key to slab chunk, large values get own allocation
+func (a *slabAllocator) Alloc(key string, value []byte) ([]byte, slabChunk) {
+	c := a.classFor(len(value))
+	if c == nil {
+		a.largeBytes.Add(int64(len(value)))
+		a.largeItems.Add(1)
+		return append([]byte(nil), value...), slabChunk{}
+	}
+
+	c.lock.Lock()
+	if len(c.free) == 0 {
+		c.lock.Unlock()
+		a.Reclaim()
+		c.lock.Lock()
+	}
+	if len(c.free) == 0 {
+		c.grow(a.page())
+	}
+	id := c.free[len(c.free)-1]
+	c.free = c.free[:len(c.free)-1]
+	c.used++
+	c.pageUsed[int(id)/c.perPage]++
+	c.owners[id] = key
+	c.requested += int64(len(value))
+	buf := c.chunk(id)
+	c.lock.Unlock()
+
+	buf = buf[:len(value)]
+	copy(buf, value)
+	return buf, slabChunk{class: uint8(c.id), id: id}
+}
+
+// Free retire chunk, it is reused after readers are gone
+func (a *slabAllocator) Free(value []byte, chunk slabChunk) {
+	if chunk.class == slabLargeClass {
+		a.largeBytes.Add(-int64(len(value)))
+		a.largeItems.Add(-1)
+		return
+	}
+
+	c := a.classes[chunk.class]
+	c.lock.Lock()
+	c.requested -= int64(len(value))
+	c.lock.Unlock()
+
+	a.epochs.retire(chunk)
+}
+
+// page return spare page or allocate new one
+func (a *slabAllocator) page() []byte {
+	a.spareLock.Lock()
+	defer a.spareLock.Unlock()
+
+	if n := len(a.spare); n > 0 {
+		page := a.spare[n-1]
+		a.spare = a.spare[:n-1]
+		return page
+	}
+
+	a.totalMalloced.Add(slabPageSize)
+	return make([]byte, slabPageSize)
+}
+
+// owns check entry value is still backed by its chunk, copies of entry share it
+func (a *slabAllocator) owns(e *MEntry) bool {
+	if e.chunk.class == slabLargeClass || len(e.Value) == 0 {
+		return false
+	}
+
+	c := a.classes[e.chunk.class]
+	c.lock.Lock()
+	buf := c.chunk(e.chunk.id)
+	c.lock.Unlock()
+
+	return unsafe.SliceData(buf) == unsafe.SliceData(e.Value)
+}
+
+// Reclaim try to advance epoch and return chunks retired two epochs ago to free lists
+func (a *slabAllocator) Reclaim() {
+	for _, chunk := range a.epochs.advance() {
+		c := a.classes[chunk.class]
+		page := int(chunk.id) / c.perPage
+		c.lock.Lock()
+		c.used--
+		c.pageUsed[page]--
+		c.owners[chunk.id] = ""
+		if page != c.draining {
+			c.free = append(c.free, chunk.id)
+		} else if c.pageUsed[page] == 0 {
+			a.release(c)
+		}
+		c.lock.Unlock()
+	}
+}
+
+// drain start release of least used page if class has more than page of free chunks,
+// returns keys of items in the page, they must be moved out or deleted
+func (a *slabAllocator) drain(c *slabClass) (page int, keys []string, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.draining >= 0 || len(c.free) <= c.perPage {
+		return 0, nil, false
+	}
+
+	page = -1
+	for i := range c.pages {
+		if c.pages[i] != nil && (page < 0 || c.pageUsed[i] < c.pageUsed[page]) {
+			page = i
+		}
+	}
+	c.draining = page
+
+	// Chunks of released page must not be allocated again
+	free := c.free[:0]
+	for _, id := range c.free {
+		if int(id)/c.perPage != page {
+			free = append(free, id)
+		}
+	}
+	c.free = free
+
+	if c.pageUsed[page] == 0 {
+		a.release(c)
+		return 0, nil, false
+	}
+
+	for id := page * c.perPage; id < (page+1)*c.perPage; id++ {
+		if c.owners[id] != "" {
+			keys = append(keys, c.owners[id])
+		}
+	}
+
+	return page, keys, true
+}
+
+// release move empty draining page to spare pages, must hold class lock
+func (a *slabAllocator) release(c *slabClass) {
+	page := c.pages[c.draining]
+	c.pages[c.draining] = nil
+	c.draining = -1
+
+	a.spareLock.Lock()
+	a.spare = append(a.spare, page)
+	a.spareLock.Unlock()
+}
+
+// Stats return usage of classes with allocated pages
+func (a *slabAllocator) Stats() []SlabStats {
+	var stats []SlabStats
+	for _, c := range a.classes[slabFirstClass:] {
+		c.lock.Lock()
+		if pages := c.totalPages(); pages > 0 {
+			stats = append(stats, SlabStats{
+				Class:         c.id,
+				ChunkSize:     c.size,
+				ChunksPerPage: c.perPage,
+				TotalPages:    pages,
+				TotalChunks:   pages * c.perPage,
+				UsedChunks:    c.used,
+				FreeChunks:    len(c.free),
+				MemRequested:  c.requested,
+				QuotaBytes:    c.quota.Load(),
+				UsageBytes:    c.usage.Load(),
+				Evicted:       c.evicted.Load(),
+			})
+		}
+		c.lock.Unlock()
+	}
+
+	return stats
+}
+
+// grow add page to class free list, slot of released page is reused, must hold class lock
+func (c *slabClass) grow(mem []byte) {
+	page := len(c.pages)
+	for i := range c.pages {
+		if c.pages[i] == nil {
+			page = i
+			break
+		}
+	}
+	if page == len(c.pages) {
+		c.pages = append(c.pages, nil)
+		c.pageUsed = append(c.pageUsed, 0)
+		c.owners = append(c.owners, make([]string, c.perPage)...)
+	}
+
+	c.pages[page] = mem
+	for i := c.perPage - 1; i >= 0; i-- {
+		c.free = append(c.free, uint32(page*c.perPage+i))
+	}
+}
+
+// totalPages return number of pages in use, must hold class lock
+func (c *slabClass) totalPages() int {
+	pages := 0
+	for _, page := range c.pages {
+		if page != nil {
+			pages++
+		}
+	}
+
+	return pages
+}
+
+// chunk return chunk memory by id, must hold class lock
+func (c *slabClass) chunk(id uint32) []byte {
+	page := c.pages[int(id)/c.perPage]
+	offset := int(id) % c.perPage * c.size
+	return page[offset : offset+c.size : offset+c.size]
+}
+
+// pin mark reader active in current epoch, returns token for unpin
+func (r *epochReclaimer) pin() uint64 {
+	e := r.epoch.Load()
+	r.readers[e&1].Add(1)
+	return e
+}
+
+func (r *epochReclaimer) unpin(e uint64) {
+	r.readers[e&1].Add(-1)
+}
+
+func (r *epochReclaimer) retire(chunk slabChunk) {
+	r.lock.Lock()
+	e := r.epoch.Load()
+	r.retired[e%3] = append(r.retired[e%3], chunk)
+	r.lock.Unlock()
+}
+
+// advance move epoch forward if readers of previous epoch are gone,
+// returns chunks retired two epochs ago, they can't be referenced anymore
+func (r *epochReclaimer) advance() []slabChunk {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	e := r.epoch.Load()
+	if r.readers[(e+1)&1].Load() != 0 {
+		return nil
+	}
+
+	r.epoch.Store(e + 1)
+	// Retired in epoch e-1, slot is reused by epoch e+2
+	freed := r.retired[(e+2)%3]
+	r.retired[(e+2)%3] = nil
+
+	return freed
+}
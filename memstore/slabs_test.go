@@ -0,0 +1,84 @@
+package memstore
+
+import (
+	"bytes"
+	"testing"
+	"unsafe"
+)
+
+func TestSlabValueCopied(t *testing.T) {
+	s := newTestStore()
+
+	value := []byte("bar")
+	s.Set("foo", &MEntry{Key: "foo", Value: value, Size: 3})
+	copy(value, "baz")
+
+	e, _ := s.Get("foo")
+	if string(e.Value) != "bar" {
+		t.Fatalf("Expected stored value to be copied, got %q", e.Value)
+	}
+	if !s.slabs.owns(e) {
+		t.Fatal("Expected value in slab chunk")
+	}
+
+	// Touch store entry copy, it must share chunk
+	e, err := s.Touch("foo", 100)
+	if err != nil || !s.slabs.owns(e) {
+		t.Fatalf("Expected touched entry to keep chunk, err %v", err)
+	}
+
+	classes, totals := s.SlabStats()
+	if len(classes) != 1 || classes[0].UsedChunks != 1 || totals.TotalMalloced != slabPageSize {
+		t.Fatalf("Unexpected slab stats %+v, malloced %d", classes, totals.TotalMalloced)
+	}
+}
+
+func TestSlabReuse(t *testing.T) {
+	s := newTestStore()
+	value := bytes.Repeat([]byte{'a'}, 100)
+
+	s.Set("foo", &MEntry{Key: "foo", Value: value, Size: uint32(len(value))})
+	old, _ := s.Get("foo")
+
+	// Pinned reader keeps old value intact
+	pin := s.Pin()
+	s.Delete("foo")
+	for i := 0; i < 4; i++ {
+		s.slabs.Reclaim()
+	}
+	s.Set("bar", &MEntry{Key: "bar", Value: bytes.Repeat([]byte{'b'}, 100), Size: 100})
+	if !bytes.Equal(old.Value, value) {
+		t.Fatal("Value of pinned reader is reused")
+	}
+	s.Unpin(pin)
+
+	for i := 0; i < 4; i++ {
+		s.slabs.Reclaim()
+	}
+	e := &MEntry{Key: "baz", Value: bytes.Repeat([]byte{'c'}, 100), Size: 100}
+	s.Set("baz", e)
+	e, _ = s.Get("baz")
+	if unsafe.SliceData(e.Value) != unsafe.SliceData(old.Value) {
+		t.Fatal("Expected freed chunk to be reused")
+	}
+
+	classes, _ := s.SlabStats()
+	if classes[0].UsedChunks != 2 {
+		t.Fatalf("Expected 2 used chunks, got %+v", classes[0])
+	}
+}
+
+func TestSlabLargeValue(t *testing.T) {
+	s := newTestStore()
+	value := make([]byte, slabMaxChunk+1)
+
+	s.Set("foo", &MEntry{Key: "foo", Value: value, Size: uint32(len(value))})
+	if _, totals := s.SlabStats(); totals.LargeItems != 1 || totals.LargeBytes != int64(len(value)) {
+		t.Fatalf("Expected 1 large item, got %d of %d bytes", totals.LargeItems, totals.LargeBytes)
+	}
+
+	s.Delete("foo")
+	if _, totals := s.SlabStats(); totals.LargeItems != 0 || totals.LargeBytes != 0 {
+		t.Fatalf("Expected no large items, got %d of %d bytes", totals.LargeItems, totals.LargeBytes)
+	}
+}
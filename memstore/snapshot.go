@@ -0,0 +1,440 @@
+package memstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot file format, all numbers are little endian:
+//
+//	header:  magic "GMCS", version uint32, cas source uint64, snapshot time unix seconds int64
+//	item:    key length uint16, key, flags [4]byte, exptime int64, cas uint64, value length uint32, value
+//	end:     key length 0
+//	trailer: CRC-32C of all bytes above uint32, since version 2
+const (
+	snapshotMagic   = "GMCS"
+	snapshotVersion = 2
+)
+
+// Largest value read from snapshot if store has no item size limit, as max of -I
+const maxSnapshotItem = 1024 * 1024 * 1024
+
+// Items written between pin renewals, snapshot must not hold back memory reuse for long
+const snapshotPinItems = 1024
+
+var (
+	ErrBadSnapshot    = errors.New("bad snapshot")
+	ErrSnapshotBusy   = errors.New("snapshot in progress")
+	ErrSnapshotNoPath = errors.New("snapshot path is not configured")
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+type (
+	snapshotHeader struct {
+		Magic   [4]byte
+		Version uint32
+		Cas     uint64
+		Time    int64
+	}
+
+	snapshotItem struct {
+		Flags   [4]byte
+		ExpTime int64
+		Cas     uint64
+		Size    uint32
+	}
+
+	// snapshotter is state of periodic and on demand snapshots, one runs at time
+	snapshotter struct {
+		lock sync.Mutex
+		path atomic.Pointer[string]
+
+		running      atomic.Bool
+		count        atomic.Uint64
+		failures     atomic.Uint64
+		lastTime     atomic.Int64 // unix seconds of last successful snapshot
+		lastDuration atomic.Int64 // microseconds
+		lastBytes    atomic.Int64
+		lastItems    atomic.Int64
+	}
+
+	// SnapshotStats is snapshot counters and last successful snapshot
+	SnapshotStats struct {
+		InProgress   bool
+		Count        uint64
+		Failures     uint64
+		LastTime     int64
+		LastDuration time.Duration
+		LastBytes    int64
+		LastItems    int64
+	}
+
+	// hashReader update hash with bytes consumed by parser, not read ahead by
+	// buffer, and copy them to stage if it is set
+	hashReader struct {
+		r     *bufio.Reader
+		hash  hash.Hash32
+		stage io.Writer
+	}
+
+	countingWriter struct {
+		w io.Writer
+		n int64
+	}
+)
+
+func (h *hashReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	if h.stage != nil {
+		h.stage.Write(p[:n])
+	}
+	return n, err
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// WriteSnapshot dump alive items to w, returns number of written items.
+// Map is read by RCU, so writers are not blocked.
+func (s *SharedStore) WriteSnapshot(w io.Writer) (int, error) {
+	crc := crc32.New(crc32c)
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+	header := snapshotHeader{Version: snapshotVersion, Cas: s.casSrc.Load(), Time: time.Now().Unix()}
+	copy(header.Magic[:], snapshotMagic)
+	if err := binary.Write(bw, binary.LittleEndian, &header); err != nil {
+		return 0, err
+	}
+
+	// Values must not be reused while they are written, pin is renewed
+	// between items, next entry is loaded by Range under new pin
+	pin := s.Pin()
+	defer func() { s.Unpin(pin) }()
+
+	items := 0
+	var err error
+	s.coolmap.Range(func(key string, e *MEntry) bool {
+		if !s.alive(e) {
+			return true
+		}
+		e, ok := s.rangeValue(key, e)
+		if !ok {
+			return true
+		}
+
+		err = writeSnapshotItem(bw, e)
+		items++
+		if items%snapshotPinItems == 0 {
+			renewed := s.Pin()
+			s.Unpin(pin)
+			pin = renewed
+		}
+		return err == nil
+	})
+	if err != nil {
+		return items, err
+	}
+
+	if err := binary.Write(bw, binary.LittleEndian, uint16(0)); err != nil {
+		return items, err
+	}
+	if err := bw.Flush(); err != nil {
+		return items, err
+	}
+	return items, binary.Write(w, binary.LittleEndian, crc.Sum32())
+}
+
+func writeSnapshotItem(w *bufio.Writer, e *MEntry) error {
+	if err := binary.Write(w, binary.LittleEndian, uint16(len(e.Key))); err != nil {
+		return err
+	}
+	w.WriteString(e.Key)
+
+	item := snapshotItem{Flags: e.Flags, ExpTime: e.ExpTime, Cas: e.Cas, Size: e.Size}
+	if err := binary.Write(w, binary.LittleEndian, &item); err != nil {
+		return err
+	}
+	_, err := w.Write(e.Value[:e.Size])
+	return err
+}
+
+// ReadSnapshot load items dumped by WriteSnapshot from stream, e.g. of primary,
+// expired items are skipped, cas values are kept. Stream is staged to temp file
+// next to snapshot path and items are stored from it once checksum at end is
+// verified, so broken snapshot loads nothing and values are not held in heap.
+func (s *SharedStore) ReadSnapshot(r io.Reader) (int, error) {
+	dir := ""
+	if path := s.snapshots.path.Load(); path != nil && *path != "" {
+		dir = filepath.Dir(*path)
+	}
+	f, err := os.CreateTemp(dir, "snapshot-stage*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	stage := bufio.NewWriter(f)
+	cas, err := s.readSnapshot(r, stage, func(*MEntry) {})
+	if err != nil {
+		return 0, err
+	}
+	if err := stage.Flush(); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	return s.loadVerified(f, cas)
+}
+
+// loadVerified store items of snapshot verified by previous pass, store
+// copies values to slab memory, so parser buffer is reused
+func (s *SharedStore) loadVerified(r io.Reader, cas uint64) (int, error) {
+	s.bumpCas(cas)
+	loaded := 0
+	_, err := s.readSnapshot(r, nil, func(e *MEntry) {
+		if s.SetKeepCas(e.Key, e) == nil {
+			loaded++
+		}
+	})
+	return loaded, err
+}
+
+// readSnapshot parse snapshot and pass alive items to fn, entry value buffer
+// is reused by next item. Items over item size limit are skipped unread, so
+// size field is never trusted for allocation. Consumed bytes are copied to
+// stage if it is set. Returns cas source of snapshot.
+func (s *SharedStore) readSnapshot(r io.Reader, stage io.Writer, fn func(e *MEntry)) (uint64, error) {
+	br := bufio.NewReader(r)
+	hr := &hashReader{r: br, hash: crc32.New(crc32c), stage: stage}
+
+	var header snapshotHeader
+	if err := binary.Read(hr, binary.LittleEndian, &header); err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrBadSnapshot, err)
+	}
+	if string(header.Magic[:]) != snapshotMagic {
+		return 0, fmt.Errorf("%w: wrong magic", ErrBadSnapshot)
+	}
+	if header.Version < 1 || header.Version > snapshotVersion {
+		return 0, fmt.Errorf("%w: unsupported version %d", ErrBadSnapshot, header.Version)
+	}
+
+	limit := uint32(maxSnapshotItem)
+	if l := s.ItemSizeLimit(); l > 0 {
+		limit = uint32(l)
+	}
+	now := time.Now().Unix()
+	var value []byte
+	for {
+		var keyLen uint16
+		if err := binary.Read(hr, binary.LittleEndian, &keyLen); err != nil {
+			return 0, fmt.Errorf("%w: %w", ErrBadSnapshot, err)
+		}
+		if keyLen == 0 {
+			break
+		}
+
+		key := make([]byte, keyLen)
+		var item snapshotItem
+		if _, err := io.ReadFull(hr, key); err != nil {
+			return 0, fmt.Errorf("%w: %w", ErrBadSnapshot, err)
+		}
+		if err := binary.Read(hr, binary.LittleEndian, &item); err != nil {
+			return 0, fmt.Errorf("%w: %w", ErrBadSnapshot, err)
+		}
+		if item.Size > limit {
+			if _, err := io.CopyN(io.Discard, hr, int64(item.Size)); err != nil {
+				return 0, fmt.Errorf("%w: %w", ErrBadSnapshot, err)
+			}
+			continue
+		}
+		if cap(value) < int(item.Size) {
+			value = make([]byte, item.Size)
+		}
+		value = value[:item.Size]
+		if _, err := io.ReadFull(hr, value); err != nil {
+			return 0, fmt.Errorf("%w: %w", ErrBadSnapshot, err)
+		}
+
+		if item.ExpTime != 0 && item.ExpTime <= now {
+			continue
+		}
+		fn(&MEntry{
+			Key:     string(key),
+			Flags:   item.Flags,
+			ExpTime: item.ExpTime,
+			Cas:     item.Cas,
+			Size:    item.Size,
+			Value:   value,
+		})
+	}
+
+	if header.Version < 2 {
+		return header.Cas, nil
+	}
+	trailer := make([]byte, 4)
+	if _, err := io.ReadFull(br, trailer); err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrBadSnapshot, err)
+	}
+	if stage != nil {
+		stage.Write(trailer)
+	}
+	if binary.LittleEndian.Uint32(trailer) != hr.hash.Sum32() {
+		return 0, fmt.Errorf("%w: checksum mismatch", ErrBadSnapshot)
+	}
+	return header.Cas, nil
+}
+
+// SaveSnapshot dump store to temp file and atomically replace path with it,
+// so crash leaves previous snapshot intact. Returns number of items and bytes.
+func (s *SharedStore) SaveSnapshot(path string) (int, int64, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(f.Name())
+
+	w := &countingWriter{w: f}
+	items, err := s.WriteSnapshot(w)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return items, w.n, err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return items, w.n, err
+	}
+	// Rename is durable once directory is synced
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return items, w.n, nil
+}
+
+// LoadSnapshot load store from file, missing file is not an error
+func (s *SharedStore) LoadSnapshot(path string) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// File is verified by first pass, so broken snapshot loads nothing
+	cas, err := s.readSnapshot(f, nil, func(*MEntry) {})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	return s.loadVerified(f, cas)
+}
+
+// SetSnapshotPath set file used by Snapshot and periodic snapshots
+func (s *SharedStore) SetSnapshotPath(path string) {
+	s.snapshots.path.Store(&path)
+}
+
+// Snapshot save store to snapshot path, waits for running snapshot to finish
+func (s *SharedStore) Snapshot() error {
+	s.snapshots.lock.Lock()
+	defer s.snapshots.lock.Unlock()
+
+	return s.snapshot()
+}
+
+// BackgroundSnapshot start snapshot in background, ErrSnapshotBusy if one is running
+func (s *SharedStore) BackgroundSnapshot() error {
+	if path := s.snapshots.path.Load(); path == nil || *path == "" {
+		return ErrSnapshotNoPath
+	}
+	if !s.snapshots.lock.TryLock() {
+		return ErrSnapshotBusy
+	}
+
+	go func() {
+		defer s.snapshots.lock.Unlock()
+		if err := s.snapshot(); err != nil {
+			slog.Error("memstore - snapshot failed", "error", err)
+		}
+	}()
+	return nil
+}
+
+// Snapshotter save snapshot every interval, it is started once path is set
+func (s *SharedStore) Snapshotter(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.BackgroundSnapshot(); err != nil && err != ErrSnapshotBusy {
+			slog.Error("memstore - periodic snapshot", "error", err)
+		}
+	}
+}
+
+// snapshot save store and account result, must hold snapshot lock
+func (s *SharedStore) snapshot() error {
+	path := s.snapshots.path.Load()
+	if path == nil || *path == "" {
+		return ErrSnapshotNoPath
+	}
+
+	st := &s.snapshots
+	st.running.Store(true)
+	defer st.running.Store(false)
+
+	start := time.Now()
+	items, size, err := s.SaveSnapshot(*path)
+	if err != nil {
+		st.failures.Add(1)
+		return err
+	}
+
+	st.count.Add(1)
+	st.lastTime.Store(start.Unix())
+	st.lastDuration.Store(time.Since(start).Microseconds())
+	st.lastBytes.Store(size)
+	st.lastItems.Store(int64(items))
+	slog.Info("memstore - snapshot saved", "path", *path, "items", items, "bytes", size, "duration", time.Since(start))
+	return nil
+}
+
+// SnapshotStats return snapshot counters
+func (s *SharedStore) SnapshotStats() SnapshotStats {
+	st := &s.snapshots
+	return SnapshotStats{
+		InProgress:   st.running.Load(),
+		Count:        st.count.Load(),
+		Failures:     st.failures.Load(),
+		LastTime:     st.lastTime.Load(),
+		LastDuration: time.Duration(st.lastDuration.Load()) * time.Microsecond,
+		LastBytes:    st.lastBytes.Load(),
+		LastItems:    st.lastItems.Load(),
+	}
+}
@@ -0,0 +1,183 @@
+package memstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	s := newTestStore()
+	for i := 0; i < 1000; i++ {
+		key := "key:" + strconv.Itoa(i)
+		value := []byte(strconv.Itoa(i * i))
+		s.Set(key, &MEntry{Key: key, Value: value, Size: uint32(len(value)), Flags: [4]byte{1, 2, 3, byte(i)}})
+	}
+	s.Set("empty", &MEntry{Key: "empty"})
+	s.Set("expiring", &MEntry{Key: "expiring", ExpTime: time.Now().Unix() + 100})
+	foo, _ := s.Get("key:7")
+
+	path := filepath.Join(t.TempDir(), "snapshot")
+	saved, _, err := s.SaveSnapshot(path)
+	if err != nil || saved != 1002 {
+		t.Fatalf("Expected 1002 saved items, got %d, err %v", saved, err)
+	}
+
+	restored := newTestStore()
+	loaded, err := restored.LoadSnapshot(path)
+	if err != nil || loaded != 1002 {
+		t.Fatalf("Expected 1002 loaded items, got %d, err %v", loaded, err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		e, ok := restored.Get("key:" + strconv.Itoa(i))
+		if !ok || string(e.Value) != strconv.Itoa(i*i) || e.Flags[3] != byte(i) {
+			t.Fatalf("Item %d is not restored", i)
+		}
+	}
+	if e, ok := restored.Get("key:7"); !ok || e.Cas != foo.Cas {
+		t.Fatal("Item cas is not preserved")
+	}
+	if e, ok := restored.Get("expiring"); !ok || e.ExpTime == 0 {
+		t.Fatal("Item exptime is not preserved")
+	}
+
+	// New items get cas values above restored ones
+	restored.Set("new", &MEntry{Key: "new"})
+	if e, _ := restored.Get("new"); e.Cas <= s.casSrc.Load() {
+		t.Fatalf("New cas %d is not above snapshot cas %d", e.Cas, s.casSrc.Load())
+	}
+}
+
+func TestSnapshotSkipsExpired(t *testing.T) {
+	var empty bytes.Buffer
+	newTestStore().WriteSnapshot(&empty)
+
+	// Header of empty snapshot, expired item, end and checksum
+	buf := bytes.NewBuffer(empty.Bytes()[:empty.Len()-6])
+	bw := bufio.NewWriter(buf)
+	writeSnapshotItem(bw, &MEntry{Key: "expired", ExpTime: time.Now().Unix() - 1, Value: []byte("bar"), Size: 3})
+	writeSnapshotItem(bw, &MEntry{Key: "foo", Value: []byte("bar"), Size: 3})
+	bw.Write([]byte{0, 0})
+	bw.Flush()
+	binary.Write(buf, binary.LittleEndian, crc32.Checksum(buf.Bytes(), crc32c))
+
+	s := newTestStore()
+	if loaded, err := s.ReadSnapshot(buf); loaded != 1 || err != nil {
+		t.Fatalf("Expected 1 loaded item, got %d, err %v", loaded, err)
+	}
+	if _, ok := s.Get("expired"); ok {
+		t.Fatal("Expired item must be skipped")
+	}
+}
+
+func TestSnapshotErrors(t *testing.T) {
+	s := newTestStore()
+	if loaded, err := s.LoadSnapshot(filepath.Join(t.TempDir(), "missing")); loaded != 0 || err != nil {
+		t.Fatalf("Missing snapshot must be ignored, got %d, err %v", loaded, err)
+	}
+
+	if _, err := s.ReadSnapshot(bytes.NewReader([]byte("NOPE0000000000000000000000000000"))); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("Expected ErrBadSnapshot for wrong magic, got %v", err)
+	}
+
+	s.Set("foo", &MEntry{Key: "foo", Value: []byte("bar"), Size: 3})
+	var buf bytes.Buffer
+	s.WriteSnapshot(&buf)
+	if _, err := newTestStore().ReadSnapshot(bytes.NewReader(buf.Bytes()[:buf.Len()-1])); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("Expected ErrBadSnapshot for truncated snapshot, got %v", err)
+	}
+
+	// Item before corrupted byte is parsed, but must not be stored
+	corrupted := bytes.Clone(buf.Bytes())
+	corrupted[len(corrupted)-8] ^= 1
+	restored := newTestStore()
+	if loaded, err := restored.ReadSnapshot(bytes.NewReader(corrupted)); loaded != 0 || !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("Expected ErrBadSnapshot for corrupted snapshot, got %d, err %v", loaded, err)
+	}
+	path := filepath.Join(t.TempDir(), "snapshot")
+	if err := os.WriteFile(path, corrupted, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := restored.LoadSnapshot(path); loaded != 0 || !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("Expected ErrBadSnapshot for corrupted file, got %d, err %v", loaded, err)
+	}
+	if _, ok := restored.Get("foo"); ok {
+		t.Fatal("Item of corrupted snapshot is loaded")
+	}
+}
+
+func TestBackgroundSnapshot(t *testing.T) {
+	s := newTestStore()
+	if err := s.BackgroundSnapshot(); err != ErrSnapshotNoPath {
+		t.Fatalf("Expected ErrSnapshotNoPath, got %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "snapshot")
+	s.SetSnapshotPath(path)
+	s.Set("foo", &MEntry{Key: "foo", Value: []byte("bar"), Size: 3})
+	if err := s.BackgroundSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	// Waits for background one
+	if err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := s.SnapshotStats()
+	if stats.Count != 2 || stats.InProgress || stats.LastItems != 1 || stats.LastBytes == 0 {
+		t.Fatalf("Unexpected snapshot stats %+v", stats)
+	}
+	if files, _ := filepath.Glob(path + "*"); len(files) != 1 {
+		t.Fatalf("Expected only snapshot file, got %v", files)
+	}
+
+	restored := newTestStore()
+	if loaded, err := restored.LoadSnapshot(path); loaded != 1 || err != nil {
+		t.Fatalf("Expected 1 loaded item, got %d, err %v", loaded, err)
+	}
+}
+
+func TestSnapshotItemSizeLimit(t *testing.T) {
+	s := newTestStore()
+	large := bytes.Repeat([]byte("v"), 2048)
+	s.Set("large", &MEntry{Key: "large", Value: large, Size: uint32(len(large))})
+	s.Set("small", &MEntry{Key: "small", Value: []byte("v"), Size: 1})
+	var buf bytes.Buffer
+	if _, err := s.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Items over limit are skipped, stream after snapshot is left unread
+	restored := newTestStore()
+	restored.SetItemSizeLimit(1024)
+	stream := bufio.NewReaderSize(io.MultiReader(&buf, strings.NewReader("next")), 64*1024)
+	if loaded, err := restored.ReadSnapshot(stream); loaded != 1 || err != nil {
+		t.Fatalf("Expected 1 loaded item, got %d, err %v", loaded, err)
+	}
+	if _, ok := restored.Get("large"); ok {
+		t.Fatal("Item over size limit is loaded")
+	}
+	if rest, _ := io.ReadAll(stream); string(rest) != "next" {
+		t.Fatalf("Expected stream after snapshot, got %q", rest)
+	}
+
+	// Corrupted size is not allocated
+	var header bytes.Buffer
+	binary.Write(&header, binary.LittleEndian, &snapshotHeader{Magic: [4]byte{'G', 'M', 'C', 'S'}, Version: snapshotVersion})
+	binary.Write(&header, binary.LittleEndian, uint16(3))
+	header.WriteString("key")
+	binary.Write(&header, binary.LittleEndian, &snapshotItem{Size: 0xffffffff})
+	if _, err := newTestStore().ReadSnapshot(&header); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("Expected ErrBadSnapshot for truncated item, got %v", err)
+	}
+}
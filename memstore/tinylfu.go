@@ -0,0 +1,237 @@
+package memstore
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// W-TinyLFU segments sizes, percent
+const (
+	windowPercent    = 1  // of all items
+	protectedPercent = 80 // of main segments
+)
+
+// W-TinyLFU reuses LRU segment ids
+const (
+	segWindow    = segHot
+	segProtected = segWarm
+	segProbation = segCold
+)
+
+type (
+	// tinyLFU is W-TinyLFU: new keys go to small LRU window, window tail is
+	// admitted to segmented main LRU only if it is more frequent than main
+	// victim by count-min sketch, so one time scans do not wash out hot keys
+	tinyLFU struct {
+		lock   sync.Mutex
+		segs   [segCount]policyList
+		sketch countMinSketch
+
+		movesToCold    atomic.Uint64
+		movesToWarm    atomic.Uint64
+		movesWithinLRU atomic.Uint64
+	}
+
+	// countMinSketch is 4 rows of 4 bit like saturating counters, halved periodically
+	countMinSketch struct {
+		table      []uint8
+		mask       uint64
+		additions  int
+		sampleSize int
+	}
+)
+
+func newTinyLFU() *tinyLFU {
+	l := &tinyLFU{}
+	for i := range l.segs {
+		l.segs[i].init()
+	}
+	l.sketch.resize(0)
+
+	return l
+}
+
+// move relink node to segment head, must hold lock
+func (l *tinyLFU) move(n *policyNode, seg int8) {
+	l.segs[n.seg].unlink(n)
+	l.segs[seg].pushFront(n, seg)
+}
+
+// frequency fold hits collected without lock into sketch and return estimate, must hold lock
+func (l *tinyLFU) frequency(n *policyNode) uint8 {
+	l.sketch.add(n.hash, n.hits.Swap(0))
+	return l.sketch.estimate(n.hash)
+}
+
+func (l *tinyLFU) total() int {
+	return l.segs[segWindow].len + l.segs[segProtected].len + l.segs[segProbation].len
+}
+
+func (l *tinyLFU) Insert(key string) *policyNode {
+	n := newPolicyNode(key)
+
+	l.lock.Lock()
+	l.segs[segWindow].pushFront(n, segWindow)
+	l.sketch.resize(l.total())
+	l.sketch.add(n.hash, 1)
+	l.lock.Unlock()
+
+	return n
+}
+
+func (l *tinyLFU) Remove(n *policyNode) {
+	l.lock.Lock()
+	if n.linked {
+		l.segs[n.seg].unlink(n)
+	}
+	l.lock.Unlock()
+}
+
+// probationTail return main victim, accessed probation keys are promoted to protected, must hold lock
+func (l *tinyLFU) probationTail() *policyNode {
+	for {
+		main := l.segs[segProtected].len + l.segs[segProbation].len
+		for i := l.segs[segProtected].len; i > 0 && l.segs[segProtected].len > main*protectedPercent/100; i-- {
+			n := l.segs[segProtected].tail()
+			if n.hits.Load() > 0 {
+				l.frequency(n)
+				l.move(n, segProtected)
+				l.movesWithinLRU.Add(1)
+				continue
+			}
+			l.move(n, segProbation)
+			l.movesToCold.Add(1)
+		}
+
+		n := l.segs[segProbation].tail()
+		if n == nil || n.hits.Load() == 0 {
+			return n
+		}
+		l.frequency(n)
+		l.move(n, segProtected)
+		l.movesToWarm.Add(1)
+	}
+}
+
+func (l *tinyLFU) Victim() *policyNode {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	window := l.total() * windowPercent / 100
+	// Main is empty, e.g. on first eviction, window overflow is admitted for free
+	if l.segs[segProtected].len+l.segs[segProbation].len == 0 {
+		for l.segs[segWindow].len > window {
+			l.move(l.segs[segWindow].tail(), segProbation)
+		}
+	}
+
+	var candidate *policyNode
+	if l.segs[segWindow].len > window {
+		candidate = l.segs[segWindow].tail()
+	}
+	victim := l.probationTail()
+
+	switch {
+	case candidate == nil && victim == nil:
+		// Everything is protected or window is small, fallback to any tail
+		for _, seg := range []int8{segProtected, segWindow} {
+			if n := l.segs[seg].tail(); n != nil {
+				l.segs[seg].unlink(n)
+				return n
+			}
+		}
+		return nil
+	case candidate == nil:
+		l.segs[segProbation].unlink(victim)
+		return victim
+	case victim == nil:
+		l.segs[segWindow].unlink(candidate)
+		return candidate
+	}
+
+	// Admission, window candidate replaces main victim only if it is more popular
+	if l.frequency(candidate) > l.frequency(victim) {
+		l.segs[segProbation].unlink(victim)
+		l.move(candidate, segProbation)
+		l.movesToCold.Add(1)
+		return victim
+	}
+
+	l.segs[segWindow].unlink(candidate)
+	return candidate
+}
+
+func (l *tinyLFU) Stats() PolicyStats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return PolicyStats{
+		Policy:         "wtinylfu",
+		NumberHot:      uint64(l.segs[segWindow].len),
+		NumberWarm:     uint64(l.segs[segProtected].len),
+		NumberCold:     uint64(l.segs[segProbation].len),
+		MovesToCold:    l.movesToCold.Load(),
+		MovesToWarm:    l.movesToWarm.Load(),
+		MovesWithinLRU: l.movesWithinLRU.Load(),
+	}
+}
+
+func (l *tinyLFU) ResetStats() {
+	l.movesToCold.Store(0)
+	l.movesToWarm.Store(0)
+	l.movesWithinLRU.Store(0)
+}
+
+// sketch rows
+const sketchDepth = 4
+
+// resize grow sketch to fit number of items, history is dropped on grow
+func (c *countMinSketch) resize(items int) {
+	width := 1024
+	if items > width {
+		width = 1 << bits.Len(uint(items-1))
+	}
+	if len(c.table) >= width*sketchDepth {
+		return
+	}
+
+	c.table = make([]uint8, width*sketchDepth)
+	c.mask = uint64(width - 1)
+	c.additions = 0
+	c.sampleSize = 10 * width
+}
+
+// index return counter position in row, rows use double hashing of 64 bit hash
+func (c *countMinSketch) index(h uint64, row int) uint64 {
+	h1, h2 := h, h>>32|h<<32
+	return uint64(row)*(c.mask+1) + (h1+uint64(row)*h2)&c.mask
+}
+
+func (c *countMinSketch) add(h uint64, count uint32) {
+	if count == 0 {
+		return
+	}
+
+	for row := 0; row < sketchDepth; row++ {
+		i := c.index(h, row)
+		c.table[i] = uint8(min(uint32(c.table[i])+count, 15))
+	}
+
+	c.additions += int(count)
+	if c.additions >= c.sampleSize {
+		for i := range c.table {
+			c.table[i] /= 2
+		}
+		c.additions /= 2
+	}
+}
+
+func (c *countMinSketch) estimate(h uint64) uint8 {
+	estimate := uint8(15)
+	for row := 0; row < sketchDepth; row++ {
+		estimate = min(estimate, c.table[c.index(h, row)])
+	}
+
+	return estimate
+}
@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// Collector write its metrics on each scrape
+	Collector func(w *Writer)
+
+	// Writer produce Prometheus text exposition format
+	Writer struct {
+		wb *bufio.Writer
+	}
+
+	// Histogram is lock free fixed buckets latency histogram
+	Histogram struct {
+		buckets []float64 // upper bounds in seconds
+		counts  []atomic.Uint64
+		count   atomic.Uint64
+		sum     atomic.Uint64 // nanoseconds
+	}
+)
+
+// LatencyBuckets cover in-memory command latency from 10us to 1s
+var LatencyBuckets = []float64{
+	0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005,
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1,
+}
+
+// NewHistogram init histogram with sorted upper bounds in seconds
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]atomic.Uint64, len(buckets)),
+	}
+}
+
+// Observe add duration to histogram
+func (h *Histogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	for i, bound := range h.buckets {
+		if seconds <= bound {
+			h.counts[i].Add(1)
+			break
+		}
+	}
+	h.count.Add(1)
+	h.sum.Add(uint64(d))
+}
+
+// Count return number of observations
+func (h *Histogram) Count() uint64 {
+	return h.count.Load()
+}
+
+// Handler serve metrics of all collectors
+func Handler(collectors ...Collector) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w := &Writer{wb: bufio.NewWriter(rw)}
+		for _, collect := range collectors {
+			collect(w)
+		}
+		w.wb.Flush()
+	})
+}
+
+// Header write HELP and TYPE lines of metric family, must precede samples
+func (w *Writer) Header(name string, help string, typ string) {
+	fmt.Fprintf(w.wb, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// Sample write single sample, labels are preformatted like `command="get"`
+func (w *Writer) Sample(name string, labels string, value float64) {
+	w.wb.WriteString(name)
+	if labels != "" {
+		w.wb.WriteString("{" + labels + "}")
+	}
+	w.wb.WriteString(" " + formatFloat(value) + "\n")
+}
+
+// Counter write counter family with single sample
+func (w *Writer) Counter(name string, help string, value uint64) {
+	w.Header(name, help, "counter")
+	w.Sample(name, "", float64(value))
+}
+
+// Gauge write gauge family with single sample
+func (w *Writer) Gauge(name string, help string, value float64) {
+	w.Header(name, help, "gauge")
+	w.Sample(name, "", value)
+}
+
+// Histogram write histogram samples, family header must be written by caller
+func (w *Writer) Histogram(name string, labels string, h *Histogram) {
+	prefix := labels
+	if prefix != "" {
+		prefix += ","
+	}
+
+	cumulative := uint64(0)
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i].Load()
+		w.Sample(name+"_bucket", prefix+`le="`+formatFloat(bound)+`"`, float64(cumulative))
+	}
+	// Observation can be in flight between bucket and count update
+	count := max(h.count.Load(), cumulative)
+	w.Sample(name+"_bucket", prefix+`le="+Inf"`, float64(count))
+	w.Sample(name+"_sum", labels, time.Duration(h.sum.Load()).Seconds())
+	w.Sample(name+"_count", labels, float64(count))
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
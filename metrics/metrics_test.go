@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]float64{0.001, 0.01})
+	h.Observe(500 * time.Microsecond)
+	h.Observe(5 * time.Millisecond)
+	h.Observe(time.Second)
+
+	if h.Count() != 3 {
+		t.Fatalf("Expected 3 observations, got %d", h.Count())
+	}
+
+	rec := httptest.NewRecorder()
+	Handler(func(w *Writer) {
+		w.Header("latency_seconds", "Test latency.", "histogram")
+		w.Histogram("latency_seconds", `command="get"`, h)
+	}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, _ := io.ReadAll(rec.Body)
+	expected := []string{
+		"# TYPE latency_seconds histogram",
+		`latency_seconds_bucket{command="get",le="0.001"} 1`,
+		`latency_seconds_bucket{command="get",le="0.01"} 2`,
+		`latency_seconds_bucket{command="get",le="+Inf"} 3`,
+		`latency_seconds_sum{command="get"} 1.0055`,
+		`latency_seconds_count{command="get"} 3`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Fatalf("Expected %q in output:\n%s", line, body)
+		}
+	}
+}
+
+func TestCounterGauge(t *testing.T) {
+	rec := httptest.NewRecorder()
+	Handler(
+		func(w *Writer) { w.Counter("requests_total", "Test counter.", 42) },
+		func(w *Writer) { w.Gauge("items", "Test gauge.", 1.5) },
+	).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	expected := "# HELP requests_total Test counter.\n# TYPE requests_total counter\nrequests_total 42\n" +
+		"# HELP items Test gauge.\n# TYPE items gauge\nitems 1.5\n"
+	if rec.Body.String() != expected {
+		t.Fatalf("Unexpected output:\n%s", rec.Body.String())
+	}
+}
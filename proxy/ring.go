@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"crypto/md5"
+	"sort"
+	"strconv"
+)
+
+// Ketama points of each backend, 40 md5 digests split to 4 points each,
+// same as libketama and twemproxy for equally weighted servers
+const (
+	ketamaDigests         = 40
+	ketamaPointsPerDigest = 4
+)
+
+type (
+	// ring is ketama continuum, immutable once built
+	ring struct {
+		points []ringPoint
+	}
+
+	ringPoint struct {
+		hash    uint32
+		backend int
+	}
+)
+
+// newRing build continuum of backends named by address, point of digest i is
+// hashed from "<address>-<i>"
+func newRing(addresses []string) *ring {
+	r := &ring{points: make([]ringPoint, 0, len(addresses)*ketamaDigests*ketamaPointsPerDigest)}
+	for i, address := range addresses {
+		for d := 0; d < ketamaDigests; d++ {
+			digest := md5.Sum([]byte(address + "-" + strconv.Itoa(d)))
+			for p := 0; p < ketamaPointsPerDigest; p++ {
+				r.points = append(r.points, ringPoint{hash: ketamaPoint(digest, p), backend: i})
+			}
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+
+	return r
+}
+
+// ketamaPoint return n-th little endian uint32 of digest
+func ketamaPoint(digest [md5.Size]byte, n int) uint32 {
+	return uint32(digest[3+n*4])<<24 | uint32(digest[2+n*4])<<16 | uint32(digest[1+n*4])<<8 | uint32(digest[n*4])
+}
+
+// ketamaHash is hash of key on continuum
+func ketamaHash(key string) uint32 {
+	return ketamaPoint(md5.Sum([]byte(key)), 0)
+}
+
+// lookup return backend of key, first point clockwise from key hash for which
+// usable is true, or -1 if no backend is usable
+func (r *ring) lookup(key string, usable func(backend int) bool) int {
+	if len(r.points) == 0 {
+		return -1
+	}
+
+	hash := ketamaHash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+	for i := 0; i < len(r.points); i++ {
+		point := r.points[(start+i)%len(r.points)]
+		if usable(point.backend) {
+			return point.backend
+		}
+	}
+
+	return -1
+}
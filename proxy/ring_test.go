@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRingDistribution(t *testing.T) {
+	addresses := []string{"10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211", "10.0.0.4:11211"}
+	r := newRing(addresses)
+	if len(r.points) != len(addresses)*160 {
+		t.Fatalf("Expected 160 points per backend, got %d", len(r.points))
+	}
+
+	const keys = 100000
+	counts := make([]int, len(addresses))
+	for i := 0; i < keys; i++ {
+		counts[r.lookup("key:"+strconv.Itoa(i), func(int) bool { return true })]++
+	}
+	for i, count := range counts {
+		if share := float64(count) / keys; share < 0.15 || share > 0.35 {
+			t.Fatalf("Backend %s got %.2f of keys", addresses[i], share)
+		}
+	}
+}
+
+func TestRingFailover(t *testing.T) {
+	addresses := []string{"10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211"}
+	r := newRing(addresses)
+	all := func(int) bool { return true }
+	withoutFirst := func(backend int) bool { return backend != 0 }
+
+	// Only keys of removed backend move, same as ring built without it
+	smaller := newRing(addresses[1:])
+	for i := 0; i < 10000; i++ {
+		key := "key:" + strconv.Itoa(i)
+		primary := r.lookup(key, all)
+		failover := r.lookup(key, withoutFirst)
+		if primary != 0 && failover != primary {
+			t.Fatalf("Key %s moved from healthy backend %d to %d", key, primary, failover)
+		}
+		if failover != smaller.lookup(key, all)+1 {
+			t.Fatalf("Key %s failover differs from ring without backend", key)
+		}
+	}
+
+	if r.lookup("key", func(int) bool { return false }) != -1 {
+		t.Fatal("Expected no backend when all are down")
+	}
+}
@@ -0,0 +1,312 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"nefelim4ag/go-memcached-server/metrics"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"log/slog"
+)
+
+// Defaults of router config
+const (
+	DefaultTimeout        = time.Second
+	DefaultHealthInterval = time.Second
+	DefaultFailureLimit   = 3
+	DefaultMaxIdle        = 16
+)
+
+var (
+	ErrNoBackends  = errors.New("no backends configured")
+	ErrUnavailable = errors.New("no backend available")
+)
+
+type (
+	// Config of router, zero fields are set to defaults
+	Config struct {
+		Backends       []string      // backend addresses, e.g. host:11211
+		Timeout        time.Duration // dial and request timeout
+		HealthInterval time.Duration // health check interval of each backend
+		FailureLimit   int           // consecutive failures which mark backend down
+		MaxIdle        int           // idle connections kept per backend
+	}
+
+	// Router forward requests to backend chosen by ketama hash of the key,
+	// keys of backend marked down go to next backend on continuum
+	Router struct {
+		config   Config
+		backends []*Backend
+		ring     *ring
+		shutdown chan struct{}
+		workers  sync.WaitGroup
+	}
+
+	// Backend is memcached server of router pool
+	Backend struct {
+		address string
+		idle    chan *Conn
+
+		up        atomic.Bool
+		failures  atomic.Int32 // consecutive failures
+		requests  atomic.Uint64
+		errors    atomic.Uint64
+		failovers atomic.Uint64 // requests sent to other backend while this one was down
+		downs     atomic.Uint64
+		checks    atomic.Uint64
+	}
+
+	// Conn is connection to backend
+	Conn struct {
+		R    *bufio.Reader
+		W    *bufio.Writer
+		conn net.Conn
+	}
+
+	// BackendStats is counters of backend
+	BackendStats struct {
+		Address   string
+		Up        bool
+		Idle      int
+		Requests  uint64
+		Errors    uint64
+		Failovers uint64
+		Downs     uint64
+		Checks    uint64
+	}
+)
+
+// NewRouter create router of backends and start health checks
+func NewRouter(config Config) (*Router, error) {
+	if len(config.Backends) == 0 {
+		return nil, ErrNoBackends
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.HealthInterval <= 0 {
+		config.HealthInterval = DefaultHealthInterval
+	}
+	if config.FailureLimit <= 0 {
+		config.FailureLimit = DefaultFailureLimit
+	}
+	if config.MaxIdle <= 0 {
+		config.MaxIdle = DefaultMaxIdle
+	}
+
+	r := &Router{
+		config:   config,
+		ring:     newRing(config.Backends),
+		shutdown: make(chan struct{}),
+	}
+	for _, address := range config.Backends {
+		b := &Backend{address: address, idle: make(chan *Conn, config.MaxIdle)}
+		b.up.Store(true)
+		r.backends = append(r.backends, b)
+	}
+
+	r.workers.Add(len(r.backends))
+	for _, b := range r.backends {
+		go r.healthCheck(b)
+	}
+	slog.Info("Router started", "backends", len(r.backends))
+
+	return r, nil
+}
+
+// Close stop health checks and close idle connections
+func (r *Router) Close() {
+	close(r.shutdown)
+	r.workers.Wait()
+
+	for _, b := range r.backends {
+		for len(b.idle) > 0 {
+			(<-b.idle).conn.Close()
+		}
+	}
+}
+
+// Pick return backend of key, backends which are down are skipped
+func (r *Router) Pick(key string) (*Backend, error) {
+	i := r.ring.lookup(key, func(backend int) bool { return r.backends[backend].up.Load() })
+	if i < 0 {
+		return nil, ErrUnavailable
+	}
+
+	b := r.backends[i]
+	if primary := r.ring.lookup(key, func(int) bool { return true }); primary != i {
+		r.backends[primary].failovers.Add(1)
+	}
+
+	return b, nil
+}
+
+// Backends return all backends in configured order, e.g. for broadcast commands
+func (r *Router) Backends() []*Backend {
+	return r.backends
+}
+
+// Address return backend address
+func (b *Backend) Address() string {
+	return b.address
+}
+
+// Up report whether backend passes health checks
+func (b *Backend) Up() bool {
+	return b.up.Load()
+}
+
+// Do run request on backend connection, fn writes request and reads reply.
+// Connection is reused unless fn fails, failure is accounted to backend health.
+func (r *Router) Do(b *Backend, fn func(c *Conn) error) error {
+	b.requests.Add(1)
+
+	c, err := r.conn(b)
+	if err == nil {
+		c.conn.SetDeadline(time.Now().Add(r.config.Timeout))
+		err = fn(c)
+	}
+	if err != nil {
+		if c != nil {
+			c.conn.Close()
+		}
+		b.errors.Add(1)
+		r.fail(b, err)
+		return fmt.Errorf("backend %s: %w", b.address, err)
+	}
+
+	b.failures.Store(0)
+	select {
+	case b.idle <- c:
+	default:
+		c.conn.Close()
+	}
+
+	return nil
+}
+
+func (r *Router) conn(b *Backend) (*Conn, error) {
+	select {
+	case c := <-b.idle:
+		return c, nil
+	default:
+	}
+
+	conn, err := net.DialTimeout("tcp", b.address, r.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{R: bufio.NewReader(conn), W: bufio.NewWriter(conn), conn: conn}, nil
+}
+
+// fail account backend failure, backend is marked down once failures reach limit
+func (r *Router) fail(b *Backend, err error) {
+	if b.failures.Add(1) >= int32(r.config.FailureLimit) && b.up.CompareAndSwap(true, false) {
+		b.downs.Add(1)
+		slog.Warn("Backend down", "backend", b.address, "error", err)
+	}
+}
+
+// healthCheck probe backend by version command, backend which is down is
+// marked up on first successful probe
+func (r *Router) healthCheck(b *Backend) {
+	defer r.workers.Done()
+
+	ticker := time.NewTicker(r.config.HealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.shutdown:
+			return
+		case <-ticker.C:
+		}
+
+		b.checks.Add(1)
+		if err := r.probe(b); err != nil {
+			r.fail(b, err)
+			continue
+		}
+		b.failures.Store(0)
+		if b.up.CompareAndSwap(false, true) {
+			slog.Info("Backend up", "backend", b.address)
+		}
+	}
+}
+
+func (r *Router) probe(b *Backend) error {
+	conn, err := net.DialTimeout("tcp", b.address, r.config.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(r.config.Timeout))
+	if _, err := io.WriteString(conn, "version\r\n"); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "VERSION ") {
+		return fmt.Errorf("unexpected version reply %q", strings.TrimSpace(line))
+	}
+
+	return nil
+}
+
+// Stats return counters of backends in configured order
+func (r *Router) Stats() []BackendStats {
+	stats := make([]BackendStats, 0, len(r.backends))
+	for _, b := range r.backends {
+		stats = append(stats, BackendStats{
+			Address:   b.address,
+			Up:        b.up.Load(),
+			Idle:      len(b.idle),
+			Requests:  b.requests.Load(),
+			Errors:    b.errors.Load(),
+			Failovers: b.failovers.Load(),
+			Downs:     b.downs.Load(),
+			Checks:    b.checks.Load(),
+		})
+	}
+
+	return stats
+}
+
+// WriteMetrics is metrics collector of per backend counters
+func (r *Router) WriteMetrics(w *metrics.Writer) {
+	stats := r.Stats()
+	families := []struct {
+		name  string
+		help  string
+		typ   string
+		value func(s BackendStats) float64
+	}{
+		{"memcached_proxy_backend_up", "Whether backend passes health checks.", "gauge", func(s BackendStats) float64 {
+			if s.Up {
+				return 1
+			}
+			return 0
+		}},
+		{"memcached_proxy_backend_idle_connections", "Idle connections to backend.", "gauge", func(s BackendStats) float64 { return float64(s.Idle) }},
+		{"memcached_proxy_backend_requests_total", "Requests sent to backend.", "counter", func(s BackendStats) float64 { return float64(s.Requests) }},
+		{"memcached_proxy_backend_errors_total", "Requests failed on backend.", "counter", func(s BackendStats) float64 { return float64(s.Errors) }},
+		{"memcached_proxy_backend_failovers_total", "Requests of backend keys sent to other backend while it was down.", "counter", func(s BackendStats) float64 { return float64(s.Failovers) }},
+		{"memcached_proxy_backend_downs_total", "Times backend was marked down.", "counter", func(s BackendStats) float64 { return float64(s.Downs) }},
+	}
+
+	for _, f := range families {
+		w.Header(f.name, f.help, f.typ)
+		for _, s := range stats {
+			w.Sample(f.name, `backend="`+s.Address+`"`, f.value(s))
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveVersion start backend answering version command only, returns its listener
+func serveVersion(t *testing.T, address string) net.Listener {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					if _, err := r.ReadString('\n'); err != nil {
+						return
+					}
+					conn.Write([]byte("VERSION 1.6.2\r\n"))
+				}
+			}()
+		}
+	}()
+
+	return l
+}
+
+// waitBackend wait for failures or health checks to mark backend up or down
+func waitBackend(t *testing.T, b *Backend, up bool) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for b.Up() != up {
+		select {
+		case <-timeout:
+			t.Fatalf("Expected backend %s up %v after %d health checks", b.address, up, b.checks.Load())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestRouterFailover(t *testing.T) {
+	first := serveVersion(t, "127.0.0.1:0")
+	second := serveVersion(t, "127.0.0.1:0")
+	r, err := NewRouter(Config{
+		Backends:       []string{first.Addr().String(), second.Addr().String()},
+		HealthInterval: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Find key of first backend
+	key := ""
+	for i := 0; key == ""; i++ {
+		if b, _ := r.Pick(string(rune('a' + i))); b == r.backends[0] {
+			key = string(rune('a' + i))
+		}
+	}
+	version := func(c *Conn) error {
+		c.W.WriteString("version\r\n")
+		if err := c.W.Flush(); err != nil {
+			return err
+		}
+		_, err := c.R.ReadString('\n')
+		return err
+	}
+	if err := r.Do(r.backends[0], version); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pooled connection and health checks fail once backend is gone
+	first.Close()
+	waitBackend(t, r.backends[0], false)
+	if b, err := r.Pick(key); err != nil || b != r.backends[1] {
+		t.Fatalf("Expected failover to second backend, got %v, %v", b, err)
+	}
+	if stats := r.Stats()[0]; stats.Downs != 1 || stats.Failovers != 1 {
+		t.Fatalf("Expected failover in stats, got %+v", stats)
+	}
+
+	// Backend is back once health check passes
+	serveVersion(t, first.Addr().String())
+	waitBackend(t, r.backends[0], true)
+	if b, _ := r.Pick(key); b != r.backends[0] {
+		t.Fatal("Expected key back on recovered backend")
+	}
+	if err := r.Do(r.backends[0], version); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRouterUnavailable(t *testing.T) {
+	if _, err := NewRouter(Config{}); err != ErrNoBackends {
+		t.Fatalf("Expected no backends error, got %v", err)
+	}
+
+	// Nothing listens on reserved port
+	l := serveVersion(t, "127.0.0.1:0")
+	l.Close()
+	r, err := NewRouter(Config{Backends: []string{l.Addr().String()}, FailureLimit: 1, HealthInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	b, _ := r.Pick("key")
+	if err := r.Do(b, func(c *Conn) error { return nil }); err == nil {
+		t.Fatal("Expected dial error")
+	}
+	if _, err := r.Pick("key"); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("Expected unavailable backend, got %v", err)
+	}
+	if stats := r.Stats()[0]; stats.Requests != 1 || stats.Errors != 1 || stats.Up {
+		t.Fatalf("Expected failed request in stats, got %+v", stats)
+	}
+}
@@ -83,9 +83,9 @@ func (Node *leafNodeType[V]) splitChild(offset uint, lvl uint) {
 	child := Node.entries[offset].Load()
 	pNode := (*petalNodeType[V])(unsafe.Pointer(child))
 	newNode := NodeType[V]{}
-	for _, v := range pNode.entries {
-		if v.Load() != nil {
-			for ln := v.Load(); ln != nil; ln = ln.next.Load() {
+	for k := range pNode.entries {
+		if pNode.entries[k].Load() != nil {
+			for ln := pNode.entries[k].Load(); ln != nil; ln = ln.next.Load() {
 				key := ln.record.key
 				h := xxh3.HashString(key)
 				newNode.rSet(h, lvl+1, key, ln.record.value.Load())
@@ -197,6 +197,69 @@ func (Node *leafNodeType[V]) updateSet(offset uint, h uint64, lvl uint, key stri
 	return v, ok
 }
 
+// Compute atomically replace value under bucket write lock
+// fn receive current value and return new one, nil means delete, old means keep
+// returns resulting value
+func (Node *NodeType[V]) Compute(key string, fn func(old *V, loaded bool) *V) (*V, bool) {
+	h := xxh3.HashString(key)
+	return Node.rCompute(h, 0, key, fn)
+}
+
+func (Node *NodeType[V]) rCompute(h uint64, lvl uint, key string, fn func(old *V, loaded bool) *V) (*V, bool) {
+	offset := getOffset(h, lvl)
+	Node.writeLock.Lock()
+
+	nextNode := Node.nodes[offset].Load()
+	if nextNode == nil {
+		value := fn(nil, false)
+		if value != nil {
+			Lnode := (*leafNodeType[V])(unsafe.Pointer(Node))
+			Lnode.createSet(offset, h, lvl, key, value)
+		}
+		Node.writeLock.Unlock()
+		return value, value != nil
+	}
+
+	if nextNode.container == petalNode {
+		Lnode := (*leafNodeType[V])(unsafe.Pointer(Node))
+		v, ok := Lnode.computeSet(offset, h, lvl, key, fn)
+		Node.writeLock.Unlock()
+		return v, ok
+	}
+
+	Node.writeLock.Unlock()
+	return nextNode.rCompute(h, lvl+1, key, fn)
+}
+
+func (Node *leafNodeType[V]) computeSet(offset uint, h uint64, lvl uint, key string, fn func(old *V, loaded bool) *V) (*V, bool) {
+	pNode := Node.entries[offset].Load()
+	if pNode.container != petalNode {
+		panic("last node in tree is not petal")
+	}
+
+	var old *V
+	var ln *listNodeType[V]
+	for ln = pNode.entries[getOffset(h, lvl+1)].Load(); ln != nil; ln = ln.next.Load() {
+		if ln.record.key == key {
+			old = ln.record.value.Load()
+			break
+		}
+	}
+
+	value := fn(old, ln != nil)
+	switch {
+	case value == nil && ln != nil:
+		pNode.filterList(h, lvl+1, key)
+	case value == nil:
+	case ln != nil:
+		ln.record.value.Store(value)
+	default:
+		Node.updateSet(offset, h, lvl, key, value)
+	}
+
+	return value, value != nil
+}
+
 func (Node *NodeType[V]) rGet(key string, h uint64, lvl uint) (*V, bool) {
 	offset := getOffset(h, lvl)
 
@@ -246,6 +309,7 @@ func (Node *NodeType[V]) rDelete(h uint64, lvl uint, key string) (*V, bool) {
 
 	nextNode := Node.nodes[offset].Load()
 	if nextNode == nil {
+		Node.writeLock.Unlock()
 		return nil, false
 	}
 
@@ -290,6 +354,10 @@ func (Node *petalNodeType[V]) filterList(h uint64, lvl uint, key string) (*V, bo
 		prevNode = ln
 	}
 
+	if !ok {
+		return nil, false
+	}
+
 	// Fisrt node
 	if Node.entries[offset].Load() == ln {
 		Node.entries[offset].Store(ln.next.Load())
@@ -389,16 +457,17 @@ func (Node *petalNodeType[V]) rForEachList(lastLN **listNodeType[V]) (*string, *
 		}
 	}
 
-	if lastLN != nil {
+	if *lastLN != nil {
 		lNode := *lastLN
 		*lastLN = lNode.next.Load()
 		return &lNode.record.key, lNode.record.value.Load()
 	}
 
-	fmt.Printf("Empty petal node %p\n", Node)
 	return nil, nil
 }
 
+// rForEach walk children from vhash position in hash order, stop on first non empty petal
+// returns nil when node exhausted, vhash is carried to parent digit in that case
 func (Node *NodeType[V]) rForEach(vhash *uint64, lastLN **listNodeType[V], dLvl uint) (*string, *V) {
 	if dLvl == 15 {
 		panic("It is not supposed to go so deep! lvl 15 must be always petalNode")
@@ -407,40 +476,32 @@ func (Node *NodeType[V]) rForEach(vhash *uint64, lastLN **listNodeType[V], dLvl
 		panic("It is not supposed to go here")
 	}
 
-	// map is empty
-	allNil := true
-	for k := range Node.nodes {
-		if Node.nodes[k].Load() != nil {
-			allNil = false
-			break
-		}
-	}
-	if allNil {
-		*vhash = incVHash(*vhash, dLvl)
-		return nil, nil
-	}
-
-	// if nextNode != nil {
-	// 	fmt.Printf("vhash: 0x%016x, dlvl: %d\n", *vhash, dLvl)
-	// }
+	for {
+		offset := getOffset(*vhash, dLvl)
+		nextNode := Node.nodes[offset].Load()
 
-	offset := getOffset(*vhash, dLvl)
-	nextNode := Node.nodes[offset].Load()
-	// Decrease recursion level manualy
-	for i := offset; i < 16 && nextNode == nil; i++ {
-		*vhash = incVHash(*vhash, dLvl)
-		offset = getOffset(*vhash, dLvl)
-		nextNode = Node.nodes[offset].Load()
-	}
+		switch {
+		case nextNode == nil:
+			*vhash = incVHash(*vhash, dLvl)
+		case nextNode.container != petalNode:
+			k, v := nextNode.rForEach(vhash, lastLN, dLvl+1)
+			if k != nil {
+				return k, v
+			}
+		default:
+			pNode := (*petalNodeType[V])(unsafe.Pointer(nextNode))
+			k, v := pNode.rForEachList(lastLN)
+			*vhash = incVHash(*vhash, dLvl)
+			if k != nil {
+				return k, v
+			}
+		}
 
-	if nextNode.container != petalNode {
-		return nextNode.rForEach(vhash, lastLN, dLvl+1)
+		// Last child done, carry already moved vhash to next parent slot
+		if offset == 15 {
+			return nil, nil
+		}
 	}
-
-	pNode := (*petalNodeType[V])(unsafe.Pointer(nextNode))
-	k, v := pNode.rForEachList(lastLN)
-	*vhash = incVHash(*vhash, dLvl)
-	return k, v
 }
 
 func (Node *NodeType[V]) ForEach() (*string, *V) {
@@ -459,7 +520,60 @@ func (Node *NodeType[V]) ForEach() (*string, *V) {
 		return &key, value
 	}
 
-	return Node.rForEach(vhash, lastLN, 0)
+	// Skip empty subtrees, give up after two full passes over hash space
+	wraps := 0
+	for wraps < 2 {
+		prev := *vhash
+		k, v := Node.rForEach(vhash, lastLN, 0)
+		if k != nil {
+			return k, v
+		}
+		if *vhash <= prev {
+			wraps++
+		}
+	}
+
+	return nil, nil
+}
+
+// EntryOverhead return approximate map memory per entry in bytes: list node and
+// share of petal node, petals are split at 96 entries so they are half full on average
+func (Node *NodeType[V]) EntryOverhead() int {
+	petalEntries := len(petalNodeType[V]{}.entries) * 6 / 2
+	return int(unsafe.Sizeof(listNodeType[V]{})) + int(unsafe.Sizeof(petalNodeType[V]{}))/petalEntries
+}
+
+// Range call fn for every entry in hash order, stops if fn returns false
+// RCU read, entries changed concurrently may be seen or not
+func (Node *NodeType[V]) Range(fn func(key string, value *V) bool) {
+	Node.rRange(fn)
+}
+
+func (Node *NodeType[V]) rRange(fn func(key string, value *V) bool) bool {
+	for k := range Node.nodes {
+		nextNode := Node.nodes[k].Load()
+		if nextNode == nil {
+			continue
+		}
+
+		if nextNode.container != petalNode {
+			if !nextNode.rRange(fn) {
+				return false
+			}
+			continue
+		}
+
+		pNode := (*petalNodeType[V])(unsafe.Pointer(nextNode))
+		for i := range pNode.entries {
+			for ln := pNode.entries[i].Load(); ln != nil; ln = ln.next.Load() {
+				if !fn(ln.record.key, ln.record.value.Load()) {
+					return false
+				}
+			}
+		}
+	}
+
+	return true
 }
 
 // Debug only
@@ -474,3 +474,73 @@ func TestSetDelete(t *testing.T) {
 		t.Fatal("Delete not works")
 	}
 }
+
+func TestCompute(t *testing.T) {
+	m := NewRecurseMap[int]()
+
+	inc := func(old *int, loaded bool) *int {
+		v := 1
+		if loaded {
+			v = *old + 1
+		}
+		return &v
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				m.Compute(strconv.Itoa(j%100), inc)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for j := 0; j < 100; j++ {
+		v, ok := m.Get(strconv.Itoa(j))
+		if !ok || *v != 80 {
+			t.Fatalf("Expected 80 for key %d, got %v", j, v)
+		}
+	}
+
+	if _, ok := m.Compute("0", func(old *int, loaded bool) *int { return nil }); ok {
+		t.Fatal("Compute returning nil must delete key")
+	}
+	if _, ok := m.Get("0"); ok {
+		t.Fatal("Key 0 must be deleted")
+	}
+	if _, ok := m.Delete("0"); ok {
+		t.Fatal("Delete of missing key reported success")
+	}
+}
+
+func TestRange(t *testing.T) {
+	m := NewRecurseMap[int]()
+	for i := 0; i < 100000; i++ {
+		v := i
+		m.Set(strconv.Itoa(i), &v)
+	}
+
+	seen := make(map[string]bool)
+	m.Range(func(key string, value *int) bool {
+		if key != strconv.Itoa(*value) {
+			t.Fatalf("Key %s has wrong value %d", key, *value)
+		}
+		seen[key] = true
+		return true
+	})
+	if len(seen) != 100000 {
+		t.Fatalf("Expected 100000 keys, got %d", len(seen))
+	}
+
+	count := 0
+	m.Range(func(key string, value *int) bool {
+		count++
+		return count < 10
+	})
+	if count != 10 {
+		t.Fatalf("Range must stop on false, got %d calls", count)
+	}
+}
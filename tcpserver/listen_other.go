@@ -0,0 +1,22 @@
+//go:build !unix
+
+package tcpserver
+
+import (
+	"io/fs"
+	"net"
+	"os"
+)
+
+// listenUnix bind socket and set its permissions, platform has no umask
+func listenUnix(path string, mode fs.FileMode) (*net.UnixListener, error) {
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package tcpserver
+
+import (
+	"io/fs"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// umaskLock serialize socket binds, umask is process wide
+var umaskLock sync.Mutex
+
+// listenUnix bind socket with umask set from mode around bind, as memcached does,
+// so socket never exists with wider permissions
+func listenUnix(path string, mode fs.FileMode) (*net.UnixListener, error) {
+	umaskLock.Lock()
+	defer umaskLock.Unlock()
+
+	umask := syscall.Umask(int(^mode & fs.ModePerm))
+	defer syscall.Umask(umask)
+
+	return net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+}
@@ -1,58 +1,174 @@
 package tcpserver
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io/fs"
+	"nefelim4ag/go-memcached-server/metrics"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"log/slog"
 )
 
 type (
-	ConnectionHandler func(conn *net.TCPConn, err error)
+	ConnectionHandler func(conn net.Conn, err error)
 
 	TCPServer interface {
-		ListenAndServe(address string, connectionQueue uint)
-		AcceptConnections()
+		ListenAndServe(address string, handler ConnectionHandler) error
+		ListenUnixAndServe(path string, mode fs.FileMode, handler ConnectionHandler) error
+		AcceptConnections(listener net.Listener, handler ConnectionHandler)
 		Stop() error
 	}
 
 	Server struct {
-		accepted sync.WaitGroup
-		listener *net.TCPListener
-		shutdown chan struct{}
-		handler  ConnectionHandler
+		// MaxConns limit open connections of all listeners, 0 is unlimited.
+		// Connections over limit get memcached error and are closed.
+		MaxConns int
+		// TLS is served on TCP listeners if set, unix sockets stay plain
+		TLS *TLS
+
+		accepted  sync.WaitGroup
+		lock      sync.Mutex
+		listeners []net.Listener
+		shutdown  chan struct{}
+
+		active   atomic.Int64
+		total    atomic.Uint64
+		rejected atomic.Uint64
+		tlsError atomic.Uint64
 	}
 )
 
+// ListenAndServe accept TCP connections on address, it can be called for
+// several addresses and together with ListenUnixAndServe
 func (s *Server) ListenAndServe(address string, handler ConnectionHandler) error {
 	addr, err := net.ResolveTCPAddr("tcp", address)
 	if err != nil {
 		return fmt.Errorf("failed to resolve address %s: %w", address, err)
 	}
 
-	s.listener, err = net.ListenTCP("tcp", addr)
+	tcpListener, err := net.ListenTCP("tcp", addr)
 	if err != nil {
 		return fmt.Errorf("failed to listen on address %s: %w", address, err)
 	}
-	slog.Info("Listening", "address", address)
+	slog.Info("Listening", "address", tcpListener.Addr(), "tls", s.TLS != nil)
 
-	s.handler = handler
-	s.shutdown = make(chan struct{})
+	var listener net.Listener = tcpListener
+	if s.TLS != nil {
+		listener = tls.NewListener(tcpListener, s.TLS.Config())
+	}
+	s.serve(listener, handler)
+	return nil
+}
 
-	go s.AcceptConnections()
+// ListenUnixAndServe accept connections on unix socket with permissions mode,
+// stale socket of previous run is replaced, socket is removed on Stop
+func (s *Server) ListenUnixAndServe(path string, mode fs.FileMode, handler ConnectionHandler) error {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&fs.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+		}
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to check socket %s: %w", path, err)
+	}
 
+	listener, err := listenUnix(path, mode)
+	if err != nil {
+		return fmt.Errorf("failed to listen on socket %s: %w", path, err)
+	}
+	slog.Info("Listening", "socket", path, "mode", mode)
+
+	s.serve(listener, handler)
 	return nil
 }
 
-func (s *Server) handlerWrap(conn *net.TCPConn, err error){
+func (s *Server) serve(listener net.Listener, handler ConnectionHandler) {
+	s.lock.Lock()
+	if s.shutdown == nil {
+		s.shutdown = make(chan struct{})
+	}
+	s.listeners = append(s.listeners, listener)
+	s.lock.Unlock()
+
+	go s.AcceptConnections(listener, handler)
+}
+
+// Addrs return addresses of all listeners, e.g. to find port chosen for :0
+func (s *Server) Addrs() []net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	addrs := []net.Addr{}
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
+}
+
+func (s *Server) handlerWrap(conn net.Conn, err error, handler ConnectionHandler) {
 	s.accepted.Add(1)
-	s.handler(conn, err)
-	s.accepted.Done()
+	defer s.accepted.Done()
+
+	if err == nil {
+		// Reserve slot first, so concurrent accepts can't overshoot limit
+		if active := s.active.Add(1); s.MaxConns > 0 && active > int64(s.MaxConns) {
+			s.active.Add(-1)
+			s.rejected.Add(1)
+			conn.Write([]byte("ERROR Too many open connections\r\n"))
+			conn.Close()
+			return
+		}
+		s.total.Add(1)
+		defer s.active.Add(-1)
+
+		// Handshake before handler, so client identity is known to it
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+			if err := tlsConn.Handshake(); err != nil {
+				s.tlsError.Add(1)
+				slog.Warn("TLS handshake failed", "client", conn.RemoteAddr(), "error", err)
+				conn.Close()
+				return
+			}
+			tlsConn.SetDeadline(time.Time{})
+			state := tlsConn.ConnectionState()
+			slog.Debug("TLS connection", "client", conn.RemoteAddr(), "identity", ClientIdentity(conn),
+				"version", tls.VersionName(state.Version), "cipher", tls.CipherSuiteName(state.CipherSuite))
+		}
+	}
+	handler(conn, err)
+}
+
+// Connections return number of open connections and total accepted connections
+func (s *Server) Connections() (active int64, total uint64) {
+	return s.active.Load(), s.total.Load()
+}
+
+// Rejected return number of connections closed over MaxConns
+func (s *Server) Rejected() uint64 {
+	return s.rejected.Load()
+}
+
+// TLSHandshakeErrors return number of connections closed on failed TLS handshake
+func (s *Server) TLSHandshakeErrors() uint64 {
+	return s.tlsError.Load()
+}
+
+// WriteMetrics is metrics collector of connection gauges
+func (s *Server) WriteMetrics(w *metrics.Writer) {
+	active, total := s.Connections()
+	w.Gauge("memcached_current_connections", "Current number of open connections.", float64(active))
+	w.Counter("memcached_connections_total", "Total number of accepted connections.", total)
+	w.Counter("memcached_rejected_connections_total", "Connections closed over connection limit.", s.Rejected())
+	w.Counter("memcached_ssl_handshake_errors_total", "Connections closed on failed TLS handshake.", s.TLSHandshakeErrors())
 }
 
-func (s *Server) AcceptConnections() {
+func (s *Server) AcceptConnections(listener net.Listener, handler ConnectionHandler) {
 	s.accepted.Add(1)
 	defer s.accepted.Done()
 
@@ -61,15 +177,24 @@ func (s *Server) AcceptConnections() {
 		case <-s.shutdown:
 			return
 		default:
-			connection, err := s.listener.AcceptTCP()
-			go s.handlerWrap(connection, err)
+			connection, err := listener.Accept()
+			go s.handlerWrap(connection, err, handler)
 		}
 	}
 }
 
 func (s *Server) Stop() error {
+	s.lock.Lock()
+	// Nothing to stop if server serves UDP only
+	if s.shutdown == nil {
+		s.lock.Unlock()
+		return nil
+	}
 	close(s.shutdown)
-	s.listener.Close()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.lock.Unlock()
 
 	done := make(chan struct{})
 	go func() {
@@ -0,0 +1,180 @@
+package tcpserver
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// echoLine reply with first line of request and close connection
+func echoLine(conn net.Conn, err error) {
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	conn.Write([]byte(conn.LocalAddr().Network() + ":" + line))
+}
+
+func call(t *testing.T, network string, address string) string {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("ping\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return line
+}
+
+func TestServeTCPAndUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "memcached.sock")
+	// Stale socket of killed server is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	s := &Server{}
+	if err := s.ListenAndServe("127.0.0.1:0", echoLine); err != nil {
+		t.Fatal(err)
+	}
+	// Each listener keeps its own handler
+	unixHandler := func(conn net.Conn, err error) {
+		if err == nil {
+			conn.Write([]byte("handler "))
+		}
+		echoLine(conn, err)
+	}
+	if err := s.ListenUnixAndServe(path, 0760, unixHandler); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&fs.ModeSocket == 0 || info.Mode().Perm() != 0760 {
+		t.Fatalf("Unexpected socket mode %v", info.Mode())
+	}
+
+	if line := call(t, "tcp", s.Addrs()[0].String()); line != "tcp:ping\n" {
+		t.Fatalf("Unexpected TCP reply %q", line)
+	}
+	if line := call(t, "unix", path); line != "handler unix:ping\n" {
+		t.Fatalf("Unexpected unix socket reply %q", line)
+	}
+	if _, total := s.Connections(); total != 2 {
+		t.Fatalf("Expected 2 connections, got %d", total)
+	}
+
+	s.Stop()
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected socket removed on stop, got %v", err)
+	}
+}
+
+func TestListenUnixNotSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{}
+	if err := s.ListenUnixAndServe(path, 0700, echoLine); err == nil {
+		t.Fatal("Expected error for regular file on socket path")
+	}
+}
+
+func TestServeUDP(t *testing.T) {
+	s := &UDPServer{Workers: 2}
+	handlers := 0
+	err := s.ListenAndServe("127.0.0.1:0", func() PacketHandler {
+		handlers++
+		return func(request []byte, local net.Addr, remote net.Addr, write func([]byte) error) {
+			// Response of two datagrams
+			write(append([]byte("1:"), request...))
+			write(append([]byte("2:"), request...))
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handlers != 2 {
+		t.Fatalf("Expected handler per worker, got %d", handlers)
+	}
+
+	conn, err := net.Dial("udp", s.Addrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 1024)
+	for _, expected := range []string{"1:ping", "2:ping"} {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != expected {
+			t.Fatalf("Expected %q, got %q", expected, buf[:n])
+		}
+	}
+
+	s.Stop()
+}
+
+func TestStopWithoutListeners(t *testing.T) {
+	s := &Server{}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	s := &Server{MaxConns: 2}
+	if err := s.ListenAndServe("127.0.0.1:0", echoLine); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	address := s.Addrs()[0].String()
+
+	// Connections waiting for request line hold slots
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	for deadline := time.Now().Add(5 * time.Second); s.active.Load() != 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 2 open connections, got %d", s.active.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if line := call(t, "tcp", address); line != "ERROR Too many open connections\r\n" {
+		t.Fatalf("Unexpected reply over limit %q", line)
+	}
+	if active, total := s.Connections(); active != 2 || total != 2 || s.Rejected() != 1 {
+		t.Fatalf("Expected 2 of 2 connections and 1 rejected, got %d of %d and %d", active, total, s.Rejected())
+	}
+}
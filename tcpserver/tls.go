@@ -0,0 +1,107 @@
+package tcpserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// handshakeTimeout limit TLS handshake of accepted connection
+const handshakeTimeout = 10 * time.Second
+
+type (
+	// TLSConfig is TLS settings of listeners, client certificates are
+	// verified by ClientCAFile according to ClientAuth
+	TLSConfig struct {
+		CertFile     string
+		KeyFile      string
+		ClientCAFile string
+		ClientAuth   tls.ClientAuthType
+		MinVersion   uint16
+		CipherSuites []uint16 // nil keeps Go defaults
+	}
+
+	// TLS is TLS config of listeners, Reload replaces it for following
+	// handshakes, established connections keep their sessions
+	TLS struct {
+		config atomic.Pointer[tls.Config]
+	}
+)
+
+// NewTLS load certificates of config
+func NewTLS(cfg TLSConfig) (*TLS, error) {
+	t := &TLS{}
+	if err := t.Reload(cfg); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload load certificates of config, on error previous config is kept
+func (t *TLS) Reload(cfg TLSConfig) error {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS client CA: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("failed to load TLS client CA: no certificates in %s", cfg.ClientCAFile)
+		}
+	} else if cfg.ClientAuth >= tls.VerifyClientCertIfGiven {
+		return errors.New("client certificate verification requires client CA")
+	}
+
+	t.config.Store(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   cfg.ClientAuth,
+		MinVersion:   cfg.MinVersion,
+		CipherSuites: cfg.CipherSuites,
+	})
+	return nil
+}
+
+// Config return config for tls.NewListener, each handshake uses latest loaded config
+func (t *TLS) Config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return t.config.Load(), nil
+		},
+	}
+}
+
+// ClientIdentity return common name of verified client certificate, or its
+// first DNS name or email if name is empty, empty for plain connections
+func ClientIdentity(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return ""
+	}
+
+	cert := state.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
@@ -0,0 +1,180 @@
+package tcpserver
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pair tls.Certificate
+}
+
+// newTestCert generate certificate signed by parent, self-signed CA if parent is nil
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{cert: cert, key: key, pair: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}}
+}
+
+// write save certificate and key as PEM files, returns their paths
+func (c *testCert) write(t *testing.T, dir string, name string) (string, string) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+// identityLine reply with client certificate identity on first line of request
+func identityLine(conn net.Conn, err error) {
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		return
+	}
+	conn.Write([]byte("identity:" + ClientIdentity(conn) + "\n"))
+}
+
+func tlsCall(address string, config *tls.Config) (string, *tls.ConnectionState, error) {
+	conn, err := tls.Dial("tcp", address, config)
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("ping\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	state := conn.ConnectionState()
+	return line, &state, err
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "test ca", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "server", ca).write(t, dir, "server")
+	client := newTestCert(t, "client-app", ca)
+
+	cfg := TLSConfig{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: caFile,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	serverTLS, err := NewTLS(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{TLS: serverTLS}
+	if err := s.ListenAndServe("127.0.0.1:0", identityLine); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	address := s.Addrs()[0].String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	line, state, err := tlsCall(address, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{client.pair}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "identity:client-app\n" {
+		t.Fatalf("Unexpected reply %q", line)
+	}
+
+	// Client without certificate is rejected
+	if _, _, err := tlsCall(address, &tls.Config{RootCAs: roots}); err == nil {
+		t.Fatal("Expected failure without client certificate")
+	}
+	// Version below minimum is rejected
+	if _, _, err := tlsCall(address, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{client.pair}, MaxVersion: tls.VersionTLS11}); err == nil {
+		t.Fatal("Expected failure of TLS 1.1")
+	}
+	for deadline := time.Now().Add(5 * time.Second); s.TLSHandshakeErrors() != 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 2 handshake errors, got %d", s.TLSHandshakeErrors())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Reloaded certificate is used by new connections, broken one is not loaded
+	cfg.CertFile, cfg.KeyFile = newTestCert(t, "server-renewed", ca).write(t, dir, "renewed")
+	if err := serverTLS.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := serverTLS.Reload(TLSConfig{CertFile: caFile, KeyFile: keyFile}); err == nil {
+		t.Fatal("Expected error for mismatched key")
+	}
+	if err := serverTLS.Reload(TLSConfig{CertFile: cfg.CertFile, KeyFile: cfg.KeyFile, ClientAuth: tls.RequireAndVerifyClientCert}); err == nil {
+		t.Fatal("Expected error for verification without client CA")
+	}
+	_, renewed, err := tlsCall(address, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{client.pair}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.PeerCertificates[0].Subject.CommonName != "server" || renewed.PeerCertificates[0].Subject.CommonName != "server-renewed" {
+		t.Fatalf("Expected renewed certificate, got %s", renewed.PeerCertificates[0].Subject.CommonName)
+	}
+}
@@ -0,0 +1,98 @@
+package tcpserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+
+	"log/slog"
+)
+
+type (
+	// PacketHandler handle request datagram, write sends response datagram to client
+	PacketHandler func(request []byte, local net.Addr, remote net.Addr, write func([]byte) error)
+
+	UDPServer struct {
+		// Workers is number of goroutines reading each socket, each has own
+		// handler from NewHandler, 0 is GOMAXPROCS
+		Workers int
+
+		lock    sync.Mutex
+		conns   []*net.UDPConn
+		running sync.WaitGroup
+	}
+)
+
+// ListenAndServe read datagrams on address, it can be called for several addresses
+func (s *UDPServer) ListenAndServe(address string, newHandler func() PacketHandler) error {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return fmt.Errorf("failed to resolve address %s: %w", address, err)
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on address %s: %w", address, err)
+	}
+	slog.Info("Listening", "udp", conn.LocalAddr())
+
+	s.lock.Lock()
+	s.conns = append(s.conns, conn)
+	s.lock.Unlock()
+
+	workers := s.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	for i := 0; i < workers; i++ {
+		s.running.Add(1)
+		go s.serve(conn, newHandler())
+	}
+
+	return nil
+}
+
+func (s *UDPServer) serve(conn *net.UDPConn, handler PacketHandler) {
+	defer s.running.Done()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Error(err.Error())
+			continue
+		}
+		handler(buf[:n], conn.LocalAddr(), remote, func(datagram []byte) error {
+			_, err := conn.WriteToUDP(datagram, remote)
+			return err
+		})
+	}
+}
+
+// Addrs return addresses of all sockets, e.g. to find port chosen for :0
+func (s *UDPServer) Addrs() []net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	addrs := []net.Addr{}
+	for _, c := range s.conns {
+		addrs = append(addrs, c.LocalAddr())
+	}
+	return addrs
+}
+
+// Stop close sockets and wait for requests in progress
+func (s *UDPServer) Stop() {
+	s.lock.Lock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.lock.Unlock()
+
+	s.running.Wait()
+}